@@ -23,16 +23,26 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math"
+	"math/big"
+	"net"
+	"net/url"
 	"os"
-	"regexp"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "github.com/denisenkom/go-mssqldb"
@@ -45,43 +55,169 @@ func main() {
 	stdout := log.New(os.Stdout, "", log.LstdFlags)
 	stderr := log.New(os.Stderr, "ERROR: ", log.LstdFlags)
 	sequenceNumberOut := log.New(os.Stderr, "SEQUENCE_NUMBER: ", 0)
+	sequenceNumberJSONOut := log.New(os.Stderr, "SEQUENCE_NUMBER_JSON: ", 0)
+	requiredSynchronizedSecondariesToCommitOut := log.New(os.Stderr, "REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT: ", 0)
+	productVersionOut := log.New(os.Stderr, "PRODUCT_VERSION: ", 0)
+	lastHardenedLSNOut := log.New(os.Stderr, "LAST_HARDENED_LSN: ", 0)
+	statusOut := log.New(os.Stdout, "", 0)
 
-	err := doMain(stdout, stderr, sequenceNumberOut)
+	err := doMain(stdout, stderr, sequenceNumberOut, sequenceNumberJSONOut, requiredSynchronizedSecondariesToCommitOut, productVersionOut, lastHardenedLSNOut, statusOut)
 	if err != nil {
 		mssqlcommon.Exit(stderr, 1, fmt.Errorf("Unexpected error: %s", err))
 	}
 }
 
-func doMain(stdout *log.Logger, stderr *log.Logger, sequenceNumberOut *log.Logger) error {
+func doMain(
+	stdout *log.Logger, stderr *log.Logger,
+	sequenceNumberOut *log.Logger, sequenceNumberJSONOut *log.Logger, requiredSynchronizedSecondariesToCommitOut *log.Logger,
+	productVersionOut *log.Logger, lastHardenedLSNOut *log.Logger, statusOut *log.Logger) error {
+
 	var (
-		hostname             string
-		sqlPort              uint64
-		agName               string
-		credentialsFile      string
-		applicationName      string
-		rawConnectionTimeout int64
-		rawHealthThreshold   uint
+		hostname                  string
+		sqlPort                   uint64
+		agName                    string
+		credentialsFile           string
+		username                  string
+		passwordFile              string
+		credentialsProviderName   string
+		vaultAddress              string
+		vaultPath                 string
+		vaultTokenFile            string
+		applicationName           string
+		appendHostnameToAppName   bool
+		rawConnectionTimeout      int64
+		rawTrustServerCertificate string
+		healthCheckPort           uint64
+		checkHostnameResolves     bool
+		rawActionTimeout          uint
+		rawHealthThreshold        uint
+		treatQueryProcessingAs    string
+		dumpDiagnostics           bool
+		onUnhealthyCommand        string
+		rawOnUnhealthyTimeout     uint
+		diagnosticsRepeatInterval uint
+		healthCheckQuery          string
+		minSQLVersion             string
+
+		rawRequiredConsecutiveFailures string
+		consecutiveFailuresFile        string
+
+		settingsCacheFile   string
+		rawSettingsCacheTTL uint
+		agRowMissingRetries uint
+		strictRole          bool
+		treatAGNotHealthyAs string
+		checkResolvingCause bool
+
+		setLagAttribute  bool
+		lagAttributeName string
+		lagThresholdKB   int64
+		attributeCommand string
 
 		action string
 
-		numRetriesForOnlineDatabases               uint
-		skipPreCheck                               bool
-		sequenceNumbers                            string
-		newMaster                                  string
-		requiredSynchronizedSecondariesToCommitArg int
+		numRetriesForOnlineDatabases                  uint
+		maxDatabaseStatesToLog                        uint
+		rawIgnoredDatabaseNames                       string
+		rawOnlineDatabasesPollInterval                uint
+		minReplicasToStart                            uint
+		rawStartFailoverWaitTimeout                   uint
+		skipPreCheck                                  bool
+		waitPrimaryRecovery                           bool
+		rawWaitPrimaryRecoveryTimeout                 uint
+		verifyNoPrimary                               bool
+		force                                         bool
+		allowDataLoss                                 bool
+		stopDemotes                                   bool
+		demoteVerify                                  bool
+		rawDemoteVerifyTimeout                        uint
+		skipHealthCheck                               bool
+		manageRequiredSynchronizedSecondariesToCommit bool
+		requirePrimary                                bool
+		failOnNonPreferredBackup                      bool
+		maxFailoverEvents                             uint
+		sequenceNumberJSON                            bool
+		sequenceNumberAttempts                        uint
+		logSequenceNumberHex                          bool
+		allAGs                                        bool
+		outputLastHardenedLSN                         bool
+		sequenceNumbers                               string
+		sequenceNumberFormat                          string
+		productVersions                               string
+		lastHardenedLSNs                              string
+		newMaster                                     string
+		listenerIP                                    string
+		outputFormat                                  string
+		requiredSynchronizedSecondariesToCommitArg    int
+		outputRequiredSynchronizedSecondariesToCommit bool
 	)
 
 	flag.StringVar(&hostname, "hostname", "localhost", "The hostname of the SQL Server instance to connect to. Default: localhost")
 	flag.Uint64Var(&sqlPort, "port", 0, "The port on which the instance is listening for logins.")
 	flag.StringVar(&agName, "ag-name", "", "The name of the Availability Group")
 	flag.StringVar(&credentialsFile, "credentials-file", "", "The path to the credentials file.")
+	flag.StringVar(&username, "username", "", "The username to use for the T-SQL connection. Must be specified with --password-file instead of --credentials-file.")
+	flag.StringVar(&passwordFile, "password-file", "", "The path to a file containing only the password to use for the T-SQL connection. Must be specified with --username instead of --credentials-file.")
+	flag.StringVar(&credentialsProviderName, "credentials-provider", "file", "The source of the credentials for the T-SQL connection. One of file, vault. "+
+		"file: Read the credentials from --credentials-file, or from --username and --password-file. "+
+		"vault: Read the credentials from the username and password keys of the HashiCorp Vault secret at --vault-path. Default: file")
+	flag.StringVar(&vaultAddress, "vault-address", "", "The address of the Vault server. Default: the value of the VAULT_ADDR environment variable")
+	flag.StringVar(&vaultPath, "vault-path", "", "The path of the Vault secret containing the credentials, like secret/data/mssql.")
+	flag.StringVar(&vaultTokenFile, "vault-token-file", "", "The path to a file containing the Vault token. Default: the value of the VAULT_TOKEN environment variable")
 	flag.StringVar(&applicationName, "application-name", "", "The application name to use for the T-SQL connection.")
+	flag.BoolVar(&appendHostnameToAppName, "append-hostname-to-appname", false, "Append the hostname of this node to the application name, like \"app (node1)\", "+
+		"so that connections can be attributed to the node they came from.")
 	flag.Int64Var(&rawConnectionTimeout, "connection-timeout", 30, "The connection timeout in seconds. "+
-		"The application will retry connecting to the instance until this time elapses. Default: 30")
+		"The application will retry connecting to the instance until this time elapses. Must be at least 1. Default: 30")
+	flag.StringVar(&rawTrustServerCertificate, "trust-server-certificate", "false", "One of true, false. "+
+		"Whether to trust the certificate presented by the instance without validating it, regardless of whether the connection is encrypted. "+
+		"This allows self-signed certificates but exposes the connection to man-in-the-middle attacks, so it should only be used in test environments. Default: false")
+	flag.Uint64Var(&healthCheckPort, "health-check-port", 0, "A port of the instance that is probed for TCP reachability before each attempt to connect to the instance. "+
+		"While the port is not open, the attempt fails without waiting for the T-SQL connection to time out, which detects a fully-down instance sooner. Default: 0 (disabled)")
+	flag.BoolVar(&checkHostnameResolves, "check-hostname-resolves", false, "Resolve --hostname before connecting to the instance, and fail with OCF_ERR_CONFIGURED if it does not exist "+
+		"instead of retrying to connect until --connection-timeout elapses. Transient DNS failures are only logged.")
+	flag.UintVar(&rawActionTimeout, "action-timeout", 0, "The time in seconds that the whole action, including connecting to the instance, may take. "+
+		"The connection timeout is reduced to fit in it, and the start, monitor, promote and demote actions stop waiting when it elapses. "+
+		"If the action overruns, the process exits with OCF_FAILED_MASTER for the promote action and OCF_ERR_GENERIC for the other actions. "+
+		"Should be less than the timeout of the Pacemaker operation. Default: 0 (no timeout)")
 	flag.UintVar(&rawHealthThreshold, "health-threshold", uint(mssqlcommon.ServerCriticalError), "The instance health threshold. Default: 3 (SERVER_CRITICAL_ERROR)")
+	flag.StringVar(&treatQueryProcessingAs, "treat-query-processing-as", "error", "One of warning, error. "+
+		"Whether a query processing error reported by sp_server_diagnostics is treated as an error (SERVER_ANY_QUALIFIED_ERROR) or only logged as a warning. Default: error")
+	flag.BoolVar(&dumpDiagnostics, "dump-diagnostics", false, "Log every row returned by sp_server_diagnostics, including the data of each component.")
+	flag.StringVar(&onUnhealthyCommand, "on-unhealthy-command", "", "A command to run when the instance health is at or below --health-threshold, before exiting, "+
+		"such as to collect a dump or page someone. It's invoked with the health status and the AG name as arguments. Default: empty (disabled)")
+	flag.UintVar(&rawOnUnhealthyTimeout, "on-unhealthy-command-timeout", 10, "The time in seconds that --on-unhealthy-command may run before it's killed, so that it can't hang the action. Default: 10")
+	flag.UintVar(&diagnosticsRepeatInterval, "diagnostics-repeat-interval", 0, "If not 0, run sp_server_diagnostics with this repeat interval in seconds and use its first complete cycle of results "+
+		"instead of running it once, for builds where a single run can report a component error before all components are populated. Must be 0 or at least 5. Default: 0")
+	flag.StringVar(&healthCheckQuery, "health-check-query", "", "A statement to run instead of sp_server_diagnostics, for logins that can't be granted VIEW SERVER STATE, "+
+		"such as EXEC dbo.health_check. It must return a single integer, 0 if the instance is healthy or the instance health otherwise, "+
+		"which is compared with --health-threshold. Default: empty (use sp_server_diagnostics)")
+	flag.StringVar(&minSQLVersion, "min-sql-version", "", "Fail with OCF_ERR_CONFIGURED before running the action if the product version of the instance is lower than this version, like 14.0. "+
+		"Actions that need a newer version, like pre-promote which needs 14.0 for the AG sequence number, always require at least that version. Default: empty (only the action's own requirement)")
+	flag.StringVar(&rawRequiredConsecutiveFailures, "required-consecutive-failures", "", "A comma-separated list of component=count pairs, like resource=3,query_processing=2. "+
+		"The monitor action only fails due to an sp_server_diagnostics component error once the component has been in error for this many consecutive monitors. "+
+		"Valid components are system, resource and query_processing. Requires --consecutive-failures-file if any count is greater than 1. Default: 1 for every component")
+	flag.StringVar(&consecutiveFailuresFile, "consecutive-failures-file", "", "The path to a file used to persist the number of consecutive failures of each sp_server_diagnostics component between monitors.")
+	flag.StringVar(&settingsCacheFile, "settings-cache-file", "", "The path to a file used to cache rarely-changing AG settings like DB_FAILOVER and the cluster type between monitors.")
+	flag.UintVar(&rawSettingsCacheTTL, "settings-cache-ttl", 0, "The time in seconds that the monitor action reuses the AG settings cached in --settings-cache-file instead of querying them. Default: 0 (disabled)")
+	flag.BoolVar(&setLagAttribute, "set-lag-attribute", false, "Make the monitor action set a node attribute to 1 if the local replica is a secondary replica whose log send queue or redo queue "+
+		"is larger than --lag-threshold-kb, and to 0 otherwise.")
+	flag.StringVar(&lagAttributeName, "lag-attribute-name", "mssql-lagging", "The name of the node attribute set by --set-lag-attribute. Default: mssql-lagging")
+	flag.Int64Var(&lagThresholdKB, "lag-threshold-kb", 0, "The size in KB of the log send queue or redo queue above which --set-lag-attribute considers the local replica to be lagging.")
+	flag.StringVar(&attributeCommand, "attribute-command", "attrd_updater", "The command used to set node attributes. It's invoked with the arguments -n <name> -U <value>. Default: attrd_updater")
 	flag.UintVar(&numRetriesForOnlineDatabases, "online-databases-retries", 60, "The number of times to try waiting for databases to be ONLINE. Default: 60")
-
-	flag.StringVar(&action, "action", "", `One of --start, --stop, --monitor, --pre-promote, --promote, --demote
+	flag.StringVar(&rawIgnoredDatabaseNames, "ignore-databases", "", "A comma-separated list of names of databases that are not waited on to be ONLINE, "+
+		"such as databases that are intentionally kept offline.")
+	flag.UintVar(&maxDatabaseStatesToLog, "max-database-states-to-log", 5, "The maximum number of non-ONLINE database states to list individually while waiting for databases to be ONLINE. "+
+		"The remaining states are summarized as a single count. 0 lists all states. Default: 5")
+	flag.UintVar(&rawOnlineDatabasesPollInterval, "online-databases-poll-interval", 1, "The time in seconds to wait between attempts to check that databases are ONLINE. Default: 1")
+	flag.UintVar(&minReplicasToStart, "min-replicas-to-start", 0, "The minimum number of replicas configured in the AG for the start action to succeed. "+
+		"Replicas are counted whether or not they are connected, since only the primary replica knows which replicas are connected. Default: 0 (disabled)")
+	flag.UintVar(&rawStartFailoverWaitTimeout, "start-failover-wait-timeout", 0, "The time in seconds that the start action waits for a failover in progress to finish, "+
+		"when the replica on this node is in RESOLVING role and changed role or state recently, before it sets the role of the replica. "+
+		"Checking for a failover in progress reads the extended events files. Default: 0 (no wait)")
+
+	flag.StringVar(&action, "action", "", `One of --start, --stop, --monitor, --pre-promote, --promote, --demote, --check-configuration, --status
 	start: Start the replica on this node.
 	stop: Stop the replica on this node.
 	monitor: Monitor the replica on this node.
@@ -89,49 +225,163 @@ func doMain(stdout *log.Logger, stderr *log.Logger, sequenceNumberOut *log.Logge
 	post-stop: After stopping an existing clone.
 	pre-promote: Fetch the sequence number of the replica on this node.
 	promote: Promote the replica on this node to master.
-	demote: Demote the replica on this node to slave.`)
-
+	demote: Demote the replica on this node to slave.
+	check-configuration: Check the AG for common misconfigurations.
+	status: Print the status of the AG replica on this node.
+	check-listener: Check that connecting through the AG listener reaches the primary replica.
+	backup-check: Check whether the replica on this node is the preferred backup replica.
+	diagnose: Print the most recent failover-related events of the AG.
+	ping: Connect to the instance and run SELECT 1, and print how long each took. Does not run sp_server_diagnostics. --ag-name is not required.`)
+
+	flag.BoolVar(&sequenceNumberJSON, "sequence-number-json", false, "In addition to the sequence number, also output a JSON object with the AG name, replica name, sequence number and availability mode "+
+		"on a line prefixed with SEQUENCE_NUMBER_JSON.")
+	flag.UintVar(&sequenceNumberAttempts, "sequence-number-attempts", 3, "The number of times to query the sequence number while it is NULL or 0, which can happen briefly while the AG configuration is changing. Default: 3")
+	flag.BoolVar(&logSequenceNumberHex, "log-sequence-number-hex", false, "Make the pre-promote and promote actions log sequence numbers in hexadecimal as well as in decimal. "+
+		"The sequence number printed on the SEQUENCE_NUMBER line is always decimal.")
+	flag.BoolVar(&allAGs, "all-ags", false, "Make the pre-promote action output the sequence numbers of the local replicas of all AGs on the instance, "+
+		"as one SEQUENCE_NUMBER_JSON line per AG, instead of only the AG of --ag-name. --ag-name is not required. Only valid for the pre-promote action. "+
+		"The SEQUENCE_NUMBER_JSON lines are always output, so --sequence-number-json is implied, and no SEQUENCE_NUMBER line is output. "+
+		"Cannot be combined with --output-last-hardened-lsn.")
+	flag.BoolVar(&outputLastHardenedLSN, "output-last-hardened-lsn", false, "Make the pre-promote action also output the last hardened LSN of each database of the AG on the local replica "+
+		"on a line prefixed with LAST_HARDENED_LSN, for use with --last-hardened-lsns of the promote action.")
+	flag.BoolVar(&stopDemotes, "stop-demotes", false, "Make the stop action set the replica on this node to SECONDARY role if it's in PRIMARY role. "+
+		"By default the stop action does nothing.")
+	flag.BoolVar(&demoteVerify, "demote-verify", false, "Make the demote action wait until the replica on this node is in SECONDARY role, "+
+		"and fail with OCF_ERR_GENERIC if it isn't within --demote-verify-timeout. By default the demote action returns as soon as the role change is requested.")
+	flag.UintVar(&rawDemoteVerifyTimeout, "demote-verify-timeout", 10, "The time in seconds that --demote-verify waits for the replica on this node to be in SECONDARY role. Default: 10")
+	flag.BoolVar(&skipHealthCheck, "skip-health-check", false, "Connect to the instance without running sp_server_diagnostics. Only valid for the status and pre-promote actions.")
+	flag.BoolVar(&requirePrimary, "require-primary", false, "Fail with OCF_ERR_GENERIC before running the action if the replica on this node is not in PRIMARY role, "+
+		"for actions that only have an effect on the primary replica. Not valid for the pre-promote and promote actions.")
+	flag.StringVar(&outputFormat, "output-format", "text", "One of text, json, yaml. The format of the output of the status action. "+
+		"json and yaml print an object with the fields ag_name, group_id, resource_id, local_role, automated_backup_preference, preferred_backup_replica, "+
+		"listener_ip_addresses (a list of objects with ip_address and state) and, on the primary replica, estimated_data_loss_seconds (replica name to seconds). "+
+		"Only that object is printed to stdout; log messages are printed to stderr. Default: text")
+	flag.BoolVar(&failOnNonPreferredBackup, "fail-on-non-preferred-backup", false, "Make the backup-check action exit with OCF_NOT_RUNNING if the replica on this node is not the preferred backup replica, "+
+		"so that a backup resource can be collocated with the preferred backup replica. By default the backup-check action only reports whether it is.")
+	flag.UintVar(&maxFailoverEvents, "max-failover-events", 20, "The maximum number of failover-related events that the diagnose action prints. Default: 20")
 	flag.BoolVar(&skipPreCheck, "skip-precheck", false, "Promote the replica on this node to master even if its availability mode is ASYNCHRONOUS_COMMIT.")
+	flag.BoolVar(&waitPrimaryRecovery, "wait-primary-recovery", false, "Make the promote action wait until the primary recovery health of the AG is ONLINE after the replica on this node is in PRIMARY role, "+
+		"so that it doesn't succeed while the databases are still recovering and can't serve queries yet. "+
+		"The promote action fails with OCF_ERR_GENERIC if the recovery doesn't finish within --wait-primary-recovery-timeout.")
+	flag.UintVar(&rawWaitPrimaryRecoveryTimeout, "wait-primary-recovery-timeout", 60, "The time in seconds that --wait-primary-recovery waits for the primary recovery health of the AG to be ONLINE. "+
+		"This should be lower than the timeout of the promote action. Default: 60")
+	flag.BoolVar(&verifyNoPrimary, "verify-no-primary", false, "Refuse to promote the replica on this node to master if it's connected to a live primary replica, "+
+		"to guard against two replicas being in PRIMARY role when the cluster is partitioned.")
+	flag.BoolVar(&force, "force", false, "Promote the replica on this node to master even if --verify-no-primary finds a live primary replica.")
+	flag.BoolVar(&allowDataLoss, "allow-data-loss", false, "Make the promote action fail over with FORCE_FAILOVER_ALLOW_DATA_LOSS instead of FAILOVER, "+
+		"so that the replica on this node can be promoted when the primary replica is lost and it is not SYNCHRONIZED. "+
+		"Transactions that the replica on this node did not receive are lost. The estimated data loss is logged before failing over.")
 	flag.StringVar(&sequenceNumbers, "sequence-numbers", "", "The sequence numbers of each replica as stored in the cluster. The value is expected to be in the format returned by attrd_updater -QA")
+	flag.StringVar(&sequenceNumberFormat, "sequence-number-format", mssqlag.SequenceNumberFormatAuto, "One of auto, attrd. The format of the lines of --sequence-numbers. "+
+		"auto: Lines of key=value attributes that include host and value attributes, in any order, with double-quoted, single-quoted or unquoted values. "+
+		"attrd: Exactly the name=\"...\" host=\"...\" value=\"...\" lines printed by attrd_updater -QA. Default: auto")
+	flag.StringVar(&productVersions, "product-versions", "", "The SQL Server product versions of each replica as stored in the cluster, in the format returned by attrd_updater -QA. "+
+		"The promote action warns if the local replica has a lower version than another replica.")
+	flag.StringVar(&lastHardenedLSNs, "last-hardened-lsns", "", "The last hardened LSNs of each replica as stored in the cluster, in the format returned by attrd_updater -QA. "+
+		"If every sequence number is 0, which happens on instances that don't have sequence numbers or while they're not available, "+
+		"the promote action compares these LSNs instead, and refuses to promote the local replica if it has a lower LSN than another replica for any database. "+
+		"The sequence numbers are always preferred when they are available.")
 	flag.StringVar(&newMaster, "new-master", "", "The name of the node that is being promoted.")
+	flag.StringVar(&listenerIP, "listener-ip", "", "The IP address of the cluster-managed IP resource of the AG listener. "+
+		"The check-configuration action fails with OCF_ERR_CONFIGURED if the listener of the AG does not have this IP address.")
+	flag.BoolVar(&manageRequiredSynchronizedSecondariesToCommit, "manage-rsstc", true, "Whether the monitor, pre-start, post-stop and promote actions set REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT. "+
+		"If false, they only log the current value, so that it can be managed by other automation. Default: true")
+	flag.BoolVar(&outputRequiredSynchronizedSecondariesToCommit, "output-required-synchronized-secondaries-to-commit", false, "Whenever REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT is set, "+
+		"also output the value on a line prefixed with REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT.")
 	flag.IntVar(&requiredSynchronizedSecondariesToCommitArg, "required-synchronized-secondaries-to-commit", -1, "Explicit value for REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT. If not provided, the value will be derived from the number of SYNCHRONOUS_COMMIT replicas.")
 
+	flag.BoolVar(&strictRole, "strict-role", false, "Make the monitor action fail with OCF_ERR_GENERIC if there is more than one local replica row for the AG, "+
+		"instead of using the role of the first one. This only happens when the metadata of the instance is corrupted.")
+	flag.StringVar(&treatAGNotHealthyAs, "treat-ag-not-healthy-as", "warning", "One of warning, error. "+
+		"Whether the monitor action on the primary replica fails with OCF_ERR_GENERIC or only logs a warning when the synchronization health of the AG as a whole is NOT_HEALTHY, "+
+		"such as when every secondary replica is disconnected, even though the local replica is PRIMARY and its databases are online. Default: warning")
+	flag.BoolVar(&checkResolvingCause, "check-resolving-cause", false, "Make the monitor action log whether the replica on this node is in RESOLVING role because its lease expired. "+
+		"This reads the extended events files of the instance, so it makes the monitor action slower while the replica is RESOLVING.")
+	flag.UintVar(&agRowMissingRetries, "ag-row-missing-retries", 0, "The number of times that the monitor action queries sys.availability_groups again, once a second, "+
+		"when it has no row for the AG, before reporting OCF_NOT_RUNNING. Right after the instance starts, the row can briefly be missing even though the AG exists. Default: 0")
 	flag.Parse()
 
+	switch outputFormat {
+	case "text":
+	case "json", "yaml":
+		// Keep stdout parseable by logging to the writer of stderr instead. This uses a new logger rather than
+		// changing the output of the caller's logger.
+		stdout = log.New(stderr.Writer(), stdout.Prefix(), stdout.Flags())
+	default:
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf(
+			"--output-format must be set to one of text, json, yaml but it was set to %s", outputFormat))
+	}
+
 	stdout.Printf(
-		"ag-helper invoked with hostname [%s]; port [%d]; ag-name [%s]; credentials-file [%s]; application-name [%s]; connection-timeout [%d]; health-threshold [%d]; action [%s]\n",
+		"ag-helper invoked with hostname [%s]; port [%d]; ag-name [%s]; credentials-file [%s]; username [%s]; password-file [%s]; credentials-provider [%s]; vault-address [%s]; vault-path [%s]; vault-token-file [%s]; application-name [%s]; append-hostname-to-appname [%t]; connection-timeout [%d]; trust-server-certificate [%s]; health-check-port [%d]; check-hostname-resolves [%t]; action-timeout [%d]; health-threshold [%d]; treat-query-processing-as [%s]; dump-diagnostics [%t]; on-unhealthy-command [%s]; on-unhealthy-command-timeout [%d]; diagnostics-repeat-interval [%d]; health-check-query [%s]; min-sql-version [%s]; action [%s]\n",
 		hostname, sqlPort,
 		agName,
-		credentialsFile,
-		applicationName,
-		rawConnectionTimeout, rawHealthThreshold,
+		credentialsFile, username, passwordFile, credentialsProviderName, vaultAddress, vaultPath, vaultTokenFile,
+		applicationName, appendHostnameToAppName,
+		rawConnectionTimeout, rawTrustServerCertificate, healthCheckPort, checkHostnameResolves, rawActionTimeout, rawHealthThreshold, treatQueryProcessingAs, dumpDiagnostics, onUnhealthyCommand, rawOnUnhealthyTimeout, diagnosticsRepeatInterval, healthCheckQuery, minSQLVersion,
 		action)
 
 	switch action {
 	case "start":
 		stdout.Printf(
-			"ag-helper invoked with online-databases-retries [%d]; required-synchronized-secondaries-to-commit [%d]\n",
-			numRetriesForOnlineDatabases, requiredSynchronizedSecondariesToCommitArg)
+			"ag-helper invoked with online-databases-retries [%d]; online-databases-poll-interval [%d]; max-database-states-to-log [%d]; ignore-databases [%s]; min-replicas-to-start [%d]; start-failover-wait-timeout [%d]; manage-rsstc [%t]; required-synchronized-secondaries-to-commit [%d]\n",
+			numRetriesForOnlineDatabases, rawOnlineDatabasesPollInterval, maxDatabaseStatesToLog, rawIgnoredDatabaseNames, minReplicasToStart, rawStartFailoverWaitTimeout, manageRequiredSynchronizedSecondariesToCommit, requiredSynchronizedSecondariesToCommitArg)
 
 	case "monitor":
 		stdout.Printf(
-			"ag-helper invoked with online-databases-retries [%d]; required-synchronized-secondaries-to-commit [%d]\n",
-			numRetriesForOnlineDatabases, requiredSynchronizedSecondariesToCommitArg)
+			"ag-helper invoked with online-databases-retries [%d]; online-databases-poll-interval [%d]; max-database-states-to-log [%d]; ignore-databases [%s]; manage-rsstc [%t]; required-synchronized-secondaries-to-commit [%d]; required-consecutive-failures [%s]; consecutive-failures-file [%s]; settings-cache-file [%s]; settings-cache-ttl [%d]; ag-row-missing-retries [%d]; strict-role [%t]; treat-ag-not-healthy-as [%s]; check-resolving-cause [%t]; set-lag-attribute [%t]; lag-attribute-name [%s]; lag-threshold-kb [%d]; attribute-command [%s]\n",
+			numRetriesForOnlineDatabases, rawOnlineDatabasesPollInterval, maxDatabaseStatesToLog, rawIgnoredDatabaseNames, manageRequiredSynchronizedSecondariesToCommit, requiredSynchronizedSecondariesToCommitArg, rawRequiredConsecutiveFailures, consecutiveFailuresFile, settingsCacheFile, rawSettingsCacheTTL, agRowMissingRetries, strictRole, treatAGNotHealthyAs, checkResolvingCause,
+			setLagAttribute, lagAttributeName, lagThresholdKB, attributeCommand)
 
 	case "pre-start":
 		stdout.Printf(
-			"ag-helper invoked with required-synchronized-secondaries-to-commit [%d]\n",
-			requiredSynchronizedSecondariesToCommitArg)
+			"ag-helper invoked with manage-rsstc [%t]; required-synchronized-secondaries-to-commit [%d]\n",
+			manageRequiredSynchronizedSecondariesToCommit, requiredSynchronizedSecondariesToCommitArg)
 
 	case "post-stop":
 		stdout.Printf(
-			"ag-helper invoked with required-synchronized-secondaries-to-commit [%d]\n",
-			requiredSynchronizedSecondariesToCommitArg)
+			"ag-helper invoked with manage-rsstc [%t]; required-synchronized-secondaries-to-commit [%d]\n",
+			manageRequiredSynchronizedSecondariesToCommit, requiredSynchronizedSecondariesToCommitArg)
+
+	case "stop":
+		stdout.Printf(
+			"ag-helper invoked with stop-demotes [%t]\n",
+			stopDemotes)
+
+	case "demote":
+		stdout.Printf(
+			"ag-helper invoked with demote-verify [%t]; demote-verify-timeout [%d]\n",
+			demoteVerify, rawDemoteVerifyTimeout)
+
+	case "pre-promote":
+		stdout.Printf(
+			"ag-helper invoked with sequence-number-json [%t]; sequence-number-attempts [%d]; all-ags [%t]; output-last-hardened-lsn [%t]; log-sequence-number-hex [%t]; skip-health-check [%t]\n",
+			sequenceNumberJSON, sequenceNumberAttempts, allAGs, outputLastHardenedLSN, logSequenceNumberHex, skipHealthCheck)
+
+	case "status":
+		stdout.Printf(
+			"ag-helper invoked with skip-health-check [%t]; output-format [%s]\n",
+			skipHealthCheck, outputFormat)
+
+	case "check-configuration":
+		stdout.Printf(
+			"ag-helper invoked with listener-ip [%s]\n",
+			listenerIP)
+
+	case "backup-check":
+		stdout.Printf(
+			"ag-helper invoked with fail-on-non-preferred-backup [%t]\n",
+			failOnNonPreferredBackup)
+
+	case "diagnose":
+		stdout.Printf(
+			"ag-helper invoked with max-failover-events [%d]\n",
+			maxFailoverEvents)
 
 	case "promote":
 		stdout.Printf(
-			"ag-helper invoked with skip-precheck [%t]; sequence-numbers [...]; new-master [%s]; required-synchronized-secondaries-to-commit [%d]\n",
-			skipPreCheck, newMaster, requiredSynchronizedSecondariesToCommitArg)
+			"ag-helper invoked with skip-precheck [%t]; wait-primary-recovery [%t]; wait-primary-recovery-timeout [%d]; verify-no-primary [%t]; force [%t]; allow-data-loss [%t]; sequence-numbers [...]; last-hardened-lsns [...]; log-sequence-number-hex [%t]; new-master [%s]; manage-rsstc [%t]; required-synchronized-secondaries-to-commit [%d]\n",
+			skipPreCheck, waitPrimaryRecovery, rawWaitPrimaryRecoveryTimeout, verifyNoPrimary, force, allowDataLoss, logSequenceNumberHex, newMaster, manageRequiredSynchronizedSecondariesToCommit, requiredSynchronizedSecondariesToCommitArg)
 	}
 
 	if hostname == "" {
@@ -142,12 +392,21 @@ func doMain(stdout *log.Logger, stderr *log.Logger, sequenceNumberOut *log.Logge
 		return errors.New("a valid port number must be specified using --port")
 	}
 
-	if agName == "" {
+	if allAGs && action != "pre-promote" {
+		return errors.New("--all-ags is only valid for the pre-promote action")
+	}
+
+	if allAGs && outputLastHardenedLSN {
+		return errors.New("--all-ags cannot be combined with --output-last-hardened-lsn")
+	}
+
+	if agName == "" && !allAGs && action != "ping" {
 		return errors.New("a valid AG name must be specified using --ag-name")
 	}
 
-	if credentialsFile == "" {
-		return errors.New("a valid path to a credentials file must be specified using --credentials-file")
+	if credentialsProviderName == "file" && credentialsFile == "" && username == "" && passwordFile == "" {
+		return errors.New("a valid path to a credentials file must be specified using --credentials-file, " +
+			"or a valid username and path to a password file must be specified using --username and --password-file")
 	}
 
 	if applicationName == "" {
@@ -169,7 +428,41 @@ func doMain(stdout *log.Logger, stderr *log.Logger, sequenceNumberOut *log.Logge
 		return err
 	}
 
-	if action == "stop" {
+	if credentialsProviderName == "file" && credentialsFile != "" && (username != "" || passwordFile != "") {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_ARGS, errors.New(
+			"Only one of --credentials-file or --username and --password-file must be specified"))
+	}
+
+	if credentialsProviderName == "file" && credentialsFile == "" && (username == "" || passwordFile == "") {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_ARGS, errors.New(
+			"--username and --password-file must be specified together"))
+	}
+
+	if appendHostnameToAppName {
+		localHostname, err := os.Hostname()
+		if err != nil {
+			return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not get hostname of this node: %s", err))
+		}
+
+		applicationName = fmt.Sprintf("%s (%s)", applicationName, localHostname)
+	}
+
+	if skipHealthCheck && action != "status" && action != "pre-promote" {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_ARGS, fmt.Errorf(
+			"--skip-health-check is only valid for the status and pre-promote actions but the action is %s", action))
+	}
+
+	if outputFormat != "text" && action != "status" {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_ARGS, fmt.Errorf(
+			"--output-format %s is only valid for the status action but the action is %s", outputFormat, action))
+	}
+
+	if requirePrimary && (action == "pre-promote" || action == "promote") {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_ARGS, fmt.Errorf(
+			"--require-primary is not valid for the %s action, which runs on a replica that is not yet in PRIMARY role", action))
+	}
+
+	if action == "stop" && !stopDemotes {
 		// This is a no-op since there is no meaning to "stopping" an AG.
 		// Don't even try to connect to the DB or perform a health check.
 
@@ -177,8 +470,123 @@ func doMain(stdout *log.Logger, stderr *log.Logger, sequenceNumberOut *log.Logge
 	}
 
 	connectionTimeout := time.Duration(rawConnectionTimeout) * time.Second
+	if connectionTimeout < mssqlcommon.MinConnectionTimeout {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf(
+			"--connection-timeout must be at least %d seconds but it was set to %d", mssqlcommon.MinConnectionTimeout/time.Second, rawConnectionTimeout))
+	}
+	trustServerCertificate, err := strconv.ParseBool(rawTrustServerCertificate)
+	if err != nil {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf(
+			"--trust-server-certificate must be set to one of true, false but it was set to %s", rawTrustServerCertificate))
+	}
+
+	if sequenceNumberFormat != mssqlag.SequenceNumberFormatAuto && sequenceNumberFormat != mssqlag.SequenceNumberFormatAttrd {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf(
+			"--sequence-number-format must be set to one of auto, attrd but it was set to %s", sequenceNumberFormat))
+	}
+
+	if checkHostnameResolves {
+		err = mssqlcommon.CheckHostnameResolves(hostname, stdout)
+		if err != nil {
+			return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, err)
+		}
+	}
+
 	healthThreshold := mssqlcommon.ServerHealth(rawHealthThreshold)
 
+	diagnosticsMapping := mssqlcommon.DefaultDiagnosticsMapping
+	switch treatQueryProcessingAs {
+	case "error":
+		// Keep the default mapping
+
+	case "warning":
+		diagnosticsMapping.QueryProcessing = mssqlcommon.ServerWarningOnly
+
+	default:
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf(
+			"--treat-query-processing-as must be set to one of warning, error but it was set to %s", treatQueryProcessingAs))
+	}
+
+	var failOnAGNotHealthy bool
+	switch treatAGNotHealthyAs {
+	case "warning":
+		failOnAGNotHealthy = false
+
+	case "error":
+		failOnAGNotHealthy = true
+
+	default:
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf(
+			"--treat-ag-not-healthy-as must be set to one of warning, error but it was set to %s", treatAGNotHealthyAs))
+	}
+
+	if diagnosticsRepeatInterval != 0 && time.Duration(diagnosticsRepeatInterval)*time.Second < mssqlcommon.MinDiagnosticsRepeatInterval {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf(
+			"--diagnostics-repeat-interval must be 0 or at least %d but it was set to %d", mssqlcommon.MinDiagnosticsRepeatInterval/time.Second, diagnosticsRepeatInterval))
+	}
+
+	if healthCheckQuery != "" && diagnosticsRepeatInterval != 0 {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, errors.New(
+			"--diagnostics-repeat-interval can't be used with --health-check-query since it only applies to sp_server_diagnostics"))
+	}
+
+	requiredProductVersion := actionMinProductVersions[action]
+	if minSQLVersion != "" {
+		// Comparing with the version itself validates it even if the action has no requirement of its own
+		otherProductVersion := requiredProductVersion
+		if otherProductVersion == "" {
+			otherProductVersion = minSQLVersion
+		}
+
+		comparison, err := mssqlcommon.CompareProductVersions(minSQLVersion, otherProductVersion)
+		if err != nil {
+			return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf("--min-sql-version is set to an invalid value: %s", err))
+		}
+
+		if comparison >= 0 {
+			requiredProductVersion = minSQLVersion
+		}
+	}
+
+	healthPolicy := &mssqlcommon.HealthPolicy{Mapping: diagnosticsMapping, DiagnosticsRepeatInterval: time.Duration(diagnosticsRepeatInterval) * time.Second, HealthCheckQuery: healthCheckQuery}
+
+	if action == "monitor" {
+		// Failures are only tolerated across consecutive monitors, so the other actions always fail immediately
+		healthPolicy.RequiredConsecutiveFailures, err = mssqlcommon.ParseComponentCounts(rawRequiredConsecutiveFailures, 1)
+		if err != nil {
+			return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf("--required-consecutive-failures is invalid: %s", err))
+		}
+
+		requiredConsecutiveFailures := healthPolicy.RequiredConsecutiveFailures
+		if consecutiveFailuresFile == "" &&
+			(requiredConsecutiveFailures.System > 1 || requiredConsecutiveFailures.Resource > 1 || requiredConsecutiveFailures.QueryProcessing > 1) {
+			return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, errors.New(
+				"--consecutive-failures-file must be specified when --required-consecutive-failures has a count greater than 1"))
+		}
+
+		if consecutiveFailuresFile != "" {
+			healthPolicy.ConsecutiveFailures, err = mssqlcommon.LoadConsecutiveFailures(consecutiveFailuresFile)
+			if err != nil {
+				// A corrupt file only loses the failures counted so far
+				stdout.Printf("Could not read consecutive failures file, so counting from 0: %s\n", err)
+				healthPolicy.ConsecutiveFailures = mssqlcommon.ComponentCounts{}
+			}
+		}
+	}
+
+	if rawOnlineDatabasesPollInterval == 0 {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, errors.New("--online-databases-poll-interval must be set to a valid number of seconds greater than 0"))
+	}
+	onlineDatabasesPollInterval := time.Duration(rawOnlineDatabasesPollInterval) * time.Second
+
+	var ignoredDatabaseNames []string
+	for _, ignoredDatabaseName := range strings.Split(rawIgnoredDatabaseNames, ",") {
+		ignoredDatabaseName = strings.TrimSpace(ignoredDatabaseName)
+		if ignoredDatabaseName != "" {
+			ignoredDatabaseNames = append(ignoredDatabaseNames, ignoredDatabaseName)
+		}
+	}
+
 	var requiredSynchronizedSecondariesToCommit *uint
 	if requiredSynchronizedSecondariesToCommitArg != -1 {
 		if requiredSynchronizedSecondariesToCommitArg < 0 || requiredSynchronizedSecondariesToCommitArg > math.MaxInt32 {
@@ -190,21 +598,120 @@ func doMain(stdout *log.Logger, stderr *log.Logger, sequenceNumberOut *log.Logge
 		requiredSynchronizedSecondariesToCommit = &requiredSynchronizedSecondariesToCommitUint
 	}
 
-	sqlUsername, sqlPassword, err := mssqlcommon.ReadCredentialsFile(credentialsFile)
+	// Cancelled when the process is asked to terminate or the action is about to overrun --action-timeout,
+	// so that long waits like waiting for databases to be ONLINE can return their last observed state instead of being killed
+	actionContext, cancelAction := context.WithCancel(context.Background())
+	defer cancelAction()
+
+	if rawActionTimeout > 0 {
+		actionTimeout := time.Duration(rawActionTimeout) * time.Second
+
+		actionContext, cancelAction = context.WithTimeout(actionContext, actionTimeout)
+		defer cancelAction()
+
+		boundedConnectionTimeout := boundConnectionTimeout(connectionTimeout, actionTimeout)
+		if boundedConnectionTimeout != connectionTimeout {
+			stdout.Printf("Reducing connection timeout from %s to %s to fit in the action timeout\n", connectionTimeout, boundedConnectionTimeout)
+			connectionTimeout = boundedConnectionTimeout
+		}
+	}
+
+	credentialProvider, err := mssqlcommon.NewCredentialProvider(credentialsProviderName, mssqlcommon.CredentialProviderOptions{
+		CredentialsFile: credentialsFile,
+		Username:        username,
+		PasswordFile:    passwordFile,
+		VaultAddress:    vaultAddress,
+		VaultPath:       vaultPath,
+		VaultTokenFile:  vaultTokenFile,
+	})
+	if errors.Is(err, mssqlcommon.ErrUnknownCredentialProvider) {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, err)
+	}
 	if err != nil {
-		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_ARGS, fmt.Errorf("Could not read credentials file: %s", err))
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_ARGS, err)
+	}
+
+	credentials, err := mssqlcommon.GetCredentialsWithTimeout(credentialProvider, connectionTimeout)
+	if err != nil {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_ARGS, fmt.Errorf("Could not read credentials: %s", err))
+	}
+
+	err = credentials.Validate()
+	if err != nil {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_ARGS, fmt.Errorf("Invalid credentials: %s", err))
+	}
+
+	sqlUsername, sqlPassword := credentials.Username, credentials.Password
+
+	if action == "ping" {
+		// Only measures the network and the connection, so none of the health checks or AG setup below are needed
+		ocfExitCode, err := ping(hostname, sqlPort, sqlUsername, sqlPassword, applicationName, connectionTimeout, trustServerCertificate, stdout)
+
+		stdout.Printf("Exiting with %s (code %d)\n", mssqlcommon.OcfCodeName(ocfExitCode), ocfExitCode)
+
+		return mssqlcommon.OcfExit(stderr, ocfExitCode, err)
+	}
+
+	if action == "stop" {
+		// A failed stop makes Pacemaker fence the node, so none of the health checks below are run
+		ocfExitCode, err := stop(actionContext, hostname, sqlPort, sqlUsername, sqlPassword, applicationName, connectionTimeout, trustServerCertificate, agName, stdout)
+
+		stdout.Printf("Exiting with %s (code %d)\n", mssqlcommon.OcfCodeName(ocfExitCode), ocfExitCode)
+
+		return mssqlcommon.OcfExit(stderr, ocfExitCode, err)
+	}
+
+	var db *sql.DB
+	var connectStats mssqlcommon.ConnectStats
+	if skipHealthCheck {
+		// These actions only query the AG, so a failure to connect is the only health problem worth reporting
+		stdout.Println("Skipping sp_server_diagnostics health check...")
+
+		db, err = mssqlcommon.OpenDB(
+			hostname, sqlPort,
+			sqlUsername, sqlPassword,
+			applicationName,
+			connectionTimeout,
+			trustServerCertificate)
+	} else {
+		db, err = mssqlcommon.OpenDBWithHealthCheck(
+			hostname, sqlPort,
+			sqlUsername, sqlPassword,
+			applicationName,
+			connectionTimeout,
+			trustServerCertificate,
+			healthCheckPort,
+			healthPolicy,
+			&connectStats,
+			stdout)
+
+		stdout.Printf("Connection attempts: %d; total wait: %s; last error: %v\n", connectStats.Attempts, connectStats.TotalWait.Round(time.Millisecond), connectStats.LastError)
+	}
+
+	if action == "monitor" && consecutiveFailuresFile != "" {
+		saveErr := mssqlcommon.SaveConsecutiveFailures(consecutiveFailuresFile, healthPolicy.ConsecutiveFailures)
+		if saveErr != nil {
+			stdout.Printf("Could not write consecutive failures file: %s\n", saveErr)
+		}
 	}
 
-	db, err := mssqlcommon.OpenDBWithHealthCheck(
-		hostname, sqlPort,
-		sqlUsername, sqlPassword,
-		applicationName,
-		connectionTimeout,
-		stdout)
 	if err != nil {
+		// SQL Server also rejects a valid login while its default database is recovering, so login failures were retried
+		// until the connection timeout. A login that still fails most likely has wrong credentials, which restarting the instance won't fix.
+		connectErrorCategory := mssqlcommon.ClassifyConnectError(err)
+		if connectErrorCategory == mssqlcommon.ConnectErrorLoginFailed {
+			return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_PERM, fmt.Errorf("Could not log in to the instance: %s", err))
+		}
+
+		stdout.Printf("Connection error category: %s\n", connectErrorCategory)
+
 		switch serverUnhealthyError := err.(type) {
 		case *mssqlcommon.ServerUnhealthyError:
 			if serverUnhealthyError.RawValue <= healthThreshold {
+				if onUnhealthyCommand != "" {
+					runOnUnhealthyCommand(onUnhealthyCommand, time.Duration(rawOnUnhealthyTimeout)*time.Second, serverUnhealthyError.RawValue, agName, stdout)
+				}
+
 				return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf(
 					"Instance health status %d is at or below the threshold value of %d",
 					serverUnhealthyError.RawValue, healthThreshold))
@@ -218,159 +725,828 @@ func doMain(stdout *log.Logger, stderr *log.Logger, sequenceNumberOut *log.Logge
 	}
 	defer db.Close()
 
-	stdout.Println("Setting session context...")
-	_, err = db.Exec(`EXEC sp_set_session_context @key = N'external_cluster', @value = N'yes', @read_only = 1`)
+	if dumpDiagnostics {
+		err = mssqlcommon.DumpDiagnostics(db, stdout)
+		if err != nil {
+			stdout.Printf("Could not dump sp_server_diagnostics results: %s\n", err)
+		}
+	}
+
+	err = setSessionContext(db, stdout)
 	if err != nil {
-		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Failed to set session context: %s", err))
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_GENERIC, err)
+	}
+
+	if !outputRequiredSynchronizedSecondariesToCommit {
+		requiredSynchronizedSecondariesToCommitOut = nil
+	}
+
+	if requiredProductVersion != "" {
+		ocfExitCode, err := checkMinProductVersion(db, requiredProductVersion, action, stdout)
+		if err != nil {
+			return mssqlcommon.OcfExit(stderr, ocfExitCode, err)
+		}
+	}
+
+	if requirePrimary {
+		isPrimary, err := isPrimary(actionContext, db, agName, stdout)
+		if err != nil {
+			return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not check if local replica is in PRIMARY role: %s", err))
+		}
+
+		if !isPrimary {
+			return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf(
+				"The %s action must be run on the primary replica of %s because --require-primary was specified", action, agName))
+		}
+	}
+
+	// Only these actions return their last observed state when actionContext is cancelled, so only they handle the signals.
+	// Any other action exits on the signal as usual.
+	switch action {
+	case "start", "monitor", "promote", "demote":
+		cancel := cancelAction
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		defer signal.Stop(signals)
+
+		go func() {
+			receivedSignal := <-signals
+			stdout.Printf("Received %s, cancelling action %s...\n", receivedSignal, action)
+			cancel()
+		}()
 	}
 
 	var ocfExitCode mssqlcommon.OcfExitCode
 
 	switch action {
 	case "start":
-		ocfExitCode, err = start(db, agName, numRetriesForOnlineDatabases, requiredSynchronizedSecondariesToCommit, stdout)
+		ocfExitCode, err = start(actionContext, db, agName, numRetriesForOnlineDatabases, onlineDatabasesPollInterval, ignoredDatabaseNames, maxDatabaseStatesToLog, minReplicasToStart, time.Duration(rawStartFailoverWaitTimeout)*time.Second, manageRequiredSynchronizedSecondariesToCommit, requiredSynchronizedSecondariesToCommit, stdout, requiredSynchronizedSecondariesToCommitOut)
 
 	case "monitor":
-		ocfExitCode, err = monitor(db, agName, numRetriesForOnlineDatabases, requiredSynchronizedSecondariesToCommit, stdout)
+		var lagAttribute *lagAttributeSettings
+		if setLagAttribute {
+			lagAttribute = &lagAttributeSettings{Name: lagAttributeName, ThresholdKB: lagThresholdKB, Command: attributeCommand}
+		}
+
+		ocfExitCode, err = monitor(actionContext, db, agName, numRetriesForOnlineDatabases, onlineDatabasesPollInterval, ignoredDatabaseNames, maxDatabaseStatesToLog, settingsCacheFile, time.Duration(rawSettingsCacheTTL)*time.Second, agRowMissingRetries, strictRole, failOnAGNotHealthy, checkResolvingCause, lagAttribute, manageRequiredSynchronizedSecondariesToCommit, requiredSynchronizedSecondariesToCommit, stdout, requiredSynchronizedSecondariesToCommitOut)
 
 	case "pre-start":
-		ocfExitCode, err = preStart(db, agName, requiredSynchronizedSecondariesToCommit, stdout)
+		ocfExitCode, err = preStart(actionContext, db, agName, manageRequiredSynchronizedSecondariesToCommit, requiredSynchronizedSecondariesToCommit, stdout, requiredSynchronizedSecondariesToCommitOut)
 
 	case "post-stop":
-		ocfExitCode, err = postStop(db, agName, requiredSynchronizedSecondariesToCommit, stdout)
+		ocfExitCode, err = postStop(actionContext, db, agName, manageRequiredSynchronizedSecondariesToCommit, requiredSynchronizedSecondariesToCommit, stdout, requiredSynchronizedSecondariesToCommitOut)
 
 	case "pre-promote":
-		ocfExitCode, err = prePromote(db, agName, stdout, sequenceNumberOut)
+		if allAGs {
+			ocfExitCode, err = prePromoteAllAGs(actionContext, db, logSequenceNumberHex, stdout, sequenceNumberJSONOut)
+		} else {
+			ocfExitCode, err = prePromote(actionContext, db, agName, sequenceNumberJSON, sequenceNumberAttempts, outputLastHardenedLSN, logSequenceNumberHex, stdout, sequenceNumberOut, sequenceNumberJSONOut, productVersionOut, lastHardenedLSNOut)
+		}
 
 	case "promote":
-		ocfExitCode, err = promote(db, agName, sequenceNumbers, newMaster, skipPreCheck, requiredSynchronizedSecondariesToCommit, stdout)
+		ocfExitCode, err = promote(actionContext, db, agName, sequenceNumbers, sequenceNumberFormat, logSequenceNumberHex, lastHardenedLSNs, productVersions, newMaster, skipPreCheck, waitPrimaryRecovery, time.Duration(rawWaitPrimaryRecoveryTimeout)*time.Second, verifyNoPrimary, force, allowDataLoss, manageRequiredSynchronizedSecondariesToCommit, requiredSynchronizedSecondariesToCommit, stdout, requiredSynchronizedSecondariesToCommitOut)
+		if promoteRefused, ok := err.(*promoteRefusedError); ok {
+			stdout.Printf("Promote refused with reason %s\n", promoteRefused.Decision)
+		}
 
 	case "demote":
-		ocfExitCode, err = demote(db, agName)
+		ocfExitCode, err = demote(actionContext, db, agName, demoteVerify, time.Duration(rawDemoteVerifyTimeout)*time.Second, stdout)
+
+	case "check-configuration":
+		ocfExitCode, err = checkConfiguration(actionContext, db, agName, listenerIP, stdout)
+
+	case "status":
+		ocfExitCode, err = status(actionContext, db, agName, outputFormat, stdout, statusOut)
+
+	case "check-listener":
+		ocfExitCode, err = checkListener(actionContext, db, agName, sqlUsername, sqlPassword, applicationName, connectionTimeout, trustServerCertificate, stdout)
+
+	case "backup-check":
+		ocfExitCode, err = backupCheck(actionContext, db, agName, failOnNonPreferredBackup, stdout)
+
+	case "diagnose":
+		ocfExitCode, err = diagnose(actionContext, db, agName, maxFailoverEvents, stdout)
 
 	default:
 		return fmt.Errorf("unknown value for --action %s", action)
 	}
 
+	ocfExitCode, err = checkActionTimeout(actionContext, action, time.Duration(rawActionTimeout)*time.Second, ocfExitCode, err)
+
+	stdout.Printf("Exiting with %s (code %d)\n", mssqlcommon.OcfCodeName(ocfExitCode), ocfExitCode)
+
 	return mssqlcommon.OcfExit(stderr, ocfExitCode, err)
 }
 
+// Function: actionTimeoutExitCode
+//
+// Description:
+//    Gets the exit code of an action that overran --action-timeout.
+//    A promote that didn't complete leaves the replica in an unknown state, like a failed failover.
+//
+func actionTimeoutExitCode(action string) mssqlcommon.OcfExitCode {
+	if action == "promote" {
+		return mssqlcommon.OCF_FAILED_MASTER
+	}
+
+	return mssqlcommon.OCF_ERR_GENERIC
+}
+
+// Function: checkActionTimeout
+//
+// Description:
+//    Replaces the result of an action that failed because it overran --action-timeout with the exit code of `actionTimeoutExitCode()`.
+//    The queries of the action are cancelled when its context is done, so a failure after the deadline is due to the timeout.
+//
+func checkActionTimeout(ctx context.Context, action string, actionTimeout time.Duration, ocfExitCode mssqlcommon.OcfExitCode, err error) (mssqlcommon.OcfExitCode, error) {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return actionTimeoutExitCode(action), fmt.Errorf("Action %s did not complete within %s: %s", action, actionTimeout, err)
+	}
+
+	return ocfExitCode, err
+}
+
+// Function: boundConnectionTimeout
+//
+// Description:
+//    Reduces the connection timeout to the action timeout, so that connecting to the instance doesn't overrun the action.
+//    The connection timeout is never reduced below `mssqlcommon.MinConnectionTimeout`.
+//
+func boundConnectionTimeout(connectionTimeout time.Duration, actionTimeout time.Duration) time.Duration {
+	if connectionTimeout <= actionTimeout {
+		return connectionTimeout
+	}
+
+	if actionTimeout < mssqlcommon.MinConnectionTimeout {
+		return mssqlcommon.MinConnectionTimeout
+	}
+
+	return actionTimeout
+}
+
+// Function: runOnUnhealthyCommand
+//
+// Description:
+//    Runs the --on-unhealthy-command with the health status and the AG name as arguments, and logs its output.
+//    The command is killed if it runs longer than the timeout. Its failure is only logged, since the action fails anyway.
+//
+func runOnUnhealthyCommand(command string, timeout time.Duration, health mssqlcommon.ServerHealth, agName string, stdout *log.Logger) {
+	stdout.Printf("Running on-unhealthy command %s...\n", command)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, command, strconv.FormatUint(uint64(health), 10), agName).CombinedOutput()
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line != "" {
+			stdout.Printf("on-unhealthy command: %s\n", line)
+		}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		stdout.Printf("On-unhealthy command timed out after %s\n", timeout)
+	} else if err != nil {
+		stdout.Printf("On-unhealthy command failed: %s\n", err)
+	}
+}
+
 // Function: start
 //
 // Description:
 //    Implements the OCF "start" action by ensuring the AG replica exists and is in SECONDARY role.
+//    If the local replica is the only replica of the AG, it's promoted to PRIMARY role instead. See `promoteSingleReplica()`.
 //
 // Returns:
 //    OCF_SUCCESS: AG replica exists and is in SECONDARY role.
-//    OCF_ERR_GENERIC: Propagated from `monitor()`
+//    OCF_ERR_GENERIC: The AG has fewer than `minReplicasToStart` replicas, or propagated from `monitor()`
 //
 func start(
+	ctx context.Context,
 	db *sql.DB, agName string,
-	numRetriesForOnlineDatabases uint,
+	numRetriesForOnlineDatabases uint, onlineDatabasesPollInterval time.Duration,
+	ignoredDatabaseNames []string, maxDatabaseStatesToLog uint,
+	minReplicasToStart uint,
+	failoverWaitTimeout time.Duration,
+	manageRequiredSynchronizedSecondariesToCommit bool,
 	requiredSynchronizedSecondariesToCommit *uint,
-	stdout *log.Logger) (mssqlcommon.OcfExitCode, error) {
+	stdout *log.Logger, requiredSynchronizedSecondariesToCommitOut *log.Logger) (mssqlcommon.OcfExitCode, error) {
 
-	// Set replica to SECONDARY, ignoring errors.
-	// Errors are ignored to handle the rare case where there's only a single replica total in the AG.
-	// ALTER AG SET (ROLE = SECONDARY) fails in this case but also promotes the replica to primary.
-	//
-	// If the AG is unhealthy for any other reason, this will be caught by `monitor()` below.
-	_ = mssqlag.SetRoleToSecondary(db, agName)
+	stdout.Printf("Querying replicas of %s...\n", agName)
+
+	replicaNames, err := mssqlag.GetReplicaList(ctx, db, agName)
+	isOnlyReplica, ocfExitCode, err := checkReplicasToStart(agName, replicaNames, err, minReplicasToStart, stdout)
+	if err != nil {
+		return ocfExitCode, err
+	}
+
+	if failoverWaitTimeout > 0 {
+		waitForNoActiveFailover(ctx, db, agName, failoverWaitTimeout, stdout)
+	}
+
+	if isOnlyReplica {
+		err = promoteSingleReplica(ctx, db, agName, stdout)
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not promote the only replica of the AG to PRIMARY role: %s", err)
+		}
+	} else {
+		// If the AG is unhealthy, this will be caught by `monitor()` below, so only log the error.
+		err = mssqlag.SetRoleToSecondary(ctx, db, agName)
+		if err != nil {
+			stdout.Printf("Could not set local replica to SECONDARY role: %s\n", err)
+		}
+	}
 
 	// `SET (ROLE = SECONDARY)` DDL returns before role change finishes, so wait till it completes.
 	// This is especially important if the previous role was RESOLVING, because monitor() will interpret
 	// RESOLVING to return OCF_NOT_RUNNING. We don't want the "start" action to return OCF_NOT_RUNNING
 	// since pacemaker treats that as a hard error and won't try to start the resource any more.
-	err := waitUntilRoleSatisfies(db, agName, stdout, func(role mssqlag.Role) bool { return role != mssqlag.RoleRESOLVING })
+	err = waitUntilRoleSatisfies(ctx, db, agName, stdout, func(role mssqlag.Role) bool { return role != mssqlag.RoleRESOLVING })
 	if err == sql.ErrNoRows {
 		return mssqlcommon.OCF_ERR_ARGS, errors.New("sys.availability_groups does not contain a row for the AG. Local replica may not be joined to the AG.")
 	}
 	if err != nil {
-		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Failed while waiting for local replica to be in SECONDARY role: %s", err)
+		return mssqlcommon.OCF_ERR_GENERIC, withLastConnectErrors(ctx, db, agName, fmt.Errorf("Failed while waiting for local replica to be in SECONDARY role: %s", err), stdout)
 	}
 
 	// Check health to confirm successful startup
-	return monitor(db, agName, numRetriesForOnlineDatabases, requiredSynchronizedSecondariesToCommit, stdout)
+	// Don't use cached settings since the replica may have just been reconfigured before being started
+	ocfExitCode, err = monitor(ctx, db, agName, numRetriesForOnlineDatabases, onlineDatabasesPollInterval, ignoredDatabaseNames, maxDatabaseStatesToLog, "", 0, 0, false, false, false, nil, manageRequiredSynchronizedSecondariesToCommit, requiredSynchronizedSecondariesToCommit, stdout, requiredSynchronizedSecondariesToCommitOut)
+	if err != nil {
+		err = withLastConnectErrors(ctx, db, agName, err, stdout)
+	}
+
+	return ocfExitCode, err
 }
 
-// Function: monitor
+// Function: checkReplicasToStart
 //
 // Description:
-//    Implements the OCF "monitor" action.
+//    Checks the replicas of the AG as queried by `mssqlag.GetReplicaList()` for `start()`.
+//    The replicas are only needed to enforce --min-replicas-to-start and to find out if the local replica is the only replica of the AG.
+//    If they couldn't be queried and --min-replicas-to-start is not set, `start()` sets the local replica to SECONDARY role
+//    like for an AG with more than one replica, so the failure is only logged.
+//
+// Params:
+//    replicaNames: The replicas of the AG.
+//    replicaListErr: The error of querying the replicas, if any.
 //
 // Returns:
-//    OCF_SUCCESS: AG replica on this instance is in SECONDARY role.
-//    OCF_RUNNING_MASTER: AG replica on this instance is in PRIMARY role. If DB_FAILOVER is ON for this AG,
-//        then all databases on this replica are ONLINE.
-//    OCF_NOT_RUNNING: The AG is not found in sys.availability_groups, or its role is RESOLVING.
-//    OCF_ERR_GENERIC: One of the above is not true.
+//    Whether the local replica is the only replica of the AG.
+//    An error, and the OCF exit code to return with it, if the start must fail:
+//        OCF_ERR_ARGS if the AG doesn't exist on this instance, or OCF_ERR_GENERIC if the AG has too few replicas.
 //
-func monitor(
-	db *sql.DB, agName string,
-	numRetriesForOnlineDatabases uint,
-	requiredSynchronizedSecondariesToCommit *uint,
-	stdout *log.Logger) (mssqlcommon.OcfExitCode, error) {
-
-	stdout.Printf("Querying role of %s on this node...\n", agName)
+func checkReplicasToStart(
+	agName string,
+	replicaNames []string, replicaListErr error,
+	minReplicasToStart uint,
+	stdout *log.Logger) (isOnlyReplica bool, ocfExitCode mssqlcommon.OcfExitCode, err error) {
+
+	if replicaListErr != nil {
+		if minReplicasToStart > 0 {
+			return false, mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query replicas to check --min-replicas-to-start: %s", replicaListErr)
+		}
 
-	role, roleDesc, err := mssqlag.GetRole(db, agName)
-	if err == sql.ErrNoRows {
-		stdout.Printf("No row found in sys.availability_groups for %s.\n", agName)
-		return mssqlcommon.OCF_NOT_RUNNING, nil
+		stdout.Printf("Could not query replicas, so setting the local replica to SECONDARY role: %s\n", replicaListErr)
+		return false, mssqlcommon.OCF_SUCCESS, nil
 	}
-	if err != nil {
-		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query replica role: %s", err)
+
+	// An AG always has at least the local replica, so no replicas means that the AG doesn't exist on this instance
+	if len(replicaNames) == 0 {
+		return false, mssqlcommon.OCF_ERR_ARGS, errors.New("sys.availability_groups does not contain a row for the AG. Local replica may not be joined to the AG.")
 	}
 
-	stdout.Printf("%s is in %s (%d) role.\n", agName, roleDesc, role)
+	stdout.Printf("%s has %d replicas: %s\n", agName, len(replicaNames), strings.Join(replicaNames, ", "))
 
-	if role == mssqlag.RolePRIMARY {
-		stdout.Printf("Querying DB_FAILOVER setting of %s...\n", agName)
+	// These are the replicas configured in the AG, not only the connected ones. The local replica isn't PRIMARY yet,
+	// so it doesn't know which of the other replicas are connected.
+	if uint(len(replicaNames)) < minReplicasToStart {
+		return false, mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf(
+			"AG has %d replicas but at least %d replicas are required to start the local replica",
+			len(replicaNames), minReplicasToStart)
+	}
 
-		dbFailoverMode, err := mssqlag.GetDBFailoverMode(db, agName)
-		if err != nil {
-			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query DB_FAILOVER setting: %s", err)
-		}
+	return len(replicaNames) == 1, mssqlcommon.OCF_SUCCESS, nil
+}
 
-		var dbFailoverModeString string
-		if dbFailoverMode {
-			dbFailoverModeString = "ON"
-		} else {
-			dbFailoverModeString = "OFF"
-		}
+// Function: waitForNoActiveFailover
+//
+// Description:
+//    Waits up to `timeout` for a failover in progress to finish before `start()` sets the role of the local replica, so that it doesn't
+//    interfere with the failover. A failover is considered in progress while the local replica is in RESOLVING role and its most recent
+//    change of role or state happened less than `activeFailoverWindow` ago.
+//
+//    The most recent change is read from the extended events files only once. After that only the role is polled,
+//    until it's no longer RESOLVING or the change is older than `activeFailoverWindow`.
+//
+//    Nothing here is a reason to fail the start, so errors are only logged and the start continues when the timeout elapses.
+//
+func waitForNoActiveFailover(ctx context.Context, db *sql.DB, agName string, timeout time.Duration, stdout *log.Logger) {
+	role, roleDesc, err := mssqlag.GetRole(ctx, db, agName)
+	if err != nil {
+		stdout.Printf("Could not query role of %s to check for a failover in progress: %s\n", agName, err)
+		return
+	}
 
-		stdout.Printf("%s has DB_FAILOVER = %s.\n", agName, dbFailoverModeString)
+	if role != mssqlag.RoleRESOLVING {
+		stdout.Printf("%s is in %s (%d) role, so no failover is in progress.\n", agName, roleDesc, role)
+		return
+	}
 
-		if dbFailoverMode {
-			err = waitForDatabasesToBeOnline(db, agName, numRetriesForOnlineDatabases, stdout)
-			if err != nil {
-				return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Failed while waiting for databases to be online: %s", err)
-			}
+	lastStateChange, ok, err := mssqlag.GetLastStateChange(ctx, db, agName)
+	if err != nil {
+		stdout.Printf("Could not query the last state change of %s to check for a failover in progress: %s\n", agName, err)
+		return
+	}
+
+	if !ok {
+		stdout.Printf("%s is in RESOLVING role but has no recent state change, so no failover is in progress.\n", agName)
+		return
+	}
+
+	sinceLastStateChange := time.Since(lastStateChange.Timestamp)
+	if sinceLastStateChange > activeFailoverWindow {
+		stdout.Printf(
+			"%s is in RESOLVING role but last changed state from %s to %s %s ago, so no failover is in progress.\n",
+			agName, lastStateChange.PreviousState, lastStateChange.CurrentState, sinceLastStateChange.Round(time.Second))
+		return
+	}
+
+	stdout.Printf(
+		"%s is in RESOLVING role and changed state from %s to %s %s ago. Waiting up to %s for the failover in progress to finish...\n",
+		agName, lastStateChange.PreviousState, lastStateChange.CurrentState, sinceLastStateChange.Round(time.Second), timeout)
+
+	deadline := time.Now().Add(timeout)
+	windowEnd := lastStateChange.Timestamp.Add(activeFailoverWindow)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-time.After(activeFailoverPollInterval):
 		}
 
-		// Update REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT if necessary
-		if requiredSynchronizedSecondariesToCommit == nil {
-			err = calculateAndSetRequiredSynchronizedSecondariesToCommit(db, agName, stdout)
+		role, roleDesc, err = mssqlag.GetRole(ctx, db, agName)
+		if err != nil {
+			stdout.Printf("Could not query role of %s to check for a failover in progress: %s\n", agName, err)
+			return
+		}
+
+		if role != mssqlag.RoleRESOLVING {
+			stdout.Printf("%s is in %s (%d) role, so the failover has finished.\n", agName, roleDesc, role)
+			return
+		}
+
+		if time.Now().After(windowEnd) {
+			stdout.Printf("%s is still in RESOLVING role but its last state change is older than %s, so no failover is in progress.\n", agName, activeFailoverWindow)
+			return
+		}
+
+		if time.Now().After(deadline) {
+			stdout.Printf("Timed out after %s while waiting for a failover of %s in progress to finish. Starting anyway.\n", timeout, agName)
+			return
+		}
+	}
+}
+
+// Function: promoteSingleReplica
+//
+// Description:
+//    Promotes the local replica to PRIMARY role when it's the only replica of the AG, for `start()`.
+//    There is no other replica that could be promoted instead, and `SET (ROLE = SECONDARY)` can't be used since it fails
+//    for the only replica of an AG, even though it also promotes it.
+//
+func promoteSingleReplica(ctx context.Context, db *sql.DB, agName string, stdout *log.Logger) error {
+	stdout.Printf("Local replica is the only replica of %s, so promoting it to PRIMARY role instead of setting it to SECONDARY role.\n", agName)
+
+	isPrimary, err := isPrimary(ctx, db, agName, stdout)
+	if err != nil {
+		return err
+	}
+	if isPrimary {
+		return nil
+	}
+
+	err = mssqlag.Failover(ctx, db, agName)
+	if err != nil {
+		return err
+	}
+
+	return waitUntilRoleSatisfies(ctx, db, agName, stdout, func(role mssqlag.Role) bool { return role == mssqlag.RolePRIMARY })
+}
+
+// Function: withLastConnectErrors
+//
+// Description:
+//    Appends the last connection error of every replica of the AG to the given error, if any replica has one.
+//    A replica that can't join the AG usually can't connect to the other replicas' endpoints, so this
+//    makes endpoint and firewall problems visible in the error of a failed start.
+//
+func withLastConnectErrors(ctx context.Context, db *sql.DB, agName string, err error, stdout *log.Logger) error {
+	lastConnectErrors, queryErr := mssqlag.GetReplicaLastConnectErrors(ctx, db, agName)
+	if queryErr != nil {
+		stdout.Printf("Could not query last connection errors of replicas: %s\n", queryErr)
+		return err
+	}
+
+	if len(lastConnectErrors) == 0 {
+		return err
+	}
+
+	replicaNames := make([]string, 0, len(lastConnectErrors))
+	for replicaName := range lastConnectErrors {
+		replicaNames = append(replicaNames, replicaName)
+	}
+	sort.Strings(replicaNames)
+
+	details := make([]string, 0, len(replicaNames))
+	for _, replicaName := range replicaNames {
+		details = append(details, fmt.Sprintf("%s: %s", replicaName, lastConnectErrors[replicaName]))
+	}
+
+	return fmt.Errorf("%s. Replica connection errors: %s", err, strings.Join(details, "; "))
+}
+
+// Function: stop
+//
+// Description:
+//    Implements the OCF "stop" action when --stop-demotes is specified, by ensuring the AG replica is not in PRIMARY role.
+//    This lets Pacemaker move the master role to another node cleanly, such as when draining a node for maintenance.
+//
+//    A failed stop makes Pacemaker fence the node, so the instance is connected to without a health check, and an instance that
+//    can't be connected to or queried is treated as having nothing to demote.
+//
+// Returns:
+//    OCF_SUCCESS: AG replica was not confirmed to be in PRIMARY role, or was successfully set to SECONDARY role.
+//    OCF_ERR_GENERIC: AG replica was in PRIMARY role and could not be set to SECONDARY role.
+//
+func stop(
+	ctx context.Context,
+	hostname string, port uint64,
+	username string, password string,
+	applicationName string,
+	connectionTimeout time.Duration,
+	trustServerCertificate bool,
+	agName string,
+	stdout *log.Logger) (mssqlcommon.OcfExitCode, error) {
+
+	db, err := mssqlcommon.OpenDB(hostname, port, username, password, applicationName, connectionTimeout, trustServerCertificate)
+	if err != nil {
+		stdout.Printf("Could not connect to the instance, so there is nothing to demote: %s\n", err)
+		return mssqlcommon.OCF_SUCCESS, nil
+	}
+	defer db.Close()
+
+	err = setSessionContext(db, stdout)
+	if err != nil {
+		stdout.Printf("%s, so the local replica can't be demoted.\n", err)
+		return mssqlcommon.OCF_SUCCESS, nil
+	}
+
+	isPrimary, err := isPrimary(ctx, db, agName, stdout)
+	if err == sql.ErrNoRows {
+		// There is no AG replica to demote
+		stdout.Printf("No row found in sys.availability_groups for %s.\n", agName)
+		return mssqlcommon.OCF_SUCCESS, nil
+	}
+	if err != nil {
+		stdout.Printf("Could not check if local replica is in PRIMARY role, so not demoting it: %s\n", err)
+		return mssqlcommon.OCF_SUCCESS, nil
+	}
+
+	if !isPrimary {
+		return mssqlcommon.OCF_SUCCESS, nil
+	}
+
+	stdout.Printf("Setting role of %s on this node to SECONDARY before stopping...\n", agName)
+
+	return demote(ctx, db, agName, false, 0, stdout)
+}
+
+// Function: monitor
+//
+// Description:
+//    Implements the OCF "monitor" action.
+//
+// Returns:
+//    OCF_SUCCESS: AG replica on this instance is in SECONDARY role.
+//    OCF_RUNNING_MASTER: AG replica on this instance is in PRIMARY role. If DB_FAILOVER is ON for this AG,
+//        then all databases on this replica are ONLINE. If `failOnAGNotHealthy` is set, then the AG is not NOT_HEALTHY.
+//    OCF_NOT_RUNNING: The AG is not found in sys.availability_groups, or its role is RESOLVING.
+//    OCF_ERR_GENERIC: One of the above is not true.
+//
+func monitor(
+	ctx context.Context,
+	db *sql.DB, agName string,
+	numRetriesForOnlineDatabases uint, onlineDatabasesPollInterval time.Duration,
+	ignoredDatabaseNames []string, maxDatabaseStatesToLog uint,
+	settingsCacheFile string, settingsCacheTTL time.Duration,
+	agRowMissingRetries uint,
+	strictRole bool,
+	failOnAGNotHealthy bool,
+	checkResolvingCause bool,
+	lagAttribute *lagAttributeSettings,
+	manageRequiredSynchronizedSecondariesToCommit bool,
+	requiredSynchronizedSecondariesToCommit *uint,
+	stdout *log.Logger, requiredSynchronizedSecondariesToCommitOut *log.Logger) (mssqlcommon.OcfExitCode, error) {
+
+	stdout.Printf("Querying role of %s on this node...\n", agName)
+
+	// The monitor runs several queries about the AG, so look it up by name only once, in the same query as the role
+	groupID, role, roleDesc, err := resolveGroupIDAndRoleWithRetry(ctx, db, agName, agRowMissingRetries, stdout)
+	if err == sql.ErrNoRows {
+		stdout.Printf("No row found in sys.availability_groups for %s.\n", agName)
+		return mssqlcommon.OCF_NOT_RUNNING, nil
+	}
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query replica role: %s", err)
+	}
+
+	if strictRole {
+		role, roleDesc, err = mssqlag.GetRoleStrictByGroupID(ctx, db, groupID)
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query replica role: %s", err)
+		}
+	}
+
+	stdout.Printf("%s is in %s (%d) role.\n", agName, roleDesc, role)
+
+	// The AG-level health only fails the monitor of the primary replica with --treat-ag-not-healthy-as=error,
+	// but log it to summarize the health of all replicas in one line
+	synchronizationHealthDesc, primaryRecoveryHealthDesc, err := mssqlag.GetGroupHealthByGroupID(ctx, db, groupID)
+	if err != nil {
+		stdout.Printf("Could not query health of %s: %s\n", agName, err)
+	} else {
+		stdout.Printf("%s has synchronization health [%s]; primary recovery health [%s]\n", agName, synchronizationHealthDesc, primaryRecoveryHealthDesc)
+	}
+
+	syncProgressSummary, err := mssqlag.GetSyncProgressSummaryByGroupID(ctx, db, groupID)
+	if err != nil {
+		stdout.Printf("Could not query synchronization progress of %s: %s\n", agName, err)
+	} else {
+		stdout.Printf(
+			"%s has %d of %d database replicas SYNCHRONIZED; max log send queue [%d KB]; max redo queue [%d KB]\n",
+			agName, syncProgressSummary.NumSynchronized, syncProgressSummary.NumDatabaseReplicas,
+			syncProgressSummary.MaxLogSendQueueSizeKB, syncProgressSummary.MaxRedoQueueSizeKB)
+
+		if lagAttribute != nil {
+			// On a secondary replica, sys.dm_hadr_database_replica_states only has rows for the local database replicas,
+			// so the summary describes only the local replica.
+			lagging := role == mssqlag.RoleSECONDARY &&
+				(syncProgressSummary.MaxLogSendQueueSizeKB > lagAttribute.ThresholdKB || syncProgressSummary.MaxRedoQueueSizeKB > lagAttribute.ThresholdKB)
+
+			// The attribute is informational, so don't fail the monitor if it can't be set
+			err = setNodeAttribute(ctx, lagAttribute.Command, lagAttribute.Name, lagging, stdout)
+			if err != nil {
+				stdout.Printf("Could not set node attribute %s: %s\n", lagAttribute.Name, err)
+			}
+		}
+	}
+
+	if role == mssqlag.RolePRIMARY {
+		var dbFailoverMode bool
+		if settingsCacheFile != "" && settingsCacheTTL > 0 {
+			stdout.Printf("Querying DB_FAILOVER setting and cluster type of %s, or reusing them if they were cached less than %s ago...\n", agName, settingsCacheTTL)
+
+			settings, fromCache, err := getSettingsCached(ctx, db, agName, groupID, settingsCacheFile, settingsCacheTTL, stdout)
+			if err != nil {
+				return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query DB_FAILOVER setting and cluster type: %s", err)
+			}
+			if fromCache {
+				stdout.Println("Reusing cached DB_FAILOVER setting and cluster type.")
+			}
+
+			// Pacemaker can only drive failovers of an AG created with CLUSTER_TYPE = EXTERNAL
+			if settings.ClusterTypeDesc != "EXTERNAL" {
+				stdout.Printf("Warning: %s has cluster type %s, but an AG managed by Pacemaker must have cluster type EXTERNAL.\n", agName, settings.ClusterTypeDesc)
+			}
+
+			dbFailoverMode = settings.DBFailoverMode
+		} else {
+			stdout.Printf("Querying DB_FAILOVER setting of %s...\n", agName)
+
+			dbFailoverMode, err = mssqlag.GetDBFailoverModeByGroupID(ctx, db, groupID)
 			if err != nil {
-				return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not calculate and set value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT: %s", err)
+				return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query DB_FAILOVER setting: %s", err)
 			}
+		}
+
+		var dbFailoverModeString string
+		if dbFailoverMode {
+			dbFailoverModeString = "ON"
 		} else {
-			err = setRequiredSynchronizedSecondariesToCommit(db, agName, *requiredSynchronizedSecondariesToCommit, stdout)
+			dbFailoverModeString = "OFF"
+		}
+
+		stdout.Printf("%s has DB_FAILOVER = %s.\n", agName, dbFailoverModeString)
+
+		if dbFailoverMode {
+			err = waitForDatabasesToBeOnline(ctx, db, agName, groupID, numRetriesForOnlineDatabases, onlineDatabasesPollInterval, ignoredDatabaseNames, maxDatabaseStatesToLog, stdout)
 			if err != nil {
-				return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not set value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT: %s", err)
+				logUnhealthyDatabases(ctx, db, agName, stdout)
+
+				return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Failed while waiting for databases to be online: %s", err)
+			}
+		}
+
+		// NOT_HEALTHY on the primary replica means that no secondary replica is synchronizing, so a failure of the primary replica would lose data
+		// or the AG altogether. The health is empty if it couldn't be queried above, which was already logged.
+		if synchronizationHealthDesc == "NOT_HEALTHY" {
+			if failOnAGNotHealthy {
+				return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("%s has synchronization health NOT_HEALTHY even though the local replica is PRIMARY", agName)
 			}
+
+			stdout.Printf("Warning: %s has synchronization health NOT_HEALTHY even though the local replica is PRIMARY.\n", agName)
+		}
+
+		// Update REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT if necessary
+		err = updateRequiredSynchronizedSecondariesToCommit(
+			ctx, db, agName, manageRequiredSynchronizedSecondariesToCommit, requiredSynchronizedSecondariesToCommit, stdout, requiredSynchronizedSecondariesToCommitOut)
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not update value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT: %s", err)
 		}
 
 		return mssqlcommon.OCF_RUNNING_MASTER, nil
 	} else if role == mssqlag.RoleRESOLVING {
 		// AG is neither PRIMARY nor SECONDARY, which means it's waiting to be explicitly set to one or the other via start / promote.
 		// So tell Pacemaker that the resource is not running.
+		// Reading the extended events files is too slow to do on every monitor, so it's opt-in
+		if checkResolvingCause {
+			logResolvingCause(ctx, db, agName, stdout)
+		}
+
 		return mssqlcommon.OCF_NOT_RUNNING, nil
 	}
 
+	// Being disconnected from the primary doesn't fail the monitor, but log why to help diagnose sync issues
+	_, connected, connectionErrorDetail, err := mssqlag.GetPrimaryConnectionErrorDetailByGroupID(ctx, db, groupID)
+	if err != nil {
+		stdout.Printf("Could not query connection state of %s to the primary replica: %s\n", agName, err)
+	} else if !connected {
+		stdout.Printf("Secondary replica of %s is disconnected from the primary replica: %s\n", agName, connectionErrorDetail)
+	}
+
 	return mssqlcommon.OCF_SUCCESS, nil
 }
 
+// The node attribute that `monitor()` sets to report whether the local replica is lagging
+type lagAttributeSettings struct {
+	// The name of the node attribute
+	Name string
+
+	// The size in KB of the log send queue or redo queue above which the local replica is lagging
+	ThresholdKB int64
+
+	// The command used to set the node attribute, like attrd_updater
+	Command string
+}
+
+// Function: setNodeAttribute
+//
+// Description:
+//    Sets the given node attribute of the local node to 1 or 0 by running the given command with the arguments -n <name> -U <value>.
+//
+func setNodeAttribute(ctx context.Context, command string, name string, value bool, stdout *log.Logger) error {
+	valueString := "0"
+	if value {
+		valueString = "1"
+	}
+
+	stdout.Printf("Setting node attribute %s to %s...\n", name, valueString)
+
+	output, err := exec.CommandContext(ctx, command, "-n", name, "-U", valueString).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s: %s", command, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// The rarely-changing settings of an AG that `monitor()` caches in the settings cache file
+type cachedSettings struct {
+	// The DB_FAILOVER setting. `true` means ON, `false` means OFF.
+	DBFailoverMode bool `json:"dbFailoverMode"`
+
+	// The cluster_type_desc of the AG, like EXTERNAL
+	ClusterTypeDesc string `json:"clusterTypeDesc"`
+
+	CachedAt time.Time `json:"cachedAt"`
+}
+
+// Function: getSettingsCached
+//
+// Description:
+//    Gets the DB_FAILOVER setting and cluster type of the given AG, but reuses the values stored in the given cache file
+//    if they were queried less than `ttl` ago.
+//
+//    The cache file holds the settings of every AG keyed by AG name. It is only an optimization,
+//    so a cache file that can't be read or written is treated as empty and doesn't cause an error.
+//
+// Returns:
+//    The settings. fromCache is true if they were read from the cache file.
+//
+func getSettingsCached(
+	ctx context.Context, db *sql.DB, agName string, groupID string,
+	cacheFilename string, ttl time.Duration,
+	stdout *log.Logger) (settings cachedSettings, fromCache bool, err error) {
+
+	cache := make(map[string]cachedSettings)
+
+	contents, readErr := ioutil.ReadFile(cacheFilename)
+	if readErr == nil {
+		// A corrupt cache file is overwritten below
+		_ = json.Unmarshal(contents, &cache)
+	}
+
+	now := time.Now()
+
+	settings, ok := lookupCachedSettings(cache, agName, now, ttl)
+	if ok {
+		return settings, true, nil
+	}
+
+	settings.DBFailoverMode, err = mssqlag.GetDBFailoverModeByGroupID(ctx, db, groupID)
+	if err != nil {
+		return
+	}
+
+	settings.ClusterTypeDesc, err = mssqlag.GetClusterTypeByGroupID(ctx, db, groupID)
+	if err != nil {
+		return
+	}
+
+	settings.CachedAt = now
+	cache[agName] = settings
+
+	saveErr := saveSettingsCache(cacheFilename, cache)
+	if saveErr != nil {
+		stdout.Printf("Could not save settings cache file %s: %s\n", cacheFilename, saveErr)
+	}
+
+	return
+}
+
+// Function: lookupCachedSettings
+//
+// Description:
+//    Gets the cached settings of the given AG for `getSettingsCached()` if they were cached less than `ttl` before `now`.
+//
+func lookupCachedSettings(cache map[string]cachedSettings, agName string, now time.Time, ttl time.Duration) (settings cachedSettings, ok bool) {
+	settings, ok = cache[agName]
+	if !ok {
+		return
+	}
+
+	// Settings cached before the cluster type was cached don't have it
+	if settings.ClusterTypeDesc == "" {
+		return cachedSettings{}, false
+	}
+
+	age := now.Sub(settings.CachedAt)
+
+	// A cache time in the future means the clock was changed, so the age of the value is unknown
+	if age < 0 || age >= ttl {
+		return cachedSettings{}, false
+	}
+
+	return
+}
+
+// Function: saveSettingsCache
+//
+// Description:
+//    Writes the given settings cache to the given file.
+//
+//    The cache is written to a uniquely-named temporary file that is renamed over the original,
+//    so that concurrent monitors never write the same temporary file and a reader never sees a partial file.
+//
+func saveSettingsCache(filename string, cache map[string]cachedSettings) (err error) {
+	contents, err := json.Marshal(cache)
+	if err != nil {
+		return
+	}
+
+	temporaryFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return
+	}
+
+	_, err = temporaryFile.Write(contents)
+	closeErr := temporaryFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temporaryFile.Name(), filename)
+	}
+	if err != nil {
+		_ = os.Remove(temporaryFile.Name())
+	}
+
+	return
+}
+
 // Function: preStart
 //
 // Description:
@@ -381,326 +1557,1929 @@ func monitor(
 //    OCF_ERR_GENERIC
 //
 func preStart(
-	db *sql.DB, agName string,
+	ctx context.Context, db *sql.DB, agName string,
+	manageRequiredSynchronizedSecondariesToCommit bool,
 	requiredSynchronizedSecondariesToCommit *uint,
-	stdout *log.Logger) (mssqlcommon.OcfExitCode, error) {
+	stdout *log.Logger, requiredSynchronizedSecondariesToCommitOut *log.Logger) (mssqlcommon.OcfExitCode, error) {
 
-	isPrimary, err := isPrimary(db, agName, stdout)
+	// A replica is going to start. If it's starting because a new replica was added to the AG, then the primary replica needs to update REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT.
+	err := updateRequiredSynchronizedSecondariesToCommit(
+		ctx, db, agName, manageRequiredSynchronizedSecondariesToCommit, requiredSynchronizedSecondariesToCommit, stdout, requiredSynchronizedSecondariesToCommitOut)
+	if notPrimaryError, ok := err.(*mssqlag.NotPrimaryError); ok {
+		stdout.Printf("%s is in %s (%d) role, so REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT is not updated.\n", agName, notPrimaryError.RoleDesc, notPrimaryError.Role)
+		return mssqlcommon.OCF_SUCCESS, nil
+	}
 	if err != nil {
-		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not check if local replica is in PRIMARY role: %s", err)
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not update value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT: %s", err)
 	}
 
-	if isPrimary {
-		// A replica is going to start. If it's starting because a new replica was added to the AG, then we need to update REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT.
-		if requiredSynchronizedSecondariesToCommit == nil {
-			err := calculateAndSetRequiredSynchronizedSecondariesToCommit(db, agName, stdout)
-			if err != nil {
-				return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not calculate and set value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT: %s", err)
+	return mssqlcommon.OCF_SUCCESS, nil
+}
+
+// Function: postStop
+//
+// Description:
+//    Invoked to handle post-stop notifications from the OCF "notify" action.
+//
+// Returns:
+//    OCF_SUCCESS
+//    OCF_ERR_GENERIC
+//
+func postStop(
+	ctx context.Context, db *sql.DB, agName string,
+	manageRequiredSynchronizedSecondariesToCommit bool,
+	requiredSynchronizedSecondariesToCommit *uint,
+	stdout *log.Logger, requiredSynchronizedSecondariesToCommitOut *log.Logger) (mssqlcommon.OcfExitCode, error) {
+
+	// A replica has stopped. If it stopped because a replica was removed from the AG, then the primary replica needs to update REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT.
+	err := updateRequiredSynchronizedSecondariesToCommit(
+		ctx, db, agName, manageRequiredSynchronizedSecondariesToCommit, requiredSynchronizedSecondariesToCommit, stdout, requiredSynchronizedSecondariesToCommitOut)
+	if notPrimaryError, ok := err.(*mssqlag.NotPrimaryError); ok {
+		stdout.Printf("%s is in %s (%d) role, so REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT is not updated.\n", agName, notPrimaryError.RoleDesc, notPrimaryError.Role)
+		return mssqlcommon.OCF_SUCCESS, nil
+	}
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not update value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT: %s", err)
+	}
+
+	return mssqlcommon.OCF_SUCCESS, nil
+}
+
+// The time to wait between queries of an operational state that is PENDING_FAILOVER or PENDING
+const operationalStatePollInterval = 1 * time.Second
+
+// The maximum time to wait for an operational state that is PENDING_FAILOVER or PENDING to change
+const operationalStateWaitTimeout = 60 * time.Second
+
+// A local replica created more recently than this may have been re-added to the AG and still be seeding its databases
+const newlyJoinedReplicaWindow = 30 * time.Minute
+
+// The time to wait between queries of the primary recovery health by `waitForPrimaryRecovery()`
+const primaryRecoveryPollInterval = 1 * time.Second
+
+// How recently the local replica must have changed role or state for `waitForNoActiveFailover()` to consider a failover in progress
+const activeFailoverWindow = 30 * time.Second
+
+// The time to wait between queries of the role by `waitForNoActiveFailover()` while a failover is in progress
+const activeFailoverPollInterval = 1 * time.Second
+
+// The time to wait between queries of a role that doesn't satisfy `waitUntilRoleSatisfies()` yet
+const rolePollInterval = 100 * time.Millisecond
+
+// The time to wait between attempts to find the row of an AG in sys.availability_groups
+const agRowMissingPollInterval = 1 * time.Second
+
+// The time to wait between attempts to query a sequence number that is NULL or 0
+const sequenceNumberPollInterval = 1 * time.Second
+
+// Session timeouts below this, the default, make replicas disconnect on brief network or scheduling delays
+const minRecommendedSessionTimeout = 10 * time.Second
+
+// The minimum product version of the instance required by each action, for actions that use DMV columns that older versions don't have
+var actionMinProductVersions = map[string]string{
+	"pre-promote": "14.0", // sys.availability_groups.sequence_number
+}
+
+// The sequence number of the local replica, as printed by `prePromote()` when --sequence-number-json is specified
+type sequenceNumberInfo struct {
+	AGName           string `json:"ag_name"`
+	ReplicaName      string `json:"replica_name"`
+	SequenceNumber   int64  `json:"sequence_number"`
+	AvailabilityMode string `json:"availability_mode"`
+}
+
+// Function: prePromote
+//
+// Description:
+//    Invoked to handle pre-promote notifications from the OCF "notify" action.
+//
+//    The sequence number is queried up to `sequenceNumberAttempts` times while it is NULL or 0, since promote() refuses to promote
+//    a replica whose sequence number is 0.
+//
+//    The sequence number is always printed to `sequenceNumberOut` as a bare integer.
+//    If `sequenceNumberJSON` is set, it's also printed to `sequenceNumberJSONOut` as a `sequenceNumberInfo` JSON object.
+//    If `outputLastHardenedLSN` is set, the last hardened LSN of each database of the AG is printed to `lastHardenedLSNOut`.
+//
+// Returns:
+//    OCF_SUCCESS: Sequence number was fetched successfully.
+//    OCF_ERR_GENERIC: Could not query sequence number of the AG replica.
+//
+func prePromote(
+	ctx context.Context, db *sql.DB, agName string,
+	sequenceNumberJSON bool,
+	sequenceNumberAttempts uint,
+	outputLastHardenedLSN bool,
+	logSequenceNumberHex bool,
+	stdout *log.Logger, sequenceNumberOut *log.Logger, sequenceNumberJSONOut *log.Logger, productVersionOut *log.Logger, lastHardenedLSNOut *log.Logger) (mssqlcommon.OcfExitCode, error) {
+
+	stdout.Printf("Querying sequence number of %s on this node...\n", agName)
+
+	availabilityMode, availabilityModeDesc, err := mssqlag.GetAvailabilityMode(ctx, db, agName)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query availability mode of local replica: %s", err)
+	}
+
+	var sequenceNumber int64
+	if availabilityMode == mssqlag.AmSYNCHRONOUS_COMMIT || availabilityMode == mssqlag.AmCONFIGURATION_ONLY {
+		sequenceNumber, err = mssqlag.GetSequenceNumberWithRetry(ctx, db, agName, sequenceNumberAttempts, sequenceNumberPollInterval)
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query sequence number of local replica: %s", err)
+		}
+	} else {
+		stdout.Printf("Availability mode of %s on this node is %s (%d).\n", agName, availabilityModeDesc, availabilityMode)
+		sequenceNumber = 0
+	}
+
+	stdout.Printf("%s has sequence number %s\n", agName, mssqlag.FormatSequenceNumber(sequenceNumber, logSequenceNumberHex))
+	sequenceNumberOut.Println(sequenceNumber)
+
+	if sequenceNumberJSON {
+		replicaName, err := mssqlag.GetCurrentReplicaName(ctx, db, agName)
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query name of local replica: %s", err)
+		}
+
+		sequenceNumberInfoJSON, err := json.Marshal(sequenceNumberInfo{
+			AGName:           agName,
+			ReplicaName:      replicaName,
+			SequenceNumber:   sequenceNumber,
+			AvailabilityMode: availabilityModeDesc,
+		})
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not serialize sequence number: %s", err)
+		}
+
+		sequenceNumberJSONOut.Println(string(sequenceNumberInfoJSON))
+	}
+
+	// The product version is only used to warn about promoting a replica with a lower version, so don't fail if it can't be queried
+	productVersion, err := mssqlcommon.GetProductVersion(db)
+	if err != nil {
+		stdout.Printf("Could not query product version of the instance: %s\n", err)
+	} else {
+		stdout.Printf("Instance has product version %s\n", productVersion)
+		productVersionOut.Println(productVersion)
+	}
+
+	// The LSN is only a fallback for when the sequence numbers of all replicas are 0, so don't fail if it can't be queried either
+	if outputLastHardenedLSN {
+		lastHardenedLSNs, err := mssqlag.GetLastHardenedLSNs(ctx, db, agName)
+		if err != nil {
+			stdout.Printf("Could not query last hardened LSNs of local replica: %s\n", err)
+		} else if len(lastHardenedLSNs) == 0 {
+			stdout.Printf("%s has no databases with a known last hardened LSN\n", agName)
+		} else {
+			formattedLastHardenedLSNs := mssqlag.FormatLastHardenedLSNs(lastHardenedLSNs)
+			stdout.Printf("%s has last hardened LSNs %s\n", agName, formattedLastHardenedLSNs)
+			lastHardenedLSNOut.Println(formattedLastHardenedLSNs)
+		}
+	}
+
+	return mssqlcommon.OCF_SUCCESS, nil
+}
+
+// Function: prePromoteAllAGs
+//
+// Description:
+//    Handles pre-promote notifications for every AG on the instance at once, so that a node hosting several AGs
+//    doesn't need one process per AG. Like `prePromote()`, the sequence number of an AG whose local replica is not
+//    SYNCHRONOUS_COMMIT or CONFIGURATION_ONLY is reported as 0.
+//
+//    The sequence numbers are only printed to `sequenceNumberJSONOut`, one `sequenceNumberInfo` JSON object per AG,
+//    regardless of --sequence-number-json. Nothing is printed to `sequenceNumberOut`, since a bare integer
+//    can't say which AG it belongs to.
+//
+// Returns:
+//    OCF_SUCCESS
+//    OCF_ERR_GENERIC: Could not query the sequence numbers.
+//
+func prePromoteAllAGs(ctx context.Context, db *sql.DB, logSequenceNumberHex bool, stdout *log.Logger, sequenceNumberJSONOut *log.Logger) (mssqlcommon.OcfExitCode, error) {
+	stdout.Println("Querying sequence numbers of all AGs on this node...")
+
+	sequenceNumbers, err := mssqlag.GetAllSequenceNumbers(ctx, db)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query sequence numbers of local replicas: %s", err)
+	}
+
+	for _, agSequenceNumber := range sequenceNumbers {
+		sequenceNumber := agSequenceNumber.SequenceNumber
+		if agSequenceNumber.AvailabilityMode != mssqlag.AmSYNCHRONOUS_COMMIT && agSequenceNumber.AvailabilityMode != mssqlag.AmCONFIGURATION_ONLY {
+			stdout.Printf("Availability mode of %s on this node is %s (%d).\n", agSequenceNumber.AGName, agSequenceNumber.AvailabilityModeDesc, agSequenceNumber.AvailabilityMode)
+			sequenceNumber = 0
+		}
+
+		stdout.Printf("%s has sequence number %s\n", agSequenceNumber.AGName, mssqlag.FormatSequenceNumber(sequenceNumber, logSequenceNumberHex))
+
+		sequenceNumberInfoJSON, err := json.Marshal(sequenceNumberInfo{
+			AGName:           agSequenceNumber.AGName,
+			ReplicaName:      agSequenceNumber.ReplicaName,
+			SequenceNumber:   sequenceNumber,
+			AvailabilityMode: agSequenceNumber.AvailabilityModeDesc,
+		})
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not serialize sequence number: %s", err)
+		}
+
+		sequenceNumberJSONOut.Println(string(sequenceNumberInfoJSON))
+	}
+
+	return mssqlcommon.OCF_SUCCESS, nil
+}
+
+// A promoteDecision is the reason that `promote()` refused to promote the local replica.
+type promoteDecision string
+
+const (
+	promoteDecisionNotSynchronousCommit promoteDecision = "NOT_SYNCHRONOUS_COMMIT"
+	promoteDecisionLowSequenceNumber    promoteDecision = "LOW_SEQUENCE_NUMBER"
+	promoteDecisionZeroSequenceNumber   promoteDecision = "ZERO_SEQUENCE_NUMBER"
+	promoteDecisionLowLastHardenedLSN   promoteDecision = "LOW_LAST_HARDENED_LSN"
+	promoteDecisionInsufficientReplicas promoteDecision = "INSUFFICIENT_REPLICAS"
+	promoteDecisionLivePrimary          promoteDecision = "LIVE_PRIMARY"
+)
+
+// A promoteRefusedError is returned by `promote()` when it refuses to promote the local replica,
+// so that callers can tell the reason apart without matching on the message.
+type promoteRefusedError struct {
+	Decision promoteDecision
+	Inner    error
+}
+
+func (err *promoteRefusedError) Error() string {
+	return err.Inner.Error()
+}
+
+// Function: promote
+//
+// Description:
+//    Implements the OCF "promote" action by failing over the AG replica to PRIMARY role.
+//
+// Returns:
+//    OCF_SUCCESS: AG replica is already in PRIMARY role or was successfully failed over to PRIMARY role.
+//    OCF_FAILED_MASTER: AG replica could not be failed over to PRIMARY role and is now in unknown state.
+//    OCF_ERR_GENERIC: Could not determine initial role of AG replica, or --skip-precheck was not passed and the availability mode is
+//        ASYNCHRONOUS_COMMIT or could not be successfully retrieved, or the sequence number of the AG replica is lower than the
+//        sequence number of some other replica, or --verify-no-primary was passed without --force and the AG replica is
+//        connected to a live primary replica, or --wait-primary-recovery was passed and the databases did not finish recovering
+//        within --wait-primary-recovery-timeout.
+//
+//    If the sequence numbers of all replicas are 0 and `lastHardenedLSNs` is not empty, the last hardened LSNs are compared instead
+//    of the sequence numbers. See `compareLastHardenedLSNs()`.
+//
+//    If `allowDataLoss` is set, the failover is forced with FORCE_FAILOVER_ALLOW_DATA_LOSS after logging the estimated data loss.
+//    See `logEstimatedDataLoss()`.
+//
+func promote(
+	ctx context.Context,
+	db *sql.DB, agName string,
+	sequenceNumbers string, sequenceNumberFormat string,
+	logSequenceNumberHex bool,
+	lastHardenedLSNs string,
+	productVersions string,
+	newMaster string,
+	skipPreCheck bool,
+	waitPrimaryRecovery bool, waitPrimaryRecoveryTimeout time.Duration,
+	verifyNoPrimary bool, force bool,
+	allowDataLoss bool,
+	manageRequiredSynchronizedSecondariesToCommit bool,
+	requiredSynchronizedSecondariesToCommit *uint,
+	stdout *log.Logger, requiredSynchronizedSecondariesToCommitOut *log.Logger) (mssqlcommon.OcfExitCode, error) {
+
+	isPrimary, err := isPrimary(ctx, db, agName, stdout)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not check if local replica is in PRIMARY role: %s", err)
+	}
+	if isPrimary {
+		return mssqlcommon.OCF_SUCCESS, nil
+	}
+
+	if verifyNoPrimary {
+		stdout.Printf("Verifying that the local replica of %s is not connected to a live primary replica...\n", agName)
+
+		primaryReplicaName, connected, _, err := mssqlag.GetPrimaryConnectionErrorDetail(ctx, db, agName)
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query connection state of local replica to the primary replica: %s", err)
+		}
+
+		if connected {
+			if !force {
+				return mssqlcommon.OCF_ERR_GENERIC, &promoteRefusedError{
+					Decision: promoteDecisionLivePrimary,
+					Inner: fmt.Errorf(
+						"Local replica is connected to live primary replica %s, so it cannot be promoted. Pass --force to promote anyway.",
+						primaryReplicaName),
+				}
 			}
+
+			stdout.Printf("Local replica is connected to live primary replica %s but --force was specified, so promoting anyway.\n", primaryReplicaName)
+
+			logEstimatedDataLoss(ctx, db, agName, stdout)
+		}
+	}
+
+	if skipPreCheck {
+		stdout.Println("Skipping pre-check since --skip-precheck was specified.")
+	} else {
+		// The availability mode can't be relied on while a change to it is pending, so wait for the change to finish first
+		err = waitForStableOperationalState(ctx, db, agName, operationalStateWaitTimeout, stdout)
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not wait for a stable operational state of local replica: %s", err)
+		}
+
+		stdout.Printf("Checking availability mode of %s on this node...\n", agName)
+
+		availabilityMode, availabilityModeDesc, err := mssqlag.GetAvailabilityMode(ctx, db, agName)
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query availability mode of local replica: %s", err)
+		}
+
+		if availabilityMode == mssqlag.AmSYNCHRONOUS_COMMIT {
+			stdout.Printf("Availability mode of %s on this node is SYNCHRONOUS_COMMIT.\n", agName)
 		} else {
-			err := setRequiredSynchronizedSecondariesToCommit(db, agName, *requiredSynchronizedSecondariesToCommit, stdout)
-			if err != nil {
-				return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not set value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT: %s", err)
+			return mssqlcommon.OCF_ERR_GENERIC, &promoteRefusedError{
+				Decision: promoteDecisionNotSynchronousCommit,
+				Inner: fmt.Errorf(
+					"Local replica has availability mode %s (%d), so it cannot be promoted to PRIMARY",
+					availabilityModeDesc, availabilityMode),
 			}
 		}
 	}
 
+	numSequenceNumbers, err := compareSequenceNumbers(agName, sequenceNumbers, sequenceNumberFormat, logSequenceNumberHex, lastHardenedLSNs, newMaster, stdout)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, err
+	}
+
+	stdout.Println("Querying number of SYNCHRONOUS_COMMIT replicas...")
+
+	numSyncCommitReplicas, err := mssqlag.GetNumSyncCommitReplicas(ctx, db, agName)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query number of SYNCHRONOUS_COMMIT replicas: %s", err)
+	}
+
+	stdout.Printf("%s has %d SYNCHRONOUS_COMMIT replicas.\n", agName, numSyncCommitReplicas)
+
+	var requiredSynchronizedSecondariesToCommitValue uint
+	if requiredSynchronizedSecondariesToCommit == nil {
+		requiredSynchronizedSecondariesToCommitValue = calculateRequiredSynchronizedSecondariesToCommit(numSyncCommitReplicas)
+	} else {
+		requiredSynchronizedSecondariesToCommitValue = *requiredSynchronizedSecondariesToCommit
+	}
+
+	err = checkNumSequenceNumbers(numSequenceNumbers, numSyncCommitReplicas, requiredSynchronizedSecondariesToCommitValue)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, err
+	}
+
+	if productVersions != "" {
+		warnIfLowerProductVersion(db, productVersions, newMaster, stdout)
+	}
+
+	if allowDataLoss {
+		logEstimatedDataLoss(ctx, db, agName, stdout)
+
+		stdout.Printf("Forcing role of %s on this node to primary, allowing data loss...\n", agName)
+
+		err = mssqlag.FailoverWithDataLoss(ctx, db, agName)
+		if err == nil {
+			// Like the FAILOVER DDL, the forced failover returns before the role change finishes
+			err = waitUntilRoleSatisfies(ctx, db, agName, stdout, func(role mssqlag.Role) bool { return role == mssqlag.RolePRIMARY })
+		}
+	} else {
+		stdout.Printf("Changing role of %s on this node to primary...\n", agName)
+
+		// Wait until the role change completes or the action is cancelled, such as by --action-timeout
+		err = mssqlag.FailoverAndWait(ctx, db, agName, 0)
+	}
+	if err != nil {
+		return mssqlcommon.OCF_FAILED_MASTER, fmt.Errorf("Could not promote local replica to PRIMARY role: %s", err)
+	}
+
+	stdout.Printf("%s is now primary role.\n", agName)
+
+	// The calculation of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT relies on the configuration-only replica for quorum if there is one,
+	// so a configuration-only replica that is down makes the promotion less safe than the sequence numbers suggest.
+	// Only the primary replica knows the connected state of the other replicas, so this is checked once the local replica is PRIMARY.
+	coReplicaName, coConnectedStateDesc, err := mssqlag.GetConfigurationOnlyReplicaHealth(ctx, db, agName)
+	switch {
+	case err == sql.ErrNoRows:
+		// The AG has no configuration-only replica
+
+	case err != nil:
+		stdout.Printf("Could not query health of configuration-only replica: %s\n", err)
+
+	case coConnectedStateDesc == "DISCONNECTED":
+		stdout.Printf(
+			"Warning: Configuration-only replica %s is DISCONNECTED. REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT %d assumes it is available for quorum.\n",
+			coReplicaName, requiredSynchronizedSecondariesToCommitValue)
+
+	case coConnectedStateDesc == "":
+		stdout.Printf("Connected state of configuration-only replica %s is not known to the local replica.\n", coReplicaName)
+
+	default:
+		stdout.Printf("Configuration-only replica %s is %s.\n", coReplicaName, coConnectedStateDesc)
+	}
+
+	if manageRequiredSynchronizedSecondariesToCommit {
+		err = setRequiredSynchronizedSecondariesToCommit(ctx, db, agName, requiredSynchronizedSecondariesToCommitValue, stdout, requiredSynchronizedSecondariesToCommitOut)
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not set value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT: %s", err)
+		}
+	} else {
+		logRequiredSynchronizedSecondariesToCommit(ctx, db, agName, stdout, requiredSynchronizedSecondariesToCommitOut)
+	}
+
+	// The local replica is already PRIMARY, so REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT is updated before the wait,
+	// so that it's correct for the new primary even if the wait times out.
+	if waitPrimaryRecovery {
+		err = waitForPrimaryRecovery(ctx, db, agName, waitPrimaryRecoveryTimeout, stdout)
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Local replica is in PRIMARY role but its databases did not finish recovering: %s", err)
+		}
+	}
+
+	return mssqlcommon.OCF_SUCCESS, nil
+}
+
+// Function: checkMinProductVersion
+//
+// Description:
+//    Checks that the product version of the instance is at least the given version, so that an action that depends on
+//    a newer version fails early with a clear error instead of failing on a missing column.
+//
+// Returns:
+//    OCF_SUCCESS: The instance has at least the given version.
+//    OCF_ERR_CONFIGURED: The instance is older than the given version.
+//    OCF_ERR_GENERIC: Could not query the product version of the instance.
+//
+func checkMinProductVersion(db *sql.DB, minProductVersion string, action string, stdout *log.Logger) (mssqlcommon.OcfExitCode, error) {
+	productVersion, err := mssqlcommon.GetProductVersion(db)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query product version of the instance: %s", err)
+	}
+
+	comparison, err := mssqlcommon.CompareProductVersions(productVersion, minProductVersion)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not compare product version of the instance: %s", err)
+	}
+
+	if comparison < 0 {
+		return mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf(
+			"The %s action requires SQL Server version %s or later but the instance has version %s", action, minProductVersion, productVersion)
+	}
+
+	stdout.Printf("Instance has product version %s, which is at least the required version %s\n", productVersion, minProductVersion)
+
+	return mssqlcommon.OCF_SUCCESS, nil
+}
+
+// Function: waitForPrimaryRecovery
+//
+// Description:
+//    Waits until the primary recovery health of the AG is ONLINE, which means that the databases of the primary replica have finished
+//    recovering after the failover. Until then, the role of the local replica is already PRIMARY but the databases can't serve queries.
+//    Stops waiting after `timeout`, or early if `ctx` is cancelled, returning the last observed health as the error.
+//
+func waitForPrimaryRecovery(ctx context.Context, db *sql.DB, agName string, timeout time.Duration, stdout *log.Logger) error {
+	stdout.Printf("Waiting up to %s for the primary recovery health of %s to be ONLINE...\n", timeout, agName)
+
+	deadline := time.Now().Add(timeout)
+
+	// The health is polled, so look the AG up by name only once
+	groupID, _, _, err := mssqlag.ResolveGroupIDAndRole(ctx, db, agName)
+	if err != nil {
+		return fmt.Errorf("Could not query group_id: %s", err)
+	}
+
+	for {
+		_, primaryRecoveryHealthDesc, err := mssqlag.GetGroupHealthByGroupID(ctx, db, groupID)
+		if err != nil {
+			return fmt.Errorf("Could not query primary recovery health: %s", err)
+		}
+
+		if primaryRecoveryHealthDesc == "ONLINE" {
+			stdout.Printf("%s has primary recovery health ONLINE.\n", agName)
+			return nil
+		}
+
+		stdout.Printf("%s has primary recovery health [%s].\n", agName, primaryRecoveryHealthDesc)
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("primary recovery health is still %s after %s", primaryRecoveryHealthDesc, timeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("primary recovery health is %s: %s", primaryRecoveryHealthDesc, ctx.Err())
+
+		case <-time.After(primaryRecoveryPollInterval):
+		}
+	}
+}
+
+// Function: logEstimatedDataLoss
+//
+// Description:
+//    Logs the estimated data loss of promoting the local replica, for `promote()` before a failover that allows data loss
+//    with --allow-data-loss, or when --force overrides a live primary replica.
+//    The estimate is only logged, since it must not stop a promotion that was explicitly forced.
+//
+func logEstimatedDataLoss(ctx context.Context, db *sql.DB, agName string, stdout *log.Logger) {
+	estimatedDataLoss, ok, err := mssqlag.GetLocalEstimatedDataLoss(ctx, db, agName)
+	if err != nil {
+		stdout.Printf("Could not query estimated data loss of local replica: %s\n", err)
+		return
+	}
+
+	if !ok {
+		stdout.Println("Estimated data loss of promoting the local replica is not known, since none of its databases has received any log.")
+		return
+	}
+
+	stdout.Printf("Estimated data loss of promoting the local replica: ~%s\n", estimatedDataLoss.Round(time.Second))
+}
+
+// Function: logSequenceNumberTable
+//
+// Description:
+//    Logs the sequence numbers that `promote()` parsed, one line per host sorted by host, so that the data that a promotion decision
+//    was based on can be reviewed in one place after the fact.
+//
+func logSequenceNumberTable(agName string, sequenceNumbers map[string]int64, newMaster string, logSequenceNumberHex bool, stdout *log.Logger) {
+	hosts := make([]string, 0, len(sequenceNumbers))
+	for host := range sequenceNumbers {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	stdout.Printf("Parsed sequence numbers of %s (%d hosts):\n", agName, len(hosts))
+
+	for _, host := range hosts {
+		stdout.Printf(
+			"    host [%s]; sequence number [%s]; new master [%t]\n",
+			host, mssqlag.FormatSequenceNumber(sequenceNumbers[host], logSequenceNumberHex), host == newMaster)
+	}
+
+	if _, ok := sequenceNumbers[newMaster]; !ok {
+		stdout.Printf("    No sequence number was parsed for the new master %s\n", newMaster)
+	}
+}
+
+// Function: compareSequenceNumbers
+//
+// Description:
+//    Verifies that the sequence number of the replica on the new master is not lower than the sequence number of any other replica.
+//    If no replica has a sequence number and `lastHardenedLSNs` is not empty, the last hardened LSNs are compared instead.
+//    See `compareLastHardenedLSNs()`.
+//
+// Params:
+//    sequenceNumbers: The sequence numbers of each replica as stored in the cluster. See `mssqlag.ParseSequenceNumberLine()`.
+//    newMaster: The name of the node that is being promoted.
+//
+// Returns:
+//    The number of replicas with a non-zero sequence number.
+//    A promoteRefusedError if the replica on the new master has a lower sequence number than another replica, or a sequence number of 0.
+//
+func compareSequenceNumbers(
+	agName string,
+	sequenceNumbers string, sequenceNumberFormat string,
+	logSequenceNumberHex bool,
+	lastHardenedLSNs string,
+	newMaster string,
+	stdout *log.Logger) (numSequenceNumbers uint, err error) {
+
+	stdout.Println("Verifying local replica's sequence number vs all sequence numbers...")
+
+	var maxSequenceNumber int64
+	var newMasterSequenceNumber int64
+	parsedSequenceNumbers := make(map[string]int64)
+
+	for _, line := range strings.Split(sequenceNumbers, "\n") {
+		stdout.Printf("Sequence number line [%s]\n", line)
+
+		var host string
+		var value int64
+		var ok bool
+		host, value, ok, err = mssqlag.ParseSequenceNumberLine(line, sequenceNumberFormat)
+		if err != nil {
+			err = fmt.Errorf("Could not parse sequence number line: %s", err)
+			return
+		}
+
+		if !ok {
+			stdout.Printf("Line does not match expected %s syntax. Ignoring.\n", sequenceNumberFormat)
+			continue
+		}
+
+		parsedSequenceNumbers[host] = value
+
+		if host == newMaster {
+			newMasterSequenceNumber = value
+		}
+
+		if value > maxSequenceNumber {
+			maxSequenceNumber = value
+		}
+
+		if value > 0 {
+			numSequenceNumbers++
+		}
+	}
+
+	logSequenceNumberTable(agName, parsedSequenceNumbers, newMaster, logSequenceNumberHex, stdout)
+
+	stdout.Printf("Max sequence number of all replicas of %s is %s\n", agName, mssqlag.FormatSequenceNumber(maxSequenceNumber, logSequenceNumberHex))
+	stdout.Printf("Sequence number of %s replica on %s is %s\n", agName, newMaster, mssqlag.FormatSequenceNumber(newMasterSequenceNumber, logSequenceNumberHex))
+	stdout.Printf("%d sequence numbers were found\n", numSequenceNumbers)
+
+	stdout.Println("Verifying local replica's sequence number vs all sequence numbers...")
+
+	if newMasterSequenceNumber < maxSequenceNumber {
+		err = &promoteRefusedError{
+			Decision: promoteDecisionLowSequenceNumber,
+			Inner: fmt.Errorf(
+				"Local replica has sequence number %s but max sequence number is %s, so it cannot be promoted",
+				mssqlag.FormatSequenceNumber(newMasterSequenceNumber, logSequenceNumberHex), mssqlag.FormatSequenceNumber(maxSequenceNumber, logSequenceNumberHex)),
+		}
+		return
+	}
+
+	if newMasterSequenceNumber == 0 && maxSequenceNumber == 0 && lastHardenedLSNs != "" {
+		stdout.Println("No replica has a sequence number. Verifying local replica's last hardened LSN vs all last hardened LSNs instead...")
+
+		return compareLastHardenedLSNs(agName, lastHardenedLSNs, newMaster, stdout)
+	}
+
+	if newMasterSequenceNumber == 0 {
+		err = &promoteRefusedError{
+			Decision: promoteDecisionZeroSequenceNumber,
+			Inner:    fmt.Errorf("Local replica has sequence number %d, so it cannot be promoted", newMasterSequenceNumber),
+		}
+	}
+
+	return
+}
+
+// Function: checkNumSequenceNumbers
+//
+// Description:
+//    Verifies that enough replicas reported a sequence number for the promotion to be safe, which is every SYNCHRONOUS_COMMIT replica
+//    except for the number of synchronized secondaries that REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT allows to be missing.
+//
+// Returns:
+//    A promoteRefusedError if not enough replicas reported a sequence number.
+//
+func checkNumSequenceNumbers(numSequenceNumbers uint, numSyncCommitReplicas uint, requiredSynchronizedSecondariesToCommit uint) error {
+	requiredNumSequenceNumbers := numSyncCommitReplicas - requiredSynchronizedSecondariesToCommit
+	if numSequenceNumbers < requiredNumSequenceNumbers {
+		return &promoteRefusedError{
+			Decision: promoteDecisionInsufficientReplicas,
+			Inner: fmt.Errorf(
+				"Expected to receive %d sequence numbers but only received %d. Not enough replicas are online to safely promote the local replica.",
+				requiredNumSequenceNumbers, numSequenceNumbers),
+		}
+	}
+
+	return nil
+}
+
+// Function: compareLastHardenedLSNs
+//
+// Description:
+//    Verifies that, for every database of the AG, the last hardened LSN of the replica on the new master is not lower than
+//    the last hardened LSN of the database on any other replica. LSNs are only compared within a database.
+//    Used by `promote()` instead of the sequence numbers when no replica has a sequence number.
+//
+// Params:
+//    lastHardenedLSNs: The last hardened LSNs of each replica as stored in the cluster. See `mssqlag.ParseLastHardenedLSNLine()`.
+//    newMaster: The name of the node that is being promoted.
+//
+// Returns:
+//    The number of replicas with a non-zero last hardened LSN, which stands in for the number of sequence numbers.
+//    A promoteRefusedError if the replica on the new master has no LSNs, or is missing a database or has a lower LSN for it than another replica.
+//
+func compareLastHardenedLSNs(agName string, lastHardenedLSNs string, newMaster string, stdout *log.Logger) (numLastHardenedLSNs uint, err error) {
+	maxLastHardenedLSNs := make(map[string]*big.Int)
+	var newMasterLastHardenedLSNs map[string]*big.Int
+
+	for _, line := range strings.Split(lastHardenedLSNs, "\n") {
+		stdout.Printf("Last hardened LSN line [%s]\n", line)
+
+		host, values, ok := mssqlag.ParseLastHardenedLSNLine(line)
+		if !ok {
+			stdout.Println("Line does not contain a host and last hardened LSNs. Ignoring.")
+			continue
+		}
+
+		if host == newMaster {
+			newMasterLastHardenedLSNs = values
+		}
+
+		hasNonZeroLastHardenedLSN := false
+		for groupDatabaseID, value := range values {
+			if maxLastHardenedLSN, ok := maxLastHardenedLSNs[groupDatabaseID]; !ok || value.Cmp(maxLastHardenedLSN) > 0 {
+				maxLastHardenedLSNs[groupDatabaseID] = value
+			}
+
+			if value.Sign() > 0 {
+				hasNonZeroLastHardenedLSN = true
+			}
+		}
+
+		if hasNonZeroLastHardenedLSN {
+			numLastHardenedLSNs++
+		}
+	}
+
+	stdout.Printf("Max last hardened LSNs of all replicas of %s are %s\n", agName, mssqlag.FormatLastHardenedLSNs(maxLastHardenedLSNs))
+	stdout.Printf("%d replicas with last hardened LSNs were found\n", numLastHardenedLSNs)
+
+	newMasterHasNonZeroLastHardenedLSN := false
+	for _, value := range newMasterLastHardenedLSNs {
+		if value.Sign() > 0 {
+			newMasterHasNonZeroLastHardenedLSN = true
+		}
+	}
+
+	if !newMasterHasNonZeroLastHardenedLSN {
+		err = &promoteRefusedError{
+			Decision: promoteDecisionZeroSequenceNumber,
+			Inner:    fmt.Errorf("Local replica has sequence number 0 and no last hardened LSN, so it cannot be promoted"),
+		}
+		return
+	}
+
+	stdout.Printf("Last hardened LSNs of %s replica on %s are %s\n", agName, newMaster, mssqlag.FormatLastHardenedLSNs(newMasterLastHardenedLSNs))
+
+	groupDatabaseIDs := make([]string, 0, len(maxLastHardenedLSNs))
+	for groupDatabaseID := range maxLastHardenedLSNs {
+		groupDatabaseIDs = append(groupDatabaseIDs, groupDatabaseID)
+	}
+	sort.Strings(groupDatabaseIDs)
+
+	for _, groupDatabaseID := range groupDatabaseIDs {
+		maxLastHardenedLSN := maxLastHardenedLSNs[groupDatabaseID]
+
+		newMasterLastHardenedLSN, ok := newMasterLastHardenedLSNs[groupDatabaseID]
+		if !ok {
+			err = &promoteRefusedError{
+				Decision: promoteDecisionLowLastHardenedLSN,
+				Inner: fmt.Errorf(
+					"Local replica has no last hardened LSN for database %s but max last hardened LSN is %s, so it cannot be promoted",
+					groupDatabaseID, maxLastHardenedLSN),
+			}
+			return
+		}
+
+		if newMasterLastHardenedLSN.Cmp(maxLastHardenedLSN) < 0 {
+			err = &promoteRefusedError{
+				Decision: promoteDecisionLowLastHardenedLSN,
+				Inner: fmt.Errorf(
+					"Local replica has last hardened LSN %s for database %s but max last hardened LSN is %s, so it cannot be promoted",
+					newMasterLastHardenedLSN, groupDatabaseID, maxLastHardenedLSN),
+			}
+			return
+		}
+	}
+
+	return
+}
+
+// Function: warnIfLowerProductVersion
+//
+// Description:
+//    Logs a warning if the local instance has a lower product version than the instance of another replica.
+//    During a rolling upgrade, a replica with a higher version may already have upgraded the databases,
+//    and a replica with a lower version then can't synchronize them after it's promoted.
+//
+// Params:
+//    productVersions: The product versions of each replica as stored in the cluster. See `mssqlag.ParseProductVersionLine()`.
+//    newMaster: The name of the node that is being promoted.
+//
+func warnIfLowerProductVersion(db *sql.DB, productVersions string, newMaster string, stdout *log.Logger) {
+	localProductVersion, err := mssqlcommon.GetProductVersion(db)
+	if err != nil {
+		stdout.Printf("Could not query product version of the instance: %s\n", err)
+		return
+	}
+
+	var higherVersionReplicas []string
+	for _, line := range strings.Split(productVersions, "\n") {
+		host, productVersion, ok := mssqlag.ParseProductVersionLine(line)
+		if !ok || host == newMaster {
+			continue
+		}
+
+		comparison, err := mssqlcommon.CompareProductVersions(productVersion, localProductVersion)
+		if err != nil {
+			stdout.Printf("Could not compare product version of %s: %s\n", host, err)
+			continue
+		}
+
+		if comparison > 0 {
+			higherVersionReplicas = append(higherVersionReplicas, fmt.Sprintf("%s (%s)", host, productVersion))
+		}
+	}
+
+	if len(higherVersionReplicas) > 0 {
+		stdout.Printf(
+			"Warning: Local instance has product version %s, which is lower than the product version of %s. "+
+				"If the databases were already upgraded by an instance with a higher version, they will not synchronize after the promotion.\n",
+			localProductVersion, strings.Join(higherVersionReplicas, ", "))
+	}
+}
+
+// Function: demote
+//
+// Description:
+//    Implements the OCF "demote" action by setting the AG replica to SECONDARY role.
+//    If verify is true, also waits up to verifyTimeout for the role change to complete, since the DDL returns before it does.
+//
+// Returns:
+//    OCF_SUCCESS: AG replica was successfully set to SECONDARY role.
+//    OCF_ERR_GENERIC: Could not set AG replica to SECONDARY role, or verify is true and it did not reach SECONDARY role in time.
+//
+func demote(ctx context.Context, db *sql.DB, agName string, verify bool, verifyTimeout time.Duration, stdout *log.Logger) (mssqlcommon.OcfExitCode, error) {
+	// Set replica to SECONDARY
+	err := mssqlag.SetRoleToSecondary(ctx, db, agName)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not set local replica to SECONDARY role: %s", err)
+	}
+
+	if verify {
+		verifyContext, cancel := context.WithTimeout(ctx, verifyTimeout)
+		defer cancel()
+
+		err = waitUntilRoleSatisfies(verifyContext, db, agName, stdout, func(role mssqlag.Role) bool { return role == mssqlag.RoleSECONDARY })
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Local replica did not reach SECONDARY role within %s: %s", verifyTimeout, err)
+		}
+	}
+
+	return mssqlcommon.OCF_SUCCESS, nil
+}
+
+// Function: checkConfiguration
+//
+// Description:
+//    Implements the "check-configuration" action by checking the AG for common misconfigurations.
+//    Unlike the OCF "validate-all" action, which only validates the resource parameters, this needs the instance to be running.
+//
+// Returns:
+//    OCF_SUCCESS: No misconfiguration was found. Suspicious but valid configurations, like an AG without databases, are only logged.
+//    OCF_ERR_CONFIGURED: The HADR feature is not enabled on the instance, or the local server name does not match the name of the local replica,
+//        or the endpoints of the AG replicas are invalid, use different protocols or ports, or point to loopback addresses,
+//        or listenerIP is not empty and is not an IP address of the listener of the AG.
+//    OCF_ERR_GENERIC: Could not query the configuration of the AG.
+//
+func checkConfiguration(ctx context.Context, db *sql.DB, agName string, listenerIP string, stdout *log.Logger) (mssqlcommon.OcfExitCode, error) {
+	stdout.Println("Querying whether HADR is enabled on the instance...")
+
+	hadrEnabled, err := mssqlag.IsHadrEnabled(ctx, db)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query whether HADR is enabled: %s", err)
+	}
+
+	if !hadrEnabled {
+		return mssqlcommon.OCF_ERR_CONFIGURED, errors.New(
+			"The Always On Availability Groups feature (hadr enabled) is not enabled on the instance. Enable it with mssql-conf and restart the instance.")
+	}
+
+	stdout.Println("Querying local server name...")
+
+	localServerName, err := mssqlcommon.GetLocalServerName(db)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query local server name: %s", err)
+	}
+
+	stdout.Printf("Querying name of the local replica of %s...\n", agName)
+
+	currentReplicaName, err := mssqlag.GetCurrentReplicaName(ctx, db, agName)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query name of the local replica: %s", err)
+	}
+
+	stdout.Printf("Local server name is %s and local replica name is %s\n", localServerName, currentReplicaName)
+
+	if !strings.EqualFold(localServerName, currentReplicaName) {
+		// This usually means the instance was cloned from another replica's machine and not renamed
+		return mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf(
+			"Local server name %s does not match the name of the local replica of %s, %s. Rename the instance with sp_dropserver and sp_addserver to match the replica name.",
+			localServerName, agName, currentReplicaName)
+	}
+
+	stdout.Printf("Querying endpoint URLs of %s replicas...\n", agName)
+
+	endpointURLs, err := mssqlag.GetReplicaEndpointURLs(ctx, db, agName)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query endpoint URLs of replicas: %s", err)
+	}
+
+	replicaNames := make([]string, 0, len(endpointURLs))
+	for replicaName := range endpointURLs {
+		replicaNames = append(replicaNames, replicaName)
+	}
+	sort.Strings(replicaNames)
+
+	for _, replicaName := range replicaNames {
+		stdout.Printf("Replica %s has endpoint URL [%s]\n", replicaName, endpointURLs[replicaName])
+	}
+
+	err = checkEndpointURLs(endpointURLs)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_CONFIGURED, err
+	}
+
+	stdout.Printf("Querying number of databases in %s...\n", agName)
+
+	numDatabases, err := mssqlag.GetAGDatabaseCount(ctx, db, agName)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query number of databases: %s", err)
+	}
+
+	stdout.Printf("%s has %d databases.\n", agName, numDatabases)
+
+	if numDatabases == 0 {
+		// An AG without databases is valid, but usually means that the AG was created and never had any databases added to it.
+		stdout.Printf("Warning: %s does not contain any databases. Monitoring it will not detect any database health issues.\n", agName)
+	}
+
+	stdout.Printf("Querying seeding modes of %s replicas...\n", agName)
+
+	seedingModes, err := mssqlag.GetReplicaSeedingModes(ctx, db, agName)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query seeding modes of replicas: %s", err)
+	}
+
+	for _, replicaName := range replicaNames {
+		stdout.Printf("Replica %s has seeding mode %d\n", replicaName, seedingModes[replicaName])
+	}
+
+	if seedingModes[currentReplicaName] == mssqlag.SmAUTOMATIC && numDatabases > 0 {
+		role, _, err := mssqlag.GetRole(ctx, db, agName)
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query role of local replica: %s", err)
+		}
+
+		if role == mssqlag.RoleSECONDARY {
+			numUnjoinedDatabases, err := mssqlag.GetNumUnjoinedDatabases(ctx, db, agName)
+			if err != nil {
+				return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query number of databases not joined on the local replica: %s", err)
+			}
+
+			// Automatic seeding silently does nothing on a secondary replica that hasn't been granted permission to create the databases
+			if numUnjoinedDatabases > 0 {
+				stdout.Printf(
+					"Warning: Local replica uses AUTOMATIC seeding but %d databases of %s have not been seeded to it. "+
+						"If it has not been granted permission to create them, run ALTER AVAILABILITY GROUP %s GRANT CREATE ANY DATABASE on this instance.\n",
+					numUnjoinedDatabases, agName, mssqlag.QuoteName(agName))
+			}
+		}
+	}
+
+	stdout.Printf("Querying failover modes of %s replicas...\n", agName)
+
+	failoverModes, err := mssqlag.GetReplicaFailoverModes(ctx, db, agName)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query failover modes of replicas: %s", err)
+	}
+
+	var automaticFailoverReplicas []string
+	for _, replicaName := range replicaNames {
+		stdout.Printf("Replica %s has failover mode %s\n", replicaName, failoverModes[replicaName])
+
+		if failoverModes[replicaName] == "AUTOMATIC" {
+			automaticFailoverReplicas = append(automaticFailoverReplicas, replicaName)
+		}
+	}
+
+	if len(automaticFailoverReplicas) > 0 {
+		// SQL Server and Pacemaker could then both fail over the AG, one right after the other
+		stdout.Printf(
+			"Warning: Replicas %s have failover mode AUTOMATIC, which conflicts with failovers driven by the cluster. Set their failover mode to the one that the cluster type of %s requires, like EXTERNAL or MANUAL.\n",
+			strings.Join(automaticFailoverReplicas, ", "), agName)
+	}
+
+	stdout.Printf("Querying health check settings of %s...\n", agName)
+
+	healthCheckTimeout, failureConditionLevel, err := mssqlag.GetHealthCheckSettings(ctx, db, agName)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query health check settings: %s", err)
+	}
+
+	stdout.Printf("%s has health check timeout %s and failure condition level %d\n", agName, healthCheckTimeout, failureConditionLevel)
+
+	stdout.Printf("Querying session timeouts of %s replicas...\n", agName)
+
+	sessionTimeouts, err := mssqlag.GetReplicaSessionTimeouts(ctx, db, agName)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query session timeouts of replicas: %s", err)
+	}
+
+	for _, replicaName := range replicaNames {
+		sessionTimeout := sessionTimeouts[replicaName]
+
+		stdout.Printf("Replica %s has session timeout %s\n", replicaName, sessionTimeout)
+
+		// The resulting disconnects look like intermittent health problems rather than a configuration issue
+		if sessionTimeout < minRecommendedSessionTimeout {
+			stdout.Printf(
+				"Warning: Replica %s has a session timeout of %s, which is below the recommended minimum of %s and can cause the replicas to repeatedly disconnect. "+
+					"Raise it with ALTER AVAILABILITY GROUP %s MODIFY REPLICA ON '%s' WITH (SESSION_TIMEOUT = %d).\n",
+				replicaName, sessionTimeout, minRecommendedSessionTimeout,
+				mssqlag.QuoteName(agName), strings.Replace(replicaName, "'", "''", -1), minRecommendedSessionTimeout/time.Second)
+		}
+	}
+
+	stdout.Printf("Querying read-only routing lists of %s replicas...\n", agName)
+
+	readOnlyRoutingList, err := mssqlag.GetReadOnlyRoutingList(ctx, db, agName)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query read-only routing lists: %s", err)
+	}
+
+	if len(readOnlyRoutingList) == 0 {
+		stdout.Printf("%s does not have any read-only routing lists. Read-intent connections are not routed away from the primary replica.\n", agName)
+	}
+
+	for _, replicaName := range replicaNames {
+		routes, ok := readOnlyRoutingList[replicaName]
+		if !ok {
+			continue
+		}
+
+		var routeReplicaNames []string
+		for _, route := range routes {
+			routeReplicaNames = append(routeReplicaNames, route.ReplicaName)
+
+			// Read-intent connections routed to these replicas fail, or fall back to the primary replica if the list has other entries
+			if route.RoutingURL == "" {
+				stdout.Printf("Warning: Read-only routing list of replica %s includes replica %s, which does not have a read-only routing URL.\n", replicaName, route.ReplicaName)
+			} else if route.SecondaryRoleAllowConnectionsDesc == "NO" {
+				stdout.Printf("Warning: Read-only routing list of replica %s includes replica %s, which does not allow connections in SECONDARY role.\n", replicaName, route.ReplicaName)
+			}
+		}
+
+		stdout.Printf("Replica %s routes read-intent connections to %s\n", replicaName, strings.Join(routeReplicaNames, ", "))
+	}
+
+	if len(readOnlyRoutingList) > 0 {
+		stdout.Printf("Querying readable secondary modes of %s replicas...\n", agName)
+
+		allowConnections, err := mssqlag.GetReplicaSecondaryRoleAllowConnections(ctx, db, agName)
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query readable secondary modes of replicas: %s", err)
+		}
+
+		anyReadableSecondary := false
+		for _, replicaName := range replicaNames {
+			stdout.Printf("Replica %s allows %s connections in SECONDARY role\n", replicaName, allowConnections[replicaName])
+
+			if allowConnections[replicaName] != "NO" {
+				anyReadableSecondary = true
+			}
+		}
+
+		// Routing is configured, but every read-intent connection would fail or stay on the primary replica
+		if !anyReadableSecondary {
+			stdout.Printf(
+				"Warning: %s has read-only routing lists but none of its replicas allow connections in SECONDARY role. Set SECONDARY_ROLE (ALLOW_CONNECTIONS = READ_ONLY) on the replicas that read-intent connections should be routed to.\n",
+				agName)
+		}
+	}
+
+	if listenerIP != "" {
+		stdout.Printf("Querying IP addresses of the listener of %s...\n", agName)
+
+		listenerIPStates, err := mssqlag.GetListenerIPStates(ctx, db, agName)
+		if err != nil {
+			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query IP addresses of the listener: %s", err)
+		}
+
+		if len(listenerIPStates) == 0 {
+			return mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf("%s does not have a listener with IP address %s", agName, listenerIP)
+		}
+
+		var listenerIPAddresses []string
+		var matchingIPState *mssqlag.ListenerIPState
+		for i, ipState := range listenerIPStates {
+			stdout.Printf("Listener IP address %s has state %s\n", ipState.IPAddress, ipState.StateDesc)
+
+			listenerIPAddresses = append(listenerIPAddresses, ipState.IPAddress)
+
+			if net.ParseIP(ipState.IPAddress).Equal(net.ParseIP(listenerIP)) {
+				matchingIPState = &listenerIPStates[i]
+			}
+		}
+
+		// Clients would connect to a stale address after a failover
+		if matchingIPState == nil {
+			return mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf(
+				"The listener of %s has IP addresses %s but the cluster-managed IP address is %s",
+				agName, strings.Join(listenerIPAddresses, ", "), listenerIP)
+		}
+
+		if matchingIPState.StateDesc != "ONLINE" {
+			stdout.Printf("Warning: Listener IP address %s of %s is %s.\n", listenerIP, agName, matchingIPState.StateDesc)
+		}
+	}
+
+	return mssqlcommon.OCF_SUCCESS, nil
+}
+
+// The status of the AG replica on this node, as printed by `status()` when --output-format is json or yaml.
+//
+// The JSON field names are part of the output format that dashboards parse, so existing names must not be changed.
+// The YAML output uses the same names.
+type statusInfo struct {
+	AGName     string `json:"ag_name"`
+	GroupID    string `json:"group_id"`
+	ResourceID string `json:"resource_id"`
+	LocalRole  string `json:"local_role"`
+
+	// Omitted if they couldn't be queried, since they're not needed to correlate the AG with the cluster resource
+	AutomatedBackupPreference string `json:"automated_backup_preference,omitempty"`
+	PreferredBackupReplica    *bool  `json:"preferred_backup_replica,omitempty"`
+
+	// Always present, empty if the AG doesn't have a listener, and null if they couldn't be queried
+	ListenerIPAddresses []statusListenerIPAddress `json:"listener_ip_addresses"`
+
+	// Replica name to estimated data loss in seconds. Only present when the local replica is in PRIMARY role.
+	EstimatedDataLossSeconds map[string]int64 `json:"estimated_data_loss_seconds,omitempty"`
+}
+
+// An IP address of the listener of the AG, as printed in `statusInfo`
+type statusListenerIPAddress struct {
+	IPAddress string `json:"ip_address"`
+	State     string `json:"state"`
+}
+
+// Function: checkEndpointURLs
+//
+// Description:
+//    Checks that the endpoint URLs of the AG replicas, keyed by replica name, are valid, all use the same protocol and port,
+//    and don't point to a loopback address, which the other replicas cannot connect to.
+//    The protocol and port used by the most replicas are taken to be the intended ones.
+//
+// Returns:
+//    An error that lists every offending replica of every check, or nil if there are none.
+//
+func checkEndpointURLs(endpointURLs map[string]string) error {
+	replicaNames := make([]string, 0, len(endpointURLs))
+	for replicaName := range endpointURLs {
+		replicaNames = append(replicaNames, replicaName)
+	}
+	sort.Strings(replicaNames)
+
+	var invalidReplicas []string
+	var loopbackReplicas []string
+	endpointSchemes := make(map[string]string)
+	numReplicasWithEndpointScheme := make(map[string]int)
+	endpointPorts := make(map[string]string)
+	numReplicasWithEndpointPort := make(map[string]int)
+	for _, replicaName := range replicaNames {
+		endpointURL := endpointURLs[replicaName]
+
+		parsedEndpointURL, err := url.Parse(endpointURL)
+		if err != nil || parsedEndpointURL.Scheme == "" {
+			invalidReplicas = append(invalidReplicas, fmt.Sprintf("%s [%s]", replicaName, endpointURL))
+			continue
+		}
+
+		scheme := strings.ToLower(parsedEndpointURL.Scheme)
+		endpointSchemes[replicaName] = scheme
+		numReplicasWithEndpointScheme[scheme]++
+
+		endpointPorts[replicaName] = parsedEndpointURL.Port()
+		numReplicasWithEndpointPort[parsedEndpointURL.Port()]++
+
+		endpointHost := parsedEndpointURL.Hostname()
+		if endpointIP := net.ParseIP(endpointHost); strings.EqualFold(endpointHost, "localhost") || (endpointIP != nil && endpointIP.IsLoopback()) {
+			loopbackReplicas = append(loopbackReplicas, replicaName)
+		}
+	}
+
+	expectedScheme := mostCommonValue(numReplicasWithEndpointScheme)
+	expectedPort := mostCommonValue(numReplicasWithEndpointPort)
+
+	var mismatchedSchemeReplicas []string
+	var mismatchedPortReplicas []string
+	for _, replicaName := range replicaNames {
+		scheme, ok := endpointSchemes[replicaName]
+		if !ok {
+			// Already reported as invalid
+			continue
+		}
+
+		if scheme != expectedScheme {
+			mismatchedSchemeReplicas = append(mismatchedSchemeReplicas, fmt.Sprintf("%s (%s)", replicaName, scheme))
+		}
+
+		// Different ports usually mean that an endpoint was created with the wrong port or the firewall is only open for one of them
+		if endpointPorts[replicaName] != expectedPort {
+			mismatchedPortReplicas = append(mismatchedPortReplicas, fmt.Sprintf("%s (port %s)", replicaName, endpointPorts[replicaName]))
+		}
+	}
+
+	var problems []string
+
+	if len(invalidReplicas) > 0 {
+		problems = append(problems, fmt.Sprintf("Replicas %s have invalid endpoint URLs", strings.Join(invalidReplicas, ", ")))
+	}
+
+	if len(mismatchedSchemeReplicas) > 0 {
+		problems = append(problems, fmt.Sprintf(
+			"Replicas %s have endpoint URLs that do not use the same protocol (%s) as the other replicas",
+			strings.Join(mismatchedSchemeReplicas, ", "), expectedScheme))
+	}
+
+	if len(mismatchedPortReplicas) > 0 {
+		problems = append(problems, fmt.Sprintf(
+			"Replicas %s have endpoint URLs that do not use the same port (%s) as the other replicas",
+			strings.Join(mismatchedPortReplicas, ", "), expectedPort))
+	}
+
+	if len(loopbackReplicas) > 0 {
+		problems = append(problems, fmt.Sprintf(
+			"Replicas %s have endpoint URLs that point to a loopback address, which the other replicas cannot connect to",
+			strings.Join(loopbackReplicas, ", ")))
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ". "))
+	}
+
+	return nil
+}
+
+// Function: mostCommonValue
+//
+// Description:
+//    Gets the value with the highest count, or the lowest such value if several have the highest count.
+//
+func mostCommonValue(counts map[string]int) (result string) {
+	for value, count := range counts {
+		if count > counts[result] || (count == counts[result] && value < result) {
+			result = value
+		}
+	}
+
+	return
+}
+
+// Function: status
+//
+// Description:
+//    Prints the status of the AG replica on this node, including the identifiers that correlate the AG with the cluster resource.
+//    If outputFormat is json or yaml, the status is printed to statusOut as a `statusInfo`. Otherwise it's logged to stdout as text.
+//
+// Returns:
+//    OCF_SUCCESS: The status was printed.
+//    OCF_NOT_RUNNING: The AG is not found in sys.availability_groups.
+//    OCF_ERR_GENERIC: Could not query the status.
+//
+func status(ctx context.Context, db *sql.DB, agName string, outputFormat string, stdout *log.Logger, statusOut *log.Logger) (mssqlcommon.OcfExitCode, error) {
+	groupID, resourceID, err := mssqlag.GetGroupAndResourceIds(ctx, db, agName)
+	if err == sql.ErrNoRows {
+		stdout.Printf("No row found in sys.availability_groups for %s.\n", agName)
+		return mssqlcommon.OCF_NOT_RUNNING, nil
+	}
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query identifiers of the AG: %s", err)
+	}
+
+	role, roleDesc, err := mssqlag.GetRole(ctx, db, agName)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query replica role: %s", err)
+	}
+
+	// The backup preference is only informational, so a failure to query it doesn't fail the status
+	backupPreferenceDesc, err := mssqlag.GetBackupPreference(ctx, db, agName)
+	if err != nil {
+		stdout.Printf("Could not query automated backup preference: %s\n", err)
+	}
+
+	var preferredBackupReplica *bool
+	shouldBackupHere, err := mssqlag.ShouldBackupHere(ctx, db, agName)
+	if err != nil {
+		stdout.Printf("Could not query whether the local replica is the preferred backup replica: %s\n", err)
+	} else {
+		preferredBackupReplica = &shouldBackupHere
+	}
+
+	// Like the backup preference, the listener IP addresses are only informational
+	listenerIPStates, err := mssqlag.GetListenerIPStates(ctx, db, agName)
+	listenerIPStatesKnown := err == nil
+	if err != nil {
+		stdout.Printf("Could not query IP addresses of the listener: %s\n", err)
+	}
+
+	var estimatedDataLoss map[string]time.Duration
+	if role == mssqlag.RolePRIMARY {
+		// Only the primary replica knows how far behind the secondary replicas are, so report it for a later forced failover to one of them
+		// Like the backup preference, the estimate is only informational
+		estimatedDataLoss, err = mssqlag.GetEstimatedDataLoss(ctx, db, agName)
+		if err != nil {
+			stdout.Printf("Could not query estimated data loss of secondary replicas: %s\n", err)
+		}
+	}
+
+	replicaNames := make([]string, 0, len(estimatedDataLoss))
+	for replicaName := range estimatedDataLoss {
+		replicaNames = append(replicaNames, replicaName)
+	}
+	sort.Strings(replicaNames)
+
+	if outputFormat == "text" {
+		stdout.Printf("AG: %s\n", agName)
+		stdout.Printf("Group ID: %s\n", groupID)
+		stdout.Printf("Resource ID: %s\n", resourceID)
+		stdout.Printf("Local role: %s (%d)\n", roleDesc, role)
+		if backupPreferenceDesc != "" {
+			stdout.Printf("Automated backup preference: %s\n", backupPreferenceDesc)
+		}
+		if preferredBackupReplica != nil {
+			stdout.Printf("Preferred backup replica: %t\n", *preferredBackupReplica)
+		}
+
+		for _, ipState := range listenerIPStates {
+			stdout.Printf("Listener IP address: %s (%s)\n", ipState.IPAddress, ipState.StateDesc)
+		}
+
+		for _, replicaName := range replicaNames {
+			stdout.Printf("Estimated data loss of a forced failover to %s: ~%s\n", replicaName, estimatedDataLoss[replicaName].Round(time.Second))
+		}
+
+		return mssqlcommon.OCF_SUCCESS, nil
+	}
+
+	info := statusInfo{
+		AGName:                    agName,
+		GroupID:                   groupID,
+		ResourceID:                resourceID,
+		LocalRole:                 roleDesc,
+		AutomatedBackupPreference: backupPreferenceDesc,
+		PreferredBackupReplica:    preferredBackupReplica,
+	}
+
+	if listenerIPStatesKnown {
+		info.ListenerIPAddresses = []statusListenerIPAddress{}
+	}
+
+	for _, ipState := range listenerIPStates {
+		info.ListenerIPAddresses = append(info.ListenerIPAddresses, statusListenerIPAddress{IPAddress: ipState.IPAddress, State: ipState.StateDesc})
+	}
+
+	if estimatedDataLoss != nil {
+		info.EstimatedDataLossSeconds = make(map[string]int64)
+		for replicaName, dataLoss := range estimatedDataLoss {
+			info.EstimatedDataLossSeconds[replicaName] = int64(dataLoss.Round(time.Second) / time.Second)
+		}
+	}
+
+	if outputFormat == "yaml" {
+		statusOut.Print(formatStatusYAML(info, replicaNames))
+		return mssqlcommon.OCF_SUCCESS, nil
+	}
+
+	statusJSON, err := formatStatusJSON(info)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not serialize status: %s", err)
+	}
+
+	statusOut.Println(statusJSON)
+
+	return mssqlcommon.OCF_SUCCESS, nil
+}
+
+// Function: formatStatusJSON
+//
+// Description:
+//    Formats the status as an indented JSON document.
+//
+func formatStatusJSON(info statusInfo) (string, error) {
+	statusJSON, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(statusJSON), nil
+}
+
+// Function: formatStatusYAML
+//
+// Description:
+//    Formats the status as a YAML document with the same field names as its JSON form.
+//    Strings are double-quoted, which YAML parses with the same escapes as Go.
+//
+// Params:
+//    info: The status.
+//    replicaNames: The keys of info.EstimatedDataLossSeconds in the order to print them.
+//
+func formatStatusYAML(info statusInfo, replicaNames []string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "ag_name: %s\n", strconv.Quote(info.AGName))
+	fmt.Fprintf(&b, "group_id: %s\n", strconv.Quote(info.GroupID))
+	fmt.Fprintf(&b, "resource_id: %s\n", strconv.Quote(info.ResourceID))
+	fmt.Fprintf(&b, "local_role: %s\n", strconv.Quote(info.LocalRole))
+
+	// Omitted when they couldn't be queried, like in the JSON form
+	if info.AutomatedBackupPreference != "" {
+		fmt.Fprintf(&b, "automated_backup_preference: %s\n", strconv.Quote(info.AutomatedBackupPreference))
+	}
+	if info.PreferredBackupReplica != nil {
+		fmt.Fprintf(&b, "preferred_backup_replica: %t\n", *info.PreferredBackupReplica)
+	}
+
+	if info.ListenerIPAddresses == nil {
+		b.WriteString("listener_ip_addresses: null\n")
+	} else if len(info.ListenerIPAddresses) == 0 {
+		b.WriteString("listener_ip_addresses: []\n")
+	} else {
+		b.WriteString("listener_ip_addresses:\n")
+		for _, ipAddress := range info.ListenerIPAddresses {
+			fmt.Fprintf(&b, "  - ip_address: %s\n", strconv.Quote(ipAddress.IPAddress))
+			fmt.Fprintf(&b, "    state: %s\n", strconv.Quote(ipAddress.State))
+		}
+	}
+
+	// Omitted when empty, like in the JSON form
+	if len(info.EstimatedDataLossSeconds) > 0 {
+		b.WriteString("estimated_data_loss_seconds:\n")
+		for _, replicaName := range replicaNames {
+			fmt.Fprintf(&b, "  %s: %d\n", strconv.Quote(replicaName), info.EstimatedDataLossSeconds[replicaName])
+		}
+	}
+
+	return b.String()
+}
+
+// Function: ping
+//
+// Description:
+//    Implements the "ping" action by connecting to the instance and running SELECT 1, and printing how long each took.
+//    This helps tell network latency apart from problems inside SQL Server, which the health check reports.
+//
+// Returns:
+//    OCF_SUCCESS: Connected and ran SELECT 1.
+//    OCF_ERR_GENERIC: Could not connect or run SELECT 1.
+//
+func ping(
+	hostname string, port uint64,
+	username string, password string,
+	applicationName string,
+	connectionTimeout time.Duration,
+	trustServerCertificate bool,
+	stdout *log.Logger) (mssqlcommon.OcfExitCode, error) {
+
+	stdout.Printf("Connecting to the instance at %s:%d...\n", hostname, port)
+
+	connectStartTime := time.Now()
+	db, err := mssqlcommon.OpenDB(hostname, port, username, password, applicationName, connectionTimeout, trustServerCertificate)
+	connectTime := time.Since(connectStartTime)
+	if err != nil {
+		stdout.Printf("Connection error category: %s\n", mssqlcommon.ClassifyConnectError(err))
+
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not connect to the instance at %s:%d after %s: %s", hostname, port, connectTime.Round(time.Millisecond), err)
+	}
+	defer db.Close()
+
+	stdout.Printf("Connected to the instance at %s:%d in %s\n", hostname, port, connectTime.Round(time.Millisecond))
+
+	queryStartTime := time.Now()
+	var result int
+	err = db.QueryRow("SELECT 1").Scan(&result)
+	roundTripTime := time.Since(queryStartTime)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not run SELECT 1 after %s: %s", roundTripTime.Round(time.Millisecond), err)
+	}
+
+	stdout.Printf("SELECT 1 round trip took %s\n", roundTripTime.Round(time.Microsecond))
+
+	return mssqlcommon.OCF_SUCCESS, nil
+}
+
+// Function: checkListener
+//
+// Description:
+//    Connects to the instance through the listener of the AG and checks that the listener routes to the current primary replica.
+//    This detects problems with the DNS name or IP address resources of the listener that the role of the replicas doesn't show.
+//
+// Returns:
+//    OCF_SUCCESS: The listener routes to the primary replica.
+//    OCF_ERR_CONFIGURED: The AG has no listener.
+//    OCF_ERR_GENERIC: Could not connect through the listener, or the listener routes to a replica other than the primary replica.
+//
+func checkListener(
+	ctx context.Context, db *sql.DB, agName string,
+	username string, password string,
+	applicationName string,
+	connectionTimeout time.Duration,
+	trustServerCertificate bool,
+	stdout *log.Logger) (mssqlcommon.OcfExitCode, error) {
+
+	stdout.Printf("Querying listener of %s...\n", agName)
+
+	listenerDNSName, listenerPort, err := mssqlag.GetListenerEndpoint(ctx, db, agName)
+	if err == sql.ErrNoRows {
+		return mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf("%s does not have a listener", agName)
+	}
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query listener: %s", err)
+	}
+
+	stdout.Printf("Querying primary replica of %s...\n", agName)
+
+	primaryReplicaName, err := mssqlag.GetPrimaryReplicaName(ctx, db, agName)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query primary replica: %s", err)
+	}
+
+	stdout.Printf("Connecting to the instance through listener %s:%d...\n", listenerDNSName, listenerPort)
+
+	listenerDB, err := mssqlcommon.OpenDB(listenerDNSName, listenerPort, username, password, applicationName, connectionTimeout, trustServerCertificate)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not connect through listener %s:%d: %s", listenerDNSName, listenerPort, err)
+	}
+	defer listenerDB.Close()
+
+	listenerServerName, err := mssqlcommon.GetLocalServerName(listenerDB)
+	if err != nil {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query server name through listener: %s", err)
+	}
+
+	stdout.Printf("Listener %s:%d routes to %s and the primary replica is %s\n", listenerDNSName, listenerPort, listenerServerName, primaryReplicaName)
+
+	if !strings.EqualFold(listenerServerName, primaryReplicaName) {
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf(
+			"Listener %s:%d routes to %s but the primary replica is %s",
+			listenerDNSName, listenerPort, listenerServerName, primaryReplicaName)
+	}
+
 	return mssqlcommon.OCF_SUCCESS, nil
 }
 
-// Function: postStop
+// Function: backupCheck
 //
 // Description:
-//    Invoked to handle post-stop notifications from the OCF "notify" action.
+//    Checks whether the local replica is the preferred backup replica of the AG, according to sys.fn_hadr_backup_is_preferred_replica.
 //
 // Returns:
-//    OCF_SUCCESS
-//    OCF_ERR_GENERIC
+//    OCF_SUCCESS: The local replica is the preferred backup replica, or failOnNonPreferredBackup is false.
+//    OCF_NOT_RUNNING: failOnNonPreferredBackup is true and the local replica is not the preferred backup replica.
+//    OCF_ERR_GENERIC: Could not query whether the local replica is the preferred backup replica.
 //
-func postStop(
-	db *sql.DB, agName string,
-	requiredSynchronizedSecondariesToCommit *uint,
-	stdout *log.Logger) (mssqlcommon.OcfExitCode, error) {
+func backupCheck(ctx context.Context, db *sql.DB, agName string, failOnNonPreferredBackup bool, stdout *log.Logger) (mssqlcommon.OcfExitCode, error) {
+	stdout.Printf("Querying whether the local replica is the preferred backup replica of %s...\n", agName)
 
-	isPrimary, err := isPrimary(db, agName, stdout)
+	shouldBackupHere, err := mssqlag.ShouldBackupHere(ctx, db, agName)
 	if err != nil {
-		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not check if local replica is in PRIMARY role: %s", err)
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query whether the local replica is the preferred backup replica: %s", err)
 	}
 
-	if isPrimary {
-		// A replica has stopped. If it stopped because a replica was removed from the AG, then we need to update REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT.
-		if requiredSynchronizedSecondariesToCommit == nil {
-			err := calculateAndSetRequiredSynchronizedSecondariesToCommit(db, agName, stdout)
-			if err != nil {
-				return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not calculate and set value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT: %s", err)
-			}
-		} else {
-			err := setRequiredSynchronizedSecondariesToCommit(db, agName, *requiredSynchronizedSecondariesToCommit, stdout)
-			if err != nil {
-				return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not set value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT: %s", err)
-			}
-		}
+	if shouldBackupHere {
+		stdout.Printf("Local replica is the preferred backup replica of %s.\n", agName)
+		return mssqlcommon.OCF_SUCCESS, nil
+	}
+
+	stdout.Printf("Local replica is not the preferred backup replica of %s.\n", agName)
+
+	if failOnNonPreferredBackup {
+		return mssqlcommon.OCF_NOT_RUNNING, nil
 	}
 
 	return mssqlcommon.OCF_SUCCESS, nil
 }
 
-// Function: prePromote
+// Function: diagnose
 //
 // Description:
-//    Invoked to handle pre-promote notifications from the OCF "notify" action.
+//    Prints the most recent failover-related events of the AG, such as role changes and lease expirations,
+//    to help investigate an unexpected failover.
 //
 // Returns:
-//    OCF_SUCCESS: Sequence number was fetched successfully.
-//    OCF_ERR_GENERIC: Could not query sequence number of the AG replica.
+//    OCF_SUCCESS: The events were printed.
+//    OCF_ERR_GENERIC: Could not query the events.
 //
-func prePromote(
-	db *sql.DB, agName string,
-	stdout *log.Logger, sequenceNumberOut *log.Logger) (mssqlcommon.OcfExitCode, error) {
-
-	stdout.Printf("Querying sequence number of %s on this node...\n", agName)
+func diagnose(ctx context.Context, db *sql.DB, agName string, maxFailoverEvents uint, stdout *log.Logger) (mssqlcommon.OcfExitCode, error) {
+	stdout.Printf("Querying the last %d failover-related events of %s...\n", maxFailoverEvents, agName)
 
-	availabilityMode, availabilityModeDesc, err := mssqlag.GetAvailabilityMode(db, agName)
+	events, err := mssqlag.GetFailoverHistory(ctx, db, agName, maxFailoverEvents)
 	if err != nil {
-		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query availability mode of local replica: %s", err)
+		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query failover-related events: %s", err)
 	}
 
-	var sequenceNumber int64
-	if availabilityMode == mssqlag.AmSYNCHRONOUS_COMMIT || availabilityMode == mssqlag.AmCONFIGURATION_ONLY {
-		sequenceNumber, err = mssqlag.GetSequenceNumber(db, agName)
-		if err != nil {
-			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query sequence number of local replica: %s", err)
-		}
-	} else {
-		stdout.Printf("Availability mode of %s on this node is %s (%d).\n", agName, availabilityModeDesc, availabilityMode)
-		sequenceNumber = 0
+	if len(events) == 0 {
+		stdout.Printf("No failover-related events of %s were found in the AlwaysOn_health session.\n", agName)
 	}
 
-	stdout.Printf("%s has sequence number 0x%016X\n", agName, sequenceNumber)
-	sequenceNumberOut.Println(sequenceNumber)
+	for _, event := range events {
+		if event.PreviousState != "" || event.CurrentState != "" {
+			stdout.Printf("%s %s: %s -> %s\n", event.Timestamp.Format(time.RFC3339), event.EventName, event.PreviousState, event.CurrentState)
+		} else {
+			stdout.Printf("%s %s\n", event.Timestamp.Format(time.RFC3339), event.EventName)
+		}
+	}
 
 	return mssqlcommon.OCF_SUCCESS, nil
 }
 
-// Function: promote
+// Function: waitForStableOperationalState
 //
 // Description:
-//    Implements the OCF "promote" action by failing over the AG replica to PRIMARY role.
-//
-// Returns:
-//    OCF_SUCCESS: AG replica is already in PRIMARY role or was successfully failed over to PRIMARY role.
-//    OCF_FAILED_MASTER: AG replica could not be failed over to PRIMARY role and is now in unknown state.
-//    OCF_ERR_GENERIC: Could not determine initial role of AG replica, or --skip-precheck was not passed and the availability mode is
-//        ASYNCHRONOUS_COMMIT or could not be successfully retrieved, or the sequence number of the AG replica is lower than the
-//        sequence number of some other replica.
+//    Waits until the operational state of the local replica is not PENDING_FAILOVER or PENDING,
+//    such as while its availability mode is being changed.
+//    Stops waiting after `timeout`, or early if `ctx` is cancelled, returning the last observed state as the error.
 //
-func promote(
-	db *sql.DB, agName string,
-	sequenceNumbers string,
-	newMaster string,
-	skipPreCheck bool,
-	requiredSynchronizedSecondariesToCommit *uint,
-	stdout *log.Logger) (mssqlcommon.OcfExitCode, error) {
-
-	isPrimary, err := isPrimary(db, agName, stdout)
-	if err != nil {
-		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not check if local replica is in PRIMARY role: %s", err)
-	}
-	if isPrimary {
-		return mssqlcommon.OCF_SUCCESS, nil
-	}
+func waitForStableOperationalState(ctx context.Context, db *sql.DB, agName string, timeout time.Duration, stdout *log.Logger) error {
+	deadline := time.Now().Add(timeout)
 
-	if skipPreCheck {
-		stdout.Println("Skipping pre-check since --skip-precheck was specified.")
-	} else {
-		stdout.Printf("Checking availability mode of %s on this node...\n", agName)
+	for {
+		stdout.Printf("Querying operational state of %s on this node...\n", agName)
 
-		availabilityMode, availabilityModeDesc, err := mssqlag.GetAvailabilityMode(db, agName)
+		operationalState, operationalStateDesc, err := mssqlag.GetOperationalState(ctx, db, agName)
 		if err != nil {
-			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query availability mode of local replica: %s", err)
+			return err
 		}
 
-		if availabilityMode == mssqlag.AmSYNCHRONOUS_COMMIT {
-			stdout.Printf("Availability mode of %s on this node is SYNCHRONOUS_COMMIT.\n", agName)
-		} else {
-			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf(
-				"Local replica has availability mode %s (%d), so it cannot be promoted to PRIMARY",
-				availabilityModeDesc, availabilityMode)
+		stdout.Printf("%s is in %s (%d) operational state.\n", agName, operationalStateDesc, operationalState)
+
+		if operationalState != mssqlag.OsPENDING_FAILOVER && operationalState != mssqlag.OsPENDING {
+			return nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%s is still in %s operational state after %s", agName, operationalStateDesc, timeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting: %s. Last operational state: %s", ctx.Err(), operationalStateDesc)
+
+		case <-time.After(operationalStatePollInterval):
 		}
 	}
+}
 
-	stdout.Println("Verifying local replica's sequence number vs all sequence numbers...")
+// Function: waitForDatabasesToBeOnline
+//
+// Description:
+//    Waits for all databases in the AG to be ONLINE, checking up to `numRetriesForOnlineDatabases` times
+//    with `pollInterval` between checks.
+//    Databases named in `ignoredDatabaseNames` are not waited on.
+//    Periodically prints a message detailing the number of databases that are not ONLINE,
+//    listing at most `maxDatabaseStatesToLog` states individually.
+//    Stops waiting early if `ctx` is cancelled, returning the last observed state of the databases as the error.
+//
+func waitForDatabasesToBeOnline(
+	ctx context.Context,
+	db *sql.DB, agName string, groupID string,
+	numRetriesForOnlineDatabases uint, pollInterval time.Duration,
+	ignoredDatabaseNames []string, maxDatabaseStatesToLog uint,
+	stdout *log.Logger) error {
 
-	var maxSequenceNumber int64
-	var newMasterSequenceNumber int64
-	var numSequenceNumbers uint
+	budget := time.Duration(numRetriesForOnlineDatabases) * pollInterval
+	stdout.Printf(
+		"Waiting up to %s (%d attempts every %s, until approximately %s) for databases to be ONLINE...\n",
+		budget, numRetriesForOnlineDatabases, pollInterval, time.Now().Add(budget).Format(time.RFC3339))
+
+	// The contained master and msdb databases of a contained AG can stay non-ONLINE for a while during startup,
+	// and don't affect whether the user databases are usable, so don't wait for them.
+	isContained, err := mssqlag.IsContainedByGroupID(ctx, db, groupID)
+	if err != nil {
+		return fmt.Errorf("Could not query whether the AG is contained: %s", err)
+	}
+	if isContained {
+		stdout.Printf("%s is a contained AG, so its contained system databases %s_master and %s_msdb will not be waited on.\n", agName, agName, agName)
+	}
 
-	lineRegex := regexp.MustCompile(`^name="[^"]+" host="([^"]+)" value="(\d+)"$`)
+	var lastErr error
+	loggedNewlyJoined := false
 
-	for _, line := range strings.Split(sequenceNumbers, "\n") {
-		stdout.Printf("Sequence number line [%s]\n", line)
+	for i := uint(0); i < numRetriesForOnlineDatabases; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("stopped waiting after %d attempts: %s. Last state: %s", i, ctx.Err(), lastErr)
 
-		match := lineRegex.FindStringSubmatch(line)
-		if match == nil {
-			stdout.Println("Line does not match expected syntax. Ignoring.")
-			continue
+			case <-time.After(pollInterval):
+			}
 		}
 
-		host := match[1]
-		value, err := strconv.ParseInt(match[2], 10, 64)
+		nonOnlineDatabasesMessage, err := mssqlag.GetDatabaseStatesByGroupID(ctx, db, groupID, isContained, ignoredDatabaseNames, maxDatabaseStatesToLog)
 		if err != nil {
-			return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not parse sequence number line: %s", err)
+			lastErr = err
+			continue
 		}
 
-		if host == newMaster {
-			newMasterSequenceNumber = value
-		}
+		if len(nonOnlineDatabasesMessage) > 0 {
+			stdout.Println(nonOnlineDatabasesMessage)
+			lastErr = errors.New(nonOnlineDatabasesMessage)
 
-		if value > maxSequenceNumber {
-			maxSequenceNumber = value
-		}
+			if !loggedNewlyJoined {
+				logIfNewlyJoinedReplica(ctx, db, agName, stdout)
+				loggedNewlyJoined = true
+			}
 
-		if value > 0 {
-			numSequenceNumbers++
+			continue
 		}
+
+		// All ready
+		stdout.Println("All databases are ONLINE.")
+		return nil
 	}
 
-	stdout.Printf("Max sequence number of all replicas of %s is %d\n", agName, maxSequenceNumber)
-	stdout.Printf("Sequence number of %s replica on %s is %d\n", agName, newMaster, newMasterSequenceNumber)
-	stdout.Printf("%d sequence numbers were found\n", numSequenceNumbers)
+	return lastErr
+}
 
-	stdout.Println("Verifying local replica's sequence number vs all sequence numbers...")
+// Function: resolveGroupIDAndRoleWithRetry
+//
+// Description:
+//    Resolves the group_id of the AG and the role of the local replica like `mssqlag.ResolveGroupIDAndRole()`, but queries up to `retries` more times
+//    while sys.availability_groups has no row for the AG, since the row can briefly be missing right after the instance starts.
+//    Stops retrying early if `ctx` is cancelled.
+//
+// Returns:
+//    sql.ErrNoRows if there is still no row after the retries.
+//
+func resolveGroupIDAndRoleWithRetry(
+	ctx context.Context,
+	db *sql.DB, agName string,
+	retries uint,
+	stdout *log.Logger) (groupID string, role mssqlag.Role, roleDesc string, err error) {
 
-	if newMasterSequenceNumber < maxSequenceNumber {
-		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf(
-			"Local replica has sequence number %d but max sequence number is %d, so it cannot be promoted",
-			newMasterSequenceNumber, maxSequenceNumber)
-	}
+	groupID, role, roleDesc, err = mssqlag.ResolveGroupIDAndRole(ctx, db, agName)
 
-	if newMasterSequenceNumber == 0 {
-		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Local replica has sequence number %d, so it cannot be promoted", newMasterSequenceNumber)
-	}
+	for i := uint(1); err == sql.ErrNoRows && i <= retries; i++ {
+		stdout.Printf("No row found in sys.availability_groups for %s. Retry %d of %d in %s...\n", agName, i, retries, agRowMissingPollInterval)
 
-	stdout.Println("Querying number of SYNCHRONOUS_COMMIT replicas...")
+		select {
+		case <-ctx.Done():
+			stdout.Printf("Stopped retrying: %s\n", ctx.Err())
+			return
 
-	numSyncCommitReplicas, err := mssqlag.GetNumSyncCommitReplicas(db, agName)
-	if err != nil {
-		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not query number of SYNCHRONOUS_COMMIT replicas: %s", err)
+		case <-time.After(agRowMissingPollInterval):
+		}
+
+		groupID, role, roleDesc, err = mssqlag.ResolveGroupIDAndRole(ctx, db, agName)
 	}
 
-	stdout.Printf("%s has %d SYNCHRONOUS_COMMIT replicas.\n", agName, numSyncCommitReplicas)
+	return
+}
 
-	var requiredSynchronizedSecondariesToCommitValue uint
-	if requiredSynchronizedSecondariesToCommit == nil {
-		requiredSynchronizedSecondariesToCommitValue = calculateRequiredSynchronizedSecondariesToCommit(numSyncCommitReplicas)
-	} else {
-		requiredSynchronizedSecondariesToCommitValue = *requiredSynchronizedSecondariesToCommit
+// Function: logResolvingCause
+//
+// Description:
+//    Logs whether the local replica is in RESOLVING role because its lease expired, since a lease timeout otherwise
+//    looks the same as any other cause of RESOLVING. This is informational only, so errors are logged rather than returned.
+//
+func logResolvingCause(ctx context.Context, db *sql.DB, agName string, stdout *log.Logger) {
+	leaseState, err := mssqlag.GetLeaseState(ctx, db, agName)
+	if err != nil {
+		stdout.Printf("Could not query lease state of %s: %s\n", agName, err)
+		return
 	}
 
-	requiredNumSequenceNumbers := numSyncCommitReplicas - requiredSynchronizedSecondariesToCommitValue
-	if numSequenceNumbers < requiredNumSequenceNumbers {
-		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf(
-			"Expected to receive %d sequence numbers but only received %d. Not enough replicas are online to safely promote the local replica.",
-			requiredNumSequenceNumbers, numSequenceNumbers)
+	if leaseState.ResolvingDueToLeaseExpiry {
+		stdout.Printf("Local replica of %s is in RESOLVING role due to lease expiry at %s\n", agName, leaseState.LastLeaseExpiry.Format(time.RFC3339))
+	} else {
+		stdout.Printf("Local replica of %s is in RESOLVING role, not due to a recent lease expiry\n", agName)
 	}
+}
 
-	stdout.Printf("Changing role of %s on this node to primary...\n", agName)
-
-	err = mssqlag.Failover(db, agName)
+// Function: logIfNewlyJoinedReplica
+//
+// Description:
+//    Logs that the local replica may still be seeding if it was created within `newlyJoinedReplicaWindow`,
+//    to explain databases that are not ONLINE. This is informational only, so errors are logged rather than returned.
+//
+func logIfNewlyJoinedReplica(ctx context.Context, db *sql.DB, agName string, stdout *log.Logger) {
+	currentReplicaName, err := mssqlag.GetCurrentReplicaName(ctx, db, agName)
 	if err != nil {
-		return mssqlcommon.OCF_FAILED_MASTER, fmt.Errorf("Could not promote local replica to PRIMARY role: %s", err)
+		stdout.Printf("Could not query name of the local replica: %s\n", err)
+		return
 	}
 
-	// `FAILOVER` DDL returns before role change finishes, so wait till it completes.
-	err = waitUntilRoleSatisfies(db, agName, stdout, func(role mssqlag.Role) bool { return role == mssqlag.RolePRIMARY })
+	createDates, err := mssqlag.GetReplicaCreateDates(ctx, db, agName)
 	if err != nil {
-		return mssqlcommon.OCF_FAILED_MASTER, fmt.Errorf("Failed while waiting for local replica to be in PRIMARY role: %s", err)
+		stdout.Printf("Could not query create dates of replicas: %s\n", err)
+		return
 	}
 
-	stdout.Printf("%s is now primary role.\n", agName)
+	createDate, ok := createDates[currentReplicaName]
+	if ok && createDate.Age < newlyJoinedReplicaWindow {
+		stdout.Printf(
+			"Local replica %s was added to %s %s ago (at %s), so it is newly joined and its databases may still be seeding.\n",
+			currentReplicaName, agName, createDate.Age, createDate.CreateDate.Format("2006-01-02 15:04:05"))
+	}
+}
 
-	err = setRequiredSynchronizedSecondariesToCommit(db, agName, requiredSynchronizedSecondariesToCommitValue, stdout)
+// Logs the databases of the AG that are not ONLINE, not HEALTHY or suspended, to explain why DB_FAILOVER considers the AG unhealthy.
+// Errors are logged rather than returned since this is only used to add detail to another failure.
+func logUnhealthyDatabases(ctx context.Context, db *sql.DB, agName string, stdout *log.Logger) {
+	databaseHealthStates, err := mssqlag.GetDatabaseHealthStates(ctx, db, agName)
 	if err != nil {
-		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not set value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT: %s", err)
+		stdout.Printf("Could not query health of databases: %s\n", err)
+		return
 	}
 
-	return mssqlcommon.OCF_SUCCESS, nil
+	for _, databaseHealthState := range databaseHealthStates {
+		if databaseHealthState.StateDesc == "ONLINE" && databaseHealthState.SynchronizationHealthDesc == "HEALTHY" && !databaseHealthState.IsSuspended {
+			continue
+		}
+
+		stdout.Printf(
+			"Database %s is unhealthy: state [%s]; synchronization health [%s]; suspended [%t]; suspend reason [%s]\n",
+			databaseHealthState.DatabaseName, databaseHealthState.StateDesc, databaseHealthState.SynchronizationHealthDesc,
+			databaseHealthState.IsSuspended, databaseHealthState.SuspendReasonDesc)
+	}
 }
 
-// Function: demote
+// Function: setSessionContext
 //
 // Description:
-//    Implements the OCF "demote" action by setting the AG replica to SECONDARY role.
-//
-// Returns:
-//    OCF_SUCCESS: AG replica was successfully set to SECONDARY role.
-//    OCF_ERR_GENERIC: Could not set AG replica to SECONDARY role.
+//    Sets the external_cluster key of the session context that the DDL triggers use to allow the helper to change the AG,
+//    and verifies that it was applied, since the triggers only recognize the helper by this key.
 //
-func demote(db *sql.DB, agName string) (mssqlcommon.OcfExitCode, error) {
-	// Set replica to SECONDARY
-	err := mssqlag.SetRoleToSecondary(db, agName)
+func setSessionContext(db *sql.DB, stdout *log.Logger) error {
+	stdout.Println("Setting session context...")
+
+	// Don't continue if it was silently not applied to the connection
+	externalCluster, isSet, err := mssqlcommon.SetSessionContext(db, "external_cluster", "yes")
 	if err != nil {
-		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not set local replica to SECONDARY role: %s", err)
+		return fmt.Errorf("Failed to set session context: %s", err)
+	}
+	if !isSet {
+		return errors.New("Session context external_cluster is not set after setting it")
+	}
+	if externalCluster != "yes" {
+		return fmt.Errorf(
+			"Session context external_cluster is set to [%s] instead of yes. It may have been set to a conflicting read-only value by an earlier statement on this connection", externalCluster)
 	}
 
-	return mssqlcommon.OCF_SUCCESS, nil
+	return nil
 }
 
-// Function: waitForDatabasesToBeOnline
+func isPrimary(ctx context.Context, db *sql.DB, agName string, stdout *log.Logger) (result bool, err error) {
+	stdout.Printf("Querying role of %s on this node...\n", agName)
+
+	err = mssqlag.IsPrimary(ctx, db, agName)
+	if notPrimaryError, ok := err.(*mssqlag.NotPrimaryError); ok {
+		stdout.Printf("%s is in %s (%d) role.\n", agName, notPrimaryError.RoleDesc, notPrimaryError.Role)
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+
+	stdout.Printf("%s is in PRIMARY role.\n", agName)
+
+	return true, nil
+}
+
+// Function: updateRequiredSynchronizedSecondariesToCommit
 //
 // Description:
-//    Waits for all databases in the AG to be ONLINE.
-//    Periodically prints a message detailing the number of databases that are not ONLINE.
+//    Sets REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT to `requiredSynchronizedSecondariesToCommit`, or to the value calculated from
+//    the number of SYNCHRONOUS_COMMIT replicas if it's nil, or only logs the current value if `manageRequiredSynchronizedSecondariesToCommit` is false.
 //
-func waitForDatabasesToBeOnline(
-	db *sql.DB, agName string,
-	numRetriesForOnlineDatabases uint,
-	stdout *log.Logger) error {
-
-	var lastErr error
+//    Setting the value checks the role in the same batch, so the role isn't checked beforehand. When only logging the value,
+//    the role is checked first, so that a replica that is not in PRIMARY role doesn't output it.
+//
+// Returns:
+//    A `mssqlag.NotPrimaryError` if the local replica is not in PRIMARY role, in which case nothing was set or output.
+//
+func updateRequiredSynchronizedSecondariesToCommit(
+	ctx context.Context, db *sql.DB, agName string,
+	manageRequiredSynchronizedSecondariesToCommit bool,
+	requiredSynchronizedSecondariesToCommit *uint,
+	stdout *log.Logger, requiredSynchronizedSecondariesToCommitOut *log.Logger) (err error) {
 
-	for i := uint(0); i < numRetriesForOnlineDatabases; i++ {
-		nonOnlineDatabasesMessage, err := mssqlag.GetDatabaseStates(db, agName)
+	if !manageRequiredSynchronizedSecondariesToCommit {
+		err = mssqlag.IsPrimary(ctx, db, agName)
 		if err != nil {
-			lastErr = err
-			time.Sleep(1 * time.Second)
-			continue
-		}
-
-		if len(nonOnlineDatabasesMessage) > 0 {
-			stdout.Println(nonOnlineDatabasesMessage)
-			lastErr = errors.New(nonOnlineDatabasesMessage)
-			time.Sleep(1 * time.Second)
-			continue
+			return
 		}
 
-		// All ready
-		stdout.Println("All databases are ONLINE.")
-		return nil
-	}
-
-	return lastErr
-}
-
-func isPrimary(db *sql.DB, agName string, stdout *log.Logger) (result bool, err error) {
-	stdout.Printf("Querying role of %s on this node...\n", agName)
-
-	role, roleDesc, err := mssqlag.GetRole(db, agName)
-	if err != nil {
+		logRequiredSynchronizedSecondariesToCommit(ctx, db, agName, stdout, requiredSynchronizedSecondariesToCommitOut)
 		return
 	}
 
-	stdout.Printf("%s is in %s (%d) role.\n", agName, roleDesc, role)
-
-	result = role == mssqlag.RolePRIMARY
+	// Returns a NotPrimaryError from `mssqlag.SetRequiredSynchronizedSecondariesToCommitIfPrimary()` on a replica that is not in PRIMARY role
+	if requiredSynchronizedSecondariesToCommit == nil {
+		err = calculateAndSetRequiredSynchronizedSecondariesToCommit(ctx, db, agName, stdout, requiredSynchronizedSecondariesToCommitOut)
+	} else {
+		err = setRequiredSynchronizedSecondariesToCommit(ctx, db, agName, *requiredSynchronizedSecondariesToCommit, stdout, requiredSynchronizedSecondariesToCommitOut)
+	}
 
 	return
 }
 
-func calculateAndSetRequiredSynchronizedSecondariesToCommit(db *sql.DB, agName string, stdout *log.Logger) (err error) {
+func calculateAndSetRequiredSynchronizedSecondariesToCommit(ctx context.Context, db *sql.DB, agName string, stdout *log.Logger, requiredSynchronizedSecondariesToCommitOut *log.Logger) (err error) {
 	stdout.Println("Querying number of SYNCHRONOUS_COMMIT replicas...")
 
-	numSyncCommitReplicas, err := mssqlag.GetNumSyncCommitReplicas(db, agName)
+	numSyncCommitReplicas, err := mssqlag.GetNumSyncCommitReplicas(ctx, db, agName)
 	if err != nil {
 		return
 	}
@@ -709,7 +3488,7 @@ func calculateAndSetRequiredSynchronizedSecondariesToCommit(db *sql.DB, agName s
 
 	calculatedRequiredSynchronizedSecondariesToCommit := calculateRequiredSynchronizedSecondariesToCommit(numSyncCommitReplicas)
 
-	err = setRequiredSynchronizedSecondariesToCommit(db, agName, calculatedRequiredSynchronizedSecondariesToCommit, stdout)
+	err = setRequiredSynchronizedSecondariesToCommit(ctx, db, agName, calculatedRequiredSynchronizedSecondariesToCommit, stdout, requiredSynchronizedSecondariesToCommitOut)
 
 	return
 }
@@ -729,23 +3508,60 @@ func calculateRequiredSynchronizedSecondariesToCommit(numReplicas uint) uint {
 	return numReplicas / 2
 }
 
+// Function: logRequiredSynchronizedSecondariesToCommit
+//
+// Description:
+//    Logs the current value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT instead of setting it, for --manage-rsstc=false.
+//    The value is also output like `setRequiredSynchronizedSecondariesToCommit()` does, so that the cluster records the value the AG has.
+//
+func logRequiredSynchronizedSecondariesToCommit(ctx context.Context, db *sql.DB, agName string, stdout *log.Logger, requiredSynchronizedSecondariesToCommitOut *log.Logger) {
+	value, err := mssqlag.GetRequiredSynchronizedSecondariesToCommit(ctx, db, agName)
+	if err != nil {
+		stdout.Printf("Could not query value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT: %s\n", err)
+		return
+	}
+
+	stdout.Printf("REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT of %s is %d and is not managed by ag-helper.\n", agName, value)
+
+	if requiredSynchronizedSecondariesToCommitOut != nil {
+		requiredSynchronizedSecondariesToCommitOut.Println(value)
+	}
+}
+
 func setRequiredSynchronizedSecondariesToCommit(
-	db *sql.DB, agName string,
+	ctx context.Context, db *sql.DB, agName string,
 	requiredSynchronizedSecondariesToCommit uint,
-	stdout *log.Logger) (err error) {
+	stdout *log.Logger, requiredSynchronizedSecondariesToCommitOut *log.Logger) (err error) {
 
 	stdout.Printf("Setting REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT of %s to %d...\n", agName, requiredSynchronizedSecondariesToCommit)
 
-	err = mssqlag.SetRequiredSynchronizedSecondariesToCommit(db, agName, int32(requiredSynchronizedSecondariesToCommit))
+	err = mssqlag.SetRequiredSynchronizedSecondariesToCommitIfPrimary(ctx, db, agName, int32(requiredSynchronizedSecondariesToCommit))
+	if err != nil {
+		return
+	}
+
+	// Only output the value once it's actually set, so that the cluster doesn't record a value the AG doesn't have
+	if requiredSynchronizedSecondariesToCommitOut != nil {
+		requiredSynchronizedSecondariesToCommitOut.Println(requiredSynchronizedSecondariesToCommit)
+	}
 
 	return
 }
 
-func waitUntilRoleSatisfies(db *sql.DB, agName string, stdout *log.Logger, predicate func(mssqlag.Role) bool) error {
-	for {
+func waitUntilRoleSatisfies(ctx context.Context, db *sql.DB, agName string, stdout *log.Logger, predicate func(mssqlag.Role) bool) error {
+	for i := 0; ; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+
+			case <-time.After(rolePollInterval):
+			}
+		}
+
 		stdout.Printf("Querying role of %s on this node...\n", agName)
 
-		role, roleDesc, err := mssqlag.GetRole(db, agName)
+		role, roleDesc, err := mssqlag.GetRole(ctx, db, agName)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,621 @@
+/*
+	Copyright 2017 Microsoft Corporation
+
+	Permission is hereby granted, free of charge, to any person obtaining a copy
+	of this software and associated documentation files (the "Software"), to deal
+	in the Software without restriction, including without limitation the rights
+	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+	copies of the Software, and to permit persons to whom the Software is
+	furnished to do so, subject to the following conditions:
+
+	The above copyright notice and this permission notice shall be included in
+	all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+	SOFTWARE.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mssqlcommon"
+	mssqlag "mssqlcommon/ag"
+)
+
+func TestMain(m *testing.M) {
+	// The OCF exit codes are all 0 until they're imported, so import their real values to be able to tell them apart
+	for key, value := range map[string]string{
+		"OCF_SUCCESS":           "0",
+		"OCF_ERR_GENERIC":       "1",
+		"OCF_ERR_ARGS":          "2",
+		"OCF_ERR_UNIMPLEMENTED": "3",
+		"OCF_ERR_PERM":          "4",
+		"OCF_ERR_CONFIGURED":    "6",
+		"OCF_NOT_RUNNING":       "7",
+		"OCF_RUNNING_MASTER":    "8",
+		"OCF_FAILED_MASTER":     "9",
+	} {
+		os.Setenv(key, value)
+	}
+
+	err := mssqlcommon.ImportOcfExitCodes()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not import OCF exit codes: %s\n", err)
+		os.Exit(1)
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestBoundConnectionTimeout(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		connectionTimeout time.Duration
+		actionTimeout     time.Duration
+		expected          time.Duration
+	}{
+		{30 * time.Second, 60 * time.Second, 30 * time.Second},
+		{30 * time.Second, 30 * time.Second, 30 * time.Second},
+		{60 * time.Second, 20 * time.Second, 20 * time.Second},
+		{60 * time.Second, 500 * time.Millisecond, mssqlcommon.MinConnectionTimeout},
+	} {
+		result := boundConnectionTimeout(testCase.connectionTimeout, testCase.actionTimeout)
+		if result != testCase.expected {
+			t.Fatalf(
+				"Expected boundConnectionTimeout(%s, %s) to return %s but it returned %s",
+				testCase.connectionTimeout, testCase.actionTimeout, testCase.expected, result)
+		}
+	}
+}
+
+func TestActionTimeoutExitCode(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		action   string
+		expected mssqlcommon.OcfExitCode
+	}{
+		{"promote", mssqlcommon.OCF_FAILED_MASTER},
+		{"start", mssqlcommon.OCF_ERR_GENERIC},
+		{"monitor", mssqlcommon.OCF_ERR_GENERIC},
+		{"demote", mssqlcommon.OCF_ERR_GENERIC},
+	} {
+		result := actionTimeoutExitCode(testCase.action)
+		if result != testCase.expected {
+			t.Fatalf("Expected actionTimeoutExitCode(%s) to return %d but it returned %d", testCase.action, testCase.expected, result)
+		}
+	}
+}
+
+// A hungConnector simulates an instance whose queries never complete, so they only return once their context is done
+type hungConnector struct{}
+
+func (c hungConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return hungConn{}, nil
+}
+
+func (c hungConnector) Driver() driver.Driver {
+	return nil
+}
+
+type hungConn struct{}
+
+func (c hungConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c hungConn) Close() error {
+	return nil
+}
+
+func (c hungConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c hungConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (c hungConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCheckActionTimeoutOfHungPromote(t *testing.T) {
+	t.Parallel()
+
+	actionTimeout := 250 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), actionTimeout)
+	defer cancel()
+
+	db := sql.OpenDB(hungConnector{})
+	defer db.Close()
+
+	stdout := log.New(&bytes.Buffer{}, "", 0)
+
+	returned := make(chan struct{})
+	var ocfExitCode mssqlcommon.OcfExitCode
+	var err error
+	go func() {
+		defer close(returned)
+
+		ocfExitCode, err = promote(ctx, db, "ag1", "", "", false, "", "", "", true, false, 0, false, false, false, false, nil, stdout, stdout)
+		ocfExitCode, err = checkActionTimeout(ctx, "promote", actionTimeout, ocfExitCode, err)
+	}()
+
+	select {
+	case <-returned:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected promote() to return once the action timeout of %s elapsed but it was still running after 10s", actionTimeout)
+	}
+
+	if err == nil || ocfExitCode != mssqlcommon.OCF_FAILED_MASTER {
+		t.Fatalf("Expected a hung promote() to return %d but it returned %d (%v)", mssqlcommon.OCF_FAILED_MASTER, ocfExitCode, err)
+	}
+}
+
+func TestLookupCachedSettings(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cache := map[string]cachedSettings{
+		"ag1": {DBFailoverMode: true, ClusterTypeDesc: "EXTERNAL", CachedAt: now.Add(-10 * time.Second)},
+		"ag2": {DBFailoverMode: true, ClusterTypeDesc: "EXTERNAL", CachedAt: now.Add(-90 * time.Second)},
+		"ag3": {DBFailoverMode: true, ClusterTypeDesc: "EXTERNAL", CachedAt: now.Add(10 * time.Second)},
+		"ag5": {DBFailoverMode: true, CachedAt: now.Add(-10 * time.Second)},
+	}
+
+	for _, testCase := range []struct {
+		agName     string
+		ttl        time.Duration
+		expectedOk bool
+	}{
+		{"ag1", 60 * time.Second, true},
+		{"ag1", 10 * time.Second, false},
+		{"ag1", 0, false},
+		{"ag2", 60 * time.Second, false},
+		{"ag3", 60 * time.Second, false},
+		{"ag4", 60 * time.Second, false},
+		{"ag5", 60 * time.Second, false},
+	} {
+		settings, ok := lookupCachedSettings(cache, testCase.agName, now, testCase.ttl)
+		if ok != testCase.expectedOk {
+			t.Fatalf("Expected lookupCachedSettings(%s, %s) to return ok = %t but it returned %t", testCase.agName, testCase.ttl, testCase.expectedOk, ok)
+		}
+
+		if ok && (!settings.DBFailoverMode || settings.ClusterTypeDesc != "EXTERNAL") {
+			t.Fatalf("Expected lookupCachedSettings(%s, %s) to return the cached settings but it returned %+v", testCase.agName, testCase.ttl, settings)
+		}
+	}
+}
+
+func TestSaveSettingsCache(t *testing.T) {
+	t.Parallel()
+
+	directory := t.TempDir()
+	filename := filepath.Join(directory, "settings-cache")
+
+	cachedAt := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, cache := range []map[string]cachedSettings{
+		{"ag1": {DBFailoverMode: true, ClusterTypeDesc: "EXTERNAL", CachedAt: cachedAt}},
+		{"ag1": {DBFailoverMode: false, ClusterTypeDesc: "EXTERNAL", CachedAt: cachedAt}},
+	} {
+		err := saveSettingsCache(filename, cache)
+		if err != nil {
+			t.Fatalf("Expected saveSettingsCache(%v) to succeed but it returned %s", cache, err)
+		}
+
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("Could not read %s: %s", filename, err)
+		}
+
+		var saved map[string]cachedSettings
+		err = json.Unmarshal(contents, &saved)
+		if err != nil {
+			t.Fatalf("Could not parse %s: %s", filename, err)
+		}
+
+		if len(saved) != 1 || saved["ag1"] != cache["ag1"] {
+			t.Fatalf("Expected saveSettingsCache(%v) to save the cache but it saved %v", cache, saved)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatalf("Could not read %s: %s", directory, err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("Expected saveSettingsCache() to leave only the cache file but it left %d files", len(entries))
+	}
+}
+
+func TestCheckEndpointURLs(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		endpointURLs  map[string]string
+		expectedError string
+	}{
+		{
+			map[string]string{"node1": "TCP://node1:5022", "node2": "tcp://node2:5022", "node3": "TCP://node3:5022"},
+			"",
+		},
+		{
+			map[string]string{"node1": "TCP://node1:5022", "node2": "UDP://node2:5022", "node3": "UDP://node3:5022", "node4": "TCP://node4:5022", "node5": "TCP://node5:5022"},
+			"Replicas node2 (udp), node3 (udp) have endpoint URLs that do not use the same protocol (tcp) as the other replicas",
+		},
+		{
+			map[string]string{"node1": "TCP://node1:5022", "node2": "TCP://node2:5023", "node3": "TCP://node3:5024", "node4": "TCP://node4:5022"},
+			"Replicas node2 (port 5023), node3 (port 5024) have endpoint URLs that do not use the same port (5022) as the other replicas",
+		},
+		{
+			map[string]string{"node1": "TCP://node1:5022", "node2": "UDP://localhost:5023", "node3": "TCP://node3:5022", "node4": "node4"},
+			"Replicas node4 [node4] have invalid endpoint URLs. " +
+				"Replicas node2 (udp) have endpoint URLs that do not use the same protocol (tcp) as the other replicas. " +
+				"Replicas node2 (port 5023) have endpoint URLs that do not use the same port (5022) as the other replicas. " +
+				"Replicas node2 have endpoint URLs that point to a loopback address, which the other replicas cannot connect to",
+		},
+	} {
+		err := checkEndpointURLs(testCase.endpointURLs)
+		if testCase.expectedError == "" {
+			if err != nil {
+				t.Fatalf("Expected checkEndpointURLs(%v) to succeed but it returned %s", testCase.endpointURLs, err)
+			}
+		} else if err == nil || err.Error() != testCase.expectedError {
+			t.Fatalf("Expected checkEndpointURLs(%v) to return [%s] but it returned [%v]", testCase.endpointURLs, testCase.expectedError, err)
+		}
+	}
+}
+
+func TestCheckReplicasToStart(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		name                  string
+		replicaNames          []string
+		replicaListErr        error
+		minReplicasToStart    uint
+		expectedIsOnlyReplica bool
+		expectedOcfExitCode   mssqlcommon.OcfExitCode
+	}{
+		{"only replica", []string{"node1"}, nil, 0, true, mssqlcommon.OCF_SUCCESS},
+		{"only replica with enough replicas", []string{"node1"}, nil, 1, true, mssqlcommon.OCF_SUCCESS},
+		{"several replicas", []string{"node1", "node2", "node3"}, nil, 0, false, mssqlcommon.OCF_SUCCESS},
+		{"too few replicas", []string{"node1", "node2"}, nil, 3, false, mssqlcommon.OCF_ERR_GENERIC},
+		{"missing AG", nil, nil, 0, false, mssqlcommon.OCF_ERR_ARGS},
+		{"query failed", nil, errors.New("query failed"), 0, false, mssqlcommon.OCF_SUCCESS},
+		{"query failed with --min-replicas-to-start", nil, errors.New("query failed"), 2, false, mssqlcommon.OCF_ERR_GENERIC},
+	} {
+		var output bytes.Buffer
+		isOnlyReplica, ocfExitCode, err := checkReplicasToStart("ag1", testCase.replicaNames, testCase.replicaListErr, testCase.minReplicasToStart, log.New(&output, "", 0))
+
+		if (err != nil) != (testCase.expectedOcfExitCode != mssqlcommon.OCF_SUCCESS) {
+			t.Fatalf("Expected checkReplicasToStart() for %s to return exit code %d but it returned error %v", testCase.name, testCase.expectedOcfExitCode, err)
+		}
+
+		if isOnlyReplica != testCase.expectedIsOnlyReplica || ocfExitCode != testCase.expectedOcfExitCode {
+			t.Fatalf(
+				"Expected checkReplicasToStart() for %s to return (%t, %d) but it returned (%t, %d)",
+				testCase.name, testCase.expectedIsOnlyReplica, testCase.expectedOcfExitCode, isOnlyReplica, ocfExitCode)
+		}
+	}
+}
+
+func TestCompareSequenceNumbers(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		name                       string
+		sequenceNumbers            string
+		lastHardenedLSNs           string
+		expectedNumSequenceNumbers uint
+		expectedDecision           promoteDecision
+	}{
+		{
+			name: "highest sequence number",
+			sequenceNumbers: `name="ag1-sequence-number" host="node1" value="4294967301"
+name="ag1-sequence-number" host="node2" value="4294967300"`,
+			expectedNumSequenceNumbers: 2,
+		},
+		{
+			name: "lower sequence number",
+			sequenceNumbers: `name="ag1-sequence-number" host="node1" value="4294967300"
+name="ag1-sequence-number" host="node2" value="4294967301"`,
+			expectedNumSequenceNumbers: 2,
+			expectedDecision:           promoteDecisionLowSequenceNumber,
+		},
+		{
+			name: "zero sequence number without last hardened LSNs",
+			sequenceNumbers: `name="ag1-sequence-number" host="node1" value="0"
+name="ag1-sequence-number" host="node2" value="0"`,
+			expectedDecision: promoteDecisionZeroSequenceNumber,
+		},
+		{
+			name: "zero sequence number with lower last hardened LSN",
+			sequenceNumbers: `name="ag1-sequence-number" host="node1" value="0"
+name="ag1-sequence-number" host="node2" value="0"`,
+			lastHardenedLSNs: `name="ag1-last-hardened-lsn" host="node1" value="A:100"
+name="ag1-last-hardened-lsn" host="node2" value="A:200"`,
+			expectedNumSequenceNumbers: 2,
+			expectedDecision:           promoteDecisionLowLastHardenedLSN,
+		},
+		{
+			name: "zero sequence number with highest last hardened LSN",
+			sequenceNumbers: `name="ag1-sequence-number" host="node1" value="0"
+name="ag1-sequence-number" host="node2" value="0"`,
+			lastHardenedLSNs: `name="ag1-last-hardened-lsn" host="node1" value="A:200"
+name="ag1-last-hardened-lsn" host="node2" value="A:200"`,
+			expectedNumSequenceNumbers: 2,
+		},
+	} {
+		var output bytes.Buffer
+		numSequenceNumbers, err := compareSequenceNumbers(
+			"ag1", testCase.sequenceNumbers, mssqlag.SequenceNumberFormatAuto, false, testCase.lastHardenedLSNs, "node1", log.New(&output, "", 0))
+
+		var decision promoteDecision
+		if err != nil {
+			promoteRefused, ok := err.(*promoteRefusedError)
+			if !ok {
+				t.Fatalf("Expected compareSequenceNumbers() for %s to return a promoteRefusedError but it returned %v", testCase.name, err)
+			}
+
+			decision = promoteRefused.Decision
+		}
+
+		// The number of sequence numbers is only used if the promotion isn't refused
+		if decision != testCase.expectedDecision || (decision == "" && numSequenceNumbers != testCase.expectedNumSequenceNumbers) {
+			t.Fatalf(
+				"Expected compareSequenceNumbers() for %s to return (%d, %q) but it returned (%d, %q)",
+				testCase.name,
+				testCase.expectedNumSequenceNumbers, testCase.expectedDecision,
+				numSequenceNumbers, decision)
+		}
+	}
+}
+
+func TestCheckNumSequenceNumbers(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		numSequenceNumbers                      uint
+		numSyncCommitReplicas                   uint
+		requiredSynchronizedSecondariesToCommit uint
+		expectedDecision                        promoteDecision
+	}{
+		{3, 3, 1, ""},
+		{2, 3, 1, ""},
+		{1, 3, 1, promoteDecisionInsufficientReplicas},
+		{1, 2, 0, promoteDecisionInsufficientReplicas},
+		{2, 2, 0, ""},
+	} {
+		err := checkNumSequenceNumbers(testCase.numSequenceNumbers, testCase.numSyncCommitReplicas, testCase.requiredSynchronizedSecondariesToCommit)
+
+		var decision promoteDecision
+		if err != nil {
+			promoteRefused, ok := err.(*promoteRefusedError)
+			if !ok {
+				t.Fatalf("Expected checkNumSequenceNumbers() to return a promoteRefusedError but it returned %v", err)
+			}
+
+			decision = promoteRefused.Decision
+		}
+
+		if decision != testCase.expectedDecision {
+			t.Fatalf(
+				"Expected checkNumSequenceNumbers(%d, %d, %d) to return %q but it returned %q",
+				testCase.numSequenceNumbers, testCase.numSyncCommitReplicas, testCase.requiredSynchronizedSecondariesToCommit,
+				testCase.expectedDecision, decision)
+		}
+	}
+}
+
+func TestCompareLastHardenedLSNs(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		name                        string
+		lastHardenedLSNs            string
+		expectedNumLastHardenedLSNs uint
+		expectedDecision            promoteDecision
+	}{
+		{
+			name: "highest LSN of every database",
+			lastHardenedLSNs: `name="ag1-last-hardened-lsn" host="node1" value="A:300,B:200"
+name="ag1-last-hardened-lsn" host="node2" value="A:300,B:100"`,
+			expectedNumLastHardenedLSNs: 2,
+		},
+		{
+			// The LSN of database B on node2 is higher than any LSN on node1, but it's only compared with database B
+			name: "LSNs are only compared within a database",
+			lastHardenedLSNs: `name="ag1-last-hardened-lsn" host="node1" value="A:300,B:200"
+name="ag1-last-hardened-lsn" host="node2" value="A:100,B:150"`,
+			expectedNumLastHardenedLSNs: 2,
+		},
+		{
+			name: "lower LSN of one database",
+			lastHardenedLSNs: `name="ag1-last-hardened-lsn" host="node1" value="A:300,B:100"
+name="ag1-last-hardened-lsn" host="node2" value="A:200,B:200"`,
+			expectedNumLastHardenedLSNs: 2,
+			expectedDecision:            promoteDecisionLowLastHardenedLSN,
+		},
+		{
+			name: "missing database",
+			lastHardenedLSNs: `name="ag1-last-hardened-lsn" host="node1" value="A:300"
+name="ag1-last-hardened-lsn" host="node2" value="A:200,B:200"`,
+			expectedNumLastHardenedLSNs: 2,
+			expectedDecision:            promoteDecisionLowLastHardenedLSN,
+		},
+		{
+			name:                        "no LSNs of the new master",
+			lastHardenedLSNs:            `name="ag1-last-hardened-lsn" host="node2" value="A:200"`,
+			expectedNumLastHardenedLSNs: 1,
+			expectedDecision:            promoteDecisionZeroSequenceNumber,
+		},
+	} {
+		var output bytes.Buffer
+		numLastHardenedLSNs, err := compareLastHardenedLSNs("ag1", testCase.lastHardenedLSNs, "node1", log.New(&output, "", 0))
+
+		var decision promoteDecision
+		if err != nil {
+			promoteRefused, ok := err.(*promoteRefusedError)
+			if !ok {
+				t.Fatalf("Expected compareLastHardenedLSNs() for %s to return a promoteRefusedError but it returned %v", testCase.name, err)
+			}
+
+			decision = promoteRefused.Decision
+		}
+
+		if numLastHardenedLSNs != testCase.expectedNumLastHardenedLSNs || decision != testCase.expectedDecision {
+			t.Fatalf(
+				"Expected compareLastHardenedLSNs() for %s to return (%d, %q) but it returned (%d, %q)",
+				testCase.name,
+				testCase.expectedNumLastHardenedLSNs, testCase.expectedDecision,
+				numLastHardenedLSNs, decision)
+		}
+	}
+}
+
+func TestFormatStatus(t *testing.T) {
+	t.Parallel()
+
+	preferredBackupReplica := true
+
+	for _, testCase := range []struct {
+		name         string
+		info         statusInfo
+		replicaNames []string
+		expectedJSON string
+		expectedYAML string
+	}{
+		{
+			name: "primary",
+			info: statusInfo{
+				AGName:                    "ag1",
+				GroupID:                   "0AB5F2C5-93B8-4DB3-9CE7-5E0D1C2B4A10",
+				ResourceID:                "5C7D0E4F-1B2A-4C3D-8E9F-0A1B2C3D4E5F",
+				LocalRole:                 "PRIMARY",
+				AutomatedBackupPreference: "SECONDARY",
+				PreferredBackupReplica:    &preferredBackupReplica,
+				ListenerIPAddresses:       []statusListenerIPAddress{{IPAddress: "10.0.0.10", State: "ONLINE"}},
+				EstimatedDataLossSeconds:  map[string]int64{"node2": 3, "node3": 0},
+			},
+			replicaNames: []string{"node2", "node3"},
+			expectedJSON: `{
+  "ag_name": "ag1",
+  "group_id": "0AB5F2C5-93B8-4DB3-9CE7-5E0D1C2B4A10",
+  "resource_id": "5C7D0E4F-1B2A-4C3D-8E9F-0A1B2C3D4E5F",
+  "local_role": "PRIMARY",
+  "automated_backup_preference": "SECONDARY",
+  "preferred_backup_replica": true,
+  "listener_ip_addresses": [
+    {
+      "ip_address": "10.0.0.10",
+      "state": "ONLINE"
+    }
+  ],
+  "estimated_data_loss_seconds": {
+    "node2": 3,
+    "node3": 0
+  }
+}`,
+			expectedYAML: `ag_name: "ag1"
+group_id: "0AB5F2C5-93B8-4DB3-9CE7-5E0D1C2B4A10"
+resource_id: "5C7D0E4F-1B2A-4C3D-8E9F-0A1B2C3D4E5F"
+local_role: "PRIMARY"
+automated_backup_preference: "SECONDARY"
+preferred_backup_replica: true
+listener_ip_addresses:
+  - ip_address: "10.0.0.10"
+    state: "ONLINE"
+estimated_data_loss_seconds:
+  "node2": 3
+  "node3": 0
+`,
+		},
+		{
+			name: "secondary without a listener",
+			info: statusInfo{
+				AGName:              "ag1",
+				GroupID:             "0AB5F2C5-93B8-4DB3-9CE7-5E0D1C2B4A10",
+				ResourceID:          "5C7D0E4F-1B2A-4C3D-8E9F-0A1B2C3D4E5F",
+				LocalRole:           "SECONDARY",
+				ListenerIPAddresses: []statusListenerIPAddress{},
+			},
+			expectedJSON: `{
+  "ag_name": "ag1",
+  "group_id": "0AB5F2C5-93B8-4DB3-9CE7-5E0D1C2B4A10",
+  "resource_id": "5C7D0E4F-1B2A-4C3D-8E9F-0A1B2C3D4E5F",
+  "local_role": "SECONDARY",
+  "listener_ip_addresses": []
+}`,
+			expectedYAML: `ag_name: "ag1"
+group_id: "0AB5F2C5-93B8-4DB3-9CE7-5E0D1C2B4A10"
+resource_id: "5C7D0E4F-1B2A-4C3D-8E9F-0A1B2C3D4E5F"
+local_role: "SECONDARY"
+listener_ip_addresses: []
+`,
+		},
+		{
+			name: "listener IP addresses that couldn't be queried",
+			info: statusInfo{
+				AGName:     "ag \"1\"",
+				GroupID:    "0AB5F2C5-93B8-4DB3-9CE7-5E0D1C2B4A10",
+				ResourceID: "5C7D0E4F-1B2A-4C3D-8E9F-0A1B2C3D4E5F",
+				LocalRole:  "RESOLVING",
+			},
+			expectedJSON: `{
+  "ag_name": "ag \"1\"",
+  "group_id": "0AB5F2C5-93B8-4DB3-9CE7-5E0D1C2B4A10",
+  "resource_id": "5C7D0E4F-1B2A-4C3D-8E9F-0A1B2C3D4E5F",
+  "local_role": "RESOLVING",
+  "listener_ip_addresses": null
+}`,
+			expectedYAML: `ag_name: "ag \"1\""
+group_id: "0AB5F2C5-93B8-4DB3-9CE7-5E0D1C2B4A10"
+resource_id: "5C7D0E4F-1B2A-4C3D-8E9F-0A1B2C3D4E5F"
+local_role: "RESOLVING"
+listener_ip_addresses: null
+`,
+		},
+	} {
+		statusJSON, err := formatStatusJSON(testCase.info)
+		if err != nil {
+			t.Fatalf("Expected formatStatusJSON() for %s to succeed but it failed: %s", testCase.name, err)
+		}
+		if statusJSON != testCase.expectedJSON {
+			t.Fatalf("Expected formatStatusJSON() for %s to return\n%s\nbut it returned\n%s", testCase.name, testCase.expectedJSON, statusJSON)
+		}
+
+		statusYAML := formatStatusYAML(testCase.info, testCase.replicaNames)
+		if statusYAML != testCase.expectedYAML {
+			t.Fatalf("Expected formatStatusYAML() for %s to return\n%s\nbut it returned\n%s", testCase.name, testCase.expectedYAML, statusYAML)
+		}
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -57,47 +58,89 @@ func main() {
 
 func doMain(stdout *log.Logger, stderr *log.Logger) error {
 	var (
-		hostname             string
-		sqlPort              uint64
-		credentialsFile      string
-		applicationName      string
-		rawConnectionTimeout int64
-		rawHealthThreshold   uint
+		hostname                  string
+		sqlPort                   uint64
+		credentialsFile           string
+		username                  string
+		passwordFile              string
+		credentialsProviderName   string
+		vaultAddress              string
+		vaultPath                 string
+		vaultTokenFile            string
+		applicationName           string
+		appendHostnameToAppName   bool
+		rawConnectionTimeout      int64
+		rawTrustServerCertificate string
+		healthCheckPort           uint64
+		checkHostnameResolves     bool
+		rawHealthThreshold        uint
+		treatQueryProcessingAs    string
+		dumpDiagnostics           bool
+		diagnosticsRepeatInterval uint
+		healthCheckQuery          string
 
 		action string
 
-		virtualServerName string
+		virtualServerName    string
+		rawServerNameTimeout uint
 	)
 
 	flag.StringVar(&hostname, "hostname", "localhost", "The hostname of the SQL Server instance to connect to. Default: localhost")
 	flag.Uint64Var(&sqlPort, "port", 0, "The port on which the instance is listening for logins.")
 	flag.StringVar(&credentialsFile, "credentials-file", "", "The path to the credentials file.")
+	flag.StringVar(&username, "username", "", "The username to use for the T-SQL connection. Must be specified with --password-file instead of --credentials-file.")
+	flag.StringVar(&passwordFile, "password-file", "", "The path to a file containing only the password to use for the T-SQL connection. Must be specified with --username instead of --credentials-file.")
+	flag.StringVar(&credentialsProviderName, "credentials-provider", "file", "The source of the credentials for the T-SQL connection. One of file, vault. "+
+		"file: Read the credentials from --credentials-file, or from --username and --password-file. "+
+		"vault: Read the credentials from the username and password keys of the HashiCorp Vault secret at --vault-path. Default: file")
+	flag.StringVar(&vaultAddress, "vault-address", "", "The address of the Vault server. Default: the value of the VAULT_ADDR environment variable")
+	flag.StringVar(&vaultPath, "vault-path", "", "The path of the Vault secret containing the credentials, like secret/data/mssql.")
+	flag.StringVar(&vaultTokenFile, "vault-token-file", "", "The path to a file containing the Vault token. Default: the value of the VAULT_TOKEN environment variable")
 	flag.StringVar(&applicationName, "application-name", "", "The application name to use for the T-SQL connection.")
+	flag.BoolVar(&appendHostnameToAppName, "append-hostname-to-appname", false, "Append the hostname of this node to the application name, like \"app (node1)\", "+
+		"so that connections can be attributed to the node they came from.")
 	flag.Int64Var(&rawConnectionTimeout, "connection-timeout", 30, "The connection timeout in seconds. "+
-		"The application will retry connecting to the instance until this time elapses. Default: 30")
+		"The application will retry connecting to the instance until this time elapses. Must be at least 1. Default: 30")
+	flag.StringVar(&rawTrustServerCertificate, "trust-server-certificate", "false", "One of true, false. "+
+		"Whether to trust the certificate presented by the instance without validating it, regardless of whether the connection is encrypted. "+
+		"This allows self-signed certificates but exposes the connection to man-in-the-middle attacks, so it should only be used in test environments. Default: false")
+	flag.Uint64Var(&healthCheckPort, "health-check-port", 0, "A port of the instance that is probed for TCP reachability before each attempt to connect to the instance. "+
+		"While the port is not open, the attempt fails without waiting for the T-SQL connection to time out, which detects a fully-down instance sooner. Default: 0 (disabled)")
+	flag.BoolVar(&checkHostnameResolves, "check-hostname-resolves", false, "Resolve --hostname before connecting to the instance, and fail with OCF_ERR_CONFIGURED if it does not exist "+
+		"instead of retrying to connect until --connection-timeout elapses. Transient DNS failures are only logged.")
 	flag.UintVar(&rawHealthThreshold, "health-threshold", uint(mssqlcommon.ServerCriticalError), "The instance health threshold. Default: 3 (SERVER_CRITICAL_ERROR)")
+	flag.StringVar(&treatQueryProcessingAs, "treat-query-processing-as", "error", "One of warning, error. "+
+		"Whether a query processing error reported by sp_server_diagnostics is treated as an error (SERVER_ANY_QUALIFIED_ERROR) or only logged as a warning. Default: error")
+	flag.BoolVar(&dumpDiagnostics, "dump-diagnostics", false, "Log every row returned by sp_server_diagnostics, including the data of each component.")
+	flag.UintVar(&diagnosticsRepeatInterval, "diagnostics-repeat-interval", 0, "If not 0, run sp_server_diagnostics with this repeat interval in seconds and use its first complete cycle of results "+
+		"instead of running it once, for builds where a single run can report a component error before all components are populated. Must be 0 or at least 5. Default: 0")
+	flag.StringVar(&healthCheckQuery, "health-check-query", "", "A statement to run instead of sp_server_diagnostics, for logins that can't be granted VIEW SERVER STATE, "+
+		"such as EXEC dbo.health_check. It must return a single integer, 0 if the instance is healthy or the instance health otherwise, "+
+		"which is compared with --health-threshold. Default: empty (use sp_server_diagnostics)")
 
 	flag.StringVar(&action, "action", "", `One of --start, --monitor
 	start: Start the replica on this node.
 	monitor: Monitor the replica on this node.`)
 
 	flag.StringVar(&virtualServerName, "virtual-server-name", "", "The virtual server name that should be set on the SQL Server instance.")
+	flag.UintVar(&rawServerNameTimeout, "server-name-timeout", 10, "The time in seconds that the start action waits for @@SERVERNAME to show --virtual-server-name after setting it. "+
+		"If it doesn't, the instance must be restarted for the new name to take effect, and the start action fails with OCF_ERR_ARGS. Default: 10")
 
 	flag.Parse()
 
 	stdout.Printf(
-		"fci-helper invoked with hostname [%s]; port [%d]; credentials-file [%s]; application-name [%s]; connection-timeout [%d]; health-threshold [%d]; action [%s]\n",
+		"fci-helper invoked with hostname [%s]; port [%d]; credentials-file [%s]; username [%s]; password-file [%s]; credentials-provider [%s]; vault-address [%s]; vault-path [%s]; vault-token-file [%s]; application-name [%s]; append-hostname-to-appname [%t]; connection-timeout [%d]; trust-server-certificate [%s]; health-check-port [%d]; check-hostname-resolves [%t]; health-threshold [%d]; treat-query-processing-as [%s]; dump-diagnostics [%t]; diagnostics-repeat-interval [%d]; health-check-query [%s]; action [%s]\n",
 		hostname, sqlPort,
-		credentialsFile,
-		applicationName,
-		rawConnectionTimeout, rawHealthThreshold,
+		credentialsFile, username, passwordFile, credentialsProviderName, vaultAddress, vaultPath, vaultTokenFile,
+		applicationName, appendHostnameToAppName,
+		rawConnectionTimeout, rawTrustServerCertificate, healthCheckPort, checkHostnameResolves, rawHealthThreshold, treatQueryProcessingAs, dumpDiagnostics, diagnosticsRepeatInterval, healthCheckQuery,
 		action)
 
 	switch action {
 	case "start":
 		stdout.Printf(
-			"fci-helper invoked with virtual-server-name [%s]\n",
-			virtualServerName)
+			"fci-helper invoked with virtual-server-name [%s]; server-name-timeout [%d]\n",
+			virtualServerName, rawServerNameTimeout)
 
 	case "monitor":
 		stdout.Printf(
@@ -113,8 +156,9 @@ func doMain(stdout *log.Logger, stderr *log.Logger) error {
 		return errors.New("a valid port number must be specified using --port")
 	}
 
-	if credentialsFile == "" {
-		return errors.New("a valid path to a credentials file must be specified using --credentials-file")
+	if credentialsProviderName == "file" && credentialsFile == "" && username == "" && passwordFile == "" {
+		return errors.New("a valid path to a credentials file must be specified using --credentials-file, " +
+			"or a valid username and path to a password file must be specified using --username and --password-file")
 	}
 
 	if applicationName == "" {
@@ -136,21 +180,118 @@ func doMain(stdout *log.Logger, stderr *log.Logger) error {
 		return err
 	}
 
+	if credentialsProviderName == "file" && credentialsFile != "" && (username != "" || passwordFile != "") {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_ARGS, errors.New(
+			"Only one of --credentials-file or --username and --password-file must be specified"))
+	}
+
+	if credentialsProviderName == "file" && credentialsFile == "" && (username == "" || passwordFile == "") {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_ARGS, errors.New(
+			"--username and --password-file must be specified together"))
+	}
+
+	if appendHostnameToAppName {
+		localHostname, err := os.Hostname()
+		if err != nil {
+			return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not get hostname of this node: %s", err))
+		}
+
+		applicationName = fmt.Sprintf("%s (%s)", applicationName, localHostname)
+	}
+
 	connectionTimeout := time.Duration(rawConnectionTimeout) * time.Second
+	if connectionTimeout < mssqlcommon.MinConnectionTimeout {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf(
+			"--connection-timeout must be at least %d seconds but it was set to %d", mssqlcommon.MinConnectionTimeout/time.Second, rawConnectionTimeout))
+	}
+	trustServerCertificate, err := strconv.ParseBool(rawTrustServerCertificate)
+	if err != nil {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf(
+			"--trust-server-certificate must be set to one of true, false but it was set to %s", rawTrustServerCertificate))
+	}
+
+	if checkHostnameResolves {
+		err = mssqlcommon.CheckHostnameResolves(hostname, stdout)
+		if err != nil {
+			return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, err)
+		}
+	}
+
 	healthThreshold := mssqlcommon.ServerHealth(rawHealthThreshold)
 
-	sqlUsername, sqlPassword, err := mssqlcommon.ReadCredentialsFile(credentialsFile)
+	diagnosticsMapping := mssqlcommon.DefaultDiagnosticsMapping
+	switch treatQueryProcessingAs {
+	case "error":
+		// Keep the default mapping
+
+	case "warning":
+		diagnosticsMapping.QueryProcessing = mssqlcommon.ServerWarningOnly
+
+	default:
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf(
+			"--treat-query-processing-as must be set to one of warning, error but it was set to %s", treatQueryProcessingAs))
+	}
+
+	if diagnosticsRepeatInterval != 0 && time.Duration(diagnosticsRepeatInterval)*time.Second < mssqlcommon.MinDiagnosticsRepeatInterval {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, fmt.Errorf(
+			"--diagnostics-repeat-interval must be 0 or at least %d but it was set to %d", mssqlcommon.MinDiagnosticsRepeatInterval/time.Second, diagnosticsRepeatInterval))
+	}
+
+	if healthCheckQuery != "" && diagnosticsRepeatInterval != 0 {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, errors.New(
+			"--diagnostics-repeat-interval can't be used with --health-check-query since it only applies to sp_server_diagnostics"))
+	}
+
+	credentialProvider, err := mssqlcommon.NewCredentialProvider(credentialsProviderName, mssqlcommon.CredentialProviderOptions{
+		CredentialsFile: credentialsFile,
+		Username:        username,
+		PasswordFile:    passwordFile,
+		VaultAddress:    vaultAddress,
+		VaultPath:       vaultPath,
+		VaultTokenFile:  vaultTokenFile,
+	})
+	if errors.Is(err, mssqlcommon.ErrUnknownCredentialProvider) {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_CONFIGURED, err)
+	}
+	if err != nil {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_ARGS, err)
+	}
+
+	credentials, err := mssqlcommon.GetCredentialsWithTimeout(credentialProvider, connectionTimeout)
+	if err != nil {
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_ARGS, fmt.Errorf("Could not read credentials: %s", err))
+	}
+
+	err = credentials.Validate()
 	if err != nil {
-		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_ARGS, fmt.Errorf("Could not read credentials file: %s", err))
+		return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_ARGS, fmt.Errorf("Invalid credentials: %s", err))
 	}
 
+	sqlUsername, sqlPassword := credentials.Username, credentials.Password
+
+	var connectStats mssqlcommon.ConnectStats
 	db, err := mssqlcommon.OpenDBWithHealthCheck(
 		hostname, sqlPort,
 		sqlUsername, sqlPassword,
 		applicationName,
 		connectionTimeout,
+		trustServerCertificate,
+		healthCheckPort,
+		&mssqlcommon.HealthPolicy{Mapping: diagnosticsMapping, DiagnosticsRepeatInterval: time.Duration(diagnosticsRepeatInterval) * time.Second, HealthCheckQuery: healthCheckQuery},
+		&connectStats,
 		stdout)
+
+	stdout.Printf("Connection attempts: %d; total wait: %s; last error: %v\n", connectStats.Attempts, connectStats.TotalWait.Round(time.Millisecond), connectStats.LastError)
 	if err != nil {
+		// SQL Server also rejects a valid login while its default database is recovering, so login failures were retried
+		// until the connection timeout. A login that still fails most likely has wrong credentials, which restarting the instance won't fix.
+		connectErrorCategory := mssqlcommon.ClassifyConnectError(err)
+		if connectErrorCategory == mssqlcommon.ConnectErrorLoginFailed {
+			return mssqlcommon.OcfExit(stderr, mssqlcommon.OCF_ERR_PERM, fmt.Errorf("Could not log in to the instance: %s", err))
+		}
+
+		stdout.Printf("Connection error category: %s\n", connectErrorCategory)
+
 		switch serverUnhealthyError := err.(type) {
 		case *mssqlcommon.ServerUnhealthyError:
 			if serverUnhealthyError.RawValue <= healthThreshold {
@@ -167,11 +308,18 @@ func doMain(stdout *log.Logger, stderr *log.Logger) error {
 	}
 	defer db.Close()
 
+	if dumpDiagnostics {
+		err = mssqlcommon.DumpDiagnostics(db, stdout)
+		if err != nil {
+			stdout.Printf("Could not dump sp_server_diagnostics results: %s\n", err)
+		}
+	}
+
 	var ocfExitCode mssqlcommon.OcfExitCode
 
 	switch action {
 	case "start":
-		ocfExitCode, err = start(db, virtualServerName, stdout)
+		ocfExitCode, err = start(db, virtualServerName, time.Duration(rawServerNameTimeout)*time.Second, stdout)
 
 	case "monitor":
 		ocfExitCode, err = monitor(db, virtualServerName, stdout)
@@ -180,6 +328,8 @@ func doMain(stdout *log.Logger, stderr *log.Logger) error {
 		return fmt.Errorf("unknown value for --action %s", action)
 	}
 
+	stdout.Printf("Exiting with %s (code %d)\n", mssqlcommon.OcfCodeName(ocfExitCode), ocfExitCode)
+
 	return mssqlcommon.OcfExit(stderr, ocfExitCode, err)
 }
 
@@ -188,10 +338,14 @@ func doMain(stdout *log.Logger, stderr *log.Logger) error {
 // Description:
 //    Implements the OCF "start" action
 //
-func start(db *sql.DB, virtualServerName string, stdout *log.Logger) (mssqlcommon.OcfExitCode, error) {
-	stdout.Printf("Setting local server name to %s...\n", virtualServerName)
+func start(db *sql.DB, virtualServerName string, serverNameTimeout time.Duration, stdout *log.Logger) (mssqlcommon.OcfExitCode, error) {
+	stdout.Printf("Setting local server name to %s and waiting up to %s for it to take effect...\n", virtualServerName, serverNameTimeout)
 
-	err := mssqlcommon.SetLocalServerName(db, virtualServerName)
+	err := mssqlcommon.SetLocalServerNameAndWait(db, virtualServerName, serverNameTimeout)
+	if errors.Is(err, mssqlcommon.ErrServerNameRestartRequired) {
+		// Retrying the start on this node can't succeed until the instance is restarted, so don't let Pacemaker retry it
+		return mssqlcommon.OCF_ERR_ARGS, fmt.Errorf("Local server name was set to %s but the instance must be restarted: %s", virtualServerName, err)
+	}
 	if err != nil {
 		return mssqlcommon.OCF_ERR_GENERIC, fmt.Errorf("Could not set local server name: %s", err)
 	}
@@ -23,9 +23,18 @@
 package ag
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // An AvailabilityMode represents an AG replica's availability mode.
@@ -44,6 +53,48 @@ const (
 	AmCONFIGURATION_ONLY AvailabilityMode = 4
 )
 
+// The canonical names of the availability modes, as in the availability_mode_desc field
+var availabilityModeDescs = map[AvailabilityMode]string{
+	AmASYNCHRONOUS_COMMIT: "ASYNCHRONOUS_COMMIT",
+	AmSYNCHRONOUS_COMMIT:  "SYNCHRONOUS_COMMIT",
+	AmCONFIGURATION_ONLY:  "CONFIGURATION_ONLY",
+}
+
+// Desc returns the canonical name of the availability mode, like SYNCHRONOUS_COMMIT, or UNKNOWN if it's not a known availability mode.
+func (availabilityMode AvailabilityMode) Desc() string {
+	desc, ok := availabilityModeDescs[availabilityMode]
+	if !ok {
+		return "UNKNOWN"
+	}
+
+	return desc
+}
+
+// An OperationalState represents the operational state of an AG replica.
+//
+// See the operational_state field in https://msdn.microsoft.com/en-us/library/ff878537.aspx for details.
+type OperationalState byte
+
+const (
+	// The replica is pending a failover.
+	OsPENDING_FAILOVER OperationalState = 0
+
+	// The replica is pending a change, such as a change of its availability mode.
+	OsPENDING OperationalState = 1
+
+	// The replica is online.
+	OsONLINE OperationalState = 2
+
+	// The replica is offline.
+	OsOFFLINE OperationalState = 3
+
+	// The replica has failed.
+	OsFAILED OperationalState = 4
+
+	// The replica has failed because the WSFC has no quorum.
+	OsFAILED_NO_QUORUM OperationalState = 5
+)
+
 // A Role represents an AG replica's role.
 //
 // See the role field in https://msdn.microsoft.com/en-us/library/ff878537.aspx for details.
@@ -60,6 +111,148 @@ const (
 	RoleSECONDARY Role = 2
 )
 
+// The canonical names of the roles, as in the role_desc field
+var roleDescs = map[Role]string{
+	RoleRESOLVING: "RESOLVING",
+	RolePRIMARY:   "PRIMARY",
+	RoleSECONDARY: "SECONDARY",
+}
+
+// Desc returns the canonical name of the role, like PRIMARY, or UNKNOWN if it's not a known role.
+func (role Role) Desc() string {
+	desc, ok := roleDescs[role]
+	if !ok {
+		return "UNKNOWN"
+	}
+
+	return desc
+}
+
+// A failover-related event of an AG, as returned by `GetFailoverHistory()`
+type FailoverEvent struct {
+	Timestamp time.Time
+
+	// The name of the extended event, like availability_replica_state_change or availability_group_lease_expired
+	EventName string
+
+	// The previous and current role or state of the replica, for availability_replica_state_change events
+	PreviousState string
+	CurrentState  string
+}
+
+// Whether the local replica of an AG lost its lease, as returned by `GetLeaseState()`
+type LeaseState struct {
+	// Whether the most recent transition of the local replica to RESOLVING role happened within `leaseExpiryResolvingWindow` of a lease expiry
+	ResolvingDueToLeaseExpiry bool
+
+	// The time of the most recent lease expiry, or the zero time if there is none in the AlwaysOn_health session
+	LastLeaseExpiry time.Time
+}
+
+// When an AG replica was created, as returned by `GetReplicaCreateDates()`
+type ReplicaCreateDate struct {
+	// The create_date of the replica, in the local time of the instance
+	CreateDate time.Time
+
+	// How long ago the replica was created, computed by the instance so that it doesn't depend on the local clock or time zone
+	Age time.Duration
+}
+
+// An entry of the read-only routing list of an AG replica, as returned by `GetReadOnlyRoutingList()`
+type ReadOnlyRoute struct {
+	// The name of the replica that read-intent connections are routed to
+	ReplicaName string
+
+	// The read-only routing URL of that replica, or empty if it doesn't have one
+	RoutingURL string
+
+	// Which connections that replica allows while in SECONDARY role, like NO, READ_ONLY or ALL
+	SecondaryRoleAllowConnectionsDesc string
+}
+
+// An IP address of the listener of an AG, as returned by `GetListenerIPStates()`
+type ListenerIPState struct {
+	IPAddress    string
+	IPSubnetMask string
+	IsDHCP       bool
+	StateDesc    string
+}
+
+// The health of a database of an AG on the local replica, as returned by `GetDatabaseHealthStates()`
+type DatabaseHealthState struct {
+	DatabaseName              string
+	StateDesc                 string
+	SynchronizationHealthDesc string
+	IsSuspended               bool
+	SuspendReasonDesc         string
+}
+
+// The synchronization progress of the databases of an AG, as returned by `GetSyncProgressSummary()`
+type SyncProgressSummary struct {
+	// The largest log send queue of any database replica, in KB
+	MaxLogSendQueueSizeKB int64
+
+	// The largest redo queue of any database replica, in KB
+	MaxRedoQueueSizeKB int64
+
+	// The number of database replicas in SYNCHRONIZED state
+	NumSynchronized uint
+
+	// The number of database replicas known to the local replica
+	NumDatabaseReplicas uint
+}
+
+// The connection of the local replica of an AG to the primary replica, as queried by `GetPrimaryConnectionErrorDetail()`
+type primaryConnectionState struct {
+	// The primary replica that the local replica knows of, or NULL if it doesn't know of any
+	PrimaryReplica sql.NullString
+
+	// The connected state of the local replica, which on a secondary replica is its connection to the primary replica
+	ConnectedState     sql.NullInt64
+	ConnectedStateDesc sql.NullString
+
+	LastConnectErrorNumber      sql.NullInt64
+	LastConnectErrorDescription sql.NullString
+	LastConnectErrorTimestamp   sql.NullTime
+}
+
+// The last commit time of a database replica, as queried by `GetEstimatedDataLoss()`
+type databaseCommitTime struct {
+	replicaName    string
+	databaseID     int
+	isPrimary      bool
+	lastCommitTime time.Time
+}
+
+// The times of the last log activity of a local database replica, as queried by `GetLocalEstimatedDataLoss()`
+type localDatabaseLogTimes struct {
+	lastReceivedTime sql.NullTime
+	lastRedoneTime   sql.NullTime
+	lastCommitTime   sql.NullTime
+}
+
+// A key=value attribute of a line like the lines printed by attrd_updater -QA, as parsed by `parseAttributes()`
+type attrdAttribute struct {
+	key   string
+	value string
+}
+
+// The sequence number of the local replica of an AG, as returned by `GetAllSequenceNumbers()`
+type AGSequenceNumber struct {
+	AGName               string
+	ReplicaName          string
+	SequenceNumber       int64
+	AvailabilityMode     AvailabilityMode
+	AvailabilityModeDesc string
+}
+
+// The role of the local replica of an AG, as returned by `ListAvailabilityGroups()`
+type AvailabilityGroupRole struct {
+	Name     string
+	Role     Role
+	RoleDesc string
+}
+
 // The seeding mode of an AG replica
 //
 // See the seeding_mode field in https://msdn.microsoft.com/en-us/library/ff877883.aspx for details
@@ -73,6 +266,54 @@ const (
 	SmMANUAL SeedingMode = 1
 )
 
+// A NotPrimaryError is returned by functions that must be run against the PRIMARY replica of an AG
+// when the local replica is not in PRIMARY role.
+type NotPrimaryError struct {
+	AGName   string
+	Role     Role
+	RoleDesc string
+}
+
+func (err *NotPrimaryError) Error() string {
+	return fmt.Sprintf("local replica of %s is in %s (%d) role and not in PRIMARY role", err.AGName, err.RoleDesc, err.Role)
+}
+
+// The formats of the sequence number lines parsed by `ParseSequenceNumberLine()`
+const (
+	// Any line of key=value attributes with host and value attributes, in any order and with any other attributes.
+	// Values may be double-quoted, single-quoted or unquoted.
+	SequenceNumberFormatAuto = "auto"
+
+	// Exactly the name="..." host="..." value="..." lines printed by attrd_updater -QA.
+	SequenceNumberFormatAttrd = "attrd"
+)
+
+var (
+	attrdAttributeRegex      = regexp.MustCompile(`([\w-]+)=(?:"([^"]*)"|'([^']*)'|(\S*))`)
+	sequenceNumberValueRegex = regexp.MustCompile(`^\d+$`)
+)
+
+// SQL expressions for the group_id of an AG, given its name or its group_id as returned by `ResolveGroupIDAndRole()`
+// as the query parameter, so that the name-based getters and their *ByGroupID variants share their queries.
+// They're never built from input.
+const (
+	groupIDByName    = "(SELECT ag.group_id FROM sys.availability_groups ag WHERE ag.name = ?)"
+	groupIDByGroupID = "CAST(? AS UNIQUEIDENTIFIER)"
+)
+
+// How often `FailoverAndWait()` polls the role of the local replica
+const failoverPollInterval = 100 * time.Millisecond
+
+// How close to a transition to RESOLVING role a lease expiry must be for `GetLeaseState()` to consider it the cause.
+// The two events are logged separately, so they don't have the same timestamp.
+const leaseExpiryResolvingWindow = 10 * time.Second
+
+// The number of recent failover-related events that `GetLeaseState()` looks at
+const leaseStateMaxEvents = 50
+
+// The number of recent failover-related events that `GetLastStateChange()` looks at
+const lastStateChangeMaxEvents = 10
+
 // --------------------------------------------------------------------------------------
 // Function: Drop
 //
@@ -80,11 +321,12 @@ const (
 //    Drops the given Availability Group.
 //
 // Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
 //    db: A connection to a SQL Server instance hosting a replica of the AG.
 //    agName: The name of the AG.
 //
-func Drop(db *sql.DB, agName string) error {
-	_, err := db.Exec(fmt.Sprintf("DROP AVAILABILITY GROUP %s", quoteName(agName)))
+func Drop(ctx context.Context, db *sql.DB, agName string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("DROP AVAILABILITY GROUP %s", QuoteName(agName)))
 	return err
 }
 
@@ -95,330 +337,2939 @@ func Drop(db *sql.DB, agName string) error {
 //    Performs a failover of the given Availability Group.
 //
 // Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
 //    db: A connection to a SQL Server instance hosting a replica of the AG.
 //    agName: The name of the AG.
 //
-func Failover(db *sql.DB, agName string) error {
-	_, err := db.Exec(fmt.Sprintf("ALTER AVAILABILITY GROUP %s FAILOVER", quoteName(agName)))
+func Failover(ctx context.Context, db *sql.DB, agName string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER AVAILABILITY GROUP %s FAILOVER", QuoteName(agName)))
 	return err
 }
 
 // --------------------------------------------------------------------------------------
-// Function: FailoverWithDataLoss
+// Function: FailoverAndWait
 //
 // Description:
-//    Forces a failover of the given Availability Group, accepting data loss.
+//    Performs a failover of the given Availability Group and waits for the local replica to be in PRIMARY role.
+//
+//    The `FAILOVER` DDL returns before the role change finishes, so the role of the local replica is polled
+//    until it's PRIMARY.
 //
 // Params:
+//    ctx: Bounds the failover and the wait, which stop when it is done.
 //    db: A connection to a SQL Server instance hosting a replica of the AG.
 //    agName: The name of the AG.
+//    timeout: How long to wait for the local replica to be in PRIMARY role. A timeout of 0 waits until `ctx` is done.
 //
-func FailoverWithDataLoss(db *sql.DB, agName string) error {
-	_, err := db.Exec(fmt.Sprintf("ALTER AVAILABILITY GROUP %s FORCE_FAILOVER_ALLOW_DATA_LOSS", quoteName(agName)))
-	return err
+func FailoverAndWait(ctx context.Context, db *sql.DB, agName string, timeout time.Duration) error {
+	err := Failover(ctx, db, agName)
+	if err != nil {
+		return err
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		role, roleDesc, err := GetRole(ctx, db, agName)
+		if err != nil {
+			return fmt.Errorf("Failed while waiting for local replica to be in PRIMARY role: %s", err)
+		}
+
+		if role == RolePRIMARY {
+			return nil
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return fmt.Errorf("Timed out after %s while waiting for local replica to be in PRIMARY role. It is in %s (%d) role.", timeout, roleDesc, role)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Stopped waiting for local replica to be in PRIMARY role. It is in %s (%d) role: %s", roleDesc, role, ctx.Err())
+
+		case <-time.After(failoverPollInterval):
+		}
+	}
 }
 
 // --------------------------------------------------------------------------------------
-// Function: GetAvailabilityMode
+// Function: FailoverWithDataLoss
 //
 // Description:
-//    Gets the availability mode of the given Availability Group.
+//    Forces a failover of the given Availability Group, accepting data loss.
 //
 // Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
 //    db: A connection to a SQL Server instance hosting a replica of the AG.
 //    agName: The name of the AG.
 //
-// Returns:
-//    The numeric value and string name of the availability mode, or an error if the AG was not found.
+func FailoverWithDataLoss(ctx context.Context, db *sql.DB, agName string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER AVAILABILITY GROUP %s FORCE_FAILOVER_ALLOW_DATA_LOSS", QuoteName(agName)))
+	return err
+}
+
+// --------------------------------------------------------------------------------------
+// Function: FormatLastHardenedLSNs
 //
-func GetAvailabilityMode(db *sql.DB, agName string) (availabilityMode AvailabilityMode, availabilityModeDesc string, err error) {
-	err = db.QueryRow(`
-		SELECT ar.availability_mode, ar.availability_mode_desc
-		FROM
-			sys.availability_groups ag
-			INNER JOIN sys.dm_hadr_availability_replica_states ars ON ars.group_id = ag.group_id AND ars.is_local = 1
-			INNER JOIN sys.availability_replicas ar ON ar.replica_id = ars.replica_id
-		WHERE
-			ag.name = ?`, agName).Scan(&availabilityMode, &availabilityModeDesc)
+// Description:
+//    Formats the last hardened LSN of each database as returned by `GetLastHardenedLSNs()`, to be stored in the cluster.
+//    The format is a comma-separated list of group database ID:LSN pairs, sorted by group database ID.
+//
+func FormatLastHardenedLSNs(lastHardenedLSNs map[string]*big.Int) string {
+	groupDatabaseIDs := make([]string, 0, len(lastHardenedLSNs))
+	for groupDatabaseID := range lastHardenedLSNs {
+		groupDatabaseIDs = append(groupDatabaseIDs, groupDatabaseID)
+	}
+	sort.Strings(groupDatabaseIDs)
 
-	return
+	entries := make([]string, 0, len(groupDatabaseIDs))
+	for _, groupDatabaseID := range groupDatabaseIDs {
+		entries = append(entries, fmt.Sprintf("%s:%s", groupDatabaseID, lastHardenedLSNs[groupDatabaseID]))
+	}
+
+	return strings.Join(entries, ",")
 }
 
 // --------------------------------------------------------------------------------------
-// Function: GetCurrentReplicaName
+// Function: FormatSequenceNumber
 //
 // Description:
-//    Gets the name of the local replica of the given Availability Group.
+//    Formats a sequence number for logging, in decimal like the sequence numbers stored in the cluster,
+//    so that log lines can be matched against the attributes.
+//
+// Params:
+//    sequenceNumber: The sequence number.
+//    withHex: Whether to also include the sequence number in hexadecimal, in which the AG's configuration version
+//        and the local commit counter are easier to tell apart.
+//
+func FormatSequenceNumber(sequenceNumber int64, withHex bool) string {
+	if withHex {
+		return fmt.Sprintf("%d (0x%016X)", sequenceNumber, sequenceNumber)
+	}
+
+	return strconv.FormatInt(sequenceNumber, 10)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetAGDatabaseCount
+//
+// Description:
+//    Gets the number of databases that belong to the given Availability Group.
 //
 // Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
 //    db: A connection to a SQL Server instance hosting a replica of the AG.
 //    agName: The name of the AG.
 //
-func GetCurrentReplicaName(db *sql.DB, agName string) (currentReplicaName string, err error) {
-	err = db.QueryRow(`
-		SELECT ar.replica_server_name
+func GetAGDatabaseCount(ctx context.Context, db *sql.DB, agName string) (numDatabases uint, err error) {
+	err = queryRowWithRetry(ctx, db, `
+		SELECT COUNT(*)
 		FROM
-			sys.availability_groups ag
-			INNER JOIN sys.dm_hadr_availability_replica_states ars ON ars.group_id = ag.group_id AND ars.is_local = 1
-			INNER JOIN sys.availability_replicas ar ON ar.replica_id = ars.replica_id
-		WHERE
-			ag.name = ?`, agName).Scan(&currentReplicaName)
+			sys.availability_databases_cluster adc
+			INNER JOIN sys.availability_groups ag ON adc.group_id = ag.group_id
+		WHERE ag.name = ?`, agName).Scan(&numDatabases)
 
 	return
 }
 
 // --------------------------------------------------------------------------------------
-// Function: GetDatabaseStates
+// Function: GetAllSequenceNumbers
 //
 // Description:
-//    Gets a string containing the number of databases that belong to the given Availability Group and are not ONLINE.
+//    Gets the sequence numbers of the local replicas of all Availability Groups on the instance in one query,
+//    along with the name and availability mode of each local replica.
+//
+//    Unlike `GetSequenceNumberWithRetry()`, this doesn't retry while a sequence number is NULL or 0. Such sequence numbers are returned as 0.
 //
 // Params:
-//    db: A connection to a SQL Server instance hosting a replica of the AG.
-//    agName: The name of the AG.
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance.
 //
-func GetDatabaseStates(db *sql.DB, agName string) (result string, err error) {
-	stmt, err := db.Prepare(`
-		SELECT d.state, d.state_desc, COUNT(*) FROM
+func GetAllSequenceNumbers(ctx context.Context, db *sql.DB) (sequenceNumbers []AGSequenceNumber, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT ag.name, ar.replica_server_name, COALESCE(ag.sequence_number, 0), ar.availability_mode, ar.availability_mode_desc
+		FROM
 			sys.availability_groups ag
-			INNER JOIN sys.dm_hadr_database_replica_states drs ON drs.group_id = ag.group_id AND drs.is_local = 1
-			INNER JOIN sys.databases d on d.database_id = drs.database_id
-		WHERE
-			ag.name = ? AND d.state <> 0
-		GROUP BY d.state, d.state_desc`)
-	if err != nil {
-		return
-	}
-	defer stmt.Close()
-
-	rows, err := stmt.Query(agName)
+			INNER JOIN sys.dm_hadr_availability_replica_states ars ON ars.group_id = ag.group_id AND ars.is_local = 1
+			INNER JOIN sys.availability_replicas ar ON ar.replica_id = ars.replica_id
+		ORDER BY ag.name`)
 	if err != nil {
 		return
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var state byte
-		var stateDesc string
-		var numDatabases int
-		err = rows.Scan(&state, &stateDesc, &numDatabases)
+		var sequenceNumber AGSequenceNumber
+		err = rows.Scan(&sequenceNumber.AGName, &sequenceNumber.ReplicaName, &sequenceNumber.SequenceNumber, &sequenceNumber.AvailabilityMode, &sequenceNumber.AvailabilityModeDesc)
 		if err != nil {
 			return
 		}
 
-		result += fmt.Sprintf("%d databases are %s, ", numDatabases, stateDesc)
+		sequenceNumbers = append(sequenceNumbers, sequenceNumber)
 	}
 
-	result = strings.TrimSuffix(result, ", ")
-
 	err = rows.Err()
 
 	return
 }
 
 // --------------------------------------------------------------------------------------
-// Function: GetDBFailoverMode
+// Function: GetAvailabilityMode
 //
 // Description:
-//    Gets the DB_FAILOVER setting of the given Availability Group.
+//    Gets the availability mode of the given Availability Group.
 //
 // Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
 //    db: A connection to a SQL Server instance hosting a replica of the AG.
 //    agName: The name of the AG.
 //
 // Returns:
-//    `true` means ON, `false` means OFF.
+//    The numeric value and string name of the availability mode, or an error if the AG was not found.
 //
-func GetDBFailoverMode(db *sql.DB, agName string) (dbFailoverMode bool, err error) {
-	err = db.QueryRow(`
-		SELECT ag.db_failover
+func GetAvailabilityMode(ctx context.Context, db *sql.DB, agName string) (availabilityMode AvailabilityMode, availabilityModeDesc string, err error) {
+	err = queryRowWithRetry(ctx, db, `
+		SELECT ar.availability_mode, ar.availability_mode_desc
 		FROM
 			sys.availability_groups ag
+			INNER JOIN sys.dm_hadr_availability_replica_states ars ON ars.group_id = ag.group_id AND ars.is_local = 1
+			INNER JOIN sys.availability_replicas ar ON ar.replica_id = ars.replica_id
 		WHERE
-			ag.name = ?`, agName).Scan(&dbFailoverMode)
+			ag.name = ?`, agName).Scan(&availabilityMode, &availabilityModeDesc)
 
 	return
 }
 
 // --------------------------------------------------------------------------------------
-// Function: GetNumSyncCommitReplicas
+// Function: GetBackupPreference
 //
 // Description:
-//    Gets the number of SYNCHRONOUS_COMMIT replicas in the given Availability Group.
+//    Gets the automated backup preference of the given Availability Group.
 //
 // Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
 //    db: A connection to a SQL Server instance hosting a replica of the AG.
 //    agName: The name of the AG.
 //
-func GetNumSyncCommitReplicas(db *sql.DB, agName string) (numReplicas uint, err error) {
-	err = db.QueryRow(`
-		SELECT COUNT(*)
+// Returns:
+//    The name of the automated backup preference, one of PRIMARY, SECONDARY_ONLY, SECONDARY or NONE.
+//
+func GetBackupPreference(ctx context.Context, db *sql.DB, agName string) (backupPreferenceDesc string, err error) {
+	err = queryRowWithRetry(ctx, db, `
+		SELECT ag.automated_backup_preference_desc
 		FROM
-			sys.availability_replicas ar
-			INNER JOIN sys.availability_groups ag ON ar.group_id = ag.group_id
-		WHERE ag.name = ? AND ar.availability_mode = ?`, agName, AmSYNCHRONOUS_COMMIT).Scan(&numReplicas)
+			sys.availability_groups ag
+		WHERE
+			ag.name = ?`, agName).Scan(&backupPreferenceDesc)
 
 	return
 }
 
 // --------------------------------------------------------------------------------------
-// Function: GetPrimaryReplicaName
+// Function: GetClusterType
 //
 // Description:
-//    Gets the name of the primary replica of the given Availability Group.
+//    Gets the cluster type of the given Availability Group.
 //
 // Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
 //    db: A connection to a SQL Server instance hosting a replica of the AG.
 //    agName: The name of the AG.
 //
-func GetPrimaryReplicaName(db *sql.DB, agName string) (primaryReplicaName string, err error) {
-	err = db.QueryRow(`
-		SELECT ags.primary_replica
-		FROM
-			sys.availability_groups ag
-			INNER JOIN sys.dm_hadr_availability_group_states ags ON ags.group_id = ag.group_id
-		WHERE
-			ag.name = ?`, agName).Scan(&primaryReplicaName)
+// Returns:
+//    The cluster_type_desc of the AG, like EXTERNAL, WSFC or NONE.
+//
+func GetClusterType(ctx context.Context, db *sql.DB, agName string) (clusterTypeDesc string, err error) {
+	return getClusterType(ctx, db, groupIDByName, agName)
+}
 
-	return
+// --------------------------------------------------------------------------------------
+// Function: GetClusterTypeByGroupID
+//
+// Description:
+//    Gets the cluster type of an Availability Group like `GetClusterType()`, but by its group_id.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    groupID: The group_id of the AG, as returned by `ResolveGroupIDAndRole()`.
+//
+func GetClusterTypeByGroupID(ctx context.Context, db *sql.DB, groupID string) (clusterTypeDesc string, err error) {
+	return getClusterType(ctx, db, groupIDByGroupID, groupID)
 }
 
 // --------------------------------------------------------------------------------------
-// Function: GetRole
+// Function: GetConfigurationOnlyReplicaHealth
 //
 // Description:
-//    Gets the role of the given Availability Group.
+//    Gets whether the configuration-only replica of the given Availability Group is connected.
 //
 // Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
 //    db: A connection to a SQL Server instance hosting a replica of the AG.
 //    agName: The name of the AG.
 //
 // Returns:
-//    The numeric value and name of the role, or an error if the AG was not found.
+//    The name of the configuration-only replica and its connected state, one of CONNECTED or DISCONNECTED.
+//    The connected state is empty if it's not known to the local replica, which is usually the case on a secondary replica.
+//    sql.ErrNoRows is returned if the AG does not have a configuration-only replica.
 //
-func GetRole(db *sql.DB, agName string) (role Role, roleDesc string, err error) {
-	err = db.QueryRow(`
-		SELECT ars.role, ars.role_desc
+func GetConfigurationOnlyReplicaHealth(ctx context.Context, db *sql.DB, agName string) (replicaName string, connectedStateDesc string, err error) {
+	var rawConnectedStateDesc sql.NullString
+	err = queryRowWithRetry(ctx, db, `
+		SELECT ar.replica_server_name, ars.connected_state_desc
 		FROM
-			sys.availability_groups ag
-			INNER JOIN sys.dm_hadr_availability_replica_states ars ON ars.group_id = ag.group_id AND ars.is_local = 1
+			sys.availability_replicas ar
+			INNER JOIN sys.availability_groups ag ON ar.group_id = ag.group_id
+			LEFT OUTER JOIN sys.dm_hadr_availability_replica_states ars ON ars.replica_id = ar.replica_id
 		WHERE
-			ag.name = ?`, agName).Scan(&role, &roleDesc)
+			ag.name = ? AND ar.availability_mode = ?`, agName, AmCONFIGURATION_ONLY).Scan(&replicaName, &rawConnectedStateDesc)
+	if err != nil {
+		return
+	}
+
+	connectedStateDesc = rawConnectedStateDesc.String
 
 	return
 }
 
 // --------------------------------------------------------------------------------------
-// Function: GetSeedingMode
+// Function: GetCurrentReplicaName
 //
 // Description:
-//    Gets the seeding mode of the current replica of the given Availability Group
+//    Gets the name of the local replica of the given Availability Group.
 //
 // Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
 //    db: A connection to a SQL Server instance hosting a replica of the AG.
 //    agName: The name of the AG.
 //
-// Returns:
-//    The numeric value and string name of the seeding mode, or an error if the AG was not found.
-//
-func GetSeedingMode(db *sql.DB, agName string) (seedingMode SeedingMode, seedingModeDesc string, err error) {
-	err = db.QueryRow(`
-		SELECT ar.seeding_mode, ar.seeding_mode_desc
+func GetCurrentReplicaName(ctx context.Context, db *sql.DB, agName string) (currentReplicaName string, err error) {
+	err = queryRowWithRetry(ctx, db, `
+		SELECT ar.replica_server_name
 		FROM
 			sys.availability_groups ag
 			INNER JOIN sys.dm_hadr_availability_replica_states ars ON ars.group_id = ag.group_id AND ars.is_local = 1
 			INNER JOIN sys.availability_replicas ar ON ar.replica_id = ars.replica_id
 		WHERE
-			ag.name = ?`, agName).Scan(&seedingMode, &seedingModeDesc)
+			ag.name = ?`, agName).Scan(&currentReplicaName)
 
 	return
 }
 
 // --------------------------------------------------------------------------------------
-// Function: GetSequenceNumber
+// Function: GetDatabaseHealthStates
 //
 // Description:
-//    Gets the sequence number of the current replica of the given Availability Group
+//    Gets the state and synchronization health of every database that belongs to the given Availability Group on the local replica.
 //
 // Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
 //    db: A connection to a SQL Server instance hosting a replica of the AG.
 //    agName: The name of the AG.
 //
-// Returns:
-//    The sequence number.
-//
-func GetSequenceNumber(db *sql.DB, agName string) (sequenceNumber int64, err error) {
-	err = db.QueryRow(`
-		SELECT ag.sequence_number
+func GetDatabaseHealthStates(ctx context.Context, db *sql.DB, agName string) (databaseHealthStates []DatabaseHealthState, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT d.name, d.state_desc, drs.synchronization_health_desc, drs.is_suspended, drs.suspend_reason_desc
 		FROM
 			sys.availability_groups ag
+			INNER JOIN sys.dm_hadr_database_replica_states drs ON drs.group_id = ag.group_id AND drs.is_local = 1
+			INNER JOIN sys.databases d ON d.database_id = drs.database_id
 		WHERE
-			ag.name = ?`, agName).Scan(&sequenceNumber)
+			ag.name = ?
+		ORDER BY d.name`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var databaseHealthState DatabaseHealthState
+		var synchronizationHealthDesc, suspendReasonDesc sql.NullString
+		var isSuspended sql.NullBool
+		err = rows.Scan(
+			&databaseHealthState.DatabaseName, &databaseHealthState.StateDesc,
+			&synchronizationHealthDesc, &isSuspended, &suspendReasonDesc)
+		if err != nil {
+			return
+		}
+
+		databaseHealthState.SynchronizationHealthDesc = synchronizationHealthDesc.String
+		databaseHealthState.IsSuspended = isSuspended.Bool
+		databaseHealthState.SuspendReasonDesc = suspendReasonDesc.String
+
+		databaseHealthStates = append(databaseHealthStates, databaseHealthState)
+	}
+
+	err = rows.Err()
 
 	return
 }
 
 // --------------------------------------------------------------------------------------
-// Function: GrantCreateAnyDatabase
+// Function: GetDatabaseStates
 //
 // Description:
-//    Grants the given Availability Group's replica the permission to create any databases in the AG that aren't present.
+//    Gets a string containing the number of databases that belong to the given Availability Group and are not ONLINE.
 //
 // Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
 //    db: A connection to a SQL Server instance hosting a replica of the AG.
 //    agName: The name of the AG.
+//    excludeContainedSystemDatabases: Whether to ignore the contained master and msdb databases of a contained AG.
+//    ignoredDatabaseNames: The names of databases to ignore, such as databases that are intentionally kept offline.
+//    maxStates: The maximum number of states to list individually, starting with the states with the most databases.
+//        The remaining states are summarized as a single count. 0 means all states are listed.
 //
-func GrantCreateAnyDatabase(db *sql.DB, agName string) (err error) {
-	_, err = db.Exec(fmt.Sprintf("ALTER AVAILABILITY GROUP %s GRANT CREATE ANY DATABASE", quoteName(agName)))
-	return
+func GetDatabaseStates(
+	ctx context.Context, db *sql.DB, agName string,
+	excludeContainedSystemDatabases bool, ignoredDatabaseNames []string,
+	maxStates uint) (result string, err error) {
+	return getDatabaseStates(ctx, db, groupIDByName, agName, excludeContainedSystemDatabases, ignoredDatabaseNames, maxStates)
 }
 
 // --------------------------------------------------------------------------------------
-// Function: SetRequiredSynchronizedSecondariesToCommit
+// Function: GetDatabaseStatesByGroupID
 //
 // Description:
-//    Sets the value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT on the given Availability Group on the instance.
+//    Gets the databases that are not ONLINE like `GetDatabaseStates()`, but for the Availability Group with the given group_id.
 //
 // Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
 //    db: A connection to a SQL Server instance hosting a replica of the AG.
-//    agName: The name of the AG.
-//    newValue: The new REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT value.
+//    groupID: The group_id of the AG, as returned by `ResolveGroupIDAndRole()`.
+//    excludeContainedSystemDatabases, ignoredDatabaseNames, maxStates: As for `GetDatabaseStates()`.
 //
-func SetRequiredSynchronizedSecondariesToCommit(db *sql.DB, agName string, newValue int32) (err error) {
-	_, err = db.Exec(fmt.Sprintf(`
-		DECLARE @num_ags INT;
-		SELECT @num_ags = COUNT(*) FROM sys.availability_groups WHERE name = ? AND required_synchronized_secondaries_to_commit = ?;
-		IF @num_ags = 0
-			ALTER AVAILABILITY GROUP %s SET (REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT = %d)
-		;
-	`, quoteName(agName), newValue), agName, newValue)
-	return
+func GetDatabaseStatesByGroupID(
+	ctx context.Context, db *sql.DB, groupID string,
+	excludeContainedSystemDatabases bool, ignoredDatabaseNames []string,
+	maxStates uint) (result string, err error) {
+
+	return getDatabaseStates(ctx, db, groupIDByGroupID, groupID, excludeContainedSystemDatabases, ignoredDatabaseNames, maxStates)
 }
 
 // --------------------------------------------------------------------------------------
-// Function: SetRoleToSecondary
+// Function: GetDBFailoverMode
 //
 // Description:
-//    Sets the role of the given Availability Group to SECONDARY.
+//    Gets the DB_FAILOVER setting of the given Availability Group.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    `true` means ON, `false` means OFF.
+//
+func GetDBFailoverMode(ctx context.Context, db *sql.DB, agName string) (dbFailoverMode bool, err error) {
+	return getDBFailoverMode(ctx, db, groupIDByName, agName)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetDBFailoverModeByGroupID
+//
+// Description:
+//    Gets the DB_FAILOVER setting of an Availability Group like `GetDBFailoverMode()`, but by its group_id.
 //
 // Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
 //    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    groupID: The group_id of the AG, as returned by `ResolveGroupIDAndRole()`.
+//
+func GetDBFailoverModeByGroupID(ctx context.Context, db *sql.DB, groupID string) (dbFailoverMode bool, err error) {
+	return getDBFailoverMode(ctx, db, groupIDByGroupID, groupID)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetEstimatedDataLoss
+//
+// Description:
+//    Estimates how much data would be lost if each secondary replica of the given Availability Group were forced to fail over,
+//    as the time between the last commit of each database on the primary replica and the last commit redone on the secondary replica.
+//
+//    Only the primary replica knows the state of the database replicas of the other replicas, so this must be run on the primary replica.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to the SQL Server instance hosting the primary replica of the AG.
 //    agName: The name of the AG.
 //
-func SetRoleToSecondary(db *sql.DB, agName string) (err error) {
-	_, err = db.Exec(fmt.Sprintf("ALTER AVAILABILITY GROUP %s SET (ROLE = SECONDARY)", quoteName(agName)))
+// Returns:
+//    A map of secondary replica name to the largest estimated data loss of any of its databases.
+//
+func GetEstimatedDataLoss(ctx context.Context, db *sql.DB, agName string) (estimatedDataLoss map[string]time.Duration, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT ar.replica_server_name, drs.database_id, drs.is_primary_replica, drs.last_commit_time
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.dm_hadr_database_replica_states drs ON drs.group_id = ag.group_id
+			INNER JOIN sys.availability_replicas ar ON ar.replica_id = drs.replica_id
+		WHERE
+			ag.name = ? AND drs.last_commit_time IS NOT NULL`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var commitTimes []databaseCommitTime
+
+	for rows.Next() {
+		var commitTime databaseCommitTime
+		err = rows.Scan(&commitTime.replicaName, &commitTime.databaseID, &commitTime.isPrimary, &commitTime.lastCommitTime)
+		if err != nil {
+			return
+		}
+
+		commitTimes = append(commitTimes, commitTime)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	estimatedDataLoss = estimateDataLoss(commitTimes)
+
 	return
 }
 
 // --------------------------------------------------------------------------------------
-// Function: quoteName
+// Function: GetFailoverHistory
 //
 // Description:
-//    Equivalent of QUOTENAME with quote_character = '['.
+//    Gets the most recent failover-related events of the given Availability Group, such as role changes and lease expirations,
+//    from the files of the AlwaysOn_health extended events session.
+//
+//    The AlwaysOn_health session is created with every AG and records these events, unlike the system_health session.
+//    Reading its files can take a few seconds if they are large.
 //
 // Params:
-//    s: The string to be escaped and wrapped in [].
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//    maxEvents: The maximum number of events to return.
 //
-func quoteName(s string) string {
-	return fmt.Sprintf("[%s]", strings.Replace(s, "]", "]]", -1))
+// Returns:
+//    The events, most recent first.
+//
+func GetFailoverHistory(ctx context.Context, db *sql.DB, agName string, maxEvents uint) (events []FailoverEvent, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT TOP (?) event_name, event_timestamp, previous_state, current_state
+		FROM (
+			SELECT
+				xe.object_name AS event_name,
+				xe.event_data.value('(event/@timestamp)[1]', 'datetime2') AS event_timestamp,
+				xe.event_data.value('(event/data[@name="availability_group_name"]/value)[1]', 'nvarchar(128)') AS ag_name,
+				COALESCE(xe.event_data.value('(event/data[@name="previous_state"]/text)[1]', 'nvarchar(60)'), '') AS previous_state,
+				COALESCE(xe.event_data.value('(event/data[@name="current_state"]/text)[1]', 'nvarchar(60)'), '') AS current_state
+			FROM (
+				SELECT object_name, CAST(event_data AS XML) AS event_data
+				FROM sys.fn_xe_file_target_read_file('AlwaysOn_health*.xel', NULL, NULL, NULL)
+				WHERE object_name IN ('availability_replica_state_change', 'availability_group_lease_expired')
+			) xe
+		) events
+		WHERE ag_name = ?
+		ORDER BY event_timestamp DESC`, maxEvents, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var event FailoverEvent
+		err = rows.Scan(&event.EventName, &event.Timestamp, &event.PreviousState, &event.CurrentState)
+		if err != nil {
+			return
+		}
+
+		events = append(events, event)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetGroupAndResourceIds
+//
+// Description:
+//    Gets the identifiers of the given Availability Group, which can be used to correlate it with the cluster resource.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    The group_id of the AG as a GUID string, and the resource_id of the AG.
+//
+func GetGroupAndResourceIds(ctx context.Context, db *sql.DB, agName string) (groupID string, resourceID string, err error) {
+	var rawResourceID sql.NullString
+	err = queryRowWithRetry(ctx, db, `
+		SELECT CAST(ag.group_id AS NVARCHAR(36)), ag.resource_id
+		FROM
+			sys.availability_groups ag
+		WHERE
+			ag.name = ?`, agName).Scan(&groupID, &rawResourceID)
+
+	resourceID = rawResourceID.String
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetGroupHealth
+//
+// Description:
+//    Gets the health rollup of the given Availability Group as a whole, as seen by the local replica.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    The synchronization health of the AG, one of HEALTHY, PARTIALLY_HEALTHY or NOT_HEALTHY,
+//    and the recovery health of the primary replica, which is only known on the primary replica and is empty otherwise.
+//
+func GetGroupHealth(ctx context.Context, db *sql.DB, agName string) (synchronizationHealthDesc string, primaryRecoveryHealthDesc string, err error) {
+	return getGroupHealth(ctx, db, groupIDByName, agName)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetGroupHealthByGroupID
+//
+// Description:
+//    Gets the health rollup of an Availability Group like `GetGroupHealth()`, but by its group_id.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    groupID: The group_id of the AG, as returned by `ResolveGroupIDAndRole()`.
+//
+func GetGroupHealthByGroupID(ctx context.Context, db *sql.DB, groupID string) (synchronizationHealthDesc string, primaryRecoveryHealthDesc string, err error) {
+	return getGroupHealth(ctx, db, groupIDByGroupID, groupID)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetHealthCheckSettings
+//
+// Description:
+//    Gets the settings of the given Availability Group that control how quickly SQL Server considers the primary replica unhealthy.
+//
+//    sys.availability_groups has no lease duration. The lease is held by the cluster, so its duration is a setting of the cluster, not of the AG.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    The HEALTH_CHECK_TIMEOUT and FAILURE_CONDITION_LEVEL of the AG. Either is 0 if it's not set.
+//
+func GetHealthCheckSettings(ctx context.Context, db *sql.DB, agName string) (healthCheckTimeout time.Duration, failureConditionLevel int, err error) {
+	var healthCheckTimeoutMilliseconds int64
+	err = queryRowWithRetry(ctx, db, `
+		SELECT COALESCE(health_check_timeout, 0), COALESCE(failure_condition_level, 0)
+		FROM sys.availability_groups
+		WHERE name = ?`, agName).Scan(&healthCheckTimeoutMilliseconds, &failureConditionLevel)
+	if err != nil {
+		return
+	}
+
+	healthCheckTimeout = time.Duration(healthCheckTimeoutMilliseconds) * time.Millisecond
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetLastHardenedLSNs
+//
+// Description:
+//    Gets the last hardened LSN of each database of the given Availability Group on the local replica,
+//    so that replicas can be compared by how much of the log they have hardened when their sequence numbers are not available.
+//
+//    LSNs are only comparable within a database, so the databases are identified by their group_database_id,
+//    which is the same on every replica of the AG.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    A map of group database ID to the last hardened LSN of the database. Databases without a known last hardened LSN are omitted.
+//
+func GetLastHardenedLSNs(ctx context.Context, db *sql.DB, agName string) (lastHardenedLSNs map[string]*big.Int, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT CAST(drs.group_database_id AS NVARCHAR(36)), CAST(drs.last_hardened_lsn AS NVARCHAR(32))
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.dm_hadr_database_replica_states drs ON drs.group_id = ag.group_id AND drs.is_local = 1
+		WHERE
+			ag.name = ? AND drs.last_hardened_lsn IS NOT NULL`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	lastHardenedLSNs = make(map[string]*big.Int)
+
+	for rows.Next() {
+		var groupDatabaseID, rawLastHardenedLSN string
+		err = rows.Scan(&groupDatabaseID, &rawLastHardenedLSN)
+		if err != nil {
+			return
+		}
+
+		lastHardenedLSN, ok := new(big.Int).SetString(rawLastHardenedLSN, 10)
+		if !ok {
+			err = fmt.Errorf("Could not parse last hardened LSN %s of database %s", rawLastHardenedLSN, groupDatabaseID)
+			return
+		}
+
+		lastHardenedLSNs[strings.ToUpper(groupDatabaseID)] = lastHardenedLSN
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetLastStateChange
+//
+// Description:
+//    Gets the most recent change of the role or state of the local replica of the given Availability Group,
+//    from the events returned by `GetFailoverHistory()`.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    The availability_replica_state_change event. ok is false if none of the recent events is a state change.
+//
+func GetLastStateChange(ctx context.Context, db *sql.DB, agName string) (event FailoverEvent, ok bool, err error) {
+	events, err := GetFailoverHistory(ctx, db, agName, lastStateChangeMaxEvents)
+	if err != nil {
+		return
+	}
+
+	event, ok = lastStateChangeFromEvents(events)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetLeaseState
+//
+// Description:
+//    Gets whether the local replica of the given Availability Group went into RESOLVING role because its lease expired,
+//    rather than for another reason, from the recent events returned by `GetFailoverHistory()`.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+func GetLeaseState(ctx context.Context, db *sql.DB, agName string) (leaseState LeaseState, err error) {
+	events, err := GetFailoverHistory(ctx, db, agName, leaseStateMaxEvents)
+	if err != nil {
+		return
+	}
+
+	leaseState = leaseStateFromEvents(events)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetListenerEndpoint
+//
+// Description:
+//    Gets the DNS name and port of the listener of the given Availability Group.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    The DNS name and port of the listener, or sql.ErrNoRows if the AG has no listener.
+//
+func GetListenerEndpoint(ctx context.Context, db *sql.DB, agName string) (dnsName string, port uint64, err error) {
+	err = queryRowWithRetry(ctx, db, `
+		SELECT agl.dns_name, agl.port
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.availability_group_listeners agl ON agl.group_id = ag.group_id
+		WHERE
+			ag.name = ?`, agName).Scan(&dnsName, &port)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetListenerIPStates
+//
+// Description:
+//    Gets the IP addresses of the listener of the given Availability Group and their state, like ONLINE or OFFLINE.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    The IP addresses of the listener. The slice is empty if the AG has no listener.
+//
+func GetListenerIPStates(ctx context.Context, db *sql.DB, agName string) (ipStates []ListenerIPState, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT aglip.ip_address, COALESCE(aglip.ip_subnet_mask, ''), aglip.is_dhcp, COALESCE(aglip.state_desc, '')
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.availability_group_listeners agl ON agl.group_id = ag.group_id
+			INNER JOIN sys.availability_group_listener_ip_addresses aglip ON aglip.listener_id = agl.listener_id
+		WHERE
+			ag.name = ?
+		ORDER BY aglip.ip_address`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ipState ListenerIPState
+		err = rows.Scan(&ipState.IPAddress, &ipState.IPSubnetMask, &ipState.IsDHCP, &ipState.StateDesc)
+		if err != nil {
+			return
+		}
+
+		ipStates = append(ipStates, ipState)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetLocalEstimatedDataLoss
+//
+// Description:
+//    Estimates how much data would be lost if the local replica of the given Availability Group were forced to fail over,
+//    from the state of its own database replicas. Unlike `GetEstimatedDataLoss()`, this works on a secondary replica
+//    that is disconnected from the primary replica, which is when a forced failover is needed.
+//
+//    The estimate of each database is the time since the local replica last received log for it or redid a commit of it.
+//    The primary replica may have committed transactions since then that the local replica doesn't have,
+//    so this is an upper bound of the data loss.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to the SQL Server instance hosting the local replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    The largest estimated data loss of any database. ok is false if no database has received log or redone a commit.
+//
+func GetLocalEstimatedDataLoss(ctx context.Context, db *sql.DB, agName string) (estimatedDataLoss time.Duration, ok bool, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT drs.last_received_time, drs.last_redone_time, drs.last_commit_time, GETDATE()
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.dm_hadr_database_replica_states drs ON drs.group_id = ag.group_id AND drs.is_local = 1
+		WHERE
+			ag.name = ?`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var logTimes []localDatabaseLogTimes
+	var now time.Time
+
+	for rows.Next() {
+		var databaseLogTimes localDatabaseLogTimes
+		err = rows.Scan(&databaseLogTimes.lastReceivedTime, &databaseLogTimes.lastRedoneTime, &databaseLogTimes.lastCommitTime, &now)
+		if err != nil {
+			return
+		}
+
+		logTimes = append(logTimes, databaseLogTimes)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	estimatedDataLoss, ok = estimateLocalDataLoss(logTimes, now)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetNumSyncCommitReplicas
+//
+// Description:
+//    Gets the number of SYNCHRONOUS_COMMIT replicas in the given Availability Group.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+func GetNumSyncCommitReplicas(ctx context.Context, db *sql.DB, agName string) (numReplicas uint, err error) {
+	err = queryRowWithRetry(ctx, db, `
+		SELECT COUNT(*)
+		FROM
+			sys.availability_replicas ar
+			INNER JOIN sys.availability_groups ag ON ar.group_id = ag.group_id
+		WHERE ag.name = ? AND ar.availability_mode = ?`, agName, AmSYNCHRONOUS_COMMIT).Scan(&numReplicas)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetNumUnjoinedDatabases
+//
+// Description:
+//    Gets the number of databases of the given Availability Group that have not been joined on the local replica,
+//    such as databases that are still waiting to be seeded to it.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+func GetNumUnjoinedDatabases(ctx context.Context, db *sql.DB, agName string) (numDatabases uint, err error) {
+	err = queryRowWithRetry(ctx, db, `
+		SELECT COUNT(*)
+		FROM
+			sys.availability_databases_cluster adc
+			INNER JOIN sys.availability_groups ag ON adc.group_id = ag.group_id
+		WHERE
+			ag.name = ?
+			AND NOT EXISTS (
+				SELECT 1
+				FROM sys.dm_hadr_database_replica_states drs
+				WHERE drs.group_database_id = adc.group_database_id AND drs.is_local = 1
+			)`, agName).Scan(&numDatabases)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetOperationalState
+//
+// Description:
+//    Gets the operational state of the local replica of the given Availability Group.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    The numeric value and name of the operational state, or an error if the AG was not found.
+//
+func GetOperationalState(ctx context.Context, db *sql.DB, agName string) (operationalState OperationalState, operationalStateDesc string, err error) {
+	err = queryRowWithRetry(ctx, db, `
+		SELECT ars.operational_state, ars.operational_state_desc
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.dm_hadr_availability_replica_states ars ON ars.group_id = ag.group_id AND ars.is_local = 1
+		WHERE
+			ag.name = ?`, agName).Scan(&operationalState, &operationalStateDesc)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetPrimaryConnectionErrorDetail
+//
+// Description:
+//    Gets whether the local replica of the given Availability Group is connected to the primary replica,
+//    and if it is not, a description of why.
+//
+//    On a secondary replica, sys.dm_hadr_availability_replica_states only has the row of the local replica,
+//    whose connected state is its connection to the primary replica.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a secondary replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    The name of the primary replica that the local replica knows of, or empty if it doesn't know of any.
+//    Whether the local replica is connected to the primary replica. If it's not, the detail contains
+//    the connected state and the last connection error, if any.
+//
+func GetPrimaryConnectionErrorDetail(ctx context.Context, db *sql.DB, agName string) (primaryReplicaName string, connected bool, detail string, err error) {
+	return getPrimaryConnectionErrorDetail(ctx, db, groupIDByName, agName)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetPrimaryConnectionErrorDetailByGroupID
+//
+// Description:
+//    Gets the connection of the local replica to the primary replica like `GetPrimaryConnectionErrorDetail()`,
+//    but for the Availability Group with the given group_id.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a secondary replica of the AG.
+//    groupID: The group_id of the AG, as returned by `ResolveGroupIDAndRole()`.
+//
+func GetPrimaryConnectionErrorDetailByGroupID(ctx context.Context, db *sql.DB, groupID string) (primaryReplicaName string, connected bool, detail string, err error) {
+	return getPrimaryConnectionErrorDetail(ctx, db, groupIDByGroupID, groupID)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetPrimaryReplicaName
+//
+// Description:
+//    Gets the name of the primary replica of the given Availability Group.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+func GetPrimaryReplicaName(ctx context.Context, db *sql.DB, agName string) (primaryReplicaName string, err error) {
+	err = queryRowWithRetry(ctx, db, `
+		SELECT ags.primary_replica
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.dm_hadr_availability_group_states ags ON ags.group_id = ag.group_id
+		WHERE
+			ag.name = ?`, agName).Scan(&primaryReplicaName)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetReadOnlyRoutingList
+//
+// Description:
+//    Gets the read-only routing list of every replica of the given Availability Group.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    A map of replica name to the replicas that read-intent connections are routed to while that replica is in PRIMARY role,
+//    in order of routing priority. Replicas without a read-only routing list are not in the map.
+//
+func GetReadOnlyRoutingList(ctx context.Context, db *sql.DB, agName string) (routingList map[string][]ReadOnlyRoute, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT
+			ar.replica_server_name,
+			roar.replica_server_name,
+			COALESCE(roar.read_only_routing_url, ''),
+			roar.secondary_role_allow_connections_desc
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.availability_replicas ar ON ar.group_id = ag.group_id
+			INNER JOIN sys.availability_read_only_routing_lists rorl ON rorl.replica_id = ar.replica_id
+			INNER JOIN sys.availability_replicas roar ON roar.replica_id = rorl.read_only_replica_id
+		WHERE
+			ag.name = ?
+		ORDER BY ar.replica_server_name, rorl.routing_priority`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	routingList = make(map[string][]ReadOnlyRoute)
+
+	for rows.Next() {
+		var replicaName string
+		var route ReadOnlyRoute
+		err = rows.Scan(&replicaName, &route.ReplicaName, &route.RoutingURL, &route.SecondaryRoleAllowConnectionsDesc)
+		if err != nil {
+			return
+		}
+
+		routingList[replicaName] = append(routingList[replicaName], route)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetRedoLag
+//
+// Description:
+//    Gets the redo lag of every database of the given Availability Group on the local replica.
+//
+//    The redo lag of a database is the difference between the time of the last commit record received for the database
+//    and the time of the last log record that was redone for the database. It is only meaningful on a secondary replica.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    A map of database name to redo lag. Databases with unknown times are omitted.
+//
+func GetRedoLag(ctx context.Context, db *sql.DB, agName string) (redoLag map[string]time.Duration, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT d.name, drs.last_redone_time, drs.last_commit_time
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.dm_hadr_database_replica_states drs ON drs.group_id = ag.group_id AND drs.is_local = 1
+			INNER JOIN sys.databases d ON d.database_id = drs.database_id
+		WHERE
+			ag.name = ?`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	redoLag = make(map[string]time.Duration)
+
+	for rows.Next() {
+		var databaseName string
+		var lastRedoneTime, lastCommitTime sql.NullTime
+		err = rows.Scan(&databaseName, &lastRedoneTime, &lastCommitTime)
+		if err != nil {
+			return
+		}
+
+		if !lastRedoneTime.Valid || !lastCommitTime.Valid {
+			continue
+		}
+
+		lag := lastCommitTime.Time.Sub(lastRedoneTime.Time)
+		if lag < 0 {
+			// The last redone log record is newer than the last commit record, so redo is caught up.
+			lag = 0
+		}
+
+		redoLag[databaseName] = lag
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetReplicaCounts
+//
+// Description:
+//    Gets the number of replicas of each availability mode in the given Availability Group.
+//
+//    Unlike `GetNumSyncCommitReplicas()`, this counts configuration-only replicas separately
+//    so that callers can reason about the exact topology of the AG.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    The number of SYNCHRONOUS_COMMIT, ASYNCHRONOUS_COMMIT and CONFIGURATION_ONLY replicas respectively.
+//
+func GetReplicaCounts(ctx context.Context, db *sql.DB, agName string) (numSyncCommitReplicas uint, numAsyncCommitReplicas uint, numConfigurationOnlyReplicas uint, err error) {
+	err = queryRowWithRetry(ctx, db, `
+		SELECT
+			COUNT(CASE WHEN ar.availability_mode = ? THEN 1 END),
+			COUNT(CASE WHEN ar.availability_mode = ? THEN 1 END),
+			COUNT(CASE WHEN ar.availability_mode = ? THEN 1 END)
+		FROM
+			sys.availability_replicas ar
+			INNER JOIN sys.availability_groups ag ON ar.group_id = ag.group_id
+		WHERE ag.name = ?`,
+		AmSYNCHRONOUS_COMMIT, AmASYNCHRONOUS_COMMIT, AmCONFIGURATION_ONLY, agName,
+	).Scan(&numSyncCommitReplicas, &numAsyncCommitReplicas, &numConfigurationOnlyReplicas)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetReplicaCreateDates
+//
+// Description:
+//    Gets when every replica of the given Availability Group was created.
+//    A replica that was created recently may have been re-added to the AG and still be seeding its databases.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    A map of replica name to create date.
+//
+func GetReplicaCreateDates(ctx context.Context, db *sql.DB, agName string) (createDates map[string]ReplicaCreateDate, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT ar.replica_server_name, ar.create_date, DATEDIFF(SECOND, ar.create_date, GETDATE())
+		FROM
+			sys.availability_replicas ar
+			INNER JOIN sys.availability_groups ag ON ar.group_id = ag.group_id
+		WHERE
+			ag.name = ?`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	createDates = make(map[string]ReplicaCreateDate)
+
+	for rows.Next() {
+		var replicaName string
+		var createDate time.Time
+		var ageSeconds int64
+		err = rows.Scan(&replicaName, &createDate, &ageSeconds)
+		if err != nil {
+			return
+		}
+
+		createDates[replicaName] = ReplicaCreateDate{CreateDate: createDate, Age: time.Duration(ageSeconds) * time.Second}
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetReplicaEndpointURLs
+//
+// Description:
+//    Gets the database mirroring endpoint URL of every replica of the given Availability Group.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    A map of replica name to endpoint URL. Replicas without an endpoint URL are mapped to an empty string.
+//
+func GetReplicaEndpointURLs(ctx context.Context, db *sql.DB, agName string) (endpointURLs map[string]string, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT ar.replica_server_name, ar.endpoint_url
+		FROM
+			sys.availability_replicas ar
+			INNER JOIN sys.availability_groups ag ON ar.group_id = ag.group_id
+		WHERE
+			ag.name = ?`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	endpointURLs = make(map[string]string)
+
+	for rows.Next() {
+		var replicaName string
+		var endpointURL sql.NullString
+		err = rows.Scan(&replicaName, &endpointURL)
+		if err != nil {
+			return
+		}
+
+		endpointURLs[replicaName] = endpointURL.String
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetReplicaFailoverModes
+//
+// Description:
+//    Gets the failover mode of every replica of the given Availability Group.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    A map of replica name to failover mode description, like AUTOMATIC, MANUAL or EXTERNAL.
+//
+func GetReplicaFailoverModes(ctx context.Context, db *sql.DB, agName string) (failoverModes map[string]string, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT ar.replica_server_name, ar.failover_mode_desc
+		FROM
+			sys.availability_replicas ar
+			INNER JOIN sys.availability_groups ag ON ar.group_id = ag.group_id
+		WHERE
+			ag.name = ?`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	failoverModes = make(map[string]string)
+
+	for rows.Next() {
+		var replicaName string
+		var failoverModeDesc string
+		err = rows.Scan(&replicaName, &failoverModeDesc)
+		if err != nil {
+			return
+		}
+
+		failoverModes[replicaName] = failoverModeDesc
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetReplicaLastConnectErrors
+//
+// Description:
+//    Gets the last connection error of every replica of the given Availability Group that is known to the local replica.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    A map of replica name to a description of its connected state and last connection error.
+//    Replicas that have not had a connection error are omitted.
+//
+func GetReplicaLastConnectErrors(ctx context.Context, db *sql.DB, agName string) (lastConnectErrors map[string]string, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT ar.replica_server_name, ars.connected_state_desc, ars.last_connect_error_number, ars.last_connect_error_description, ars.last_connect_error_timestamp
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.availability_replicas ar ON ar.group_id = ag.group_id
+			INNER JOIN sys.dm_hadr_availability_replica_states ars ON ars.replica_id = ar.replica_id
+		WHERE
+			ag.name = ?`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	lastConnectErrors = make(map[string]string)
+
+	for rows.Next() {
+		var replicaName string
+		var connectedStateDesc sql.NullString
+		var lastConnectErrorNumber sql.NullInt64
+		var lastConnectErrorDescription sql.NullString
+		var lastConnectErrorTimestamp sql.NullTime
+		err = rows.Scan(
+			&replicaName, &connectedStateDesc,
+			&lastConnectErrorNumber, &lastConnectErrorDescription, &lastConnectErrorTimestamp)
+		if err != nil {
+			return
+		}
+
+		if !lastConnectErrorNumber.Valid {
+			continue
+		}
+
+		detail := fmt.Sprintf("last connection error %d: %s", lastConnectErrorNumber.Int64, lastConnectErrorDescription.String)
+
+		if lastConnectErrorTimestamp.Valid {
+			detail += fmt.Sprintf(" at %s", lastConnectErrorTimestamp.Time.Format(time.RFC3339))
+		}
+
+		if connectedStateDesc.Valid {
+			detail = connectedStateDesc.String + "; " + detail
+		}
+
+		lastConnectErrors[replicaName] = detail
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetReplicaList
+//
+// Description:
+//    Gets the names of all replicas of the given Availability Group.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+func GetReplicaList(ctx context.Context, db *sql.DB, agName string) (replicaNames []string, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT ar.replica_server_name
+		FROM
+			sys.availability_replicas ar
+			INNER JOIN sys.availability_groups ag ON ar.group_id = ag.group_id
+		WHERE
+			ag.name = ?
+		ORDER BY ar.replica_server_name`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var replicaName string
+		err = rows.Scan(&replicaName)
+		if err != nil {
+			return
+		}
+
+		replicaNames = append(replicaNames, replicaName)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetReplicaRole
+//
+// Description:
+//    Gets the role of the given replica of the given Availability Group.
+//
+//    The roles of remote replicas are only known when querying the PRIMARY replica.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//    replicaName: The name of the replica.
+//
+// Returns:
+//    The numeric value and name of the role, or an error if the replica was not found or its role is not known.
+//
+func GetReplicaRole(ctx context.Context, db *sql.DB, agName string, replicaName string) (role Role, roleDesc string, err error) {
+	var rawRole sql.NullInt64
+	var rawRoleDesc sql.NullString
+	err = queryRowWithRetry(ctx, db, `
+		SELECT ars.role, ars.role_desc
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.availability_replicas ar ON ar.group_id = ag.group_id
+			INNER JOIN sys.dm_hadr_availability_replica_states ars ON ars.replica_id = ar.replica_id
+		WHERE
+			ag.name = ? AND ar.replica_server_name = ?`, agName, replicaName).Scan(&rawRole, &rawRoleDesc)
+	if err != nil {
+		return
+	}
+
+	if !rawRole.Valid {
+		err = fmt.Errorf("role of replica %s is not known on this instance", replicaName)
+		return
+	}
+
+	role = Role(rawRole.Int64)
+	if rawRoleDesc.Valid {
+		roleDesc = rawRoleDesc.String
+	} else {
+		roleDesc = role.Desc()
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetReplicaSecondaryRoleAllowConnections
+//
+// Description:
+//    Gets which connections every replica of the given Availability Group allows while it's in SECONDARY role.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    A map of replica name to secondary_role_allow_connections_desc, one of NO, READ_ONLY or ALL.
+//
+func GetReplicaSecondaryRoleAllowConnections(ctx context.Context, db *sql.DB, agName string) (allowConnections map[string]string, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT ar.replica_server_name, ar.secondary_role_allow_connections_desc
+		FROM
+			sys.availability_replicas ar
+			INNER JOIN sys.availability_groups ag ON ar.group_id = ag.group_id
+		WHERE
+			ag.name = ?`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	allowConnections = make(map[string]string)
+
+	for rows.Next() {
+		var replicaName string
+		var allowConnectionsDesc string
+		err = rows.Scan(&replicaName, &allowConnectionsDesc)
+		if err != nil {
+			return
+		}
+
+		allowConnections[replicaName] = allowConnectionsDesc
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetReplicaSeedingModes
+//
+// Description:
+//    Gets the seeding mode of every replica of the given Availability Group.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    A map of replica name to seeding mode.
+//
+func GetReplicaSeedingModes(ctx context.Context, db *sql.DB, agName string) (seedingModes map[string]SeedingMode, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT ar.replica_server_name, ar.seeding_mode
+		FROM
+			sys.availability_replicas ar
+			INNER JOIN sys.availability_groups ag ON ar.group_id = ag.group_id
+		WHERE
+			ag.name = ?`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	seedingModes = make(map[string]SeedingMode)
+
+	for rows.Next() {
+		var replicaName string
+		var seedingMode SeedingMode
+		err = rows.Scan(&replicaName, &seedingMode)
+		if err != nil {
+			return
+		}
+
+		seedingModes[replicaName] = seedingMode
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetReplicaSessionTimeouts
+//
+// Description:
+//    Gets the session timeout of every replica of the given Availability Group.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    A map of replica name to session timeout.
+//
+func GetReplicaSessionTimeouts(ctx context.Context, db *sql.DB, agName string) (sessionTimeouts map[string]time.Duration, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT ar.replica_server_name, ar.session_timeout
+		FROM
+			sys.availability_replicas ar
+			INNER JOIN sys.availability_groups ag ON ar.group_id = ag.group_id
+		WHERE
+			ag.name = ?`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	sessionTimeouts = make(map[string]time.Duration)
+
+	for rows.Next() {
+		var replicaName string
+		var sessionTimeoutSeconds int32
+		err = rows.Scan(&replicaName, &sessionTimeoutSeconds)
+		if err != nil {
+			return
+		}
+
+		sessionTimeouts[replicaName] = time.Duration(sessionTimeoutSeconds) * time.Second
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetRequiredSynchronizedSecondariesToCommit
+//
+// Description:
+//    Gets the value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT of the given Availability Group.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+func GetRequiredSynchronizedSecondariesToCommit(ctx context.Context, db *sql.DB, agName string) (value int32, err error) {
+	err = queryRowWithRetry(ctx, db, `
+		SELECT required_synchronized_secondaries_to_commit
+		FROM sys.availability_groups
+		WHERE name = ?`, agName).Scan(&value)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetRole
+//
+// Description:
+//    Gets the role of the given Availability Group.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    The numeric value and name of the role, or an error if the AG was not found.
+//    If the DMV doesn't have the name of the role, the canonical name from `Role.Desc()` is returned.
+//
+func GetRole(ctx context.Context, db *sql.DB, agName string) (role Role, roleDesc string, err error) {
+	_, role, roleDesc, err = ResolveGroupIDAndRole(ctx, db, agName)
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetRoleStrict
+//
+// Description:
+//    Gets the role of the given Availability Group like `GetRole()`, but fails if there is more than one local replica row
+//    instead of using the first one, so that corrupted metadata is reported rather than hidden.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    sql.ErrNoRows if the AG was not found.
+//
+func GetRoleStrict(ctx context.Context, db *sql.DB, agName string) (role Role, roleDesc string, err error) {
+	return getRoleStrict(ctx, db, groupIDByName, agName)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetRoleStrictByGroupID
+//
+// Description:
+//    Gets the role of the local replica like `GetRoleStrict()`, but for the Availability Group with the given group_id.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    groupID: The group_id of the AG, as returned by `ResolveGroupIDAndRole()`.
+//
+// Returns:
+//    sql.ErrNoRows if the AG was not found.
+//
+func GetRoleStrictByGroupID(ctx context.Context, db *sql.DB, groupID string) (role Role, roleDesc string, err error) {
+	return getRoleStrict(ctx, db, groupIDByGroupID, groupID)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetSeedingMode
+//
+// Description:
+//    Gets the seeding mode of the current replica of the given Availability Group
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    The numeric value and string name of the seeding mode, or an error if the AG was not found.
+//
+func GetSeedingMode(ctx context.Context, db *sql.DB, agName string) (seedingMode SeedingMode, seedingModeDesc string, err error) {
+	err = queryRowWithRetry(ctx, db, `
+		SELECT ar.seeding_mode, ar.seeding_mode_desc
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.dm_hadr_availability_replica_states ars ON ars.group_id = ag.group_id AND ars.is_local = 1
+			INNER JOIN sys.availability_replicas ar ON ar.replica_id = ars.replica_id
+		WHERE
+			ag.name = ?`, agName).Scan(&seedingMode, &seedingModeDesc)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetSequenceNumber
+//
+// Description:
+//    Gets the sequence number of the current replica of the given Availability Group
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    The sequence number, which is 0 if it is NULL.
+//
+func GetSequenceNumber(ctx context.Context, db *sql.DB, agName string) (sequenceNumber int64, err error) {
+	var rawSequenceNumber sql.NullInt64
+	err = queryRowWithRetry(ctx, db, `
+		SELECT ag.sequence_number
+		FROM
+			sys.availability_groups ag
+		WHERE
+			ag.name = ?`, agName).Scan(&rawSequenceNumber)
+	if err != nil {
+		return
+	}
+
+	sequenceNumber = rawSequenceNumber.Int64
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetSequenceNumberWithRetry
+//
+// Description:
+//    Gets the sequence number of the current replica of the given Availability Group, like `GetSequenceNumber()`.
+//
+//    The sequence number can be NULL or 0 while the AG configuration is changing, so this retries while it is
+//    until the given number of attempts have been made.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//    attempts: The maximum number of times to query the sequence number. 0 is treated as 1.
+//    interval: The time to wait between attempts.
+//
+// Returns:
+//    The sequence number, which is 0 if it was still NULL or 0 after the last attempt.
+//
+func GetSequenceNumberWithRetry(ctx context.Context, db *sql.DB, agName string, attempts uint, interval time.Duration) (sequenceNumber int64, err error) {
+	for attempt := uint(1); ; attempt++ {
+		sequenceNumber, err = GetSequenceNumber(ctx, db, agName)
+		if err != nil {
+			return
+		}
+
+		if sequenceNumber != 0 || attempt >= attempts {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+
+		case <-time.After(interval):
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetSyncProgressSummary
+//
+// Description:
+//    Gets a summary of the synchronization progress of the databases of the given Availability Group in a single query.
+//
+//    On the primary replica this covers the databases of every replica, and on a secondary replica only its own databases.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+func GetSyncProgressSummary(ctx context.Context, db *sql.DB, agName string) (summary SyncProgressSummary, err error) {
+	return getSyncProgressSummary(ctx, db, groupIDByName, agName)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetSyncProgressSummaryByGroupID
+//
+// Description:
+//    Gets the synchronization progress of the databases of an Availability Group like `GetSyncProgressSummary()`, but by its group_id.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    groupID: The group_id of the AG, as returned by `ResolveGroupIDAndRole()`.
+//
+func GetSyncProgressSummaryByGroupID(ctx context.Context, db *sql.DB, groupID string) (summary SyncProgressSummary, err error) {
+	return getSyncProgressSummary(ctx, db, groupIDByGroupID, groupID)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GrantCreateAnyDatabase
+//
+// Description:
+//    Grants the given Availability Group's replica the permission to create any databases in the AG that aren't present.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+func GrantCreateAnyDatabase(ctx context.Context, db *sql.DB, agName string) (err error) {
+	_, err = db.ExecContext(ctx, fmt.Sprintf("ALTER AVAILABILITY GROUP %s GRANT CREATE ANY DATABASE", QuoteName(agName)))
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: IsContained
+//
+// Description:
+//    Gets whether the given Availability Group is a contained AG, which has its own contained master and msdb databases.
+//    Contained AGs were introduced in SQL Server 2022, so this is always false on earlier versions.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+func IsContained(ctx context.Context, db *sql.DB, agName string) (contained bool, err error) {
+	return isContained(ctx, db, groupIDByName, agName)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: IsContainedByGroupID
+//
+// Description:
+//    Gets whether an Availability Group is a contained AG like `IsContained()`, but by its group_id.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    groupID: The group_id of the AG, as returned by `ResolveGroupIDAndRole()`.
+//
+func IsContainedByGroupID(ctx context.Context, db *sql.DB, groupID string) (contained bool, err error) {
+	return isContained(ctx, db, groupIDByGroupID, groupID)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: IsHadrEnabled
+//
+// Description:
+//    Gets whether the Always On Availability Groups feature is enabled on the instance.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance.
+//
+func IsHadrEnabled(ctx context.Context, db *sql.DB) (hadrEnabled bool, err error) {
+	var isHadrEnabled sql.NullInt64
+	err = queryRowWithRetry(ctx, db, `SELECT CAST(SERVERPROPERTY('IsHadrEnabled') AS INT)`).Scan(&isHadrEnabled)
+	if err != nil {
+		return
+	}
+
+	hadrEnabled = isHadrEnabled.Valid && isHadrEnabled.Int64 == 1
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: IsPrimary
+//
+// Description:
+//    Gets whether the local replica of the given Availability Group is in PRIMARY role.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    `nil` if the local replica is in PRIMARY role, a `NotPrimaryError` if it is in some other role,
+//    or the error encountered while querying the role.
+//
+func IsPrimary(ctx context.Context, db *sql.DB, agName string) error {
+	role, roleDesc, err := GetRole(ctx, db, agName)
+	if err != nil {
+		return err
+	}
+
+	if role != RolePRIMARY {
+		return &NotPrimaryError{AGName: agName, Role: role, RoleDesc: roleDesc}
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------
+// Function: ListAGDatabases
+//
+// Description:
+//    Gets the names of all databases of the given Availability Group, as known to the WSFC or external cluster.
+//
+//    This includes databases that have not been joined on the local replica yet,
+//    so it can be used to know which databases to expect when joining a new replica.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+func ListAGDatabases(ctx context.Context, db *sql.DB, agName string) (databaseNames []string, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT adc.database_name
+		FROM
+			sys.availability_databases_cluster adc
+			INNER JOIN sys.availability_groups ag ON adc.group_id = ag.group_id
+		WHERE
+			ag.name = ?
+		ORDER BY adc.database_name`, agName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var databaseName string
+		err = rows.Scan(&databaseName)
+		if err != nil {
+			return
+		}
+
+		databaseNames = append(databaseNames, databaseName)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: ListAvailabilityGroups
+//
+// Description:
+//    Gets the names of all Availability Groups that have a replica on the instance, along with the role of the local replica.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance.
+//
+func ListAvailabilityGroups(ctx context.Context, db *sql.DB) (availabilityGroups []AvailabilityGroupRole, err error) {
+	rows, err := queryWithRetry(ctx, db, `
+		SELECT ag.name, ars.role, ars.role_desc
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.dm_hadr_availability_replica_states ars ON ars.group_id = ag.group_id AND ars.is_local = 1
+		ORDER BY ag.name`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var availabilityGroup AvailabilityGroupRole
+		err = rows.Scan(&availabilityGroup.Name, &availabilityGroup.Role, &availabilityGroup.RoleDesc)
+		if err != nil {
+			return
+		}
+
+		availabilityGroups = append(availabilityGroups, availabilityGroup)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: ParseLastHardenedLSNLine
+//
+// Description:
+//    Parses one line of the last hardened LSNs of the replicas as stored in the cluster, like the lines printed by attrd_updater -QA.
+//    The line is parsed like `ParseProductVersionLine()`, and the value is parsed like `ParseLastHardenedLSNs()`.
+//
+// Returns:
+//    The host and the last hardened LSN of each database on the line. ok is false if the line does not contain a host and valid LSNs.
+//
+func ParseLastHardenedLSNLine(line string) (host string, lastHardenedLSNs map[string]*big.Int, ok bool) {
+	host, value := parseHostValueLine(line)
+	if host == "" || value == "" {
+		return "", nil, false
+	}
+
+	lastHardenedLSNs, ok = ParseLastHardenedLSNs(value)
+	if !ok {
+		return "", nil, false
+	}
+
+	return host, lastHardenedLSNs, true
+}
+
+// --------------------------------------------------------------------------------------
+// Function: ParseLastHardenedLSNs
+//
+// Description:
+//    Parses the last hardened LSN of each database as formatted by `FormatLastHardenedLSNs()`.
+//
+// Returns:
+//    A map of group database ID to last hardened LSN. ok is false if the value is not a valid list of LSNs.
+//
+func ParseLastHardenedLSNs(value string) (lastHardenedLSNs map[string]*big.Int, ok bool) {
+	lastHardenedLSNs = make(map[string]*big.Int)
+
+	for _, entry := range strings.Split(value, ",") {
+		separatorIndex := strings.LastIndex(entry, ":")
+		if separatorIndex <= 0 {
+			return nil, false
+		}
+
+		lastHardenedLSN, ok := new(big.Int).SetString(entry[separatorIndex+1:], 10)
+		if !ok || lastHardenedLSN.Sign() < 0 {
+			return nil, false
+		}
+
+		lastHardenedLSNs[strings.ToUpper(entry[:separatorIndex])] = lastHardenedLSN
+	}
+
+	return lastHardenedLSNs, true
+}
+
+// --------------------------------------------------------------------------------------
+// Function: ParseProductVersionLine
+//
+// Description:
+//    Parses one line of the product versions of the replicas as stored in the cluster, like the lines printed by attrd_updater -QA.
+//    Like the `SequenceNumberFormatAuto` format of `ParseSequenceNumberLine()`, the line may have any other attributes and quoting.
+//
+// Returns:
+//    The host and product version on the line. ok is false if the line does not contain a host and product version.
+//
+func ParseProductVersionLine(line string) (host string, productVersion string, ok bool) {
+	host, productVersion = parseHostValueLine(line)
+
+	if host == "" || productVersion == "" {
+		return "", "", false
+	}
+
+	return host, productVersion, true
+}
+
+// --------------------------------------------------------------------------------------
+// Function: ParseSequenceNumberLine
+//
+// Description:
+//    Parses one line of the sequence numbers of the replicas as stored in the cluster, like the lines printed by attrd_updater -QA.
+//
+// Params:
+//    line: The line to parse.
+//    format: One of `SequenceNumberFormatAuto` or `SequenceNumberFormatAttrd`.
+//
+// Returns:
+//    The host and sequence number on the line. ok is false if the line does not contain a host and sequence number.
+//    An error is only returned if the format is invalid or the sequence number is out of range.
+//
+func ParseSequenceNumberLine(line string, format string) (host string, sequenceNumber int64, ok bool, err error) {
+	var rawSequenceNumber string
+
+	switch format {
+	case SequenceNumberFormatAuto:
+		host, rawSequenceNumber = parseHostValueLine(line)
+
+	case SequenceNumberFormatAttrd:
+		// The attributes must be exactly the ones printed by attrd_updater -QA, in the same order and with the same quoting and spacing
+		attributes := parseAttributes(line)
+		if len(attributes) == 3 &&
+			attributes[0].key == "name" && attributes[0].value != "" && attributes[1].key == "host" && attributes[2].key == "value" &&
+			line == fmt.Sprintf(`name="%s" host="%s" value="%s"`, attributes[0].value, attributes[1].value, attributes[2].value) {
+
+			host = attributes[1].value
+			rawSequenceNumber = attributes[2].value
+		}
+
+	default:
+		err = fmt.Errorf("unknown sequence number format %s", format)
+		return
+	}
+
+	if host == "" || !sequenceNumberValueRegex.MatchString(rawSequenceNumber) {
+		return "", 0, false, nil
+	}
+
+	sequenceNumber, err = strconv.ParseInt(rawSequenceNumber, 10, 64)
+	if err != nil {
+		return
+	}
+
+	ok = true
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: QuoteName
+//
+// Description:
+//    Equivalent of QUOTENAME with quote_character = '['.
+//
+// Params:
+//    s: The string to be escaped and wrapped in [].
+//
+func QuoteName(s string) string {
+	return fmt.Sprintf("[%s]", strings.Replace(s, "]", "]]", -1))
+}
+
+// --------------------------------------------------------------------------------------
+// Function: ResolveGroupIDAndRole
+//
+// Description:
+//    Gets the group_id of the given Availability Group and the role of its local replica in a single query, so that a process
+//    that runs many queries about the AG can use the *ByGroupID variants of the getters instead of looking the AG up by name in every query.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    The group_id of the AG as a GUID string, and the role like `GetRole()`.
+//    sql.ErrNoRows if the AG or its local replica was not found.
+//
+func ResolveGroupIDAndRole(ctx context.Context, db *sql.DB, agName string) (groupID string, role Role, roleDesc string, err error) {
+	var rawRoleDesc sql.NullString
+	err = queryRowWithRetry(ctx, db, `
+		SELECT CAST(ag.group_id AS NVARCHAR(36)), ars.role, ars.role_desc
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.dm_hadr_availability_replica_states ars ON ars.group_id = ag.group_id AND ars.is_local = 1
+		WHERE
+			ag.name = ?`, agName).Scan(&groupID, &role, &rawRoleDesc)
+	if err != nil {
+		return
+	}
+
+	if rawRoleDesc.Valid {
+		roleDesc = rawRoleDesc.String
+	} else {
+		roleDesc = role.Desc()
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: SetRequiredSynchronizedSecondariesToCommit
+//
+// Description:
+//    Sets the value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT on the given Availability Group on the instance.
+//
+//    Only the primary replica can set it, so the role of the local replica is checked first. The role can change between the check
+//    and the ALTER AVAILABILITY GROUP statement. See `SetRequiredSynchronizedSecondariesToCommitIfPrimary()` to check it in the same batch.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//    newValue: The new REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT value.
+//
+// Returns:
+//    A `NotPrimaryError` if the local replica is not in PRIMARY role, in which case the value was not set.
+//
+func SetRequiredSynchronizedSecondariesToCommit(ctx context.Context, db *sql.DB, agName string, newValue int32) (err error) {
+	err = IsPrimary(ctx, db, agName)
+	if err != nil {
+		return
+	}
+
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`
+		DECLARE @num_ags INT;
+		SELECT @num_ags = COUNT(*) FROM sys.availability_groups WHERE name = ? AND required_synchronized_secondaries_to_commit = ?;
+		IF @num_ags = 0
+			ALTER AVAILABILITY GROUP %s SET (REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT = %d)
+		;
+	`, QuoteName(agName), newValue), agName, newValue)
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: SetRequiredSynchronizedSecondariesToCommitIfPrimary
+//
+// Description:
+//    Sets the value of REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT on the given Availability Group on the instance
+//    if the local replica is in PRIMARY role.
+//
+//    The role is checked in the same batch as the ALTER AVAILABILITY GROUP statement, so that callers don't need to check it
+//    beforehand in a separate query, after which the role could have changed.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//    newValue: The new REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT value.
+//
+// Returns:
+//    A `NotPrimaryError` if the local replica is not in PRIMARY role, in which case the value was not set,
+//    or sql.ErrNoRows if the instance has no replica of the AG.
+//
+func SetRequiredSynchronizedSecondariesToCommitIfPrimary(ctx context.Context, db *sql.DB, agName string, newValue int32) (err error) {
+	var role sql.NullInt64
+	var roleDesc sql.NullString
+	err = db.QueryRowContext(ctx, fmt.Sprintf(`
+		DECLARE @role TINYINT, @role_desc NVARCHAR(60);
+		SELECT @role = ars.role, @role_desc = ars.role_desc
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.dm_hadr_availability_replica_states ars ON ars.group_id = ag.group_id AND ars.is_local = 1
+		WHERE
+			ag.name = ?;
+		IF @role = %d AND NOT EXISTS (SELECT * FROM sys.availability_groups WHERE name = ? AND required_synchronized_secondaries_to_commit = ?)
+			ALTER AVAILABILITY GROUP %s SET (REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT = %d)
+		;
+		SELECT @role, @role_desc;
+	`, RolePRIMARY, QuoteName(agName), newValue), agName, agName, newValue).Scan(&role, &roleDesc)
+	if err != nil {
+		return
+	}
+
+	if !role.Valid {
+		err = sql.ErrNoRows
+		return
+	}
+
+	if Role(role.Int64) != RolePRIMARY {
+		notPrimaryError := &NotPrimaryError{AGName: agName, Role: Role(role.Int64), RoleDesc: roleDesc.String}
+		if !roleDesc.Valid {
+			notPrimaryError.RoleDesc = notPrimaryError.Role.Desc()
+		}
+
+		err = notPrimaryError
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: SetRoleToSecondary
+//
+// Description:
+//    Sets the role of the given Availability Group to SECONDARY.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+func SetRoleToSecondary(ctx context.Context, db *sql.DB, agName string) (err error) {
+	_, err = db.ExecContext(ctx, fmt.Sprintf("ALTER AVAILABILITY GROUP %s SET (ROLE = SECONDARY)", QuoteName(agName)))
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: ShouldBackupHere
+//
+// Description:
+//    Gets whether the local replica is the preferred backup replica of the given Availability Group,
+//    according to its automated backup preference and the backup priorities of its replicas.
+//
+//    sys.fn_hadr_backup_is_preferred_replica() is evaluated for a database of the AG,
+//    since the preference is the same for all databases of the AG.
+//
+// Params:
+//    ctx: Bounds the queries, which are cancelled when it is done.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//
+// Returns:
+//    Whether backups should be taken on the local replica. This is false if the AG has no databases.
+//
+func ShouldBackupHere(ctx context.Context, db *sql.DB, agName string) (shouldBackupHere bool, err error) {
+	err = queryRowWithRetry(ctx, db, `
+		SELECT TOP 1 sys.fn_hadr_backup_is_preferred_replica(adc.database_name)
+		FROM
+			sys.availability_groups ag
+			INNER JOIN sys.availability_databases_cluster adc ON adc.group_id = ag.group_id
+		WHERE
+			ag.name = ?
+		ORDER BY adc.database_name`, agName).Scan(&shouldBackupHere)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: WatchRole
+//
+// Description:
+//    Polls the role of the local replica of the given Availability Group and invokes the callback whenever it changes,
+//    until the context is cancelled or the role can't be queried.
+//
+//    The callback is also invoked with the initial role.
+//
+// Params:
+//    ctx: The context that stops the watch when cancelled.
+//    db: A connection to a SQL Server instance hosting a replica of the AG.
+//    agName: The name of the AG.
+//    interval: The time to wait between queries of the role.
+//    callback: Invoked with the new role whenever the role changes.
+//
+// Returns:
+//    The error of the context when it's cancelled, or the error from querying the role.
+//    sql.ErrNoRows if the AG was not found in sys.availability_groups.
+//
+func WatchRole(ctx context.Context, db *sql.DB, agName string, interval time.Duration, callback func(role Role, roleDesc string)) error {
+	var previousRole *Role
+
+	for {
+		role, roleDesc, err := GetRole(ctx, db, agName)
+		if err != nil {
+			return err
+		}
+
+		if previousRole == nil || *previousRole != role {
+			callback(role, roleDesc)
+			previousRole = &role
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-time.After(interval):
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------
+// Function: isRecoverableConnectionError
+//
+// Description:
+//    Determines whether the given error means that the connection used for a query was reset,
+//    such as by a failover, so that the query can be retried on a new connection.
+//
+//    driver.ErrBadConn is not included, since database/sql already retries a query on a new connection when the driver returns it.
+//    A timeout is not included either, since retrying a query against a hung instance would only double the time until it fails.
+//
+func isRecoverableConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, sql.ErrConnDone) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netError net.Error
+	if errors.As(err, &netError) {
+		return !netError.Timeout()
+	}
+
+	return false
+}
+
+// A row returned by `queryRowWithRetry()`
+type retryingRow struct {
+	ctx   context.Context
+	db    *sql.DB
+	query string
+	args  []interface{}
+}
+
+// --------------------------------------------------------------------------------------
+// Function: queryRowWithRetry
+//
+// Description:
+//    Equivalent of db.QueryRowContext, except that the query is retried once
+//    if it fails with a recoverable connection error. See `isRecoverableConnectionError()`.
+//
+func queryRowWithRetry(ctx context.Context, db *sql.DB, query string, args ...interface{}) *retryingRow {
+	return &retryingRow{ctx: ctx, db: db, query: query, args: args}
+}
+
+func (row *retryingRow) Scan(dest ...interface{}) error {
+	err := row.db.QueryRowContext(row.ctx, row.query, row.args...).Scan(dest...)
+	if isRecoverableConnectionError(err) {
+		err = row.db.QueryRowContext(row.ctx, row.query, row.args...).Scan(dest...)
+	}
+
+	return err
+}
+
+// --------------------------------------------------------------------------------------
+// Function: queryWithRetry
+//
+// Description:
+//    Equivalent of db.QueryContext, except that the query is retried once
+//    if it fails with a recoverable connection error. See `isRecoverableConnectionError()`.
+//    Errors while iterating over the rows are not retried.
+//
+func queryWithRetry(ctx context.Context, db *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if isRecoverableConnectionError(err) {
+		rows, err = db.QueryContext(ctx, query, args...)
+	}
+
+	return rows, err
+}
+
+// The state of a database, as queried by `GetDatabaseStates()`
+type databaseState struct {
+	name      string
+	state     byte
+	stateDesc string
+}
+
+// --------------------------------------------------------------------------------------
+// Function: summarizeDatabaseStates
+//
+// Description:
+//    Summarizes the given database states for `GetDatabaseStates()`, as the number of databases in each state,
+//    starting with the states with the most databases.
+//
+// Params:
+//    databaseStates: The states of the databases that are not ONLINE.
+//    ignoredDatabaseNames: The names of databases to leave out. Names are compared case-insensitively.
+//    maxStates: The maximum number of states to list individually. 0 means all states are listed.
+//
+func summarizeDatabaseStates(databaseStates []databaseState, ignoredDatabaseNames []string, maxStates uint) (result string) {
+	type stateCount struct {
+		state        byte
+		stateDesc    string
+		numDatabases int
+	}
+
+	var stateCounts []*stateCount
+	stateCountsByState := make(map[byte]*stateCount)
+
+databaseStates:
+	for _, databaseState := range databaseStates {
+		for _, ignoredDatabaseName := range ignoredDatabaseNames {
+			if strings.EqualFold(databaseState.name, ignoredDatabaseName) {
+				continue databaseStates
+			}
+		}
+
+		count, ok := stateCountsByState[databaseState.state]
+		if !ok {
+			count = &stateCount{state: databaseState.state, stateDesc: databaseState.stateDesc}
+			stateCountsByState[databaseState.state] = count
+			stateCounts = append(stateCounts, count)
+		}
+
+		count.numDatabases++
+	}
+
+	sort.Slice(stateCounts, func(i, j int) bool {
+		if stateCounts[i].numDatabases != stateCounts[j].numDatabases {
+			return stateCounts[i].numDatabases > stateCounts[j].numDatabases
+		}
+
+		return stateCounts[i].state < stateCounts[j].state
+	})
+
+	var numOtherStates, numOtherDatabases int
+
+	for i, count := range stateCounts {
+		if maxStates > 0 && uint(i) >= maxStates {
+			numOtherStates++
+			numOtherDatabases += count.numDatabases
+			continue
+		}
+
+		result += fmt.Sprintf("%d databases are %s, ", count.numDatabases, count.stateDesc)
+	}
+
+	result = strings.TrimSuffix(result, ", ")
+
+	if numOtherStates > 0 {
+		result += fmt.Sprintf(", and %d more databases are in %d other states", numOtherDatabases, numOtherStates)
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: estimateDataLoss
+//
+// Description:
+//    Estimates the data loss of each secondary replica for `GetEstimatedDataLoss()`.
+//
+// Params:
+//    commitTimes: The last commit times of the database replicas of the primary replica and the secondary replicas.
+//        Databases that the primary replica has no commit time for are ignored.
+//
+func estimateDataLoss(commitTimes []databaseCommitTime) map[string]time.Duration {
+	primaryCommitTimes := make(map[int]time.Time)
+	for _, commitTime := range commitTimes {
+		if commitTime.isPrimary {
+			primaryCommitTimes[commitTime.databaseID] = commitTime.lastCommitTime
+		}
+	}
+
+	result := make(map[string]time.Duration)
+	for _, commitTime := range commitTimes {
+		if commitTime.isPrimary {
+			continue
+		}
+
+		primaryCommitTime, ok := primaryCommitTimes[commitTime.databaseID]
+		if !ok {
+			continue
+		}
+
+		// The clocks of the replicas aren't compared, since the secondary replica's commit time is the time of the commit on the primary replica
+		dataLoss := primaryCommitTime.Sub(commitTime.lastCommitTime)
+		if dataLoss < 0 {
+			dataLoss = 0
+		}
+
+		if maxDataLoss, ok := result[commitTime.replicaName]; !ok || dataLoss > maxDataLoss {
+			result[commitTime.replicaName] = dataLoss
+		}
+	}
+
+	return result
+}
+
+// --------------------------------------------------------------------------------------
+// Function: estimateLocalDataLoss
+//
+// Description:
+//    Estimates the data loss of the local replica for `GetLocalEstimatedDataLoss()`.
+//
+// Params:
+//    logTimes: The times of the last log activity of the local database replicas.
+//        Databases without any log activity are ignored.
+//    now: The current time of the instance, which the times of the log activity are compared to.
+//
+func estimateLocalDataLoss(logTimes []localDatabaseLogTimes, now time.Time) (estimatedDataLoss time.Duration, ok bool) {
+	for _, databaseLogTimes := range logTimes {
+		var lastActivity time.Time
+		for _, activityTime := range []sql.NullTime{databaseLogTimes.lastReceivedTime, databaseLogTimes.lastRedoneTime, databaseLogTimes.lastCommitTime} {
+			if activityTime.Valid && activityTime.Time.After(lastActivity) {
+				lastActivity = activityTime.Time
+			}
+		}
+
+		if lastActivity.IsZero() {
+			continue
+		}
+
+		dataLoss := now.Sub(lastActivity)
+		if dataLoss < 0 {
+			dataLoss = 0
+		}
+
+		if !ok || dataLoss > estimatedDataLoss {
+			estimatedDataLoss = dataLoss
+			ok = true
+		}
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: leaseStateFromEvents
+//
+// Description:
+//    Determines the lease state for `GetLeaseState()`.
+//
+// Params:
+//    events: Failover-related events of the AG, most recent first.
+//
+func leaseStateFromEvents(events []FailoverEvent) (result LeaseState) {
+	var resolvingTime time.Time
+	for _, event := range events {
+		switch event.EventName {
+		case "availability_group_lease_expired":
+			if result.LastLeaseExpiry.IsZero() {
+				result.LastLeaseExpiry = event.Timestamp
+			}
+
+		case "availability_replica_state_change":
+			if resolvingTime.IsZero() && strings.HasPrefix(event.CurrentState, "RESOLVING") {
+				resolvingTime = event.Timestamp
+			}
+		}
+	}
+
+	if resolvingTime.IsZero() {
+		return
+	}
+
+	for _, event := range events {
+		if event.EventName != "availability_group_lease_expired" {
+			continue
+		}
+
+		difference := resolvingTime.Sub(event.Timestamp)
+		if difference < 0 {
+			difference = -difference
+		}
+
+		if difference <= leaseExpiryResolvingWindow {
+			result.ResolvingDueToLeaseExpiry = true
+			break
+		}
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: parseHostValueLine
+//
+// Description:
+//    Gets the host and value attributes of a line of key=value attributes, like the lines printed by attrd_updater -QA.
+//
+// Returns:
+//    The host and value, or empty strings for the attributes that the line does not have.
+//
+func parseHostValueLine(line string) (host string, value string) {
+	for _, attribute := range parseAttributes(line) {
+		switch attribute.key {
+		case "host":
+			host = attribute.value
+		case "value":
+			value = attribute.value
+		}
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: parseAttributes
+//
+// Description:
+//    Splits a line of key=value attributes, like the lines printed by attrd_updater -QA, into its attributes in the order they appear.
+//    Values may be double-quoted, single-quoted or unquoted. Anything on the line that is not an attribute is skipped.
+//
+func parseAttributes(line string) (attributes []attrdAttribute) {
+	for _, match := range attrdAttributeRegex.FindAllStringSubmatch(line, -1) {
+		// Only one of the double-quoted, single-quoted and unquoted groups matched
+		attributes = append(attributes, attrdAttribute{key: match[1], value: match[2] + match[3] + match[4]})
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: lastStateChangeFromEvents
+//
+// Description:
+//    Gets the most recent availability_replica_state_change event of the given events, which are ordered most recent first.
+//
+func lastStateChangeFromEvents(events []FailoverEvent) (event FailoverEvent, ok bool) {
+	for _, event := range events {
+		if event.EventName == "availability_replica_state_change" {
+			return event, true
+		}
+	}
+
+	return FailoverEvent{}, false
+}
+
+// --------------------------------------------------------------------------------------
+// Function: describePrimaryConnection
+//
+// Description:
+//    Implements the interpretation of the row queried by `GetPrimaryConnectionErrorDetail()`.
+//    The local replica is only connected if it knows of a primary replica and its connected state is CONNECTED.
+//
+func describePrimaryConnection(state primaryConnectionState) (connected bool, detail string) {
+	if !state.PrimaryReplica.Valid || state.PrimaryReplica.String == "" {
+		detail = "no primary replica is known"
+	} else {
+		connected = state.ConnectedState.Valid && state.ConnectedState.Int64 == 1
+		if connected {
+			return
+		}
+
+		if state.ConnectedStateDesc.Valid {
+			detail = state.ConnectedStateDesc.String
+		} else {
+			detail = "connected state is unknown"
+		}
+	}
+
+	if state.LastConnectErrorNumber.Valid {
+		detail += fmt.Sprintf("; last connection error %d: %s", state.LastConnectErrorNumber.Int64, state.LastConnectErrorDescription.String)
+
+		if state.LastConnectErrorTimestamp.Valid {
+			detail += fmt.Sprintf(" at %s", state.LastConnectErrorTimestamp.Time.Format(time.RFC3339))
+		}
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: getClusterType
+//
+// Description:
+//    Gets the cluster type of the Availability Group selected by `groupIDExpression`, one of `groupIDByName` or `groupIDByGroupID`.
+//
+func getClusterType(ctx context.Context, db *sql.DB, groupIDExpression string, arg string) (clusterTypeDesc string, err error) {
+	err = queryRowWithRetry(ctx, db, fmt.Sprintf(`
+		SELECT ag.cluster_type_desc
+		FROM
+			sys.availability_groups ag
+		WHERE
+			ag.group_id = %s`, groupIDExpression), arg).Scan(&clusterTypeDesc)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: getDatabaseStates
+//
+// Description:
+//    Gets the databases that are not ONLINE of the Availability Group selected by `groupIDExpression`,
+//    one of `groupIDByName` or `groupIDByGroupID`.
+//
+func getDatabaseStates(
+	ctx context.Context, db *sql.DB, groupIDExpression string, arg string,
+	excludeContainedSystemDatabases bool, ignoredDatabaseNames []string,
+	maxStates uint) (result string, err error) {
+
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(`
+		SELECT d.name, d.state, d.state_desc FROM
+			sys.availability_groups ag
+			INNER JOIN sys.dm_hadr_database_replica_states drs ON drs.group_id = ag.group_id AND drs.is_local = 1
+			INNER JOIN sys.databases d on d.database_id = drs.database_id
+		WHERE
+			ag.group_id = %s AND d.state <> 0
+			AND (? = 0 OR d.name NOT IN (ag.name + N'_master', ag.name + N'_msdb'))`, groupIDExpression))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, arg, excludeContainedSystemDatabases)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var databaseStates []databaseState
+
+	for rows.Next() {
+		var databaseState databaseState
+		err = rows.Scan(&databaseState.name, &databaseState.state, &databaseState.stateDesc)
+		if err != nil {
+			return
+		}
+
+		databaseStates = append(databaseStates, databaseState)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	result = summarizeDatabaseStates(databaseStates, ignoredDatabaseNames, maxStates)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: getDBFailoverMode
+//
+// Description:
+//    Gets the DB_FAILOVER setting of the Availability Group selected by `groupIDExpression`, one of `groupIDByName` or `groupIDByGroupID`.
+//
+func getDBFailoverMode(ctx context.Context, db *sql.DB, groupIDExpression string, arg string) (dbFailoverMode bool, err error) {
+	err = queryRowWithRetry(ctx, db, fmt.Sprintf(`
+		SELECT ag.db_failover
+		FROM
+			sys.availability_groups ag
+		WHERE
+			ag.group_id = %s`, groupIDExpression), arg).Scan(&dbFailoverMode)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: getGroupHealth
+//
+// Description:
+//    Gets the health rollup of the Availability Group selected by `groupIDExpression`, one of `groupIDByName` or `groupIDByGroupID`.
+//
+func getGroupHealth(ctx context.Context, db *sql.DB, groupIDExpression string, arg string) (synchronizationHealthDesc string, primaryRecoveryHealthDesc string, err error) {
+	var rawSynchronizationHealthDesc, rawPrimaryRecoveryHealthDesc sql.NullString
+	err = queryRowWithRetry(ctx, db, fmt.Sprintf(`
+		SELECT ags.synchronization_health_desc, ags.primary_recovery_health_desc
+		FROM
+			sys.dm_hadr_availability_group_states ags
+		WHERE
+			ags.group_id = %s`, groupIDExpression), arg).Scan(&rawSynchronizationHealthDesc, &rawPrimaryRecoveryHealthDesc)
+	if err != nil {
+		return
+	}
+
+	synchronizationHealthDesc = rawSynchronizationHealthDesc.String
+	primaryRecoveryHealthDesc = rawPrimaryRecoveryHealthDesc.String
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: getPrimaryConnectionErrorDetail
+//
+// Description:
+//    Gets the connection of the local replica to the primary replica of the Availability Group selected by `groupIDExpression`,
+//    one of `groupIDByName` or `groupIDByGroupID`.
+//
+func getPrimaryConnectionErrorDetail(ctx context.Context, db *sql.DB, groupIDExpression string, arg string) (primaryReplicaName string, connected bool, detail string, err error) {
+	var state primaryConnectionState
+	err = queryRowWithRetry(ctx, db, fmt.Sprintf(`
+		SELECT ags.primary_replica, ars.connected_state, ars.connected_state_desc, ars.last_connect_error_number, ars.last_connect_error_description, ars.last_connect_error_timestamp
+		FROM
+			sys.dm_hadr_availability_group_states ags
+			INNER JOIN sys.dm_hadr_availability_replica_states ars ON ars.group_id = ags.group_id AND ars.is_local = 1
+		WHERE
+			ags.group_id = %s`, groupIDExpression), arg).Scan(
+		&state.PrimaryReplica,
+		&state.ConnectedState, &state.ConnectedStateDesc,
+		&state.LastConnectErrorNumber, &state.LastConnectErrorDescription, &state.LastConnectErrorTimestamp)
+	if err != nil {
+		return
+	}
+
+	primaryReplicaName = state.PrimaryReplica.String
+	connected, detail = describePrimaryConnection(state)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: getRoleStrict
+//
+// Description:
+//    Gets the role of the local replica of the Availability Group selected by `groupIDExpression`, one of `groupIDByName` or `groupIDByGroupID`,
+//    and fails if there is more than one local replica row.
+//
+func getRoleStrict(ctx context.Context, db *sql.DB, groupIDExpression string, arg string) (role Role, roleDesc string, err error) {
+	rows, err := queryWithRetry(ctx, db, fmt.Sprintf(`
+		SELECT ars.role, ars.role_desc
+		FROM
+			sys.dm_hadr_availability_replica_states ars
+		WHERE
+			ars.group_id = %s AND ars.is_local = 1`, groupIDExpression), arg)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	numRows := 0
+	for rows.Next() {
+		var rawRoleDesc sql.NullString
+		err = rows.Scan(&role, &rawRoleDesc)
+		if err != nil {
+			return
+		}
+
+		if rawRoleDesc.Valid {
+			roleDesc = rawRoleDesc.String
+		} else {
+			roleDesc = role.Desc()
+		}
+
+		numRows++
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	switch numRows {
+	case 0:
+		err = sql.ErrNoRows
+
+	case 1:
+
+	default:
+		err = fmt.Errorf("found %d local replica rows for %s in sys.dm_hadr_availability_replica_states instead of 1", numRows, arg)
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: getSyncProgressSummary
+//
+// Description:
+//    Gets the synchronization progress of the databases of the Availability Group selected by `groupIDExpression`,
+//    one of `groupIDByName` or `groupIDByGroupID`.
+//
+func getSyncProgressSummary(ctx context.Context, db *sql.DB, groupIDExpression string, arg string) (summary SyncProgressSummary, err error) {
+	err = queryRowWithRetry(ctx, db, fmt.Sprintf(`
+		SELECT
+			COALESCE(MAX(drs.log_send_queue_size), 0),
+			COALESCE(MAX(drs.redo_queue_size), 0),
+			COUNT(CASE WHEN drs.synchronization_state_desc = 'SYNCHRONIZED' THEN 1 END),
+			COUNT(*)
+		FROM
+			sys.dm_hadr_database_replica_states drs
+		WHERE drs.group_id = %s`, groupIDExpression), arg,
+	).Scan(&summary.MaxLogSendQueueSizeKB, &summary.MaxRedoQueueSizeKB, &summary.NumSynchronized, &summary.NumDatabaseReplicas)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: isContained
+//
+// Description:
+//    Gets whether the Availability Group selected by `groupIDExpression`, one of `groupIDByName` or `groupIDByGroupID`, is a contained AG.
+//
+func isContained(ctx context.Context, db *sql.DB, groupIDExpression string, arg string) (contained bool, err error) {
+	// sys.availability_groups only has the is_contained column on versions that support contained AGs
+	var hasIsContainedColumn bool
+	err = queryRowWithRetry(ctx, db, `SELECT CASE WHEN COL_LENGTH('sys.availability_groups', 'is_contained') IS NULL THEN 0 ELSE 1 END`).Scan(&hasIsContainedColumn)
+	if err != nil || !hasIsContainedColumn {
+		return
+	}
+
+	err = queryRowWithRetry(ctx, db, fmt.Sprintf(`
+		SELECT ag.is_contained
+		FROM
+			sys.availability_groups ag
+		WHERE
+			ag.group_id = %s`, groupIDExpression), arg).Scan(&contained)
+
+	return
 }
@@ -0,0 +1,738 @@
+/*
+	Copyright 2017 Microsoft Corporation
+
+	Permission is hereby granted, free of charge, to any person obtaining a copy
+	of this software and associated documentation files (the "Software"), to deal
+	in the Software without restriction, including without limitation the rights
+	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+	copies of the Software, and to permit persons to whom the Software is
+	furnished to do so, subject to the following conditions:
+
+	The above copyright notice and this permission notice shall be included in
+	all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+	SOFTWARE.
+*/
+
+package ag
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsRecoverableConnectionError(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		err      error
+		expected bool
+	}{
+		{sql.ErrConnDone, true},
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{fmt.Errorf("Could not read packet: %w", io.EOF), true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, true},
+		{fmt.Errorf("Could not read packet: %w", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}), true},
+		{&net.DNSError{Err: "i/o timeout", Name: "sqlhost", IsTimeout: true}, false},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, false},
+		{driver.ErrBadConn, false},
+		{nil, false},
+		{sql.ErrNoRows, false},
+		{errors.New("Invalid object name 'sys.availability_groups'"), false},
+	} {
+		actual := isRecoverableConnectionError(testCase.err)
+		if actual != testCase.expected {
+			t.Fatalf("Expected isRecoverableConnectionError(%v) to be %t but it was %t", testCase.err, testCase.expected, actual)
+		}
+	}
+}
+
+func TestSummarizeDatabaseStates(t *testing.T) {
+	t.Parallel()
+
+	databaseStates := []databaseState{
+		{"db1", 1, "RESTORING"},
+		{"db2", 1, "RESTORING"},
+		{"db3", 1, "RESTORING"},
+		{"db4", 2, "RECOVERING"},
+		{"db5", 2, "RECOVERING"},
+		{"Reporting", 6, "OFFLINE"},
+		{"db6", 3, "RECOVERY_PENDING"},
+		{"db7", 4, "SUSPECT"},
+	}
+
+	testCases := []struct {
+		name                 string
+		ignoredDatabaseNames []string
+		maxStates            uint
+		expected             string
+	}{
+		{"all states", nil, 0, "3 databases are RESTORING, 2 databases are RECOVERING, 1 databases are RECOVERY_PENDING, 1 databases are SUSPECT, 1 databases are OFFLINE"},
+		{"ignored database", []string{"reporting"}, 0, "3 databases are RESTORING, 2 databases are RECOVERING, 1 databases are RECOVERY_PENDING, 1 databases are SUSPECT"},
+		{"summarized states", []string{"Reporting"}, 2, "3 databases are RESTORING, 2 databases are RECOVERING, and 2 more databases are in 2 other states"},
+		{"all databases ignored", []string{"db1", "db2", "db3", "db4", "db5", "db6", "db7", "Reporting"}, 0, ""},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			result := summarizeDatabaseStates(databaseStates, testCase.ignoredDatabaseNames, testCase.maxStates)
+			if result != testCase.expected {
+				t.Fatalf("Expected %q but got %q", testCase.expected, result)
+			}
+		})
+	}
+}
+
+func TestDesc(t *testing.T) {
+	t.Parallel()
+
+	for role, expected := range map[Role]string{
+		RoleRESOLVING: "RESOLVING",
+		RolePRIMARY:   "PRIMARY",
+		RoleSECONDARY: "SECONDARY",
+		Role(7):       "UNKNOWN",
+	} {
+		if desc := role.Desc(); desc != expected {
+			t.Fatalf("Expected Role(%d).Desc() to return %s but it returned %s", role, expected, desc)
+		}
+	}
+
+	for availabilityMode, expected := range map[AvailabilityMode]string{
+		AmASYNCHRONOUS_COMMIT: "ASYNCHRONOUS_COMMIT",
+		AmSYNCHRONOUS_COMMIT:  "SYNCHRONOUS_COMMIT",
+		AmCONFIGURATION_ONLY:  "CONFIGURATION_ONLY",
+		AvailabilityMode(2):   "UNKNOWN",
+	} {
+		if desc := availabilityMode.Desc(); desc != expected {
+			t.Fatalf("Expected AvailabilityMode(%d).Desc() to return %s but it returned %s", availabilityMode, expected, desc)
+		}
+	}
+}
+
+// unquoteName parses the output of `QuoteName()` like SQL Server parses a bracketed identifier, and returns the identifier
+// and whatever follows its closing bracket, which must be empty for the identifier to be safe to embed in DDL.
+func unquoteName(quoted string) (identifier string, rest string, ok bool) {
+	if !strings.HasPrefix(quoted, "[") {
+		return "", "", false
+	}
+
+	var builder strings.Builder
+	for i := 1; i < len(quoted); i++ {
+		if quoted[i] != ']' {
+			builder.WriteByte(quoted[i])
+			continue
+		}
+
+		if i+1 < len(quoted) && quoted[i+1] == ']' {
+			builder.WriteByte(']')
+			i++
+			continue
+		}
+
+		return builder.String(), quoted[i+1:], true
+	}
+
+	return "", "", false
+}
+
+func TestQuoteName(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		name     string
+		expected string
+	}{
+		{"ag1", "[ag1]"},
+		{"", "[]"},
+		{"my ag", "[my ag]"},
+		{"ag]", "[ag]]]"},
+		{"[ag]", "[[ag]]]"},
+		{"ag]; DROP DATABASE master; --", "[ag]]; DROP DATABASE master; --]"},
+		{"ag'; SELECT 1; --", "[ag'; SELECT 1; --]"},
+		{"ag\nGO\n", "[ag\nGO\n]"},
+	} {
+		result := QuoteName(testCase.name)
+		if result != testCase.expected {
+			t.Fatalf("Expected QuoteName(%q) to return %q but it returned %q", testCase.name, testCase.expected, result)
+		}
+	}
+}
+
+func FuzzQuoteName(f *testing.F) {
+	for _, seed := range []string{"ag1", "", "]", "]]", "[", "ag]; DROP DATABASE master; --", "ag\nGO\n", "ag\x00]"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		quoted := QuoteName(name)
+
+		identifier, rest, ok := unquoteName(quoted)
+		if !ok {
+			t.Fatalf("QuoteName(%q) returned %q, which is not a complete bracketed identifier", name, quoted)
+		}
+
+		if rest != "" {
+			t.Fatalf("QuoteName(%q) returned %q, which has %q after the closing bracket", name, quoted, rest)
+		}
+
+		if identifier != name {
+			t.Fatalf("QuoteName(%q) returned %q, which is the identifier %q", name, quoted, identifier)
+		}
+	})
+}
+
+func TestEstimateLocalDataLoss(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	at := func(offset time.Duration) sql.NullTime {
+		return sql.NullTime{Time: now.Add(offset), Valid: true}
+	}
+
+	for _, testCase := range []struct {
+		name       string
+		logTimes   []localDatabaseLogTimes
+		expected   time.Duration
+		expectedOk bool
+	}{
+		{"no databases", nil, 0, false},
+		{"no log activity", []localDatabaseLogTimes{{}}, 0, false},
+		{"received after the last commit", []localDatabaseLogTimes{{at(-12 * time.Second), at(-20 * time.Second), at(-30 * time.Second)}}, 12 * time.Second, true},
+		{"only a commit time", []localDatabaseLogTimes{{lastCommitTime: at(-5 * time.Second)}}, 5 * time.Second, true},
+		{"largest of several databases", []localDatabaseLogTimes{{lastReceivedTime: at(-time.Second)}, {lastReceivedTime: at(-time.Minute)}, {}}, time.Minute, true},
+		{"activity after now", []localDatabaseLogTimes{{lastReceivedTime: at(time.Second)}}, 0, true},
+	} {
+		result, ok := estimateLocalDataLoss(testCase.logTimes, now)
+		if ok != testCase.expectedOk || result != testCase.expected {
+			t.Fatalf(
+				"Expected estimateLocalDataLoss() for %s to return %s, %t but it returned %s, %t",
+				testCase.name, testCase.expected, testCase.expectedOk, result, ok)
+		}
+	}
+}
+
+func TestEstimateDataLoss(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	result := estimateDataLoss([]databaseCommitTime{
+		{"node1", 5, true, now},
+		{"node1", 6, true, now.Add(-time.Minute)},
+		{"node2", 5, false, now.Add(-12 * time.Second)},
+		{"node2", 6, false, now.Add(-time.Minute)},
+		{"node3", 5, false, now},
+		{"node3", 6, false, now.Add(-time.Minute + time.Second)},
+		{"node3", 7, false, now.Add(-time.Hour)},
+	})
+
+	expected := map[string]time.Duration{
+		"node2": 12 * time.Second,
+		"node3": 0,
+	}
+
+	if len(result) != len(expected) {
+		t.Fatalf("Expected estimateDataLoss to return %v but it returned %v", expected, result)
+	}
+
+	for replicaName, expectedDataLoss := range expected {
+		if dataLoss, ok := result[replicaName]; !ok || dataLoss != expectedDataLoss {
+			t.Fatalf("Expected estimateDataLoss to return %v but it returned %v", expected, result)
+		}
+	}
+}
+
+func TestLeaseStateFromEvents(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i, testCase := range []struct {
+		events   []FailoverEvent
+		expected LeaseState
+	}{
+		{nil, LeaseState{}},
+		{
+			[]FailoverEvent{
+				{now, "availability_replica_state_change", "PRIMARY_NORMAL", "RESOLVING_NORMAL"},
+				{now.Add(-2 * time.Second), "availability_group_lease_expired", "", ""},
+			},
+			LeaseState{ResolvingDueToLeaseExpiry: true, LastLeaseExpiry: now.Add(-2 * time.Second)},
+		},
+		{
+			// The lease expiry is too long before the transition to RESOLVING to have caused it
+			[]FailoverEvent{
+				{now, "availability_replica_state_change", "PRIMARY_NORMAL", "RESOLVING_NORMAL"},
+				{now.Add(-time.Hour), "availability_group_lease_expired", "", ""},
+			},
+			LeaseState{ResolvingDueToLeaseExpiry: false, LastLeaseExpiry: now.Add(-time.Hour)},
+		},
+		{
+			// Only the most recent transition to RESOLVING is considered
+			[]FailoverEvent{
+				{now, "availability_replica_state_change", "SECONDARY_NORMAL", "RESOLVING_NORMAL"},
+				{now.Add(-time.Hour), "availability_replica_state_change", "PRIMARY_NORMAL", "RESOLVING_NORMAL"},
+				{now.Add(-time.Hour - time.Second), "availability_group_lease_expired", "", ""},
+			},
+			LeaseState{ResolvingDueToLeaseExpiry: false, LastLeaseExpiry: now.Add(-time.Hour - time.Second)},
+		},
+		{
+			[]FailoverEvent{
+				{now, "availability_replica_state_change", "RESOLVING_NORMAL", "SECONDARY_NORMAL"},
+			},
+			LeaseState{},
+		},
+	} {
+		result := leaseStateFromEvents(testCase.events)
+		if result != testCase.expected {
+			t.Fatalf("Test case %d: expected leaseStateFromEvents to return %+v but it returned %+v", i, testCase.expected, result)
+		}
+	}
+}
+
+func TestLastStateChangeFromEvents(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i, testCase := range []struct {
+		events        []FailoverEvent
+		expectedEvent FailoverEvent
+		expectedOk    bool
+	}{
+		{nil, FailoverEvent{}, false},
+		{
+			[]FailoverEvent{
+				{now, "availability_group_lease_expired", "", ""},
+			},
+			FailoverEvent{}, false,
+		},
+		{
+			// The lease expiry is more recent, but it's not a state change
+			[]FailoverEvent{
+				{now, "availability_group_lease_expired", "", ""},
+				{now.Add(-time.Second), "availability_replica_state_change", "PRIMARY_NORMAL", "RESOLVING_NORMAL"},
+				{now.Add(-time.Hour), "availability_replica_state_change", "SECONDARY_NORMAL", "PRIMARY_NORMAL"},
+			},
+			FailoverEvent{now.Add(-time.Second), "availability_replica_state_change", "PRIMARY_NORMAL", "RESOLVING_NORMAL"}, true,
+		},
+	} {
+		event, ok := lastStateChangeFromEvents(testCase.events)
+		if event != testCase.expectedEvent || ok != testCase.expectedOk {
+			t.Fatalf("Test case %d: expected lastStateChangeFromEvents to return (%+v, %t) but it returned (%+v, %t)", i, testCase.expectedEvent, testCase.expectedOk, event, ok)
+		}
+	}
+}
+
+func TestFormatSequenceNumber(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		sequenceNumber int64
+		withHex        bool
+		expected       string
+	}{
+		{0, false, "0"},
+		{4294967301, false, "4294967301"},
+		{4294967301, true, "4294967301 (0x0000000100000005)"},
+	} {
+		result := FormatSequenceNumber(testCase.sequenceNumber, testCase.withHex)
+		if result != testCase.expected {
+			t.Fatalf("Expected FormatSequenceNumber(%d, %t) to return %q but it returned %q", testCase.sequenceNumber, testCase.withHex, testCase.expected, result)
+		}
+	}
+}
+
+func TestParseLastHardenedLSNLine(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		line                     string
+		expectedHost             string
+		expectedLastHardenedLSNs string
+		expectedOk               bool
+	}{
+		{`name="ag1-last-hardened-lsn" host="node1" value="0B7F3D6E-1C2A-4F5B-9D8E-7A6B5C4D3E2F:37000000034400001"`, "node1", "0B7F3D6E-1C2A-4F5B-9D8E-7A6B5C4D3E2F:37000000034400001", true},
+		{`value='b2:12345678901234567890123,a1:5' host='node2'`, "node2", "A1:5,B2:12345678901234567890123", true},
+		{`name="ag1-last-hardened-lsn" host="node3" value="a1:-1"`, "", "", false},
+		{`name="ag1-last-hardened-lsn" host="node4" value="a1:15.0"`, "", "", false},
+		{`name="ag1-last-hardened-lsn" host="node5" value=""`, "", "", false},
+		{`name="ag1-last-hardened-lsn" host="node6" value="37000000034400001"`, "", "", false},
+		{`name="ag1-last-hardened-lsn" host="node7" value="a1:1,"`, "", "", false},
+	} {
+		host, lastHardenedLSNs, ok := ParseLastHardenedLSNLine(testCase.line)
+
+		var lastHardenedLSNsString string
+		if lastHardenedLSNs != nil {
+			lastHardenedLSNsString = FormatLastHardenedLSNs(lastHardenedLSNs)
+		}
+
+		if host != testCase.expectedHost || lastHardenedLSNsString != testCase.expectedLastHardenedLSNs || ok != testCase.expectedOk {
+			t.Fatalf(
+				"Expected ParseLastHardenedLSNLine(%q) to return (%q, %q, %t) but it returned (%q, %q, %t)",
+				testCase.line,
+				testCase.expectedHost, testCase.expectedLastHardenedLSNs, testCase.expectedOk,
+				host, lastHardenedLSNsString, ok)
+		}
+	}
+}
+
+func TestParseProductVersionLine(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		line                   string
+		expectedHost           string
+		expectedProductVersion string
+		expectedOk             bool
+	}{
+		{`name="ag1-product-version" host="node1" value="15.0.4153.1"`, "node1", "15.0.4153.1", true},
+		{`value='16.0.1000.6' host='node2'`, "node2", "16.0.1000.6", true},
+		{`name="ag1-product-version" host="node3" value=""`, "", "", false},
+		{`Could not query value of ag1-product-version: attribute does not exist`, "", "", false},
+	} {
+		host, productVersion, ok := ParseProductVersionLine(testCase.line)
+		if host != testCase.expectedHost || productVersion != testCase.expectedProductVersion || ok != testCase.expectedOk {
+			t.Fatalf(
+				"Expected ParseProductVersionLine(%q) to return (%q, %q, %t) but it returned (%q, %q, %t)",
+				testCase.line,
+				testCase.expectedHost, testCase.expectedProductVersion, testCase.expectedOk,
+				host, productVersion, ok)
+		}
+	}
+}
+
+func TestParseSequenceNumberLine(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		line                   string
+		format                 string
+		expectedHost           string
+		expectedSequenceNumber int64
+		expectedOk             bool
+	}{
+		// attrd_updater -QA
+		{`name="ag1-sequence-number" host="node1" value="4294967301"`, SequenceNumberFormatAuto, "node1", 4294967301, true},
+		{`name="ag1-sequence-number" host="node1" value="4294967301"`, SequenceNumberFormatAttrd, "node1", 4294967301, true},
+
+		// Additional attributes, different order and different quoting
+		{`name="ag1-sequence-number" host="node2" value="5" set="status"`, SequenceNumberFormatAuto, "node2", 5, true},
+		{`name="ag1-sequence-number" host="node2" value="5" set="status"`, SequenceNumberFormatAttrd, "", 0, false},
+		{`value='7' name='ag1-sequence-number' host='node3'`, SequenceNumberFormatAuto, "node3", 7, true},
+		{`value='7' name='ag1-sequence-number' host='node3'`, SequenceNumberFormatAttrd, "", 0, false},
+		{`name=ag1-sequence-number  host=node4  value=8`, SequenceNumberFormatAuto, "node4", 8, true},
+		{`name=ag1-sequence-number  host=node4  value=8`, SequenceNumberFormatAttrd, "", 0, false},
+		{`host="node1" name="ag1-sequence-number" value="4294967301"`, SequenceNumberFormatAttrd, "", 0, false},
+		{`name="ag1-sequence-number"  host="node1" value="4294967301"`, SequenceNumberFormatAttrd, "", 0, false},
+		{`name="" host="node1" value="4294967301"`, SequenceNumberFormatAttrd, "", 0, false},
+
+		// Lines without a host or a sequence number
+		{``, SequenceNumberFormatAuto, "", 0, false},
+		{`name="ag1-sequence-number" host="node5" value=""`, SequenceNumberFormatAuto, "", 0, false},
+		{`name="ag1-sequence-number" value="9"`, SequenceNumberFormatAuto, "", 0, false},
+		{`Could not query value of ag1-sequence-number: attribute does not exist`, SequenceNumberFormatAuto, "", 0, false},
+	} {
+		host, sequenceNumber, ok, err := ParseSequenceNumberLine(testCase.line, testCase.format)
+		if err != nil {
+			t.Fatalf("Expected ParseSequenceNumberLine(%q, %s) to succeed but it failed: %s", testCase.line, testCase.format, err)
+		}
+
+		if host != testCase.expectedHost || sequenceNumber != testCase.expectedSequenceNumber || ok != testCase.expectedOk {
+			t.Fatalf(
+				"Expected ParseSequenceNumberLine(%q, %s) to return (%q, %d, %t) but it returned (%q, %d, %t)",
+				testCase.line, testCase.format,
+				testCase.expectedHost, testCase.expectedSequenceNumber, testCase.expectedOk,
+				host, sequenceNumber, ok)
+		}
+	}
+
+	_, _, _, err := ParseSequenceNumberLine(`name="ag1-sequence-number" host="node1" value="99999999999999999999"`, SequenceNumberFormatAuto)
+	if err == nil {
+		t.Fatal("Expected ParseSequenceNumberLine to fail for an out of range sequence number but it succeeded")
+	}
+
+	_, _, _, err = ParseSequenceNumberLine(`name="ag1-sequence-number" host="node1" value="1"`, "xml")
+	if err == nil {
+		t.Fatal("Expected ParseSequenceNumberLine to fail for an unknown format but it succeeded")
+	}
+}
+
+func TestDescribePrimaryConnection(t *testing.T) {
+	t.Parallel()
+
+	lastConnectErrorTimestamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, testCase := range []struct {
+		name              string
+		state             primaryConnectionState
+		expectedConnected bool
+		expectedDetail    string
+	}{
+		{
+			name: "secondary connected to primary",
+			state: primaryConnectionState{
+				PrimaryReplica:     sql.NullString{String: "node1", Valid: true},
+				ConnectedState:     sql.NullInt64{Int64: 1, Valid: true},
+				ConnectedStateDesc: sql.NullString{String: "CONNECTED", Valid: true},
+			},
+			expectedConnected: true,
+			expectedDetail:    "",
+		},
+		{
+			name: "secondary disconnected from primary",
+			state: primaryConnectionState{
+				PrimaryReplica:              sql.NullString{String: "node1", Valid: true},
+				ConnectedState:              sql.NullInt64{Int64: 0, Valid: true},
+				ConnectedStateDesc:          sql.NullString{String: "DISCONNECTED", Valid: true},
+				LastConnectErrorNumber:      sql.NullInt64{Int64: 35206, Valid: true},
+				LastConnectErrorDescription: sql.NullString{String: "A connection timeout has occurred", Valid: true},
+				LastConnectErrorTimestamp:   sql.NullTime{Time: lastConnectErrorTimestamp, Valid: true},
+			},
+			expectedConnected: false,
+			expectedDetail:    "DISCONNECTED; last connection error 35206: A connection timeout has occurred at 2020-01-02T03:04:05Z",
+		},
+		{
+			name: "secondary that doesn't know of a primary",
+			state: primaryConnectionState{
+				ConnectedState:     sql.NullInt64{Int64: 1, Valid: true},
+				ConnectedStateDesc: sql.NullString{String: "CONNECTED", Valid: true},
+			},
+			expectedConnected: false,
+			expectedDetail:    "no primary replica is known",
+		},
+		{
+			name: "unknown connected state",
+			state: primaryConnectionState{
+				PrimaryReplica: sql.NullString{String: "node1", Valid: true},
+			},
+			expectedConnected: false,
+			expectedDetail:    "connected state is unknown",
+		},
+	} {
+		connected, detail := describePrimaryConnection(testCase.state)
+		if connected != testCase.expectedConnected || detail != testCase.expectedDetail {
+			t.Fatalf(
+				"Expected describePrimaryConnection() for %s to return (%t, %q) but it returned (%t, %q)",
+				testCase.name,
+				testCase.expectedConnected, testCase.expectedDetail,
+				connected, detail)
+		}
+	}
+}
+
+// A failoverConnector simulates an instance that accepts the FAILOVER DDL, and then reports each of roles in turn
+// as the role of the local replica, repeating the last one.
+type failoverConnector struct {
+	failoverErr error
+	roles       []Role
+
+	mutex          sync.Mutex
+	numFailovers   int
+	numRoleQueries int
+}
+
+func (c *failoverConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &failoverConn{connector: c}, nil
+}
+
+func (c *failoverConnector) Driver() driver.Driver {
+	return nil
+}
+
+type failoverConn struct {
+	connector *failoverConnector
+}
+
+func (c *failoverConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *failoverConn) Close() error {
+	return nil
+}
+
+func (c *failoverConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *failoverConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.connector.mutex.Lock()
+	defer c.connector.mutex.Unlock()
+
+	if !strings.Contains(query, "FAILOVER") {
+		return nil, fmt.Errorf("unexpected statement %s", query)
+	}
+
+	c.connector.numFailovers++
+
+	if c.connector.failoverErr != nil {
+		return nil, c.connector.failoverErr
+	}
+
+	return driver.RowsAffected(0), nil
+}
+
+func (c *failoverConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.connector.mutex.Lock()
+	defer c.connector.mutex.Unlock()
+
+	if !strings.Contains(query, "ars.role_desc") {
+		return nil, fmt.Errorf("unexpected query %s", query)
+	}
+
+	role := c.connector.roles[len(c.connector.roles)-1]
+	if c.connector.numRoleQueries < len(c.connector.roles) {
+		role = c.connector.roles[c.connector.numRoleQueries]
+	}
+
+	c.connector.numRoleQueries++
+
+	return &roleRows{role: role}, nil
+}
+
+type roleRows struct {
+	role Role
+	done bool
+}
+
+func (r *roleRows) Columns() []string {
+	return []string{"group_id", "role", "role_desc"}
+}
+
+func (r *roleRows) Close() error {
+	return nil
+}
+
+func (r *roleRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+
+	r.done = true
+	dest[0] = "0AB5F2C5-93B8-4DB3-9CE7-5E0D1C2B4A10"
+	dest[1] = int64(r.role)
+	dest[2] = r.role.Desc()
+
+	return nil
+}
+
+func TestFailoverAndWait(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		name                   string
+		connector              *failoverConnector
+		timeout                time.Duration
+		contextTimeout         time.Duration
+		expectedError          string
+		expectedErrorSuffix    string
+		expectedNumFailovers   int
+		expectedNumRoleQueries int
+	}{
+		{
+			name:                   "PRIMARY role after the role change",
+			connector:              &failoverConnector{roles: []Role{RoleSECONDARY, RoleRESOLVING, RolePRIMARY}},
+			expectedNumFailovers:   1,
+			expectedNumRoleQueries: 3,
+		},
+		{
+			name:                   "failover fails",
+			connector:              &failoverConnector{failoverErr: errors.New("failover failed"), roles: []Role{RolePRIMARY}},
+			expectedError:          "failover failed",
+			expectedNumFailovers:   1,
+			expectedNumRoleQueries: 0,
+		},
+		{
+			name:                 "never PRIMARY role",
+			connector:            &failoverConnector{roles: []Role{RoleRESOLVING}},
+			timeout:              250 * time.Millisecond,
+			expectedError:        "Timed out after 250ms while waiting for local replica to be in PRIMARY role. It is in RESOLVING (0) role.",
+			expectedNumFailovers: 1,
+		},
+		{
+			// The context can expire during a role query or between two of them
+			name:                 "never PRIMARY role before the context is done",
+			connector:            &failoverConnector{roles: []Role{RoleRESOLVING}},
+			contextTimeout:       250 * time.Millisecond,
+			expectedErrorSuffix:  context.DeadlineExceeded.Error(),
+			expectedNumFailovers: 1,
+		},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		if testCase.contextTimeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), testCase.contextTimeout)
+		}
+
+		db := sql.OpenDB(testCase.connector)
+
+		err := FailoverAndWait(ctx, db, "ag1", testCase.timeout)
+		_ = db.Close()
+		cancel()
+
+		if testCase.expectedErrorSuffix != "" {
+			if err == nil || !strings.HasSuffix(err.Error(), testCase.expectedErrorSuffix) {
+				t.Fatalf("Expected FailoverAndWait() for %s to fail with an error ending in %q but it returned %v", testCase.name, testCase.expectedErrorSuffix, err)
+			}
+		} else if testCase.expectedError == "" && err != nil {
+			t.Fatalf("Expected FailoverAndWait() for %s to succeed but it failed: %s", testCase.name, err)
+		}
+		if testCase.expectedError != "" && (err == nil || err.Error() != testCase.expectedError) {
+			t.Fatalf("Expected FailoverAndWait() for %s to fail with %q but it returned %v", testCase.name, testCase.expectedError, err)
+		}
+
+		if testCase.connector.numFailovers != testCase.expectedNumFailovers {
+			t.Fatalf(
+				"Expected FailoverAndWait() for %s to run the FAILOVER DDL %d times but it ran it %d times",
+				testCase.name, testCase.expectedNumFailovers, testCase.connector.numFailovers)
+		}
+
+		// The number of role queries of a timeout depends on how long each poll took
+		if testCase.timeout == 0 && testCase.contextTimeout == 0 && testCase.connector.numRoleQueries != testCase.expectedNumRoleQueries {
+			t.Fatalf(
+				"Expected FailoverAndWait() for %s to query the role %d times but it queried it %d times",
+				testCase.name, testCase.expectedNumRoleQueries, testCase.connector.numRoleQueries)
+		}
+	}
+}
+
+func TestSetRequiredSynchronizedSecondariesToCommitNotPrimary(t *testing.T) {
+	t.Parallel()
+
+	connector := &failoverConnector{roles: []Role{RoleSECONDARY}}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	err := SetRequiredSynchronizedSecondariesToCommit(context.Background(), db, "ag1", 1)
+
+	notPrimaryError, ok := err.(*NotPrimaryError)
+	if !ok || notPrimaryError.Role != RoleSECONDARY {
+		t.Fatalf("Expected SetRequiredSynchronizedSecondariesToCommit() on a SECONDARY replica to return a NotPrimaryError but it returned %v", err)
+	}
+
+	if connector.numRoleQueries != 1 {
+		t.Fatalf("Expected SetRequiredSynchronizedSecondariesToCommit() to query the role once but it queried it %d times", connector.numRoleQueries)
+	}
+}
@@ -24,9 +24,16 @@ package mssqlcommon
 
 import (
 	"bufio"
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"strconv"
@@ -40,9 +47,41 @@ type Diagnostics struct {
 	QueryProcessing bool
 }
 
+// A DiagnosticsRow is a row returned by sp_server_diagnostics.
+//
+// See https://msdn.microsoft.com/en-us/library/ff878233.aspx for details.
+type DiagnosticsRow struct {
+	CreationTime  string
+	ComponentType string
+	ComponentName string
+	State         int
+	StateDesc     string
+
+	// The XML data of the component, such as memory and CPU figures for the resource component
+	Data string
+}
+
+// A DiagnosticsQuerier runs the sp_server_diagnostics query for `QueryDiagnosticsContext()`. *sql.DB implements it.
+//
+// Tests can implement it to simulate an instance that doesn't respond to the query.
+type DiagnosticsQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// The minimum connection timeout that the helpers accept. A timeout of 0 would make `OpenDBWithHealthCheck()` time out immediately,
+// and makes some drivers wait indefinitely for a connection.
+const MinConnectionTimeout = 1 * time.Second
+
+// The minimum repeat interval that sp_server_diagnostics accepts, other than 0 which makes it run once
+const MinDiagnosticsRepeatInterval = 5 * time.Second
+
 type ServerHealth uint
 
 const (
+	// sp_server_diagnostics errors of a component mapped to this value are only reported as warnings
+	// and don't cause the health check to fail. See `DiagnosticsMapping`.
+	ServerWarningOnly ServerHealth = 0
+
 	// The instance is down or refusing connections
 	//
 	// This library can't distinguish between down or unresponsive, which is why a single health code is used for both,
@@ -59,6 +98,63 @@ const (
 	ServerAnyQualifiedError ServerHealth = 5
 )
 
+// A DiagnosticsMapping maps each sp_server_diagnostics component to the server health that's reported
+// when that component is in error.
+type DiagnosticsMapping struct {
+	System          ServerHealth
+	Resource        ServerHealth
+	QueryProcessing ServerHealth
+}
+
+// The mapping used by `Diagnose()`
+var DefaultDiagnosticsMapping = DiagnosticsMapping{
+	System:          ServerCriticalError,
+	Resource:        ServerModerateError,
+	QueryProcessing: ServerAnyQualifiedError,
+}
+
+// A ComponentCounts holds a count for each sp_server_diagnostics component.
+type ComponentCounts struct {
+	System          uint `json:"system"`
+	Resource        uint `json:"resource"`
+	QueryProcessing uint `json:"query_processing"`
+}
+
+// A HealthPolicy determines the server health from sp_server_diagnostics results, using a mapping of components to server health
+// and a number of consecutive health checks in which each component must be in error before the error is reported.
+type HealthPolicy struct {
+	Mapping DiagnosticsMapping
+
+	// The number of consecutive health checks in which a component must be in error before the error is reported.
+	// Values of 0 and 1 both mean that the error is reported immediately.
+	RequiredConsecutiveFailures ComponentCounts
+
+	// The number of consecutive health checks in which each component has been in error so far.
+	// This is updated by `DiagnoseWithPolicy()`, and should be persisted by the caller between health checks.
+	ConsecutiveFailures ComponentCounts
+
+	// If not 0, `OpenDBWithHealthCheck()` runs sp_server_diagnostics with this repeat interval and uses its first complete cycle of results
+	// instead of running it once. See `QueryDiagnosticsWithRepeatInterval()`.
+	DiagnosticsRepeatInterval time.Duration
+
+	// If not empty, `OpenDBWithHealthCheck()` runs this statement instead of sp_server_diagnostics, for logins that don't have
+	// the VIEW SERVER STATE permission that sp_server_diagnostics requires. See `QueryHealthCheck()`.
+	// The mapping, consecutive failures and repeat interval only apply to sp_server_diagnostics, so they're ignored.
+	HealthCheckQuery string
+}
+
+// The statistics of the connection attempts made by `OpenDBWithHealthCheck()`, so that callers can record them as metrics
+type ConnectStats struct {
+	// The number of attempts to connect to the instance, including the successful attempt if any
+	Attempts uint
+
+	// The time spent connecting to the instance, including the waits between attempts
+	TotalWait time.Duration
+
+	// The error of the last failed attempt, or nil if no attempt failed
+	LastError error
+}
+
 type ServerUnhealthyError struct {
 	RawValue ServerHealth
 	Inner    error
@@ -83,8 +179,221 @@ func (err *ServerUnhealthyError) Error() string {
 	}
 }
 
+func (err *ServerUnhealthyError) Unwrap() error {
+	return err.Inner
+}
+
+// The cause of a failure to connect to the instance, as determined by `ClassifyConnectError()`
+type ConnectErrorCategory uint
+
+const (
+	// The cause could not be determined
+	ConnectErrorOther ConnectErrorCategory = iota
+
+	// The instance rejected the login. This is usually caused by wrong credentials or a disabled or locked out login,
+	// but SQL Server also rejects a valid login while its default database is still recovering, so it can be transient.
+	ConnectErrorLoginFailed
+
+	// The hostname could not be resolved, or the instance refused the connection or could not be reached
+	ConnectErrorHostUnreachable
+
+	// The connection or the login did not complete before the connection timeout
+	ConnectErrorTimeout
+)
+
+func (category ConnectErrorCategory) String() string {
+	switch category {
+	case ConnectErrorLoginFailed:
+		return "LOGIN_FAILED"
+
+	case ConnectErrorHostUnreachable:
+		return "HOST_UNREACHABLE"
+
+	case ConnectErrorTimeout:
+		return "TIMEOUT"
+
+	default:
+		return "OTHER"
+	}
+}
+
+// Wrapped by the error that `OpenDBWithHealthCheck()` returns when the connection timeout elapses
+var ErrConnectTimedOut = errors.New("timed out")
+
+// Wrapped by the error that `SetLocalServerNameAndWait()` returns when @@SERVERNAME doesn't show the new name in time.
+// @@SERVERNAME only changes when the instance restarts, so waiting longer doesn't help.
+var ErrServerNameRestartRequired = errors.New("restart required")
+
+// Wrapped by the error that `NewCredentialProvider()` returns for a provider name it doesn't know
+var ErrUnknownCredentialProvider = errors.New("unknown credential provider")
+
+// The error numbers of SQL Server login errors. SQL Server sends every login failure to the client as 18456 with state 1,
+// so a wrong password can't be told apart from a valid login whose default database is still recovering.
+var loginFailedErrorNumbers = map[int32]bool{
+	18456: true, // Login failed
+	18470: true, // Login failed, the account is disabled
+	18486: true, // Login failed, the account is locked out
+	18487: true, // Login failed, the password has expired
+	18488: true, // Login failed, the password must be changed
+}
+
+// The SQL username and password used to connect to the instance, as returned by a `CredentialProvider`
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Validate returns an error if the credentials are missing a required field.
+func (credentials Credentials) Validate() error {
+	if credentials.Username == "" {
+		return errors.New("the username is empty")
+	}
+
+	if credentials.Password == "" {
+		return errors.New("the password is empty")
+	}
+
+	return nil
+}
+
+// A CredentialProvider provides the SQL username and password used to connect to the instance.
+type CredentialProvider interface {
+	// Gets the username and password. Implementations should give up when the context is done.
+	// Callers validate the credentials with `Credentials.Validate()`.
+	GetCredentials(ctx context.Context) (credentials Credentials, err error)
+}
+
+// A FileCredentialProvider reads the username and password from a credentials file, FIFO or file descriptor,
+// in the format described in `ReadCredentialsFile()`.
+type FileCredentialProvider struct {
+	Filename string
+}
+
+func (provider *FileCredentialProvider) GetCredentials(ctx context.Context) (credentials Credentials, err error) {
+	credentials.Username, credentials.Password, err = readCredentialsWithContext(ctx, func() (string, string, error) { return ReadCredentialsFile(provider.Filename) })
+	return
+}
+
+// A PasswordFileCredentialProvider provides a fixed username and reads the password from a password file,
+// in the format described in `ReadPasswordFile()`.
+type PasswordFileCredentialProvider struct {
+	Username     string
+	PasswordFile string
+}
+
+func (provider *PasswordFileCredentialProvider) GetCredentials(ctx context.Context) (credentials Credentials, err error) {
+	credentials.Password, err = ReadPasswordFile(provider.PasswordFile)
+	if err != nil {
+		return
+	}
+
+	credentials.Username = provider.Username
+
+	return
+}
+
+// A VaultCredentialProvider reads the username and password from a secret in a HashiCorp Vault KV secrets engine.
+// The secret must have username and password keys. Both versions 1 and 2 of the KV secrets engine are supported.
+type VaultCredentialProvider struct {
+	// The address of the Vault server, like https://vault.example.com:8200
+	Address string
+
+	// The path of the secret, like secret/data/mssql for version 2 of the KV secrets engine
+	Path string
+
+	// The token used to authenticate to Vault
+	Token string
+}
+
+func (provider *VaultCredentialProvider) GetCredentials(ctx context.Context) (credentials Credentials, err error) {
+	secretURL := strings.TrimSuffix(provider.Address, "/") + "/v1/" + strings.TrimPrefix(provider.Path, "/")
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, secretURL, nil)
+	if err != nil {
+		err = fmt.Errorf("Could not create Vault request: %s", err)
+		return
+	}
+	request.Header.Set("X-Vault-Token", provider.Token)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		err = fmt.Errorf("Could not read secret %s from Vault: %s", provider.Path, err)
+		return
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		// Parse the secret below
+
+	case http.StatusForbidden:
+		err = fmt.Errorf("Vault denied access to secret %s. The token may be invalid or expired, or may not have read access to the path.", provider.Path)
+		return
+
+	case http.StatusNotFound:
+		err = fmt.Errorf("Vault does not have a secret at %s", provider.Path)
+		return
+
+	default:
+		err = fmt.Errorf("Vault returned %s while reading secret %s", response.Status, provider.Path)
+		return
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&secret)
+	if err != nil {
+		err = fmt.Errorf("Could not parse secret %s from Vault: %s", provider.Path, err)
+		return
+	}
+
+	// Version 2 of the KV secrets engine nests the secret's data alongside its metadata
+	data := secret.Data
+	if nestedData, ok := data["data"].(map[string]interface{}); ok {
+		data = nestedData
+	}
+
+	credentials.Username, _ = data["username"].(string)
+	credentials.Password, _ = data["password"].(string)
+	if credentials.Username == "" || credentials.Password == "" {
+		err = fmt.Errorf("Secret %s in Vault does not have both username and password keys", provider.Path)
+		return
+	}
+
+	return
+}
+
+// The settings that `NewCredentialProvider()` uses to create the selected `CredentialProvider`, as given by the command-line flags
+type CredentialProviderOptions struct {
+	CredentialsFile string
+	Username        string
+	PasswordFile    string
+	VaultAddress    string
+	VaultPath       string
+	VaultTokenFile  string
+}
+
 type OcfExitCode int
 
+// The function used by `Exit()` to terminate the process. Tests replace it to observe the exit code.
+var exitFunc = os.Exit
+
+// A function that opens a connection to a SQL Server instance, like `OpenDB()`
+type dbOpener func(hostname string, port uint64, username string, password string, applicationName string, connectionTimeout time.Duration, trustServerCertificate bool) (*sql.DB, error)
+
+// The time that `OpenDBWithHealthCheck()` waits between connection attempts
+const connectRetryInterval = 1 * time.Second
+
+// The function used by `IsHostnameNotFound()` to resolve hostnames. Tests replace it to simulate DNS failures.
+var lookupHostFunc = net.LookupHost
+
+// The timeout of each TCP reachability probe of the health check port by `OpenDBWithHealthCheck()`
+const healthCheckPortProbeTimeout = 1 * time.Second
+
+// How often `SetLocalServerNameAndWait()` queries @@SERVERNAME
+const serverNamePollInterval = 1 * time.Second
+
 var (
 	OCF_ERR_CONFIGURED    OcfExitCode
 	OCF_ERR_GENERIC       OcfExitCode
@@ -97,15 +406,27 @@ var (
 	OCF_SUCCESS           OcfExitCode
 )
 
+// The names of the OCF exit codes, populated by `ImportOcfExitCodes()`. See `OcfCodeName()`.
+var ocfCodeNames = map[OcfExitCode]string{}
+
+// The default offset added to OCF exit codes by `OcfExit()`.
+const DefaultOcfExitCodeOffset = 10
+
+// The offset added to OCF exit codes by `OcfExit()`. `ImportOcfExitCodes()` overrides it from MSSQL_OCF_EXIT_CODE_OFFSET if that is set.
+var ocfExitCodeOffset = DefaultOcfExitCodeOffset
+
 // --------------------------------------------------------------------------------------
 // Function: ImportOcfExitCodes
 //
 // Description:
-//    Imports the OCF exit codes from corresponding environment variables.
+//    Imports the OCF exit codes from corresponding environment variables,
+//    and the offset that `OcfExit()` adds to them from MSSQL_OCF_EXIT_CODE_OFFSET if it's set.
 //
 func ImportOcfExitCodes() error {
 	var err error
 
+	ocfCodeNames = map[OcfExitCode]string{}
+
 	OCF_ERR_CONFIGURED, err = importOcfExitCode("OCF_ERR_CONFIGURED")
 	if err != nil {
 		return err
@@ -151,9 +472,40 @@ func ImportOcfExitCodes() error {
 		return err
 	}
 
+	ocfExitCodeOffset, err = importOcfExitCodeOffset()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
+func importOcfExitCodeOffset() (int, error) {
+	stringValue, ok := os.LookupEnv("MSSQL_OCF_EXIT_CODE_OFFSET")
+	if !ok || stringValue == "" {
+		return DefaultOcfExitCodeOffset, nil
+	}
+
+	offset, err := strconv.Atoi(stringValue)
+	if err != nil {
+		return 0, fmt.Errorf("MSSQL_OCF_EXIT_CODE_OFFSET is set to an invalid value [%s]", stringValue)
+	}
+
+	// Exit codes 1 and 2 are used by panics and flag parsing errors, and the process exit code can't exceed 255
+	maxOcfExitCode := 0
+	for code := range ocfCodeNames {
+		if int(code) > maxOcfExitCode {
+			maxOcfExitCode = int(code)
+		}
+	}
+
+	if offset < 3 || offset+maxOcfExitCode > 255 {
+		return 0, fmt.Errorf("MSSQL_OCF_EXIT_CODE_OFFSET is set to [%d] but it must be between 3 and %d", offset, 255-maxOcfExitCode)
+	}
+
+	return offset, nil
+}
+
 func importOcfExitCode(name string) (OcfExitCode, error) {
 	stringValue := os.Getenv(name)
 	intValue, err := strconv.Atoi(stringValue)
@@ -161,179 +513,1192 @@ func importOcfExitCode(name string) (OcfExitCode, error) {
 		return 0, fmt.Errorf("%s is set to an invalid value [%s]", name, stringValue)
 	}
 
+	ocfCodeNames[OcfExitCode(intValue)] = name
+
 	return OcfExitCode(intValue), nil
 }
 
 // --------------------------------------------------------------------------------------
-// Function: Diagnose
+// Function: CheckHostnameResolves
 //
 // Description:
-//    Uses the server health diagnostics to determine server health
+//    Checks that the given hostname resolves, so that a misspelled hostname fails fast
+//    instead of being retried until the action times out.
+//    Other failures to resolve the hostname, such as a DNS server timing out, are only logged, since the hostname may still exist.
 //
-// Params:
-//    diagnostics: The diagnostics object returned by `QueryDiagnostics()`
+// Returns:
+//    An error if DNS reported that the hostname does not exist.
 //
-func Diagnose(diagnostics Diagnostics) error {
-	if !diagnostics.System {
-		return &ServerUnhealthyError{RawValue: ServerCriticalError, Inner: fmt.Errorf("sp_server_diagnostics result indicates system error")}
-	}
-
-	if !diagnostics.Resource {
-		return &ServerUnhealthyError{RawValue: ServerModerateError, Inner: fmt.Errorf("sp_server_diagnostics result indicates resource error")}
+func CheckHostnameResolves(hostname string, stdout *log.Logger) error {
+	notFound, err := IsHostnameNotFound(hostname)
+	if notFound {
+		return fmt.Errorf("hostname %s does not resolve", hostname)
 	}
 
-	if !diagnostics.QueryProcessing {
-		return &ServerUnhealthyError{RawValue: ServerAnyQualifiedError, Inner: fmt.Errorf("sp_server_diagnostics result indicates query processing error")}
+	if err != nil {
+		stdout.Printf("Could not resolve hostname %s, connecting anyway: %s\n", hostname, err)
 	}
 
 	return nil
 }
 
-// Function: Exit
+// --------------------------------------------------------------------------------------
+// Function: ClassifyConnectError
 //
 // Description:
-//    Helper to exit with the given exit code and error.
+//    Determines the cause of an error returned by `OpenDB()` or `OpenDBWithHealthCheck()`, which report every failure to connect
+//    as a `ServerUnhealthyError` with `ServerDownOrUnresponsive`.
 //
-func Exit(logger *log.Logger, exitCode int, err error) error {
-	if err != nil {
-		// Print each line individually to ensure that each line is prefixed with the logger prefix
-		for _, line := range strings.Split(err.Error(), "\n") {
-			logger.Println(line)
-		}
+//    Errors of the SQL Server driver are recognized by their SQLErrorNumber() method, so that this package doesn't depend on the driver.
+//
+// Returns:
+//    The category of the error, or `ConnectErrorOther` if it isn't recognized.
+//
+func ClassifyConnectError(err error) ConnectErrorCategory {
+	if err == nil {
+		return ConnectErrorOther
 	}
 
-	os.Exit(exitCode)
+	var sqlError interface{ SQLErrorNumber() int32 }
+	if errors.As(err, &sqlError) && loginFailedErrorNumbers[sqlError.SQLErrorNumber()] {
+		return ConnectErrorLoginFailed
+	}
 
-	return nil
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		return ConnectErrorTimeout
+	}
+
+	var opError *net.OpError
+	var dnsError *net.DNSError
+	if errors.As(err, &opError) || errors.As(err, &dnsError) {
+		return ConnectErrorHostUnreachable
+	}
+
+	if errors.Is(err, ErrConnectTimedOut) || errors.Is(err, context.DeadlineExceeded) {
+		return ConnectErrorTimeout
+	}
+
+	return ConnectErrorOther
 }
 
 // --------------------------------------------------------------------------------------
-// Function: GetLocalServerName
+// Function: CompareProductVersions
 //
 // Description:
-//    Gets the local server name.
-//
-// Params:
-//    db: A connection to a SQL Server instance.
+//    Compares two SQL Server product versions, like "15.0.4153.1", numerically part by part.
+//    Missing parts are treated as 0.
 //
 // Returns:
-//    The name of the local server.
+//    -1 if a is lower than b, 0 if they are equal and 1 if a is higher than b.
 //
-func GetLocalServerName(db *sql.DB) (serverName string, err error) {
-	err = db.QueryRow("SELECT @@SERVERNAME").Scan(&serverName)
-	return
+func CompareProductVersions(a string, b string) (int, error) {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aPart, bPart uint64
+		var err error
+
+		if i < len(aParts) {
+			aPart, err = strconv.ParseUint(aParts[i], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid product version [%s]", a)
+			}
+		}
+
+		if i < len(bParts) {
+			bPart, err = strconv.ParseUint(bParts[i], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid product version [%s]", b)
+			}
+		}
+
+		if aPart < bPart {
+			return -1, nil
+		}
+
+		if aPart > bPart {
+			return 1, nil
+		}
+	}
+
+	return 0, nil
 }
 
-// Function: OcfExit
+// --------------------------------------------------------------------------------------
+// Function: Diagnose
 //
 // Description:
-//    Helper to exit with the given OCF exit code and error.
+//    Uses the server health diagnostics to determine server health
 //
-//    To distinguish OCF exit codes from other exit codes (like 1 for panics),
-//    the actual exit code is 10 + the OCF exit code.
+// Params:
+//    diagnostics: The diagnostics object returned by `QueryDiagnostics()`
 //
-func OcfExit(logger *log.Logger, ocfExitCode OcfExitCode, err error) error {
-	return Exit(logger, int(ocfExitCode)+10, err)
+func Diagnose(diagnostics Diagnostics) error {
+	return DiagnoseWith(diagnostics, DefaultDiagnosticsMapping)
 }
 
 // --------------------------------------------------------------------------------------
-// Function: OpenDB
+// Function: DiagnoseWith
 //
 // Description:
-//    Opens a connection to a SQL Server instance using the given parameters.
+//    Uses the server health diagnostics to determine server health, using the given mapping
+//    of components to server health.
 //
-// Params:
-//    hostname: Hostname of the instance.
-//    port: Port number for the T-SQL endpoint of the instance.
-//    username: Username to use to connect to the instance.
-//    password: Password to use to connect to the instance.
-//    applicationName: The application name that the connection will use.
-//    connectionTimeout: Connection timeout.
+//    If more than one component is in error, the most severe server health is returned.
+//    Components mapped to `ServerWarningOnly` are ignored. Use `DiagnosticsWarnings()` to report them.
 //
-// Returns:
-//    A connection to the SQL Server instance.
+// Params:
+//    diagnostics: The diagnostics object returned by `QueryDiagnostics()`
+//    mapping: The server health to report for each component.
 //
-func OpenDB(hostname string, port uint64, username string, password string, applicationName string, connectionTimeout time.Duration) (*sql.DB, error) {
-	query := url.Values{}
-	query.Add("app name", applicationName)
-	query.Add("connection timeout", fmt.Sprintf("%d", connectionTimeout/time.Second))
-
-	u := &url.URL{
-		Scheme:   "sqlserver",
-		User:     url.UserPassword(username, password),
-		Host:     fmt.Sprintf("%s:%d", hostname, port),
-		RawQuery: query.Encode(),
-	}
+func DiagnoseWith(diagnostics Diagnostics, mapping DiagnosticsMapping) error {
+	var result *ServerUnhealthyError
 
-	connectionString := u.String()
+	for _, component := range diagnosticsComponents(diagnostics, mapping) {
+		if component.healthy || component.health == ServerWarningOnly {
+			continue
+		}
 
-	db, err := sql.Open("mssql", connectionString)
-	if err != nil {
-		return nil, &ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: err}
+		if result == nil || component.health < result.RawValue {
+			result = &ServerUnhealthyError{
+				RawValue: component.health,
+				Inner:    fmt.Errorf("sp_server_diagnostics result indicates %s error", component.name),
+			}
+		}
 	}
 
-	err = db.Ping()
-	if err != nil {
-		_ = db.Close()
-		return nil, &ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: err}
+	if result == nil {
+		return nil
 	}
 
-	return db, nil
+	return result
 }
 
 // --------------------------------------------------------------------------------------
-// Function: OpenDBWithHealthCheck
+// Function: DiagnosticsWarnings
 //
 // Description:
-//    Opens a connection to a SQL Server instance using the given parameters,
-//    and performs a health check.
+//    Gets a message for every component that's in error but mapped to `ServerWarningOnly`.
 //
 // Params:
-//    hostname: Hostname of the instance.
-//    port: Port number for the T-SQL endpoint of the instance.
-//    username: Username to use to connect to the instance.
-//    password: Password to use to connect to the instance.
-//    connectionTimeout: Connection timeout.
-//        If connection fails, this function will retry until this time has elapsed.
-//        If this time elapses, the last error encountered will be returned.
-//
-// Returns:
-//    A connection to the SQL Server instance.
+//    diagnostics: The diagnostics object returned by `QueryDiagnostics()`
+//    mapping: The server health to report for each component.
 //
-func OpenDBWithHealthCheck(
-	hostname string, port uint64,
-	username string, password string,
-	applicationName string,
-	connectionTimeout time.Duration,
+func DiagnosticsWarnings(diagnostics Diagnostics, mapping DiagnosticsMapping) (warnings []string) {
+	for _, component := range diagnosticsComponents(diagnostics, mapping) {
+		if !component.healthy && component.health == ServerWarningOnly {
+			warnings = append(warnings, fmt.Sprintf("sp_server_diagnostics result indicates %s error", component.name))
+		}
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: DiagnoseWithPolicy
+//
+// Description:
+//    Uses the server health diagnostics to determine server health, using the given health policy.
+//
+//    The consecutive failures of the policy are updated with the given diagnostics. A component in error only causes
+//    an error to be returned once it has been in error for the required number of consecutive health checks.
+//    Until then, and for components mapped to `ServerWarningOnly`, a warning is returned instead.
+//
+// Params:
+//    diagnostics: The diagnostics object returned by `QueryDiagnostics()`
+//    policy: The health policy. Its consecutive failures are updated.
+//
+// Returns:
+//    A message for every component whose error was not reported, and the most severe error of the remaining components.
+//
+func DiagnoseWithPolicy(diagnostics Diagnostics, policy *HealthPolicy) (warnings []string, err error) {
+	consecutiveFailures := []*uint{
+		&policy.ConsecutiveFailures.System,
+		&policy.ConsecutiveFailures.Resource,
+		&policy.ConsecutiveFailures.QueryProcessing,
+	}
+	requiredConsecutiveFailures := []uint{
+		policy.RequiredConsecutiveFailures.System,
+		policy.RequiredConsecutiveFailures.Resource,
+		policy.RequiredConsecutiveFailures.QueryProcessing,
+	}
+
+	var result *ServerUnhealthyError
+
+	for i, component := range diagnosticsComponents(diagnostics, policy.Mapping) {
+		if component.healthy {
+			*consecutiveFailures[i] = 0
+			continue
+		}
+
+		*consecutiveFailures[i]++
+
+		if component.health == ServerWarningOnly {
+			warnings = append(warnings, fmt.Sprintf("sp_server_diagnostics result indicates %s error", component.name))
+			continue
+		}
+
+		if *consecutiveFailures[i] < requiredConsecutiveFailures[i] {
+			warnings = append(warnings, fmt.Sprintf(
+				"sp_server_diagnostics result indicates %s error (%d of %d consecutive errors required to fail)",
+				component.name, *consecutiveFailures[i], requiredConsecutiveFailures[i]))
+			continue
+		}
+
+		if result == nil || component.health < result.RawValue {
+			result = &ServerUnhealthyError{
+				RawValue: component.health,
+				Inner:    fmt.Errorf("sp_server_diagnostics result indicates %s error", component.name),
+			}
+		}
+	}
+
+	if result != nil {
+		err = result
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: DumpDiagnostics
+//
+// Description:
+//    Runs sp_server_diagnostics and logs every row it returns, including the data of each component.
+//
+// Params:
+//    db: A connection to the SQL Server instance.
+//    stdout: The logger to log the rows to.
+//
+func DumpDiagnostics(db *sql.DB, stdout *log.Logger) error {
+	rows, err := QueryDiagnosticsRaw(db)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		stdout.Printf(
+			"sp_server_diagnostics component [%s]; type [%s]; state [%s (%d)]; creation time [%s]; data [%s]\n",
+			row.ComponentName, row.ComponentType, row.StateDesc, row.State, row.CreationTime, row.Data)
+	}
+
+	return nil
+}
+
+// Function: Exit
+//
+// Description:
+//    Helper to exit with the given exit code and error.
+//
+func Exit(logger *log.Logger, exitCode int, err error) error {
+	logError(logger, err)
+
+	exitFunc(exitCode)
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetCredentialsWithTimeout
+//
+// Description:
+//    Gets the credentials from the given provider, giving up after the given timeout.
+//    The credentials file may be a FIFO or file descriptor, so the time spent waiting for the credentials must be bounded.
+//
+func GetCredentialsWithTimeout(provider CredentialProvider, timeout time.Duration) (credentials Credentials, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	credentials, err = provider.GetCredentials(ctx)
+	if err != nil && errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("Timed out after %s while reading credentials.", timeout)
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetLocalServerName
+//
+// Description:
+//    Gets the local server name.
+//
+// Params:
+//    db: A connection to a SQL Server instance.
+//
+// Returns:
+//    The name of the local server.
+//
+func GetLocalServerName(db *sql.DB) (serverName string, err error) {
+	err = db.QueryRow("SELECT @@SERVERNAME").Scan(&serverName)
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: GetProductVersion
+//
+// Description:
+//    Gets the product version of the SQL Server instance, like "15.0.4153.1".
+//
+func GetProductVersion(db *sql.DB) (productVersion string, err error) {
+	err = db.QueryRow("SELECT CAST(SERVERPROPERTY('ProductVersion') AS NVARCHAR(128))").Scan(&productVersion)
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: IsHostnameNotFound
+//
+// Description:
+//    Resolves the given hostname to determine whether it definitely does not exist,
+//    so that callers can fail fast instead of retrying to connect to a name that will never resolve.
+//
+// Returns:
+//    true if DNS reported that the hostname does not exist.
+//    An error if the lookup failed for another reason, such as a DNS server timing out, in which case the hostname may still exist.
+//
+func IsHostnameNotFound(hostname string) (notFound bool, err error) {
+	_, err = lookupHostFunc(hostname)
+	if dnsError, ok := err.(*net.DNSError); ok && dnsError.IsNotFound {
+		return true, nil
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: NewCredentialProvider
+//
+// Description:
+//    Creates the credential provider with the given name, as given by --credentials-provider.
+//
+// Params:
+//    name: One of file, vault.
+//    options: The settings of the provider.
+//
+// Returns:
+//    An error that wraps `ErrUnknownCredentialProvider` if the name is not known,
+//    or another error if the settings of the provider are missing or invalid.
+//
+func NewCredentialProvider(name string, options CredentialProviderOptions) (CredentialProvider, error) {
+	switch name {
+	case "file":
+		if options.CredentialsFile != "" {
+			return &FileCredentialProvider{Filename: options.CredentialsFile}, nil
+		}
+
+		return &PasswordFileCredentialProvider{Username: options.Username, PasswordFile: options.PasswordFile}, nil
+
+	case "vault":
+		return newVaultCredentialProvider(options, os.Getenv)
+
+	default:
+		return nil, fmt.Errorf("%w: --credentials-provider must be set to one of file, vault but it was set to %s", ErrUnknownCredentialProvider, name)
+	}
+}
+
+// --------------------------------------------------------------------------------------
+// Function: LoadConsecutiveFailures
+//
+// Description:
+//    Reads the consecutive failures of each sp_server_diagnostics component from the given file, as written by `SaveConsecutiveFailures()`.
+//    If the file does not exist, all counts are 0.
+//
+func LoadConsecutiveFailures(filename string) (consecutiveFailures ComponentCounts, err error) {
+	contents, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return ComponentCounts{}, nil
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(contents, &consecutiveFailures)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: OcfCodeName
+//
+// Description:
+//    Gets the name of the given OCF exit code, like "OCF_RUNNING_MASTER", for logging.
+//    `ImportOcfExitCodes()` must have been called first.
+//
+func OcfCodeName(ocfExitCode OcfExitCode) string {
+	name, ok := ocfCodeNames[ocfExitCode]
+	if !ok {
+		return "unknown OCF exit code"
+	}
+
+	return name
+}
+
+// Function: OcfExit
+//
+// Description:
+//    Helper to exit with the given OCF exit code and error.
+//
+//    To distinguish OCF exit codes from other exit codes (like 1 for panics),
+//    the actual exit code is the offset imported by `ImportOcfExitCodes()` (10 by default) + the OCF exit code.
+//
+func OcfExit(logger *log.Logger, ocfExitCode OcfExitCode, err error) error {
+	return Exit(logger, ocfProcessExitCode(ocfExitCode), err)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: OpenDB
+//
+// Description:
+//    Opens a connection to a SQL Server instance using the given parameters.
+//
+// Params:
+//    hostname: Hostname of the instance.
+//    port: Port number for the T-SQL endpoint of the instance.
+//    username: Username to use to connect to the instance.
+//    password: Password to use to connect to the instance.
+//    applicationName: The application name that the connection will use.
+//    connectionTimeout: Connection timeout.
+//    trustServerCertificate: Whether to trust the certificate of the instance without validating it, regardless of whether the connection is encrypted.
+//
+// Returns:
+//    A connection to the SQL Server instance.
+//
+func OpenDB(hostname string, port uint64, username string, password string, applicationName string, connectionTimeout time.Duration, trustServerCertificate bool) (*sql.DB, error) {
+	query := url.Values{}
+	query.Add("app name", applicationName)
+	query.Add("connection timeout", fmt.Sprintf("%d", connectionTimeout/time.Second))
+	if trustServerCertificate {
+		query.Add("TrustServerCertificate", "true")
+	}
+
+	u := &url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(username, password),
+		Host:     fmt.Sprintf("%s:%d", hostname, port),
+		RawQuery: query.Encode(),
+	}
+
+	connectionString := u.String()
+
+	db, err := sql.Open("mssql", connectionString)
+	if err != nil {
+		return nil, &ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: err}
+	}
+
+	err = db.Ping()
+	if err != nil {
+		_ = db.Close()
+		return nil, &ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: err}
+	}
+
+	return db, nil
+}
+
+// --------------------------------------------------------------------------------------
+// Function: OpenDBWithHealthCheck
+//
+// Description:
+//    Opens a connection to a SQL Server instance using the given parameters,
+//    and performs a health check.
+//
+// Params:
+//    hostname: Hostname of the instance.
+//    port: Port number for the T-SQL endpoint of the instance.
+//    username: Username to use to connect to the instance.
+//    password: Password to use to connect to the instance.
+//    connectionTimeout: Connection timeout. Should be at least `MinConnectionTimeout`.
+//        If connection fails, this function will retry until this time has elapsed.
+//        If this time elapses, the last error encountered will be returned.
+//        A login failure is retried like any other error, since it can be caused by the default database still recovering.
+//    trustServerCertificate: Whether to trust the certificate of the instance without validating it. See `OpenDB()`.
+//    healthCheckPort: If not 0, a port of the instance that is probed for TCP reachability before each connection attempt.
+//        While the port is not open, the attempt fails with ServerDownOrUnresponsive without waiting for the slower T-SQL connection.
+//    healthPolicy: The health policy used to determine server health from the sp_server_diagnostics results.
+//        Its consecutive failures are updated.
+//    connectStats: If not nil, is set to the statistics of the connection attempts, whether the connection succeeded or not.
+//
+// Returns:
+//    A connection to the SQL Server instance.
+//
+func OpenDBWithHealthCheck(
+	hostname string, port uint64,
+	username string, password string,
+	applicationName string,
+	connectionTimeout time.Duration,
+	trustServerCertificate bool,
+	healthCheckPort uint64,
+	healthPolicy *HealthPolicy,
+	connectStats *ConnectStats,
+	stdout *log.Logger) (db *sql.DB, err error) {
+
+	return openDBWithHealthCheck(
+		OpenDB, connectRetryInterval,
+		hostname, port, username, password, applicationName, connectionTimeout, trustServerCertificate,
+		healthCheckPort, healthPolicy, connectStats, stdout)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: ParseComponentCounts
+//
+// Description:
+//    Parses a comma-separated list of component=count pairs, like "resource=3,query_processing=2".
+//    Valid components are system, resource and query_processing. Components that are not in the list have the default count.
+//
+func ParseComponentCounts(s string, defaultCount uint) (result ComponentCounts, err error) {
+	result = ComponentCounts{System: defaultCount, Resource: defaultCount, QueryProcessing: defaultCount}
+
+	if s == "" {
+		return
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			err = fmt.Errorf("[%s] is not in the format component=count", pair)
+			return
+		}
+
+		var count uint64
+		count, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+		if err != nil {
+			err = fmt.Errorf("[%s] does not have a valid count: %s", pair, err)
+			return
+		}
+
+		switch strings.TrimSpace(parts[0]) {
+		case "system":
+			result.System = uint(count)
+		case "resource":
+			result.Resource = uint(count)
+		case "query_processing":
+			result.QueryProcessing = uint(count)
+		default:
+			err = fmt.Errorf("[%s] does not have a valid component. Valid components are system, resource and query_processing", pair)
+			return
+		}
+	}
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: QueryDiagnostics
+//
+// Description:
+//    Gets the server health diagnostics of a SQL Server instance.
+//
+// Params:
+//    db: A connection to the SQL Server instance.
+//
+func QueryDiagnostics(db *sql.DB) (result Diagnostics, err error) {
+	return QueryDiagnosticsContext(context.Background(), db)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: QueryDiagnosticsContext
+//
+// Description:
+//    Gets the server health diagnostics of a SQL Server instance like `QueryDiagnostics()`, but stops waiting for
+//    sp_server_diagnostics when the given context is done.
+//
+// Params:
+//    ctx: The context of the query. If it's done before the query completes, the query is cancelled.
+//    querier: Runs the query, usually a connection to the SQL Server instance.
+//
+// Returns:
+//    A ServerUnhealthyError with ServerDownOrUnresponsive if the context is done before the query completes.
+//
+func QueryDiagnosticsContext(ctx context.Context, querier DiagnosticsQuerier) (result Diagnostics, err error) {
+	rows, err := queryDiagnosticsRaw(ctx, querier)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = &ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: fmt.Errorf("sp_server_diagnostics did not complete: %s", ctx.Err())}
+		}
+
+		return
+	}
+
+	result = diagnosticsFromRows(rows)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: QueryDiagnosticsWithRepeatInterval
+//
+// Description:
+//    Gets the server health diagnostics of a SQL Server instance like `QueryDiagnostics()`, but runs sp_server_diagnostics
+//    with the given repeat interval and waits for the first cycle of results that has all of the system, resource and
+//    query_processing components.
+//
+//    On some builds, a single run of sp_server_diagnostics can return before all components are populated,
+//    which looks like a component error. This is slower than `QueryDiagnostics()`, since a cycle can take up to the repeat interval.
+//
+// Params:
+//    ctx: The context of the query. If it's done before a complete cycle has been read, the query is cancelled.
+//    querier: Runs the query, usually a connection to the SQL Server instance.
+//    repeatInterval: The repeat interval of sp_server_diagnostics. Must be at least `MinDiagnosticsRepeatInterval`.
+//
+// Returns:
+//    A ServerUnhealthyError with ServerDownOrUnresponsive if the context is done before a complete cycle has been read.
+//
+func QueryDiagnosticsWithRepeatInterval(ctx context.Context, querier DiagnosticsQuerier, repeatInterval time.Duration) (result Diagnostics, err error) {
+	if repeatInterval < MinDiagnosticsRepeatInterval {
+		err = fmt.Errorf("repeat interval %s is shorter than the minimum of %s", repeatInterval, MinDiagnosticsRepeatInterval)
+		return
+	}
+
+	// sp_server_diagnostics returns results until the query is cancelled, so cancel it once a complete cycle has been read
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = &ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: fmt.Errorf("sp_server_diagnostics did not return a complete cycle of results: %s", ctx.Err())}
+		}
+	}()
+
+	rows, err := querier.QueryContext(ctx, "EXEC sp_server_diagnostics @repeat_interval = ?", int(repeatInterval/time.Second))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var diagnosticsRows []DiagnosticsRow
+
+	for {
+		for rows.Next() {
+			var row DiagnosticsRow
+			err = rows.Scan(&row.CreationTime, &row.ComponentType, &row.ComponentName, &row.State, &row.StateDesc, &row.Data)
+			if err != nil {
+				return
+			}
+
+			diagnosticsRows = append(diagnosticsRows, row)
+
+			if cycle, ok := firstCompleteDiagnosticsCycle(diagnosticsRows); ok {
+				result = diagnosticsFromRows(cycle)
+				return
+			}
+		}
+
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+
+		if !rows.NextResultSet() {
+			err = errors.New("sp_server_diagnostics did not return a complete cycle of results")
+			return
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------
+// Function: QueryDiagnosticsRaw
+//
+// Description:
+//    Gets the rows returned by sp_server_diagnostics for a SQL Server instance, including the data of each component.
+//
+// Params:
+//    db: A connection to the SQL Server instance.
+//
+func QueryDiagnosticsRaw(db *sql.DB) (result []DiagnosticsRow, err error) {
+	return queryDiagnosticsRaw(context.Background(), db)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: QueryHealthCheck
+//
+// Description:
+//    Runs a custom health check statement, such as a call to a stored procedure that the login is granted EXECUTE on,
+//    instead of sp_server_diagnostics.
+//
+//    The statement must return a single row with a single integer column. 0 means the instance is healthy,
+//    and any other value is the `ServerHealth` of the instance, like 3 for `ServerCriticalError`.
+//
+// Params:
+//    ctx: The context of the query. If it's done before the query completes, the query is cancelled.
+//    querier: Runs the query, usually a connection to the SQL Server instance.
+//    query: The statement to run.
+//
+// Returns:
+//    A ServerUnhealthyError with ServerDownOrUnresponsive if the context is done before the query completes.
+//
+func QueryHealthCheck(ctx context.Context, querier DiagnosticsQuerier, query string) (health ServerHealth, err error) {
+	rows, err := querier.QueryContext(ctx, query)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = &ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: fmt.Errorf("health check query did not complete: %s", ctx.Err())}
+		} else {
+			err = fmt.Errorf("Could not run health check query: %s", err)
+		}
+
+		return
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		err = rows.Err()
+		if err == nil {
+			err = errors.New("health check query did not return a row")
+		}
+
+		return
+	}
+
+	var value int64
+	err = rows.Scan(&value)
+	if err != nil {
+		err = fmt.Errorf("Could not read result of health check query as a single integer: %s", err)
+		return
+	}
+
+	if value < 0 {
+		err = fmt.Errorf("health check query returned %d but it must not be negative", value)
+		return
+	}
+
+	health = ServerHealth(value)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: ReadCredentials
+//
+// Description:
+//    Reads a SQL username and password from the given reader, in the format described in `ReadCredentialsFile()`.
+//
+//    The reader may be backed by a pipe, in which case the read blocks until the writer provides the credentials.
+//    If the credentials have not been read when the timeout elapses, an error is returned.
+//
+// Params:
+//    reader: The source of the credentials.
+//    timeout: How long to wait for the credentials to be read.
+//
+func ReadCredentials(reader io.Reader, timeout time.Duration) (username string, password string, err error) {
+	return readCredentialsWithTimeout(func() (string, string, error) { return readCredentials(reader) }, timeout)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: ReadCredentialsFile
+//
+// Description:
+//    Reads the specified credentials file to extract a SQL username and password.
+//    - The first line contains the username.
+//    - The second line contains the password.
+//    - Lines are separated by LF.
+//    - The second line can end with LF or EOF.
+//
+func ReadCredentialsFile(filename string) (username string, password string, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	return readCredentials(file)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: ReadCredentialsFileWithTimeout
+//
+// Description:
+//    Reads the specified credentials file like `ReadCredentialsFile()`, but gives up if the credentials
+//    have not been read when the timeout elapses.
+//
+//    This allows the credentials to be delivered over a FIFO or a file descriptor (like /dev/fd/3), where opening
+//    and reading the file blocks until the writer provides the credentials.
+//
+// Params:
+//    filename: The path to the credentials file, FIFO or file descriptor.
+//    timeout: How long to wait for the credentials to be read.
+//
+func ReadCredentialsFileWithTimeout(filename string, timeout time.Duration) (username string, password string, err error) {
+	return readCredentialsWithTimeout(func() (string, string, error) { return ReadCredentialsFile(filename) }, timeout)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: ReadPasswordFile
+//
+// Description:
+//    Reads the specified password file to extract a SQL password.
+//    - The file contains only the password.
+//    - A single trailing LF (or CRLF) is not considered part of the password.
+//
+func ReadPasswordFile(filename string) (password string, err error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+
+	password = strings.TrimSuffix(string(contents), "\n")
+	password = strings.TrimSuffix(password, "\r")
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: SaveConsecutiveFailures
+//
+// Description:
+//    Writes the consecutive failures of each sp_server_diagnostics component to the given file,
+//    so that they can be read by `LoadConsecutiveFailures()` during the next health check.
+//
+func SaveConsecutiveFailures(filename string, consecutiveFailures ComponentCounts) error {
+	contents, err := json.Marshal(consecutiveFailures)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it over the original so that a concurrent reader never sees a partial file
+	temporaryFilename := filename + ".tmp"
+
+	err = ioutil.WriteFile(temporaryFilename, contents, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporaryFilename, filename)
+}
+
+// --------------------------------------------------------------------------------------
+// Function: SetLocalServerName
+//
+// Description:
+//    Sets the local server name to the given name via sp_dropserver + sp_addserver
+//
+// Params:
+//    db: A connection to a SQL Server instance.
+//    serverName: The new name of the local server.
+//
+func SetLocalServerName(db *sql.DB, serverName string) error {
+	var currentServerName string
+	err := db.QueryRow(`SELECT name FROM sys.servers WHERE server_id = 0`).Scan(&currentServerName)
+
+	if err == nil && strings.EqualFold(currentServerName, serverName) {
+		// Existing sys.servers row already has the specified name
+		return nil
+	}
+
+	if err != nil && err != sql.ErrNoRows {
+		// Unexpected error
+		return err
+	}
+
+	if err == nil {
+		// There is an existing sys.servers row and it has a different name than the specified name. Drop it.
+		_, err = db.Exec("EXEC sp_dropserver ?", currentServerName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// At this point there is no sys.servers row for a local server. Add a row with the specified name.
+	_, err = db.Exec("EXEC sp_addserver ?, local", serverName)
+
+	return err
+}
+
+// --------------------------------------------------------------------------------------
+// Function: SetLocalServerNameAndWait
+//
+// Description:
+//    Sets the local server name like `SetLocalServerName()`, then waits for @@SERVERNAME to show the new name,
+//    since the change to sys.servers doesn't always take effect immediately.
+//
+// Params:
+//    db: A connection to a SQL Server instance.
+//    serverName: The new name of the local server.
+//    timeout: How long to wait for @@SERVERNAME to show the new name.
+//
+// Returns:
+//    An error that wraps ErrServerNameRestartRequired if @@SERVERNAME still doesn't show the new name after the timeout.
+//
+func SetLocalServerNameAndWait(db *sql.DB, serverName string, timeout time.Duration) error {
+	err := SetLocalServerName(db, serverName)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		currentServerName, err := GetLocalServerName(db)
+		if err != nil {
+			return err
+		}
+
+		if strings.EqualFold(currentServerName, serverName) {
+			return nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf(
+				"%w: @@SERVERNAME is still %s instead of %s after %s. The instance must be restarted for the new name to take effect",
+				ErrServerNameRestartRequired, currentServerName, serverName, timeout)
+		}
+
+		time.Sleep(serverNamePollInterval)
+	}
+}
+
+// --------------------------------------------------------------------------------------
+// Function: SetSessionContext
+//
+// Description:
+//    Sets the given key of the session context of the connection to the given read-only value with sp_set_session_context,
+//    and reads it back in the same batch, so that both statements are guaranteed to run on the same connection.
+//
+// Returns:
+//    The value of the key after setting it, and whether the key is set at all.
+//
+func SetSessionContext(db *sql.DB, key string, value string) (appliedValue string, isSet bool, err error) {
+	var nullableValue sql.NullString
+	err = db.QueryRow(
+		"EXEC sp_set_session_context @key = ?, @value = ?, @read_only = 1; SELECT CAST(SESSION_CONTEXT(?) AS NVARCHAR(4000))",
+		key, value, key).Scan(&nullableValue)
+	if err != nil {
+		return
+	}
+
+	appliedValue = nullableValue.String
+	isSet = nullableValue.Valid
+
+	return
+}
+
+// Resolves the Vault settings of the given options, falling back to the VAULT_ADDR and VAULT_TOKEN environment variables
+// the same way the Vault CLI does. A token file takes precedence over VAULT_TOKEN.
+func newVaultCredentialProvider(options CredentialProviderOptions, getenv func(string) string) (*VaultCredentialProvider, error) {
+	if options.VaultPath == "" {
+		return nil, errors.New("a valid Vault secret path must be specified using --vault-path")
+	}
+
+	vaultAddress := options.VaultAddress
+	if vaultAddress == "" {
+		vaultAddress = getenv("VAULT_ADDR")
+	}
+	if vaultAddress == "" {
+		return nil, errors.New("a valid Vault address must be specified using --vault-address or the VAULT_ADDR environment variable")
+	}
+
+	vaultToken := getenv("VAULT_TOKEN")
+	if options.VaultTokenFile != "" {
+		var err error
+		vaultToken, err = ReadPasswordFile(options.VaultTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read Vault token file: %s", err)
+		}
+	}
+	if vaultToken == "" {
+		return nil, errors.New("a valid Vault token must be specified using --vault-token-file or the VAULT_TOKEN environment variable")
+	}
+
+	return &VaultCredentialProvider{Address: vaultAddress, Path: options.VaultPath, Token: vaultToken}, nil
+}
+
+func readCredentials(reader io.Reader) (username string, password string, err error) {
+	scanner := bufio.NewScanner(reader)
+
+	if !scanner.Scan() {
+		err = fmt.Errorf("Could not read first line to extract username.")
+		return
+	}
+	username = scanner.Text()
+
+	if !scanner.Scan() {
+		err = fmt.Errorf("Could not read second line to extract password.")
+		return
+	}
+	password = scanner.Text()
+
+	return
+}
+
+func readCredentialsWithTimeout(read func() (string, string, error), timeout time.Duration) (username string, password string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	username, password, err = readCredentialsWithContext(ctx, read)
+	if err == context.DeadlineExceeded {
+		err = fmt.Errorf("Timed out after %s while reading credentials.", timeout)
+	}
+
+	return
+}
+
+func readCredentialsWithContext(ctx context.Context, read func() (string, string, error)) (username string, password string, err error) {
+	type result struct {
+		username string
+		password string
+		err      error
+	}
+
+	// Buffered so that the reading goroutine can exit even if the timeout has already elapsed.
+	// If the read never completes, the goroutine is leaked, which is acceptable for these short-lived processes.
+	resultChannel := make(chan result, 1)
+
+	go func() {
+		username, password, err := read()
+		resultChannel <- result{username, password, err}
+	}()
+
+	select {
+	case r := <-resultChannel:
+		return r.username, r.password, r.err
+
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	}
+}
+
+func logError(logger *log.Logger, err error) {
+	if err != nil {
+		// Print each line individually to ensure that each line is prefixed with the logger prefix
+		for _, line := range strings.Split(err.Error(), "\n") {
+			logger.Println(line)
+		}
+	}
+}
+
+func probeTCPPort(hostname string, port uint64, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(hostname, strconv.FormatUint(port, 10)), timeout)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+func ocfProcessExitCode(ocfExitCode OcfExitCode) int {
+	return int(ocfExitCode) + ocfExitCodeOffset
+}
+
+type diagnosticsComponent struct {
+	name    string
+	healthy bool
+	health  ServerHealth
+}
+
+func diagnosticsComponents(diagnostics Diagnostics, mapping DiagnosticsMapping) []diagnosticsComponent {
+	return []diagnosticsComponent{
+		{name: "system", healthy: diagnostics.System, health: mapping.System},
+		{name: "resource", healthy: diagnostics.Resource, health: mapping.Resource},
+		{name: "query processing", healthy: diagnostics.QueryProcessing, health: mapping.QueryProcessing},
+	}
+}
+
+func openDBWithHealthCheckInner(
+	hostname string, port uint64,
+	username string, password string,
+	applicationName string,
+	connectionTimeout time.Duration,
+	trustServerCertificate bool) (db *sql.DB, err error) {
+
+	db, err = OpenDB(hostname, port, username, password, applicationName, connectionTimeout, trustServerCertificate)
+	if err != nil {
+		return
+	}
+
+	diagnostics, err := QueryDiagnostics(db)
+	if err != nil {
+		return
+	}
+
+	err = Diagnose(diagnostics)
+
+	return
+}
+
+// --------------------------------------------------------------------------------------
+// Function: openDBWithHealthCheck
+//
+// Description:
+//    Implements `OpenDBWithHealthCheck()` with the given function to open each connection attempt
+//    and the given time to wait between attempts.
+//
+//    The connection attempts run in a goroutine that stops when this function returns,
+//    and that closes a connection it opens after this function has returned.
+//
+func openDBWithHealthCheck(
+	openDB dbOpener, retryInterval time.Duration,
+	hostname string, port uint64,
+	username string, password string,
+	applicationName string,
+	connectionTimeout time.Duration,
+	trustServerCertificate bool,
+	healthCheckPort uint64,
+	healthPolicy *HealthPolicy,
+	connectStats *ConnectStats,
 	stdout *log.Logger) (db *sql.DB, err error) {
 
 	dbChannel := make(chan *sql.DB)
 	errChannel := make(chan error)
+	done := make(chan struct{})
+	defer close(done)
+	startTime := time.Now()
 	timeoutChannel := time.After(connectionTimeout)
+	var numFailedAttempts uint
+	var lastAttemptErr error
+	var connected bool
+
+	if connectStats != nil {
+		defer func() {
+			connectStats.Attempts = numFailedAttempts
+			if connected {
+				connectStats.Attempts++
+			}
+			connectStats.TotalWait = time.Since(startTime)
+			connectStats.LastError = lastAttemptErr
+		}()
+	}
 
 	go func() {
-		var db *sql.DB
-		var err error
-
 		for i := uint(1); ; i++ {
 			stdout.Printf("Attempt %d to connect to the instance at %s:%d and run sp_server_diagnostics\n", i, hostname, port)
 
-			if db != nil {
-				_ = db.Close()
+			if healthCheckPort != 0 {
+				err := probeTCPPort(hostname, healthCheckPort, healthCheckPortProbeTimeout)
+				if err != nil {
+					stdout.Printf("Attempt %d could not reach health check port %d: %s\n", i, healthCheckPort, err)
+
+					if !sendOrDone(errChannel, &ServerUnhealthyError{
+						RawValue: ServerDownOrUnresponsive,
+						Inner:    fmt.Errorf("health check port %s:%d is not open: %s", hostname, healthCheckPort, err),
+					}, done) || !sleepOrDone(retryInterval, done) {
+						return
+					}
+
+					continue
+				}
 			}
 
-			db, err = OpenDB(hostname, port, username, password, applicationName, connectionTimeout)
+			// Every attempt opens a new connection pool, and a failed attempt closes its pool before returning,
+			// so no connection is reused across attempts and the hostname is resolved again each time.
+			// This picks up a DNS change or failover that happens while retrying.
+			db, err := openDB(hostname, port, username, password, applicationName, connectionTimeout, trustServerCertificate)
 			if err == nil {
 				stdout.Printf("Connected to the instance at %s:%d\n", hostname, port)
-				dbChannel <- db
+
+				select {
+				case dbChannel <- db:
+				case <-done:
+					// The caller has already timed out, so drain the connections of the pool instead of leaking them
+					_ = db.Close()
+				}
+
 				return
 			}
 
 			stdout.Printf("Attempt %d returned error: %s\n", i, err)
 
-			errChannel <- err
-
-			time.Sleep(1 * time.Second)
+			if !sendOrDone(errChannel, err, done) || !sleepOrDone(retryInterval, done) {
+				return
+			}
 		}
 	}()
 
@@ -341,25 +1706,68 @@ func OpenDBWithHealthCheck(
 	for {
 		select {
 		case db = <-dbChannel:
+			connected = true
+
+			if healthPolicy.HealthCheckQuery != "" {
+				healthCheckContext, cancel := context.WithDeadline(context.Background(), startTime.Add(connectionTimeout))
+				var health ServerHealth
+				health, err = QueryHealthCheck(healthCheckContext, db, healthPolicy.HealthCheckQuery)
+				cancel()
+				if err != nil {
+					_ = db.Close()
+					return nil, err
+				}
+
+				if health != 0 {
+					err = &ServerUnhealthyError{RawValue: health, Inner: fmt.Errorf("health check query returned %d", health)}
+				}
+
+				return
+			}
+
+			// The query counts against the connection timeout, so that an instance that accepts connections but hangs in sp_server_diagnostics is reported as unresponsive
+			diagnosticsContext, cancel := context.WithDeadline(context.Background(), startTime.Add(connectionTimeout))
 			var diagnostics Diagnostics
-			diagnostics, err = QueryDiagnostics(db)
+			if healthPolicy.DiagnosticsRepeatInterval > 0 {
+				diagnostics, err = QueryDiagnosticsWithRepeatInterval(diagnosticsContext, db, healthPolicy.DiagnosticsRepeatInterval)
+			} else {
+				diagnostics, err = QueryDiagnosticsContext(diagnosticsContext, db)
+			}
+			cancel()
 			if err != nil {
 				_ = db.Close()
 				return nil, err
 			}
-			err = Diagnose(diagnostics)
+			var warnings []string
+			warnings, err = DiagnoseWithPolicy(diagnostics, healthPolicy)
+			for _, warning := range warnings {
+				stdout.Printf("Warning: %s\n", warning)
+			}
 			return
 
 		case err = <-errChannel:
 			// Store the latest error so that it can be returned on timeout
+			numFailedAttempts++
+			lastAttemptErr = err
 
 		case _ = <-timeoutChannel:
+			elapsed := time.Since(startTime).Round(time.Millisecond)
+
 			if err == nil {
 				// Connection goroutine timed out without failing even once, so construct a ServerDownOrUnresponsive error to return to the caller
 
 				err = &ServerUnhealthyError{
 					RawValue: ServerDownOrUnresponsive,
-					Inner:    fmt.Errorf("timed out while attempting to connect to the instance at %s:%d and run sp_server_diagnostics", hostname, port),
+					Inner: fmt.Errorf(
+						"%w after %s and %d failed attempts while attempting to connect to the instance at %s:%d and run sp_server_diagnostics",
+						ErrConnectTimedOut, elapsed, numFailedAttempts, hostname, port),
+				}
+			} else if serverUnhealthyError, ok := err.(*ServerUnhealthyError); ok {
+				err = &ServerUnhealthyError{
+					RawValue: serverUnhealthyError.RawValue,
+					Inner: fmt.Errorf(
+						"%w after %s and %d failed attempts while attempting to connect to the instance at %s:%d and run sp_server_diagnostics. Last error: %w",
+						ErrConnectTimedOut, elapsed, numFailedAttempts, hostname, port, serverUnhealthyError.Inner),
 				}
 			}
 
@@ -369,38 +1777,26 @@ func OpenDBWithHealthCheck(
 }
 
 // --------------------------------------------------------------------------------------
-// Function: QueryDiagnostics
+// Function: queryDiagnosticsRaw
 //
 // Description:
-//    Gets the server health diagnostics of a SQL Server instance.
-//
-// Params:
-//    db: A connection to the SQL Server instance.
+//    Implements `QueryDiagnosticsRaw()` with a context and a querier, for `QueryDiagnosticsContext()`.
 //
-func QueryDiagnostics(db *sql.DB) (result Diagnostics, err error) {
-	rows, err := db.Query("EXEC sp_server_diagnostics")
+func queryDiagnosticsRaw(ctx context.Context, querier DiagnosticsQuerier) (result []DiagnosticsRow, err error) {
+	rows, err := querier.QueryContext(ctx, "EXEC sp_server_diagnostics")
 	if err != nil {
-		return result, err
+		return
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var creationTime, componentType, componentName, stateDesc, data string
-		var state int // https://msdn.microsoft.com/en-us/library/ff878233.aspx
-
-		err = rows.Scan(&creationTime, &componentType, &componentName, &state, &stateDesc, &data)
+		var row DiagnosticsRow
+		err = rows.Scan(&row.CreationTime, &row.ComponentType, &row.ComponentName, &row.State, &row.StateDesc, &row.Data)
 		if err != nil {
-			break
+			return
 		}
 
-		switch componentName {
-		case "system":
-			result.System = state == 1
-		case "resource":
-			result.Resource = state == 1
-		case "query_processing":
-			result.QueryProcessing = state == 1
-		}
+		result = append(result, row)
 	}
 
 	err = rows.Err()
@@ -409,94 +1805,103 @@ func QueryDiagnostics(db *sql.DB) (result Diagnostics, err error) {
 }
 
 // --------------------------------------------------------------------------------------
-// Function: ReadCredentialsFile
+// Function: diagnosticsFromRows
 //
 // Description:
-//    Reads the specified credentials file to extract a SQL username and password.
-//    - The first line contains the username.
-//    - The second line contains the password.
-//    - Lines are separated by LF.
-//    - The second line can end with LF or EOF.
+//    Gets the server health diagnostics from the rows returned by sp_server_diagnostics.
 //
-func ReadCredentialsFile(filename string) (username string, password string, err error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-
-	if !scanner.Scan() {
-		err = fmt.Errorf("Could not read first line to extract username.")
-		return
-	}
-	username = scanner.Text()
-
-	if !scanner.Scan() {
-		err = fmt.Errorf("Could not read second line to extract password.")
-		return
+func diagnosticsFromRows(rows []DiagnosticsRow) (result Diagnostics) {
+	for _, row := range rows {
+		switch row.ComponentName {
+		case "system":
+			result.System = row.State == 1
+		case "resource":
+			result.Resource = row.State == 1
+		case "query_processing":
+			result.QueryProcessing = row.State == 1
+		}
 	}
-	password = scanner.Text()
 
 	return
 }
 
 // --------------------------------------------------------------------------------------
-// Function: SetLocalServerName
+// Function: firstCompleteDiagnosticsCycle
 //
 // Description:
-//    Sets the local server name to the given name via sp_dropserver + sp_addserver
+//    Finds the first cycle of rows returned by sp_server_diagnostics with a repeat interval that has all of the
+//    system, resource and query_processing components. The rows of a cycle have the same creation time.
 //
-// Params:
-//    db: A connection to a SQL Server instance.
-//    serverName: The new name of the local server.
+// Returns:
+//    The rows of the cycle. ok is false if no cycle is complete yet.
 //
-func SetLocalServerName(db *sql.DB, serverName string) error {
-	var currentServerName string
-	err := db.QueryRow(`SELECT name FROM sys.servers WHERE server_id = 0`).Scan(&currentServerName)
+func firstCompleteDiagnosticsCycle(rows []DiagnosticsRow) (cycle []DiagnosticsRow, ok bool) {
+	var creationTimes []string
+	cycles := make(map[string][]DiagnosticsRow)
+	for _, row := range rows {
+		if _, seen := cycles[row.CreationTime]; !seen {
+			creationTimes = append(creationTimes, row.CreationTime)
+		}
 
-	if err == nil && strings.EqualFold(currentServerName, serverName) {
-		// Existing sys.servers row already has the specified name
-		return nil
+		cycles[row.CreationTime] = append(cycles[row.CreationTime], row)
 	}
 
-	if err != nil && err != sql.ErrNoRows {
-		// Unexpected error
-		return err
-	}
+	for _, creationTime := range creationTimes {
+		var hasSystem, hasResource, hasQueryProcessing bool
+		for _, row := range cycles[creationTime] {
+			switch row.ComponentName {
+			case "system":
+				hasSystem = true
+			case "resource":
+				hasResource = true
+			case "query_processing":
+				hasQueryProcessing = true
+			}
+		}
 
-	if err == nil {
-		// There is an existing sys.servers row and it has a different name than the specified name. Drop it.
-		_, err = db.Exec("EXEC sp_dropserver ?", currentServerName)
-		if err != nil {
-			return err
+		if hasSystem && hasResource && hasQueryProcessing {
+			return cycles[creationTime], true
 		}
 	}
 
-	// At this point there is no sys.servers row for a local server. Add a row with the specified name.
-	_, err = db.Exec("EXEC sp_addserver ?, local", serverName)
-
-	return err
+	return nil, false
 }
 
-func openDBWithHealthCheckInner(
-	hostname string, port uint64,
-	username string, password string,
-	applicationName string,
-	connectionTimeout time.Duration) (db *sql.DB, err error) {
-
-	db, err = OpenDB(hostname, port, username, password, applicationName, connectionTimeout)
-	if err != nil {
-		return
+// --------------------------------------------------------------------------------------
+// Function: sendOrDone
+//
+// Description:
+//    Sends the error to the channel unless the done channel is closed first.
+//
+// Returns:
+//    false if the done channel was closed.
+//
+func sendOrDone(errChannel chan<- error, err error, done <-chan struct{}) bool {
+	select {
+	case errChannel <- err:
+		return true
+	case <-done:
+		return false
 	}
+}
 
-	diagnostics, err := QueryDiagnostics(db)
-	if err != nil {
-		return
+// --------------------------------------------------------------------------------------
+// Function: sleepOrDone
+//
+// Description:
+//    Sleeps for the given duration unless the done channel is closed first.
+//
+// Returns:
+//    false if the done channel was closed.
+//
+func sleepOrDone(duration time.Duration, done <-chan struct{}) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
 	}
-
-	err = Diagnose(diagnostics)
-
-	return
 }
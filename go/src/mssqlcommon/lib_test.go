@@ -23,9 +23,25 @@
 package mssqlcommon
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestImportOcfExitCodes(t *testing.T) {
@@ -58,6 +74,13 @@ func TestImportOcfExitCodes(t *testing.T) {
 		t.Fatalf("Expected ImportOcfExitCodes to succeed but it failed: %s", err)
 	}
 
+	for key, value := range requiredEnvironmentVariables {
+		code, _ := strconv.Atoi(value)
+		if OcfCodeName(OcfExitCode(code)) != key {
+			t.Fatalf("Expected OcfCodeName(%d) to be %s but it was %s", code, key, OcfCodeName(OcfExitCode(code)))
+		}
+	}
+
 	// One var not set
 	os.Unsetenv("OCF_SUCCESS")
 	err = ImportOcfExitCodes()
@@ -79,6 +102,66 @@ func TestImportOcfExitCodes(t *testing.T) {
 	}
 }
 
+func TestOcfExitCodeOffset(t *testing.T) {
+	var requiredEnvironmentVariables = map[string]string{
+		"OCF_SUCCESS":           "0",
+		"OCF_ERR_ARGS":          "2",
+		"OCF_ERR_CONFIGURED":    "6",
+		"OCF_ERR_GENERIC":       "1",
+		"OCF_ERR_PERM":          "4",
+		"OCF_ERR_UNIMPLEMENTED": "3",
+		"OCF_FAILED_MASTER":     "9",
+		"OCF_NOT_RUNNING":       "7",
+		"OCF_RUNNING_MASTER":    "8",
+	}
+
+	for key, value := range requiredEnvironmentVariables {
+		os.Setenv(key, value)
+	}
+
+	var exitCode int
+	exitFunc = func(code int) { exitCode = code }
+	defer func() {
+		exitFunc = os.Exit
+		ocfExitCodeOffset = DefaultOcfExitCodeOffset
+		os.Unsetenv("MSSQL_OCF_EXIT_CODE_OFFSET")
+	}()
+
+	logger := log.New(ioutil.Discard, "", 0)
+
+	for _, testCase := range []struct {
+		offset           string
+		expectedExitCode int
+	}{
+		{"", 17},
+		{"3", 10},
+		{"100", 107},
+		{"246", 253},
+	} {
+		os.Setenv("MSSQL_OCF_EXIT_CODE_OFFSET", testCase.offset)
+
+		err := ImportOcfExitCodes()
+		if err != nil {
+			t.Fatalf("Expected ImportOcfExitCodes to succeed with offset [%s] but it failed: %s", testCase.offset, err)
+		}
+
+		OcfExit(logger, OCF_NOT_RUNNING, nil)
+
+		if exitCode != testCase.expectedExitCode {
+			t.Fatalf("Expected OcfExit with offset [%s] to exit with %d but it exited with %d", testCase.offset, testCase.expectedExitCode, exitCode)
+		}
+	}
+
+	for _, offset := range []string{"A", "-1", "2", "247"} {
+		os.Setenv("MSSQL_OCF_EXIT_CODE_OFFSET", offset)
+
+		err := ImportOcfExitCodes()
+		if err == nil {
+			t.Fatalf("Expected ImportOcfExitCodes to fail with offset [%s] but it succeeded", offset)
+		}
+	}
+}
+
 func TestDiagnose(t *testing.T) {
 	t.Parallel()
 
@@ -144,3 +227,1035 @@ func TestDiagnose(t *testing.T) {
 		}
 	}
 }
+
+func TestDiagnoseWith(t *testing.T) {
+	t.Parallel()
+
+	queryProcessingAsWarning := DefaultDiagnosticsMapping
+	queryProcessingAsWarning.QueryProcessing = ServerWarningOnly
+
+	resourceAsCritical := DefaultDiagnosticsMapping
+	resourceAsCritical.System = ServerModerateError
+	resourceAsCritical.Resource = ServerCriticalError
+
+	testCases := []struct {
+		name             string
+		diagnostics      Diagnostics
+		mapping          DiagnosticsMapping
+		expectedHealth   ServerHealth
+		expectedWarnings int
+	}{
+		{"query processing error as warning", Diagnostics{System: true, Resource: true, QueryProcessing: false}, queryProcessingAsWarning, ServerWarningOnly, 1},
+		{"resource error with query processing as warning", Diagnostics{System: true, Resource: false, QueryProcessing: false}, queryProcessingAsWarning, ServerModerateError, 1},
+		{"most severe component wins", Diagnostics{System: false, Resource: false, QueryProcessing: true}, resourceAsCritical, ServerCriticalError, 0},
+		{"healthy", Diagnostics{System: true, Resource: true, QueryProcessing: true}, queryProcessingAsWarning, ServerWarningOnly, 0},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := DiagnoseWith(testCase.diagnostics, testCase.mapping)
+
+			if testCase.expectedHealth == ServerWarningOnly {
+				if err != nil {
+					t.Fatalf("Expected DiagnoseWith to succeed but it failed: %s", err)
+				}
+			} else {
+				serverUnhealthyError, ok := err.(*ServerUnhealthyError)
+				if !ok {
+					t.Fatalf("DiagnoseWith did not return an error of type ServerUnhealthyError: %v", err)
+				}
+
+				if serverUnhealthyError.RawValue != testCase.expectedHealth {
+					t.Fatalf("Expected DiagnoseWith to fail with %d but it failed with %d", testCase.expectedHealth, serverUnhealthyError.RawValue)
+				}
+			}
+
+			warnings := DiagnosticsWarnings(testCase.diagnostics, testCase.mapping)
+			if len(warnings) != testCase.expectedWarnings {
+				t.Fatalf("Expected %d warnings but got %d: %v", testCase.expectedWarnings, len(warnings), warnings)
+			}
+		})
+	}
+}
+
+func TestDiagnoseWithPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy := &HealthPolicy{
+		Mapping:                     DefaultDiagnosticsMapping,
+		RequiredConsecutiveFailures: ComponentCounts{System: 1, Resource: 3, QueryProcessing: 1},
+	}
+
+	resourceError := Diagnostics{System: true, Resource: false, QueryProcessing: true}
+
+	for i := uint(1); i < 3; i++ {
+		warnings, err := DiagnoseWithPolicy(resourceError, policy)
+		if err != nil {
+			t.Fatalf("Expected DiagnoseWithPolicy to tolerate resource error %d but it failed: %s", i, err)
+		}
+
+		if len(warnings) != 1 {
+			t.Fatalf("Expected 1 warning but got %d: %v", len(warnings), warnings)
+		}
+
+		if policy.ConsecutiveFailures.Resource != i {
+			t.Fatalf("Expected %d consecutive resource failures but got %d", i, policy.ConsecutiveFailures.Resource)
+		}
+	}
+
+	_, err := DiagnoseWithPolicy(resourceError, policy)
+	serverUnhealthyError, ok := err.(*ServerUnhealthyError)
+	if !ok {
+		t.Fatalf("DiagnoseWithPolicy did not return an error of type ServerUnhealthyError: %v", err)
+	}
+	if serverUnhealthyError.RawValue != ServerModerateError {
+		t.Fatalf("Expected DiagnoseWithPolicy to fail with %d but it failed with %d", ServerModerateError, serverUnhealthyError.RawValue)
+	}
+
+	_, err = DiagnoseWithPolicy(Diagnostics{System: true, Resource: true, QueryProcessing: true}, policy)
+	if err != nil {
+		t.Fatalf("Expected DiagnoseWithPolicy to succeed but it failed: %s", err)
+	}
+	if policy.ConsecutiveFailures.Resource != 0 {
+		t.Fatalf("Expected consecutive resource failures to be reset but got %d", policy.ConsecutiveFailures.Resource)
+	}
+
+	_, err = DiagnoseWithPolicy(Diagnostics{System: false, Resource: true, QueryProcessing: true}, policy)
+	serverUnhealthyError, ok = err.(*ServerUnhealthyError)
+	if !ok || serverUnhealthyError.RawValue != ServerCriticalError {
+		t.Fatalf("Expected DiagnoseWithPolicy to fail immediately with %d for a system error: %v", ServerCriticalError, err)
+	}
+}
+
+func TestParseComponentCounts(t *testing.T) {
+	t.Parallel()
+
+	counts, err := ParseComponentCounts("resource=3, query_processing=2", 1)
+	if err != nil {
+		t.Fatalf("Expected ParseComponentCounts to succeed but it failed: %s", err)
+	}
+
+	expected := ComponentCounts{System: 1, Resource: 3, QueryProcessing: 2}
+	if counts != expected {
+		t.Fatalf("Expected %+v but got %+v", expected, counts)
+	}
+
+	for _, invalid := range []string{"resource", "memory=3", "resource=-1", "resource=many"} {
+		_, err = ParseComponentCounts(invalid, 1)
+		if err == nil {
+			t.Fatalf("Expected ParseComponentCounts to fail for %q but it succeeded", invalid)
+		}
+	}
+}
+
+func TestSaveAndLoadConsecutiveFailures(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "consecutive-failures")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := dir + "/consecutive-failures.json"
+
+	counts, err := LoadConsecutiveFailures(filename)
+	if err != nil {
+		t.Fatalf("Expected LoadConsecutiveFailures to succeed for a missing file but it failed: %s", err)
+	}
+	if counts != (ComponentCounts{}) {
+		t.Fatalf("Expected zero counts for a missing file but got %+v", counts)
+	}
+
+	expected := ComponentCounts{System: 0, Resource: 2, QueryProcessing: 1}
+	err = SaveConsecutiveFailures(filename, expected)
+	if err != nil {
+		t.Fatalf("Expected SaveConsecutiveFailures to succeed but it failed: %s", err)
+	}
+
+	counts, err = LoadConsecutiveFailures(filename)
+	if err != nil {
+		t.Fatalf("Expected LoadConsecutiveFailures to succeed but it failed: %s", err)
+	}
+	if counts != expected {
+		t.Fatalf("Expected %+v but got %+v", expected, counts)
+	}
+}
+
+func TestReadPasswordFile(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]string{
+		"password":       "password",
+		"password\n":     "password",
+		"password\r\n":   "password",
+		"pass word\n\n":  "pass word\n",
+		"\n":             "",
+		"password\nmore": "password\nmore",
+	}
+
+	for contents, expectedPassword := range testCases {
+		contents := contents
+		expectedPassword := expectedPassword
+
+		t.Run(fmt.Sprintf("%q", contents), func(t *testing.T) {
+			t.Parallel()
+
+			file, err := ioutil.TempFile("", "password")
+			if err != nil {
+				t.Fatalf("Could not create password file: %s", err)
+			}
+			defer os.Remove(file.Name())
+
+			_, err = file.WriteString(contents)
+			file.Close()
+			if err != nil {
+				t.Fatalf("Could not write password file: %s", err)
+			}
+
+			password, err := ReadPasswordFile(file.Name())
+			if err != nil {
+				t.Fatalf("Expected ReadPasswordFile to succeed but it failed: %s", err)
+			}
+
+			if password != expectedPassword {
+				t.Fatalf("Expected password %q but got %q", expectedPassword, password)
+			}
+		})
+	}
+}
+
+func TestOcfExit(t *testing.T) {
+	var exitCode int
+	exitFunc = func(code int) { exitCode = code }
+	defer func() { exitFunc = os.Exit }()
+
+	var output bytes.Buffer
+	logger := log.New(&output, "ERROR: ", 0)
+
+	OcfExit(logger, OcfExitCode(8), errors.New("first line\nsecond line"))
+
+	if exitCode != 18 {
+		t.Fatalf("Expected OcfExit to exit with 18 but it exited with %d", exitCode)
+	}
+
+	if output.String() != "ERROR: first line\nERROR: second line\n" {
+		t.Fatalf("OcfExit did not prefix each line of the error: %q", output.String())
+	}
+
+	output.Reset()
+
+	OcfExit(logger, OcfExitCode(0), nil)
+
+	if exitCode != 10 {
+		t.Fatalf("Expected OcfExit to exit with 10 but it exited with %d", exitCode)
+	}
+
+	if output.Len() != 0 {
+		t.Fatalf("Expected OcfExit to not log anything but it logged %q", output.String())
+	}
+}
+
+func TestOpenDBWithHealthCheckTimeout(t *testing.T) {
+	t.Parallel()
+
+	// No SQL Server driver is registered in this test binary, so every connection attempt fails immediately.
+	var output bytes.Buffer
+	_, err := OpenDBWithHealthCheck(
+		"localhost", 1433,
+		"username", "password",
+		"test",
+		1500*time.Millisecond,
+		false,
+		0,
+		&HealthPolicy{Mapping: DefaultDiagnosticsMapping},
+		nil,
+		log.New(&output, "", 0))
+
+	serverUnhealthyError, ok := err.(*ServerUnhealthyError)
+	if !ok {
+		t.Fatalf("OpenDBWithHealthCheck did not return an error of type ServerUnhealthyError: %v", err)
+	}
+
+	if serverUnhealthyError.RawValue != ServerDownOrUnresponsive {
+		t.Fatalf("OpenDBWithHealthCheck did not fail with ServerDownOrUnresponsive: %d", serverUnhealthyError.RawValue)
+	}
+
+	if !regexp.MustCompile(`^timed out after \S+ and [1-9]\d* failed attempts .* Last error: `).MatchString(serverUnhealthyError.Inner.Error()) {
+		t.Fatalf("OpenDBWithHealthCheck did not report the elapsed time and number of attempts: %s", serverUnhealthyError.Inner)
+	}
+}
+
+// An error of the SQL Server driver, which `ClassifyConnectError()` recognizes by its SQLErrorNumber() method
+type numberedSQLError struct {
+	number int32
+}
+
+func (err numberedSQLError) Error() string {
+	return fmt.Sprintf("mssql: error %d", err.number)
+}
+
+func (err numberedSQLError) SQLErrorNumber() int32 {
+	return err.number
+}
+
+func TestClassifyConnectError(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		err      error
+		expected ConnectErrorCategory
+	}{
+		{nil, ConnectErrorOther},
+		{errors.New("unknown"), ConnectErrorOther},
+		{&ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: numberedSQLError{18456}}, ConnectErrorLoginFailed},
+		{&ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: numberedSQLError{18486}}, ConnectErrorLoginFailed},
+		{&ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: numberedSQLError{4060}}, ConnectErrorOther},
+		{&ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}, ConnectErrorHostUnreachable},
+		{&ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: &net.DNSError{Name: "sqlserver.example.com", IsNotFound: true}}, ConnectErrorHostUnreachable},
+		{&ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: &net.DNSError{Name: "sqlserver.example.com", IsTimeout: true}}, ConnectErrorTimeout},
+		{&ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: fmt.Errorf("%w after 30s", ErrConnectTimedOut)}, ConnectErrorTimeout},
+		{&ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: fmt.Errorf("%w after 30s. Last error: %w", ErrConnectTimedOut, numberedSQLError{18456})}, ConnectErrorLoginFailed},
+	} {
+		category := ClassifyConnectError(testCase.err)
+		if category != testCase.expected {
+			t.Fatalf("Expected ClassifyConnectError(%v) to return %s but it returned %s", testCase.err, testCase.expected, category)
+		}
+	}
+}
+
+// A resolvingDriver simulates a SQL Server driver that connects to the address that a hostname resolves to.
+// A connection to any address other than liveAddress is opened but fails to ping, like a connection to a stale address.
+// The connections that are not closed are counted, so that a test can verify that failed attempts drained their connection pools.
+type resolvingDriver struct {
+	liveAddress string
+
+	mutex     sync.Mutex
+	openConns int
+}
+
+func (d *resolvingDriver) Open(address string) (driver.Conn, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.openConns++
+
+	return &resolvingConn{driver: d, address: address}, nil
+}
+
+func (d *resolvingDriver) numOpenConns() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.openConns
+}
+
+type resolvingConn struct {
+	driver  *resolvingDriver
+	address string
+}
+
+func (c *resolvingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *resolvingConn) Close() error {
+	c.driver.mutex.Lock()
+	defer c.driver.mutex.Unlock()
+
+	c.driver.openConns--
+
+	return nil
+}
+
+func (c *resolvingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *resolvingConn) Ping(ctx context.Context) error {
+	if c.address != c.driver.liveAddress {
+		return fmt.Errorf("could not connect to %s", c.address)
+	}
+
+	return nil
+}
+
+// Every query returns a single row with a health of 0, like a health check query of a healthy instance
+func (c *resolvingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return &healthyRows{}, nil
+}
+
+type healthyRows struct {
+	done bool
+}
+
+func (r *healthyRows) Columns() []string {
+	return []string{"health"}
+}
+
+func (r *healthyRows) Close() error {
+	return nil
+}
+
+func (r *healthyRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+
+	r.done = true
+	dest[0] = int64(0)
+
+	return nil
+}
+
+var testResolvingDriver = &resolvingDriver{liveAddress: "10.0.0.2"}
+
+func init() {
+	sql.Register("resolving", testResolvingDriver)
+}
+
+func TestOpenDBWithHealthCheckReopensEachAttempt(t *testing.T) {
+	// The hostname resolves to a new address after the second attempt, as if DNS changed during a failover.
+	// Only the new address is live, so the connection only succeeds if every attempt resolves the hostname again.
+	var mutex sync.Mutex
+	var numAttempts int
+	openDB := func(hostname string, port uint64, username string, password string, applicationName string, connectionTimeout time.Duration, trustServerCertificate bool) (*sql.DB, error) {
+		mutex.Lock()
+		numAttempts++
+		address := "10.0.0.1"
+		if numAttempts > 2 {
+			address = "10.0.0.2"
+		}
+		mutex.Unlock()
+
+		db, err := sql.Open("resolving", address)
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.Ping()
+		if err != nil {
+			_ = db.Close()
+			return nil, &ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: err}
+		}
+
+		return db, nil
+	}
+
+	var output bytes.Buffer
+	var connectStats ConnectStats
+	db, err := openDBWithHealthCheck(
+		openDB, 10*time.Millisecond,
+		"sqlserver.example.com", 1433,
+		"username", "password",
+		"test",
+		5*time.Second,
+		false,
+		0,
+		&HealthPolicy{HealthCheckQuery: "EXEC dbo.health_check", Mapping: DefaultDiagnosticsMapping},
+		&connectStats,
+		log.New(&output, "", 0))
+	if err != nil {
+		t.Fatalf("Expected OpenDBWithHealthCheck to connect to the new address but it failed: %s", err)
+	}
+
+	if connectStats.Attempts != 3 || connectStats.LastError == nil {
+		t.Fatalf("Expected OpenDBWithHealthCheck to connect on the third attempt but it reported %+v", connectStats)
+	}
+
+	// Only the connection of the successful attempt is still open, so the failed attempts drained their connection pools
+	if numOpenConns := testResolvingDriver.numOpenConns(); numOpenConns != 1 {
+		t.Fatalf("Expected only the connection of the successful attempt to be open but there were %d open connections", numOpenConns)
+	}
+
+	_ = db.Close()
+
+	if numOpenConns := testResolvingDriver.numOpenConns(); numOpenConns != 0 {
+		t.Fatalf("Expected no open connections after closing the connection pool but there were %d", numOpenConns)
+	}
+}
+
+func TestOpenDBWithHealthCheckStopsRetrying(t *testing.T) {
+	t.Parallel()
+
+	var mutex sync.Mutex
+	var numAttempts int
+	openDB := func(hostname string, port uint64, username string, password string, applicationName string, connectionTimeout time.Duration, trustServerCertificate bool) (*sql.DB, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		numAttempts++
+
+		return nil, &ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: errors.New("could not connect")}
+	}
+
+	var output bytes.Buffer
+	_, err := openDBWithHealthCheck(
+		openDB, 10*time.Millisecond,
+		"sqlserver.example.com", 1433,
+		"username", "password",
+		"test",
+		100*time.Millisecond,
+		false,
+		0,
+		&HealthPolicy{Mapping: DefaultDiagnosticsMapping},
+		nil,
+		log.New(&output, "", 0))
+	if err == nil {
+		t.Fatal("Expected OpenDBWithHealthCheck to fail but it succeeded")
+	}
+
+	mutex.Lock()
+	numAttemptsOnReturn := numAttempts
+	mutex.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// An attempt that was in progress when OpenDBWithHealthCheck returned may still complete, but no new attempt is started
+	mutex.Lock()
+	defer mutex.Unlock()
+	if numAttempts > numAttemptsOnReturn+1 {
+		t.Fatalf("Expected connection attempts to stop when OpenDBWithHealthCheck returned but there were %d more", numAttempts-numAttemptsOnReturn)
+	}
+}
+
+func TestOpenDBWithHealthCheckClosedHealthCheckPort(t *testing.T) {
+	t.Parallel()
+
+	// Find a port that is not open by listening on an ephemeral port and closing it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen on an ephemeral port: %s", err)
+	}
+	healthCheckPort := uint64(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	var mutex sync.Mutex
+	var numAttempts int
+	openDB := func(hostname string, port uint64, username string, password string, applicationName string, connectionTimeout time.Duration, trustServerCertificate bool) (*sql.DB, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		numAttempts++
+
+		return nil, errors.New("unexpected T-SQL connection attempt")
+	}
+
+	var output bytes.Buffer
+	_, err = openDBWithHealthCheck(
+		openDB, 10*time.Millisecond,
+		"127.0.0.1", 1433,
+		"username", "password",
+		"test",
+		200*time.Millisecond,
+		false,
+		healthCheckPort,
+		&HealthPolicy{Mapping: DefaultDiagnosticsMapping},
+		nil,
+		log.New(&output, "", 0))
+
+	mutex.Lock()
+	if numAttempts != 0 {
+		t.Fatalf("Expected no T-SQL connection attempts while the health check port is closed but there were %d", numAttempts)
+	}
+	mutex.Unlock()
+
+	serverUnhealthyError, ok := err.(*ServerUnhealthyError)
+	if !ok {
+		t.Fatalf("OpenDBWithHealthCheck did not return an error of type ServerUnhealthyError: %v", err)
+	}
+
+	if serverUnhealthyError.RawValue != ServerDownOrUnresponsive {
+		t.Fatalf("OpenDBWithHealthCheck did not fail with ServerDownOrUnresponsive: %d", serverUnhealthyError.RawValue)
+	}
+
+	if !strings.Contains(serverUnhealthyError.Inner.Error(), fmt.Sprintf("health check port 127.0.0.1:%d is not open", healthCheckPort)) {
+		t.Fatalf("OpenDBWithHealthCheck did not report that the health check port is not open: %s", serverUnhealthyError.Inner)
+	}
+}
+
+func TestOpenDBWithHealthCheckLoginFailed(t *testing.T) {
+	t.Parallel()
+
+	var mutex sync.Mutex
+	var numAttempts int
+	openDB := func(hostname string, port uint64, username string, password string, applicationName string, connectionTimeout time.Duration, trustServerCertificate bool) (*sql.DB, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		numAttempts++
+
+		return nil, &ServerUnhealthyError{RawValue: ServerDownOrUnresponsive, Inner: numberedSQLError{18456}}
+	}
+
+	var output bytes.Buffer
+	_, err := openDBWithHealthCheck(
+		openDB, 10*time.Millisecond,
+		"sqlserver.example.com", 1433,
+		"username", "password",
+		"test",
+		200*time.Millisecond,
+		false,
+		0,
+		&HealthPolicy{Mapping: DefaultDiagnosticsMapping},
+		nil,
+		log.New(&output, "", 0))
+
+	// The login can fail while the default database is recovering, so it's retried until the timeout
+	mutex.Lock()
+	if numAttempts < 2 {
+		t.Fatalf("Expected a login failure to be retried but there were %d connection attempts", numAttempts)
+	}
+	mutex.Unlock()
+
+	if category := ClassifyConnectError(err); category != ConnectErrorLoginFailed {
+		t.Fatalf("Expected OpenDBWithHealthCheck to return a login failure but it returned %v (%s)", err, category)
+	}
+}
+
+func TestIsHostnameNotFound(t *testing.T) {
+	defer func() { lookupHostFunc = net.LookupHost }()
+
+	lookupHostFunc = func(host string) ([]string, error) {
+		return []string{"10.0.0.1"}, nil
+	}
+	notFound, err := IsHostnameNotFound("sqlserver.example.com")
+	if notFound || err != nil {
+		t.Fatalf("Expected IsHostnameNotFound to return (false, nil) for a hostname that resolves but it returned (%t, %v)", notFound, err)
+	}
+
+	lookupHostFunc = func(host string) ([]string, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	notFound, err = IsHostnameNotFound("sqlserver.example.com")
+	if !notFound || err != nil {
+		t.Fatalf("Expected IsHostnameNotFound to return (true, nil) for a hostname that does not exist but it returned (%t, %v)", notFound, err)
+	}
+
+	lookupHostFunc = func(host string) ([]string, error) {
+		return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true, IsTemporary: true}
+	}
+	notFound, err = IsHostnameNotFound("sqlserver.example.com")
+	if notFound || err == nil {
+		t.Fatalf("Expected IsHostnameNotFound to return (false, error) for a transient DNS failure but it returned (%t, %v)", notFound, err)
+	}
+}
+
+func TestCheckHostnameResolves(t *testing.T) {
+	defer func() { lookupHostFunc = net.LookupHost }()
+
+	var logOutput bytes.Buffer
+	stdout := log.New(&logOutput, "", 0)
+
+	lookupHostFunc = func(host string) ([]string, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	err := CheckHostnameResolves("sqlserver.example.com", stdout)
+	if err == nil {
+		t.Fatal("Expected CheckHostnameResolves to fail for a hostname that does not exist but it succeeded")
+	}
+
+	lookupHostFunc = func(host string) ([]string, error) {
+		return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true, IsTemporary: true}
+	}
+	err = CheckHostnameResolves("sqlserver.example.com", stdout)
+	if err != nil {
+		t.Fatalf("Expected CheckHostnameResolves to succeed for a transient DNS failure but it failed: %s", err)
+	}
+	if !strings.Contains(logOutput.String(), "connecting anyway") {
+		t.Fatalf("Expected CheckHostnameResolves to log the transient DNS failure but it logged [%s]", logOutput.String())
+	}
+}
+
+func TestFirstCompleteDiagnosticsCycle(t *testing.T) {
+	t.Parallel()
+
+	row := func(creationTime string, componentName string, state int) DiagnosticsRow {
+		return DiagnosticsRow{CreationTime: creationTime, ComponentType: "sp_server_diagnostics", ComponentName: componentName, State: state}
+	}
+
+	// The first cycle is missing the query_processing component
+	rows := []DiagnosticsRow{
+		row("2020-01-01 00:00:00", "system", 1),
+		row("2020-01-01 00:00:00", "resource", 3),
+		row("2020-01-01 00:00:05", "system", 1),
+		row("2020-01-01 00:00:05", "resource", 1),
+	}
+
+	_, ok := firstCompleteDiagnosticsCycle(rows)
+	if ok {
+		t.Fatalf("Expected firstCompleteDiagnosticsCycle to not find a complete cycle")
+	}
+
+	rows = append(rows, row("2020-01-01 00:00:05", "query_processing", 1), row("2020-01-01 00:00:05", "io_subsystem", 1))
+
+	cycle, ok := firstCompleteDiagnosticsCycle(rows)
+	if !ok {
+		t.Fatalf("Expected firstCompleteDiagnosticsCycle to find a complete cycle")
+	}
+
+	if len(cycle) != 4 || cycle[0].CreationTime != "2020-01-01 00:00:05" {
+		t.Fatalf("Expected firstCompleteDiagnosticsCycle to return the second cycle but it returned %v", cycle)
+	}
+
+	diagnostics := diagnosticsFromRows(cycle)
+	if !diagnostics.System || !diagnostics.Resource || !diagnostics.QueryProcessing {
+		t.Fatalf("Expected every component of the second cycle to be clean but got %+v", diagnostics)
+	}
+}
+
+func TestCompareProductVersions(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"15.0.4153.1", "15.0.4153.1", 0},
+		{"15.0.4153.1", "15.0.4223.1", -1},
+		{"15.0.10000.1", "15.0.4223.1", 1},
+		{"16.0.1000.6", "15.0.4223.1", 1},
+		{"15.0", "15.0.0.0", 0},
+		{"15.0", "15.0.1", -1},
+	} {
+		result, err := CompareProductVersions(testCase.a, testCase.b)
+		if err != nil {
+			t.Fatalf("Expected CompareProductVersions(%q, %q) to succeed but it failed: %s", testCase.a, testCase.b, err)
+		}
+
+		if result != testCase.expected {
+			t.Fatalf("Expected CompareProductVersions(%q, %q) to return %d but it returned %d", testCase.a, testCase.b, testCase.expected, result)
+		}
+	}
+
+	_, err := CompareProductVersions("15.0.x", "15.0.4223.1")
+	if err == nil {
+		t.Fatalf("Expected CompareProductVersions to fail for an invalid product version but it succeeded")
+	}
+}
+
+func TestCredentialProviders(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	credentialsFile := dir + "/credentials"
+	passwordFile := dir + "/password"
+
+	err = ioutil.WriteFile(credentialsFile, []byte("user\npass\n"), 0600)
+	if err != nil {
+		t.Fatalf("Could not write credentials file: %s", err)
+	}
+
+	err = ioutil.WriteFile(passwordFile, []byte("pass\n"), 0600)
+	if err != nil {
+		t.Fatalf("Could not write password file: %s", err)
+	}
+
+	providers := map[string]CredentialProvider{
+		"file":          &FileCredentialProvider{Filename: credentialsFile},
+		"password file": &PasswordFileCredentialProvider{Username: "user", PasswordFile: passwordFile},
+	}
+
+	for name, provider := range providers {
+		credentials, err := provider.GetCredentials(context.Background())
+		if err != nil {
+			t.Fatalf("Expected %s provider to succeed but it failed: %s", name, err)
+		}
+
+		if credentials.Username != "user" || credentials.Password != "pass" {
+			t.Fatalf("%s provider returned unexpected credentials [%s] [%s]", name, credentials.Username, credentials.Password)
+		}
+	}
+}
+
+func TestCredentialsValidate(t *testing.T) {
+	t.Parallel()
+
+	for _, testCase := range []struct {
+		credentials   Credentials
+		expectedValid bool
+	}{
+		{Credentials{Username: "user", Password: "pass"}, true},
+		{Credentials{Username: "", Password: "pass"}, false},
+		{Credentials{Username: "user", Password: ""}, false},
+	} {
+		err := testCase.credentials.Validate()
+		if (err == nil) != testCase.expectedValid {
+			t.Fatalf("Expected Validate of %+v to return valid [%t] but it returned %v", testCase.credentials, testCase.expectedValid, err)
+		}
+	}
+}
+
+func TestVaultCredentialProvider(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v1/kv/mssql":
+			fmt.Fprint(w, `{"data": {"username": "user", "password": "pass"}}`)
+
+		case "/v1/secret/data/mssql":
+			fmt.Fprint(w, `{"data": {"data": {"username": "user", "password": "pass"}, "metadata": {"version": 1}}}`)
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"kv/mssql", "secret/data/mssql"} {
+		provider := &VaultCredentialProvider{Address: server.URL, Path: path, Token: "token"}
+
+		credentials, err := provider.GetCredentials(context.Background())
+		if err != nil {
+			t.Fatalf("Expected Vault provider to succeed for %s but it failed: %s", path, err)
+		}
+
+		if credentials.Username != "user" || credentials.Password != "pass" {
+			t.Fatalf("Vault provider returned unexpected credentials [%s] [%s] for %s", credentials.Username, credentials.Password, path)
+		}
+	}
+
+	_, err := (&VaultCredentialProvider{Address: server.URL, Path: "kv/mssql", Token: "wrong"}).GetCredentials(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "denied access") {
+		t.Fatalf("Expected Vault provider to fail with an access denied error but it returned: %v", err)
+	}
+
+	_, err = (&VaultCredentialProvider{Address: server.URL, Path: "kv/missing", Token: "token"}).GetCredentials(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "does not have a secret") {
+		t.Fatalf("Expected Vault provider to fail with a missing secret error but it returned: %v", err)
+	}
+}
+
+func TestReadCredentialsFromPipe(t *testing.T) {
+	t.Parallel()
+
+	reader, writer := io.Pipe()
+	defer reader.Close()
+
+	go func() {
+		// Deliver the credentials in pieces to simulate a slow writer
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(writer, "user")
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(writer, "name\npass")
+		io.WriteString(writer, "word\n")
+		writer.Close()
+	}()
+
+	username, password, err := ReadCredentials(reader, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Expected ReadCredentials to succeed but it failed: %s", err)
+	}
+
+	if username != "username" || password != "password" {
+		t.Fatalf("ReadCredentials returned unexpected credentials [%s] [%s]", username, password)
+	}
+}
+
+func TestNewCredentialProvider(t *testing.T) {
+	t.Parallel()
+
+	provider, err := NewCredentialProvider("file", CredentialProviderOptions{CredentialsFile: "/credentials"})
+	if _, ok := provider.(*FileCredentialProvider); !ok || err != nil {
+		t.Fatalf("Expected NewCredentialProvider(file) with a credentials file to return a FileCredentialProvider but it returned %T, %v", provider, err)
+	}
+
+	provider, err = NewCredentialProvider("file", CredentialProviderOptions{Username: "user", PasswordFile: "/password"})
+	if _, ok := provider.(*PasswordFileCredentialProvider); !ok || err != nil {
+		t.Fatalf("Expected NewCredentialProvider(file) with a password file to return a PasswordFileCredentialProvider but it returned %T, %v", provider, err)
+	}
+
+	_, err = NewCredentialProvider("vault", CredentialProviderOptions{})
+	if err == nil || errors.Is(err, ErrUnknownCredentialProvider) {
+		t.Fatalf("Expected NewCredentialProvider(vault) without --vault-path to return an invalid settings error but it returned %v", err)
+	}
+
+	_, err = NewCredentialProvider("keyring", CredentialProviderOptions{})
+	if !errors.Is(err, ErrUnknownCredentialProvider) {
+		t.Fatalf("Expected NewCredentialProvider(keyring) to return ErrUnknownCredentialProvider but it returned %v", err)
+	}
+}
+
+func TestNewVaultCredentialProvider(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := dir + "/token"
+	err = ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600)
+	if err != nil {
+		t.Fatalf("Could not write token file: %s", err)
+	}
+
+	environment := map[string]string{"VAULT_ADDR": "https://env:8200", "VAULT_TOKEN": "env-token"}
+	getenv := func(key string) string { return environment[key] }
+	emptyGetenv := func(key string) string { return "" }
+
+	for _, testCase := range []struct {
+		options         CredentialProviderOptions
+		getenv          func(string) string
+		expectedAddress string
+		expectedToken   string
+		expectedError   bool
+	}{
+		{CredentialProviderOptions{VaultPath: "kv/mssql"}, getenv, "https://env:8200", "env-token", false},
+		{CredentialProviderOptions{VaultPath: "kv/mssql", VaultAddress: "https://flag:8200", VaultTokenFile: tokenFile}, getenv, "https://flag:8200", "file-token", false},
+		{CredentialProviderOptions{VaultAddress: "https://flag:8200"}, getenv, "", "", true},
+		{CredentialProviderOptions{VaultPath: "kv/mssql"}, emptyGetenv, "", "", true},
+		{CredentialProviderOptions{VaultPath: "kv/mssql", VaultAddress: "https://flag:8200"}, emptyGetenv, "", "", true},
+	} {
+		provider, err := newVaultCredentialProvider(testCase.options, testCase.getenv)
+		if testCase.expectedError {
+			if err == nil {
+				t.Fatalf("Expected newVaultCredentialProvider(%+v) to fail but it succeeded", testCase.options)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Expected newVaultCredentialProvider(%+v) to succeed but it failed: %s", testCase.options, err)
+		}
+
+		if provider.Address != testCase.expectedAddress || provider.Token != testCase.expectedToken || provider.Path != testCase.options.VaultPath {
+			t.Fatalf(
+				"Expected newVaultCredentialProvider(%+v) to return address %s and token %s but it returned %+v",
+				testCase.options, testCase.expectedAddress, testCase.expectedToken, provider)
+		}
+	}
+}
+
+// A hungCredentialProvider simulates a credentials FIFO that is never written to
+type hungCredentialProvider struct{}
+
+func (hungCredentialProvider) GetCredentials(ctx context.Context) (Credentials, error) {
+	<-ctx.Done()
+	return Credentials{}, ctx.Err()
+}
+
+func TestGetCredentialsWithTimeout(t *testing.T) {
+	t.Parallel()
+
+	_, err := GetCredentialsWithTimeout(hungCredentialProvider{}, 200*time.Millisecond)
+	if err == nil || err.Error() != "Timed out after 200ms while reading credentials." {
+		t.Fatalf("Expected GetCredentialsWithTimeout to fail with a timeout error but it returned %v", err)
+	}
+}
+
+func TestReadCredentialsFromPipeTimeout(t *testing.T) {
+	t.Parallel()
+
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	defer reader.Close()
+
+	go func() {
+		// Only the username is ever written
+		io.WriteString(writer, "username\n")
+	}()
+
+	startTime := time.Now()
+
+	_, _, err := ReadCredentials(reader, 200*time.Millisecond)
+	if err == nil {
+		t.Fatal("Expected ReadCredentials to fail but it succeeded")
+	}
+
+	if elapsed := time.Since(startTime); elapsed > 2*time.Second {
+		t.Fatalf("ReadCredentials took %s to time out", elapsed)
+	}
+
+	if err.Error() != "Timed out after 200ms while reading credentials." {
+		t.Fatalf("ReadCredentials did not fail with a timeout error: %s", err)
+	}
+}
+
+// A hungDiagnosticsQuerier simulates an instance that accepts the sp_server_diagnostics query but never returns results
+type hungDiagnosticsQuerier struct{}
+
+func (hungDiagnosticsQuerier) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestQueryHealthCheckCancellation(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := QueryHealthCheck(ctx, hungDiagnosticsQuerier{}, "EXEC dbo.health_check")
+
+	serverUnhealthyError, ok := err.(*ServerUnhealthyError)
+	if !ok {
+		t.Fatalf("QueryHealthCheck did not return an error of type ServerUnhealthyError: %v", err)
+	}
+
+	if serverUnhealthyError.RawValue != ServerDownOrUnresponsive {
+		t.Fatalf("QueryHealthCheck did not fail with ServerDownOrUnresponsive: %d", serverUnhealthyError.RawValue)
+	}
+}
+
+func TestQueryDiagnosticsContextCancellation(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	startTime := time.Now()
+
+	_, err := QueryDiagnosticsContext(ctx, hungDiagnosticsQuerier{})
+	if err == nil {
+		t.Fatal("Expected QueryDiagnosticsContext to fail but it succeeded")
+	}
+
+	if elapsed := time.Since(startTime); elapsed > 2*time.Second {
+		t.Fatalf("QueryDiagnosticsContext took %s to return after the context was done", elapsed)
+	}
+
+	serverUnhealthyError, ok := err.(*ServerUnhealthyError)
+	if !ok {
+		t.Fatalf("QueryDiagnosticsContext did not fail with a ServerUnhealthyError: %s", err)
+	}
+
+	if serverUnhealthyError.RawValue != ServerDownOrUnresponsive {
+		t.Fatalf("QueryDiagnosticsContext failed with health %d instead of ServerDownOrUnresponsive", serverUnhealthyError.RawValue)
+	}
+}
+
+func TestQueryDiagnosticsWithRepeatIntervalCancellation(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err := QueryDiagnosticsWithRepeatInterval(ctx, hungDiagnosticsQuerier{}, MinDiagnosticsRepeatInterval)
+
+	serverUnhealthyError, ok := err.(*ServerUnhealthyError)
+	if !ok {
+		t.Fatalf("QueryDiagnosticsWithRepeatInterval did not fail with a ServerUnhealthyError: %v", err)
+	}
+
+	if serverUnhealthyError.RawValue != ServerDownOrUnresponsive {
+		t.Fatalf("QueryDiagnosticsWithRepeatInterval failed with health %d instead of ServerDownOrUnresponsive", serverUnhealthyError.RawValue)
+	}
+}